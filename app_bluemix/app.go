@@ -7,12 +7,13 @@ import (
 
 	"net/http"
 
+	"golang.org/x/net/context"
+
 	"github.com/spf13/cobra"
 
 	"github.com/gocraft/web"
-	"github.com/hyperledger/fabric/core/util"
-	pb "github.com/hyperledger/fabric/protos"
 	"github.com/spf13/viper"
+	"github.com/wutongtree/blue/chaincode_bluemix/validation"
 )
 
 // --------------- AppCmd ---------------
@@ -36,12 +37,23 @@ var appStartCmd = &cobra.Command{
 
 type BlueResponse struct {
 	Status string `protobuf:"bytes,1,opt,name=status" json:"status,omitempty"`
+	ID     string `protobuf:"bytes,2,opt,name=id" json:"id,omitempty"`
+	TxID   string `protobuf:"bytes,3,opt,name=txid" json:"txid,omitempty"`
+	// Fields maps the request fields in error to their problem
+	Fields map[string]string `json:"fields,omitempty"`
 }
 
 // --------------- BlueAPP ---------------
 
 // BlueAPP defines the Blue REST service object.
 type BlueAPP struct {
+	// ctx is cancelled when the client disconnects, set by RequestContext
+	ctx context.Context
+	// principal is the authenticated caller, set by Authenticate
+	principal *Principal
+	// idempotencyKey is the Idempotency-Key of the request, set by
+	// Idempotency
+	idempotencyKey string
 }
 
 func buildBlueRouter() *web.Router {
@@ -49,10 +61,34 @@ func buildBlueRouter() *web.Router {
 
 	// Add middleware
 	router.Middleware((*BlueAPP).SetResponseType)
+	router.Middleware((*BlueAPP).RequestContext)
+	router.Middleware((*BlueAPP).Authenticate)
+	router.Middleware((*BlueAPP).Idempotency)
 
 	// Add routes
-	router.Post("/tx/send", (*BlueAPP).Send)
-	router.Post("/tx/offer", (*BlueAPP).Offer)
+	for _, route := range blueRoutes {
+		if route.Idempotent {
+			idempotentRoutes[route.Method+" "+route.Path] = true
+		}
+		switch route.Method {
+		case "GET":
+			router.Get(route.Path, route.Handler)
+		case "POST":
+			router.Post(route.Path, route.Handler)
+		case "PUT":
+			router.Put(route.Path, route.Handler)
+		case "DELETE":
+			router.Delete(route.Path, route.Handler)
+		default:
+			panic(fmt.Errorf("Unsupported method %s of route %s", route.Method, route.Path))
+		}
+	}
+
+	spec, err := buildOpenAPI(blueRoutes)
+	if err != nil {
+		panic(fmt.Errorf("Failed building the OpenAPI document: %s", err))
+	}
+	blueSpec = spec
 
 	// Add not found page
 	router.NotFound((*BlueAPP).NotFound)
@@ -62,13 +98,17 @@ func buildBlueRouter() *web.Router {
 
 // SetResponseType is a middleware function that sets the appropriate response
 // headers. Currently, it is setting the "Content-Type" to "application/json" as
-// well as the necessary headers in order to enable CORS for Swagger usage.
+// well as the necessary headers in order to enable CORS for the origins in
+// app.auth.allowedOrigins, e.g. a Swagger UI reading /openapi.json.
 func (s *BlueAPP) SetResponseType(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
 	rw.Header().Set("Content-Type", "application/json")
 
 	// Enable CORS
-	rw.Header().Set("Access-Control-Allow-Origin", "*")
-	rw.Header().Set("Access-Control-Allow-Headers", "accept, content-type")
+	if origin := req.Header.Get("Origin"); origin != "" && blueAuth.origins[origin] {
+		rw.Header().Set("Access-Control-Allow-Origin", origin)
+		rw.Header().Set("Access-Control-Allow-Headers", "accept, authorization, content-type, x-api-key, idempotency-key")
+		rw.Header().Set("Vary", "Origin")
+	}
 
 	next(rw, req)
 }
@@ -76,8 +116,7 @@ func (s *BlueAPP) SetResponseType(rw web.ResponseWriter, req *web.Request, next
 // NotFound returns a custom landing page when a given hyperledger end point
 // had not been defined.
 func (s *BlueAPP) NotFound(rw web.ResponseWriter, r *web.Request) {
-	rw.WriteHeader(http.StatusNotFound)
-	json.NewEncoder(rw).Encode(BlueResponse{Status: "Blue endpoint not found."})
+	writeError(rw, r, newAPIError(http.StatusNotFound, codeNotFound, "Blue endpoint not found."))
 }
 
 // send send transactions
@@ -89,15 +128,17 @@ func (s *BlueAPP) Send(rw web.ResponseWriter, req *web.Request) {
 	receiver := req.FormValue("receiver")
 	amount := req.FormValue("amount")
 	currency := req.FormValue("currency")
+	destinationTag := req.FormValue("destinationTag")
+	sourceTag := req.FormValue("sourceTag")
+	memo := req.FormValue("memo")
+	invoiceID := req.FormValue("invoiceID")
 
-	logger.Infof("send: sender=%v receiver=%v amount=%v currency=%v", sender, receiver, amount, currency)
-
-	// Check that the enrollId and enrollSecret are not left blank.
-	if (sender == "") || (receiver == "") || (amount == "") || (currency == "") {
-		rw.WriteHeader(http.StatusBadRequest)
-		encoder.Encode(BlueResponse{Status: "params error"})
-		logger.Error("Error: params error.")
+	logger.Infof("send: sender=%v receiver=%v amount=%v currency=%v destinationTag=%v sourceTag=%v invoiceID=%v",
+		sender, receiver, amount, currency, destinationTag, sourceTag, invoiceID)
 
+	// check the accounts, amount and currency
+	errs := validation.Send(blueCurrencies.currencies(), sender, receiver, amount, currency)
+	if !checkParams(rw, req, validationError(errs)) {
 		return
 	}
 
@@ -111,33 +152,20 @@ func (s *BlueAPP) Send(rw web.ResponseWriter, req *web.Request) {
 		receiver,
 		amount,
 		currency,
-		timestr}
-
-	chaincodeInput := &pb.ChaincodeInput{
-		Args: util.ToChaincodeArgs(args...),
-	}
+		timestr,
+		destinationTag,
+		sourceTag,
+		memo,
+		invoiceID}
 
 	// invoke chaincode
-	resp, err := invokeChaincode(deployerClient, chaincodeInput)
-	if err != nil {
-		errstr := fmt.Sprintf("offer error: %v", err)
-		rw.WriteHeader(http.StatusBadRequest)
-		encoder.Encode(BlueResponse{Status: errstr})
-		logger.Error(errstr)
-
-		return
-	}
-	if resp.Status != 200 {
-		errstr := fmt.Sprintf("offer error: %v", err)
-		rw.WriteHeader(http.StatusBadRequest)
-		encoder.Encode(BlueResponse{Status: errstr})
-		logger.Error(errstr)
-
+	txid := s.invokeBlue(rw, req, args)
+	if txid == "" {
 		return
 	}
 
 	rw.WriteHeader(http.StatusOK)
-	encoder.Encode(BlueResponse{Status: "success"})
+	encoder.Encode(BlueResponse{Status: "success", TxID: txid})
 	logger.Infof("send successful.\n")
 
 	return
@@ -154,12 +182,9 @@ func (s *BlueAPP) Offer(rw web.ResponseWriter, req *web.Request) {
 
 	logger.Infof("offer: sender=%v takerGets=%v takerPays=%v", sender, takerGets, takerPays)
 
-	// Check that the enrollId and enrollSecret are not left blank.
-	if (sender == "") || (takerGets == "") || (takerPays == "") {
-		rw.WriteHeader(http.StatusBadRequest)
-		encoder.Encode(BlueResponse{Status: "params error"})
-		logger.Error("Error: params error.")
-
+	// check the sender and the amounts
+	errs := validation.Offer(blueCurrencies.currencies(), sender, takerGets, takerPays)
+	if !checkParams(rw, req, validationError(errs)) {
 		return
 	}
 
@@ -174,37 +199,497 @@ func (s *BlueAPP) Offer(rw web.ResponseWriter, req *web.Request) {
 		takerPays,
 		timestr}
 
-	chaincodeInput := &pb.ChaincodeInput{
-		Args: util.ToChaincodeArgs(args...),
+	// invoke chaincode
+	txid := s.invokeBlue(rw, req, args)
+	if txid == "" {
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(BlueResponse{Status: "success", TxID: txid})
+	logger.Infof("offer successful: '%s'\n", txid)
+
+	return
+}
+
+// OfferCancel take a resting offer off the book
+func (s *BlueAPP) OfferCancel(rw web.ResponseWriter, req *web.Request) {
+	encoder := json.NewEncoder(rw)
+
+	// get params
+	id := req.FormValue("id")
+	account := req.FormValue("account")
+
+	logger.Infof("offerCancel: id=%v account=%v", id, account)
+
+	e := mergeErrors(validationError(accountErrors("account", account)), required("id", id))
+	if !checkParams(rw, req, e) {
+		return
 	}
 
+	args := []string{
+		"offerCancel",
+		id,
+		account}
+
 	// invoke chaincode
-	resp, err := invokeChaincode(deployerClient, chaincodeInput)
-	if err != nil {
-		errstr := fmt.Sprintf("offer error: %v", err)
+	txid := s.invokeBlue(rw, req, args)
+	if txid == "" {
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(BlueResponse{Status: "success", TxID: txid})
+	logger.Infof("offerCancel successful.\n")
+
+	return
+}
+
+// AccountSet set or clear account flags
+func (s *BlueAPP) AccountSet(rw web.ResponseWriter, req *web.Request) {
+	encoder := json.NewEncoder(rw)
+
+	// get params
+	account := req.FormValue("account")
+	flag := req.FormValue("flag")
+	enabled := req.FormValue("enabled")
+
+	logger.Infof("accountSet: account=%v flag=%v enabled=%v", account, flag, enabled)
+
+	e := mergeErrors(validationError(accountErrors("account", account)), required("flag", flag, "enabled", enabled))
+	if !checkParams(rw, req, e) {
+		return
+	}
+
+	args := []string{
+		"accountSet",
+		account,
+		flag,
+		enabled}
+
+	// invoke chaincode
+	txid := s.invokeBlue(rw, req, args)
+	if txid == "" {
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(BlueResponse{Status: "success", TxID: txid})
+	logger.Infof("accountSet successful.\n")
+
+	return
+}
+
+// IssuerSet set or clear the issuer flag of a gateway account, which may send
+// more than its balance
+func (s *BlueAPP) IssuerSet(rw web.ResponseWriter, req *web.Request) {
+	encoder := json.NewEncoder(rw)
+
+	// get params
+	account := req.FormValue("account")
+	enabled := req.FormValue("enabled")
+
+	logger.Infof("issuerSet: account=%v enabled=%v", account, enabled)
+
+	e := mergeErrors(validationError(accountErrors("account", account)), required("enabled", enabled))
+	if !checkParams(rw, req, e) {
+		return
+	}
+
+	args := []string{
+		"issuerSet",
+		account,
+		enabled}
+
+	// invoke chaincode
+	txid := s.invokeBlue(rw, req, args)
+	if txid == "" {
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(BlueResponse{Status: "success", TxID: txid})
+	logger.Infof("issuerSet successful.\n")
+
+	return
+}
+
+// CreateInvoice create a payment request, the response carries its ID
+func (s *BlueAPP) CreateInvoice(rw web.ResponseWriter, req *web.Request) {
+	encoder := json.NewEncoder(rw)
+
+	// get params
+	payee := req.FormValue("payee")
+	amount := req.FormValue("amount")
+	currency := req.FormValue("currency")
+	expiry := req.FormValue("expiry")
+	reference := req.FormValue("reference")
+	payer := req.FormValue("payer")
+
+	logger.Infof("createInvoice: payee=%v amount=%v currency=%v expiry=%v reference=%v payer=%v",
+		payee, amount, currency, expiry, reference, payer)
+
+	errs := validation.Invoice(blueCurrencies.currencies(), payee, payer, amount, currency)
+	if !checkParams(rw, req, validationError(errs)) {
+		return
+	}
+
+	args := []string{
+		"createInvoice",
+		payee,
+		amount,
+		currency,
+		expiry,
+		reference,
+		payer}
+
+	// invoke chaincode, the invoice ID is the transaction ID
+	txid := s.invokeBlue(rw, req, args)
+	if txid == "" {
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(BlueResponse{Status: "success", ID: txid, TxID: txid})
+	logger.Infof("createInvoice successful: '%s'\n", txid)
+
+	return
+}
+
+// PayInvoice pay a payment request
+func (s *BlueAPP) PayInvoice(rw web.ResponseWriter, req *web.Request) {
+	encoder := json.NewEncoder(rw)
+
+	// get params
+	id := req.FormValue("id")
+	payer := req.FormValue("payer")
+	amount := req.FormValue("amount")
+	currency := req.FormValue("currency")
+
+	logger.Infof("payInvoice: id=%v payer=%v amount=%v currency=%v", id, payer, amount, currency)
+
+	errs := accountErrors("payer", payer)
+	errs.Add(validation.CurrencyAmount(blueCurrencies.currencies(), "amount", "currency", amount, currency))
+	if !checkParams(rw, req, mergeErrors(validationError(errs), required("id", id))) {
+		return
+	}
+
+	// construct chaincodeInput
+	location, _ := time.LoadLocation("Asia/Chongqing")
+	timestr := time.Now().In(location).String()
+
+	args := []string{
+		"payInvoice",
+		id,
+		payer,
+		amount,
+		currency,
+		timestr}
+
+	// invoke chaincode
+	txid := s.invokeBlue(rw, req, args)
+	if txid == "" {
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(BlueResponse{Status: "success", TxID: txid})
+	logger.Infof("payInvoice successful.\n")
+
+	return
+}
+
+// Invoice query an invoice by ID
+func (s *BlueAPP) Invoice(rw web.ResponseWriter, req *web.Request) {
+	id := req.PathParams["id"]
+
+	logger.Infof("invoice: id=%v", id)
+
+	s.queryBlue(rw, req, []string{"queryInvoice", id})
+}
+
+// Invoices query the invoices of a payee or a payer
+func (s *BlueAPP) Invoices(rw web.ResponseWriter, req *web.Request) {
+	payee := req.FormValue("payee")
+	payer := req.FormValue("payer")
+
+	logger.Infof("invoices: payee=%v payer=%v", payee, payer)
+
+	if (payee == "") == (payer == "") {
 		rw.WriteHeader(http.StatusBadRequest)
-		encoder.Encode(BlueResponse{Status: errstr})
-		logger.Error(errstr)
+		json.NewEncoder(rw).Encode(BlueResponse{Status: "params error: expecting one of payee or payer"})
+		logger.Error("Error: params error.")
+
+		return
+	}
 
+	if payee != "" {
+		s.queryBlue(rw, req, []string{"queryInvoicesByPayee", payee})
+	} else {
+		s.queryBlue(rw, req, []string{"queryInvoicesByPayer", payer})
+	}
+}
+
+// CheckCreate create a check the receiver cashes later, the response carries its ID
+func (s *BlueAPP) CheckCreate(rw web.ResponseWriter, req *web.Request) {
+	encoder := json.NewEncoder(rw)
+
+	// get params
+	sender := req.FormValue("sender")
+	receiver := req.FormValue("receiver")
+	sendMax := req.FormValue("sendMax")
+	currency := req.FormValue("currency")
+	expiry := req.FormValue("expiry")
+	destinationTag := req.FormValue("destinationTag")
+	invoiceID := req.FormValue("invoiceID")
+
+	logger.Infof("checkCreate: sender=%v receiver=%v sendMax=%v currency=%v expiry=%v destinationTag=%v invoiceID=%v",
+		sender, receiver, sendMax, currency, expiry, destinationTag, invoiceID)
+
+	errs := validation.Check(blueCurrencies.currencies(), sender, receiver, sendMax, currency)
+	if !checkParams(rw, req, validationError(errs)) {
+		return
+	}
+
+	args := []string{
+		"checkCreate",
+		sender,
+		receiver,
+		sendMax,
+		currency,
+		expiry,
+		destinationTag,
+		invoiceID}
+
+	// invoke chaincode, the check ID is the transaction ID
+	txid := s.invokeBlue(rw, req, args)
+	if txid == "" {
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(BlueResponse{Status: "success", ID: txid, TxID: txid})
+	logger.Infof("checkCreate successful: '%s'\n", txid)
+
+	return
+}
+
+// CheckCash cash a check
+func (s *BlueAPP) CheckCash(rw web.ResponseWriter, req *web.Request) {
+	encoder := json.NewEncoder(rw)
+
+	// get params
+	id := req.FormValue("id")
+	receiver := req.FormValue("receiver")
+	amount := req.FormValue("amount")
+
+	logger.Infof("checkCash: id=%v receiver=%v amount=%v", id, receiver, amount)
+
+	// the precision of amount is checked by the chaincode, which knows the
+	// currency of the check
+	e := mergeErrors(validationError(accountErrors("receiver", receiver)), required("id", id, "amount", amount))
+	if !checkParams(rw, req, e) {
+		return
+	}
+
+	// construct chaincodeInput
+	location, _ := time.LoadLocation("Asia/Chongqing")
+	timestr := time.Now().In(location).String()
+
+	args := []string{
+		"checkCash",
+		id,
+		receiver,
+		amount,
+		timestr}
+
+	// invoke chaincode
+	txid := s.invokeBlue(rw, req, args)
+	if txid == "" {
 		return
 	}
 
-	if resp.Status != 200 {
-		errstr := fmt.Sprintf("offer error: %v", err)
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(BlueResponse{Status: "success", TxID: txid})
+	logger.Infof("checkCash successful.\n")
+
+	return
+}
+
+// CheckCancel cancel a check
+func (s *BlueAPP) CheckCancel(rw web.ResponseWriter, req *web.Request) {
+	encoder := json.NewEncoder(rw)
+
+	// get params
+	id := req.FormValue("id")
+	account := req.FormValue("account")
+
+	logger.Infof("checkCancel: id=%v account=%v", id, account)
+
+	e := mergeErrors(validationError(accountErrors("account", account)), required("id", id))
+	if !checkParams(rw, req, e) {
+		return
+	}
+
+	args := []string{
+		"checkCancel",
+		id,
+		account}
+
+	// invoke chaincode
+	txid := s.invokeBlue(rw, req, args)
+	if txid == "" {
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(BlueResponse{Status: "success", TxID: txid})
+	logger.Infof("checkCancel successful.\n")
+
+	return
+}
+
+// Check query a check by ID
+func (s *BlueAPP) Check(rw web.ResponseWriter, req *web.Request) {
+	id := req.PathParams["id"]
+
+	logger.Infof("check: id=%v", id)
+
+	s.queryBlue(rw, req, []string{"queryCheck", id})
+}
+
+// Checks query the checks of a sender or a receiver
+func (s *BlueAPP) Checks(rw web.ResponseWriter, req *web.Request) {
+	sender := req.FormValue("sender")
+	receiver := req.FormValue("receiver")
+
+	logger.Infof("checks: sender=%v receiver=%v", sender, receiver)
+
+	if (sender == "") == (receiver == "") {
 		rw.WriteHeader(http.StatusBadRequest)
-		encoder.Encode(BlueResponse{Status: errstr})
-		logger.Error(errstr)
+		json.NewEncoder(rw).Encode(BlueResponse{Status: "params error: expecting one of sender or receiver"})
+		logger.Error("Error: params error.")
+
+		return
+	}
+
+	if sender != "" {
+		s.queryBlue(rw, req, []string{"queryChecksBySender", sender})
+	} else {
+		s.queryBlue(rw, req, []string{"queryChecksByReceiver", receiver})
+	}
+}
+
+// Book query the resting offers of a pair
+func (s *BlueAPP) Book(rw web.ResponseWriter, req *web.Request) {
+	pair := req.PathParams["gets"] + "/" + req.PathParams["pays"]
+
+	logger.Infof("book: pair=%v", pair)
+
+	s.queryBlue(rw, req, []string{"queryBook", pair})
+}
+
+// Balances query the balances of an account by currency
+func (s *BlueAPP) Balances(rw web.ResponseWriter, req *web.Request) {
+	account := req.PathParams["account"]
 
+	logger.Infof("balances: account=%v", account)
+
+	s.queryBlue(rw, req, []string{"queryBalances", account})
+}
+
+// DepositPreauth allow a sender to deposit into an account with depositAuth
+func (s *BlueAPP) DepositPreauth(rw web.ResponseWriter, req *web.Request) {
+	s.depositAuth(rw, req, "depositPreauth")
+}
+
+// DepositUnauth remove a sender from the deposit allow-list of an account
+func (s *BlueAPP) DepositUnauth(rw web.ResponseWriter, req *web.Request) {
+	s.depositAuth(rw, req, "depositUnauth")
+}
+
+func (s *BlueAPP) depositAuth(rw web.ResponseWriter, req *web.Request, function string) {
+	encoder := json.NewEncoder(rw)
+
+	// get params
+	account := req.FormValue("account")
+	authorized := req.FormValue("authorized")
+
+	logger.Infof("%s: account=%v authorized=%v", function, account, authorized)
+
+	if !checkParams(rw, req, validationError(validation.Preauth(account, authorized))) {
+		return
+	}
+
+	args := []string{
+		function,
+		account,
+		authorized}
+
+	// invoke chaincode
+	txid := s.invokeBlue(rw, req, args)
+	if txid == "" {
 		return
 	}
 
 	rw.WriteHeader(http.StatusOK)
-	encoder.Encode(BlueResponse{Status: "success"})
-	logger.Infof("offer successful: '%s'\n", resp.Msg)
+	encoder.Encode(BlueResponse{Status: "success", TxID: txid})
+	logger.Infof("%s successful.\n", function)
 
 	return
 }
 
+// DepositAuthorized query whether an account accepts funds from a sender
+func (s *BlueAPP) DepositAuthorized(rw web.ResponseWriter, req *web.Request) {
+	account := req.PathParams["account"]
+	sender := req.FormValue("sender")
+	destinationTag := req.FormValue("destinationTag")
+
+	logger.Infof("depositAuthorized: account=%v sender=%v destinationTag=%v", account, sender, destinationTag)
+
+	if sender == "" {
+		rw.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(rw).Encode(BlueResponse{Status: "params error"})
+		logger.Error("Error: params error.")
+
+		return
+	}
+
+	s.queryBlue(rw, req, []string{"queryDepositAuthorized", sender, account, destinationTag})
+}
+
+// invokeBlue invokes the blue chaincode with args, the first of which is the
+// function name, signed by the request's user, and returns the transaction
+// ID. With wait=committed it returns only once the transaction is in a block.
+// On failure, rejection or timeout it writes the response and returns an
+// empty string.
+func (s *BlueAPP) invokeBlue(rw web.ResponseWriter, req *web.Request, args []string) string {
+	txid, e := s.submitBlue(req, args)
+	if e != nil {
+		writeError(rw, req, e)
+		logger.Errorf("Error: %s", e.Message)
+
+		return ""
+	}
+
+	return txid
+}
+
+// queryBlue queries the blue chaincode with args, the first of which is the
+// function name, and writes the JSON result or the error response.
+func (s *BlueAPP) queryBlue(rw web.ResponseWriter, req *web.Request, args []string) {
+	result, e := s.queryOwned(args)
+	if e != nil {
+		writeError(rw, req, e)
+		logger.Error(e.Message)
+
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(result)
+}
+
 // --------------- common function --------------
 
 // StartBlueServer initializes the REST service and adds the required
@@ -233,6 +718,52 @@ func startBlueServer() {
 
 // start serve
 func serve(args []string) error {
+	// Attach to the chaincode before serving
+	if err := connectBlue(); err != nil {
+		return err
+	}
+
+	// Open the local store and start the background subsystems
+	if err := initStore(); err != nil {
+		return fmt.Errorf("Error opening store: %s", err)
+	}
+	if err := startAuth(); err != nil {
+		return fmt.Errorf("Error loading authentication settings: %s", err)
+	}
+	if err := startUsers(); err != nil {
+		return fmt.Errorf("Error creating users table: %s", err)
+	}
+	startValidation()
+	startPeerHealth()
+	startEventHub()
+	if err := startTxStatus(); err != nil {
+		return fmt.Errorf("Error creating transaction status table: %s", err)
+	}
+	if err := startOutbox(); err != nil {
+		return fmt.Errorf("Error creating outbox table: %s", err)
+	}
+	if err := startIdempotency(); err != nil {
+		return fmt.Errorf("Error creating idempotency key table: %s", err)
+	}
+	if err := startStream(); err != nil {
+		return fmt.Errorf("Error creating stream table: %s", err)
+	}
+	if err := startUpgrade(); err != nil {
+		return fmt.Errorf("Error creating upgrade tables: %s", err)
+	}
+	if err := startIndexer(); err != nil {
+		return fmt.Errorf("Error creating index tables: %s", err)
+	}
+	if err := startReconcile(); err != nil {
+		return fmt.Errorf("Error creating reconcile table: %s", err)
+	}
+	if err := startScheduler(); err != nil {
+		return err
+	}
+	if err := startWebhooks(); err != nil {
+		return fmt.Errorf("Error creating webhook tables: %s", err)
+	}
+
 	// Create and register the REST service if configured
 	startBlueServer()
 
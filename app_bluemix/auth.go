@@ -0,0 +1,372 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gocraft/web"
+	"github.com/spf13/viper"
+)
+
+// scopes granted to API keys and tokens
+const (
+	scopeRead  = "read"
+	scopeWrite = "write"
+	scopeAdmin = "admin"
+)
+
+// authentication methods of a principal
+const (
+	authAPIKey = "apikey"
+	authJWT    = "jwt"
+	authNone   = "none"
+)
+
+// apiKeyHeader is the header carrying an API key
+const apiKeyHeader = "X-API-Key"
+
+// publicRoutes are served without authentication
+var publicRoutes = map[string]bool{
+	"/version": true,
+	"/health":  true,
+	"/login":   true,
+
+	"/openapi.json": true,
+}
+
+var (
+	errNoCredentials = errors.New("missing credentials")
+	errBadToken      = errors.New("invalid token")
+	errBadAPIKey     = errors.New("invalid API key")
+)
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	Subject  string   `json:"subject"`
+	EnrollID string   `json:"enrollId"`
+	Scopes   []string `json:"scopes"`
+	Method   string   `json:"method"`
+}
+
+// HasScope reports whether the principal was granted scope, admin implies
+// every scope
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope || s == scopeAdmin {
+			return true
+		}
+	}
+
+	return false
+}
+
+// apiKey is an API key configured under app.auth.apiKeys. Only the SHA-256
+// hash of the key is configured.
+type apiKey struct {
+	Name     string
+	Hash     string
+	EnrollID string `mapstructure:"enrollId"`
+	Scopes   []string
+}
+
+// authSettings is the authentication configuration, set by startAuth
+type authSettings struct {
+	enabled   bool
+	apiKeys   []apiKey
+	jwtSecret []byte
+	jwtIssuer string
+	jwtTTL    time.Duration
+	jwtScopes []string
+	origins   map[string]bool
+}
+
+var blueAuth = &authSettings{}
+
+// startAuth loads the app.auth settings
+func startAuth() error {
+	auth := &authSettings{
+		enabled:   viper.GetBool("app.auth.enabled"),
+		jwtSecret: []byte(viper.GetString("app.auth.jwt.secret")),
+		jwtIssuer: viper.GetString("app.auth.jwt.issuer"),
+		jwtTTL:    viper.GetDuration("app.auth.jwt.ttl"),
+		jwtScopes: viper.GetStringSlice("app.auth.jwt.scopes"),
+		origins:   make(map[string]bool),
+	}
+	if err := viper.UnmarshalKey("app.auth.apiKeys", &auth.apiKeys); err != nil {
+		return err
+	}
+	if auth.jwtTTL <= 0 {
+		auth.jwtTTL = time.Hour
+	}
+	if len(auth.jwtScopes) == 0 {
+		auth.jwtScopes = []string{scopeRead, scopeWrite}
+	}
+	for _, origin := range viper.GetStringSlice("app.auth.allowedOrigins") {
+		auth.origins[origin] = true
+	}
+
+	if auth.enabled && len(auth.jwtSecret) < 32 {
+		return errors.New("app.auth.jwt.secret must be at least 32 bytes")
+	}
+	if !auth.enabled {
+		logger.Warning("Authentication is disabled, requests act for their secureContext.")
+	}
+
+	blueAuth = auth
+
+	return nil
+}
+
+// requiredScope returns the scope a request needs, the one of the route
+// serving it. A request no route serves gets the not found page, it needs
+// read for GET and write otherwise.
+func requiredScope(req *web.Request) string {
+	if route := matchRoute(req.Method, req.URL.Path); route != nil {
+		return route.scope()
+	}
+	if req.Method == "GET" {
+		return scopeRead
+	}
+
+	return scopeWrite
+}
+
+// Authenticate is a middleware function that authenticates the request with a
+// bearer token or an API key and checks the scope of the route. Public routes
+// and CORS preflight requests are let through.
+func (s *BlueAPP) Authenticate(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	if publicRoutes[req.URL.Path] || req.Method == "OPTIONS" {
+		next(rw, req)
+		return
+	}
+
+	if !blueAuth.enabled {
+		s.principal = &Principal{
+			Subject:  req.FormValue("secureContext"),
+			EnrollID: req.FormValue("secureContext"),
+			Scopes:   []string{scopeAdmin},
+			Method:   authNone,
+		}
+		next(rw, req)
+		return
+	}
+
+	principal, err := authenticate(req)
+	if err != nil {
+		rw.Header().Set("WWW-Authenticate", `Bearer realm="blue"`)
+		writeError(rw, req, newAPIError(http.StatusUnauthorized, codeUnauthorized, err.Error()))
+		logger.Errorf("Error: %s %s: %v", req.Method, req.URL.Path, err)
+
+		return
+	}
+
+	if scope := requiredScope(req); !principal.HasScope(scope) {
+		writeError(rw, req, newAPIError(http.StatusForbidden, codeForbidden, "scope "+scope+" required"))
+		logger.Errorf("Error: %s lacks scope %s for %s %s", principal.Subject, scope, req.Method, req.URL.Path)
+
+		return
+	}
+
+	s.principal = principal
+	next(rw, req)
+}
+
+// authenticate returns the principal of the request's credentials
+func authenticate(req *web.Request) (*Principal, error) {
+	if key := req.Header.Get(apiKeyHeader); key != "" {
+		return authenticateAPIKey(key)
+	}
+
+	authorization := req.Header.Get("Authorization")
+	if strings.HasPrefix(authorization, "Bearer ") {
+		return parseToken(strings.TrimPrefix(authorization, "Bearer "), time.Now())
+	}
+
+	return nil, errNoCredentials
+}
+
+// authenticateAPIKey returns the principal of a configured API key
+func authenticateAPIKey(key string) (*Principal, error) {
+	sum := sha256.Sum256([]byte(key))
+	hash := hex.EncodeToString(sum[:])
+
+	for _, k := range blueAuth.apiKeys {
+		if subtle.ConstantTimeCompare([]byte(strings.ToLower(k.Hash)), []byte(hash)) == 1 {
+			return &Principal{Subject: k.Name, EnrollID: k.EnrollID, Scopes: k.Scopes, Method: authAPIKey}, nil
+		}
+	}
+
+	return nil, errBadAPIKey
+}
+
+// --------------- tokens ---------------
+
+// tokenHeader is the JOSE header of the issued tokens, only HS256 is accepted
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// tokenClaims are the JWT claims of a bearer token.
+type tokenClaims struct {
+	Subject   string `json:"sub"`
+	Issuer    string `json:"iss,omitempty"`
+	Scope     string `json:"scope"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// issueToken signs a token for enrollID granting the configured scopes
+func issueToken(enrollID string, now time.Time) (string, time.Time, error) {
+	expires := now.Add(blueAuth.jwtTTL)
+	claims, err := json.Marshal(&tokenClaims{
+		Subject:   enrollID,
+		Issuer:    blueAuth.jwtIssuer,
+		Scope:     strings.Join(blueAuth.jwtScopes, " "),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expires.Unix(),
+	})
+	if err != nil {
+		return "", expires, err
+	}
+
+	signed := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	return signed + "." + signToken(signed), expires, nil
+}
+
+// parseToken verifies the signature, issuer and expiry of a token and returns
+// its principal
+func parseToken(token string, now time.Time) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != tokenHeader {
+		return nil, errBadToken
+	}
+	if !hmac.Equal([]byte(signToken(parts[0]+"."+parts[1])), []byte(parts[2])) {
+		return nil, errBadToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errBadToken
+	}
+	claims := &tokenClaims{}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, errBadToken
+	}
+	if claims.Subject == "" || claims.Issuer != blueAuth.jwtIssuer || now.Unix() >= claims.ExpiresAt {
+		return nil, errBadToken
+	}
+
+	return &Principal{Subject: claims.Subject, EnrollID: claims.Subject, Scopes: strings.Fields(claims.Scope), Method: authJWT}, nil
+}
+
+func signToken(signed string) string {
+	mac := hmac.New(sha256.New, blueAuth.jwtSecret)
+	mac.Write([]byte(signed))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// --------------- handlers ---------------
+
+// LoginResponse is the response of a successful login.
+type LoginResponse struct {
+	Status    string `json:"status"`
+	Token     string `json:"token"`
+	ExpiresAt string `json:"expiresAt"`
+}
+
+// Login check a registered user's enrollSecret and issue a bearer token
+func (s *BlueAPP) Login(rw web.ResponseWriter, req *web.Request) {
+	encoder := json.NewEncoder(rw)
+
+	// get params
+	enrollID := req.FormValue("enrollId")
+	enrollSecret := req.FormValue("enrollSecret")
+
+	logger.Infof("login: enrollId=%v", enrollID)
+
+	if enrollID == "" || enrollSecret == "" {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(BlueResponse{Status: "params error"})
+		logger.Error("Error: params error.")
+
+		return
+	}
+
+	if !blueAuth.enabled {
+		rw.WriteHeader(http.StatusNotFound)
+		encoder.Encode(BlueResponse{Status: "authentication is disabled"})
+		return
+	}
+
+	if err := verifyUser(enrollID, enrollSecret); err != nil {
+		rw.WriteHeader(http.StatusUnauthorized)
+		encoder.Encode(BlueResponse{Status: "login error: " + err.Error()})
+		logger.Errorf("login error: %v", err)
+
+		return
+	}
+
+	token, expires, err := issueToken(enrollID, time.Now())
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		encoder.Encode(BlueResponse{Status: "login error: " + err.Error()})
+		logger.Errorf("login error: %v", err)
+
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(LoginResponse{Status: "success", Token: token, ExpiresAt: formatUnix(expires.Unix())})
+	logger.Infof("login successful: %s\n", enrollID)
+}
+
+// VersionResponse is the response of /version.
+type VersionResponse struct {
+	Version string `json:"version"`
+}
+
+// HealthResponse is the response of /health.
+type HealthResponse struct {
+	Status string       `json:"status"`
+	Store  string       `json:"store"`
+	Events string       `json:"events"`
+	Peers  []PeerHealth `json:"peers"`
+}
+
+// Version returns the app version
+func (s *BlueAPP) Version(rw web.ResponseWriter, req *web.Request) {
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(VersionResponse{Version: viper.GetString("app.version")})
+}
+
+// Health reports whether the local store and the event hub are reachable
+func (s *BlueAPP) Health(rw web.ResponseWriter, req *web.Request) {
+	health := HealthResponse{Status: "ok", Store: "ok", Events: "connected"}
+
+	if err := appDB.Ping(); err != nil {
+		health.Status, health.Store = "unavailable", err.Error()
+	}
+	if blueEvents == nil || !blueEvents.Connected() {
+		health.Events = "disconnected"
+	}
+	peers, available := bluePeers.health()
+	health.Peers = peers
+	if !available {
+		health.Status = "unavailable"
+	}
+
+	if health.Status == "ok" {
+		rw.WriteHeader(http.StatusOK)
+	} else {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(rw).Encode(health)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchRoute(t *testing.T) {
+	tests := []struct {
+		method, path string
+		want         string
+	}{
+		{"POST", "/tx/issuerset", "/tx/issuerset"},
+		{"POST", "/tx/issuerset/", "/tx/issuerset"},
+		{"POST", "/tx/issuerset//", ""},
+		{"GET", "/tx/tx-1", "/tx/:id"},
+		{"GET", "/tx/tx-1/", "/tx/:id"},
+		{"GET", "/webhooks/deadletters/", "/webhooks/deadletters"},
+		{"DELETE", "/webhooks/deadletters", "/webhooks/:id"},
+		{"GET", "/v1/books/USD/CNY", "/v1/books/:gets/:pays"},
+		{"GET", "/tx/issuerset/more", ""},
+		{"PUT", "/tx/send", ""},
+	}
+	for _, tt := range tests {
+		route := matchRoute(tt.method, tt.path)
+		got := ""
+		if route != nil {
+			got = route.Path
+		}
+		if got != tt.want {
+			t.Errorf("%s %s: matched %q, want %q", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+// TestAdminScopeTrailingSlash checks that a token with the default read and
+// write scopes reaches no admin route, with or without a trailing slash
+func TestAdminScopeTrailingSlash(t *testing.T) {
+	token, restore := enableTestAuth(t)
+	defer restore()
+
+	server := httptest.NewServer(buildBlueRouter())
+	defer server.Close()
+
+	for _, route := range blueRoutes {
+		if route.scope() != scopeAdmin {
+			continue
+		}
+
+		path := strings.Replace(route.Path, ":id", "1", -1)
+		for _, p := range []string{path, path + "/"} {
+			req, err := http.NewRequest(route.Method, server.URL+p, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusForbidden {
+				t.Errorf("%s %s: status %d, want %d", route.Method, p, resp.StatusCode, http.StatusForbidden)
+			}
+		}
+	}
+}
+
+// TestReadOwnership checks that the read routes serve an account's data only
+// to its owner
+func TestReadOwnership(t *testing.T) {
+	openTestStore(t, func() error { return execSchema(usersSchema) }, func() error { return execSchema(indexSchema) })
+	if err := saveAccount("alice-account", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveAccount("bob-account", "bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	token, restore := enableTestAuth(t)
+	defer restore()
+
+	server := httptest.NewServer(buildBlueRouter())
+	defer server.Close()
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/accounts/alice-account/history", http.StatusOK},
+		{"/accounts/bob-account/history", http.StatusForbidden},
+		{"/accounts/bob-account/statement", http.StatusForbidden},
+		{"/accounts/bob-account/statement?format=csv", http.StatusForbidden},
+		{"/accounts/bob-account/balances", http.StatusForbidden},
+		{"/v1/accounts/bob-account/balances", http.StatusForbidden},
+		{"/invoices?payee=bob-account", http.StatusForbidden},
+		{"/v1/invoices?payer=bob-account", http.StatusForbidden},
+		{"/checks?sender=bob-account", http.StatusForbidden},
+		{"/v1/checks?receiver=bob-account", http.StatusForbidden},
+		{"/stream?topic=payments&account=bob-account", http.StatusForbidden},
+		{"/stream?topic=trades&account=bob-account", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", server.URL+tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("GET %s: status %d, want %d", tt.path, resp.StatusCode, tt.want)
+		}
+	}
+}
+
+// enableTestAuth enables the authentication and returns a token of alice
+// with the default read and write scopes, and a function restoring the
+// settings
+func enableTestAuth(t *testing.T) (string, func()) {
+	saved := blueAuth
+	blueAuth = &authSettings{
+		enabled:   true,
+		jwtSecret: []byte(strings.Repeat("s", 32)),
+		jwtTTL:    time.Hour,
+		jwtScopes: []string{scopeRead, scopeWrite},
+	}
+
+	token, _, err := issueToken("alice", time.Now())
+	if err != nil {
+		blueAuth = saved
+		t.Fatal(err)
+	}
+
+	return token, func() { blueAuth = saved }
+}
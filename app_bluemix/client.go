@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// output formats of the client commands
+const (
+	outputJSON  = "json"
+	outputTable = "table"
+)
+
+// clientFlags are the flags of the tx and query commands, which call a
+// running app over its REST API and need no crypto material
+var clientFlags struct {
+	url            string
+	apiKey         string
+	token          string
+	output         string
+	timeout        time.Duration
+	wait           bool
+	idempotencyKey string
+}
+
+// addClientFlags adds the connection and output flags to a client command
+func addClientFlags(cmd *cobra.Command) {
+	flags := cmd.PersistentFlags()
+	flags.StringVar(&clientFlags.url, "url", "", "URL of the app, defaults to app.client.url")
+	flags.StringVar(&clientFlags.apiKey, "api-key", "", "API key, defaults to app.client.apiKey")
+	flags.StringVar(&clientFlags.token, "token", "", "Bearer token, defaults to app.client.token")
+	flags.StringVar(&clientFlags.output, "output", outputTable, "Output format, json or table")
+	flags.DurationVar(&clientFlags.timeout, "timeout", 60*time.Second, "Timeout of the request")
+}
+
+// --------------- TxCmd ---------------
+
+var txFlags struct {
+	sender         string
+	receiver       string
+	amount         string
+	currency       string
+	destinationTag string
+	sourceTag      string
+	memo           string
+	invoiceID      string
+	takerGets      string
+	takerPays      string
+	id             string
+	account        string
+}
+
+// TxCmd returns the cobra command submitting transactions to a running app
+func TxCmd() *cobra.Command {
+	addClientFlags(txCmd)
+	txCmd.PersistentFlags().BoolVar(&clientFlags.wait, "wait", false, "Wait until the transaction is committed")
+	txCmd.PersistentFlags().StringVar(&clientFlags.idempotencyKey, "idempotency-key", "", "Idempotency-Key of a send or offer, safe to retry")
+
+	flags := txSendCmd.Flags()
+	flags.StringVar(&txFlags.sender, "sender", "", "Sender account")
+	flags.StringVar(&txFlags.receiver, "receiver", "", "Receiver account")
+	flags.StringVar(&txFlags.amount, "amount", "", "Amount")
+	flags.StringVar(&txFlags.currency, "currency", "", "Currency")
+	flags.StringVar(&txFlags.destinationTag, "destination-tag", "", "Destination tag")
+	flags.StringVar(&txFlags.sourceTag, "source-tag", "", "Source tag")
+	flags.StringVar(&txFlags.memo, "memo", "", "Memo")
+	flags.StringVar(&txFlags.invoiceID, "invoice-id", "", "ID of the invoice paid")
+
+	flags = txOfferCmd.Flags()
+	flags.StringVar(&txFlags.sender, "sender", "", "Sender account")
+	flags.StringVar(&txFlags.takerGets, "taker-gets", "", "Amount the taker gets, <value>/<currency>")
+	flags.StringVar(&txFlags.takerPays, "taker-pays", "", "Amount the taker pays, <value>/<currency>")
+
+	flags = txCancelCmd.Flags()
+	flags.StringVar(&txFlags.id, "id", "", "ID of the offer, the txid that placed it")
+	flags.StringVar(&txFlags.account, "account", "", "Account cancelling the offer, its sender")
+
+	txCmd.AddCommand(txSendCmd)
+	txCmd.AddCommand(txOfferCmd)
+	txCmd.AddCommand(txCancelCmd)
+
+	return txCmd
+}
+
+var txCmd = &cobra.Command{
+	Use:   "tx",
+	Short: "Submit transactions to a running app.",
+	Long:  `Submit transactions to a running app over its REST API.`,
+}
+
+var txSendCmd = &cobra.Command{
+	Use:          "send",
+	Short:        "Send a payment.",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		body := &SendRequest{
+			Sender:    txFlags.sender,
+			Receiver:  txFlags.receiver,
+			Amount:    txFlags.amount,
+			Currency:  txFlags.currency,
+			Memo:      txFlags.memo,
+			InvoiceID: txFlags.invoiceID,
+		}
+		var err error
+		if body.DestinationTag, err = parseTagFlag("destination-tag", txFlags.destinationTag); err != nil {
+			return err
+		}
+		if body.SourceTag, err = parseTagFlag("source-tag", txFlags.sourceTag); err != nil {
+			return err
+		}
+
+		return submitTx("/v1/tx/send", body)
+	},
+}
+
+var txOfferCmd = &cobra.Command{
+	Use:          "offer",
+	Short:        "Place an offer.",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		takerGets, err := parseAmountFlag("taker-gets", txFlags.takerGets)
+		if err != nil {
+			return err
+		}
+		takerPays, err := parseAmountFlag("taker-pays", txFlags.takerPays)
+		if err != nil {
+			return err
+		}
+
+		return submitTx("/v1/tx/offer", &OfferRequest{Sender: txFlags.sender, TakerGets: takerGets, TakerPays: takerPays})
+	},
+}
+
+var txCancelCmd = &cobra.Command{
+	Use:          "cancel",
+	Short:        "Take an offer off the book.",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return submitTx("/v1/tx/offercancel", &OfferCancelRequest{ID: txFlags.id, Account: txFlags.account})
+	},
+}
+
+// submitTx posts a transaction and prints the response
+func submitTx(path string, body interface{}) error {
+	if clientFlags.wait {
+		path += "?wait=" + waitCommitted
+	}
+
+	tx := &TxResponse{}
+	if err := callApp("POST", path, body, tx); err != nil {
+		return err
+	}
+
+	return printOutput(tx, []string{"STATUS", "TXID", "ID"}, [][]string{{tx.Status, tx.TxID, tx.ID}})
+}
+
+// parseAmountFlag parses an amount flag of the form <value>/<currency>
+func parseAmountFlag(name, value string) (Amount, error) {
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 {
+		return Amount{}, fmt.Errorf("--%s must be <value>/<currency>", name)
+	}
+
+	return Amount{Value: parts[0], Currency: parts[1]}, nil
+}
+
+// parseTagFlag parses an optional tag flag
+func parseTagFlag(name, value string) (*uint32, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	tag, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("--%s must be an unsigned 32-bit integer", name)
+	}
+	t := uint32(tag)
+
+	return &t, nil
+}
+
+// --------------- QueryCmd ---------------
+
+var queryFlags struct {
+	currency string
+	before   string
+	limit    int
+}
+
+// QueryCmd returns the cobra command querying a running app
+func QueryCmd() *cobra.Command {
+	addClientFlags(queryCmd)
+
+	queryHistoryCmd.Flags().StringVar(&queryFlags.currency, "currency", "", "Only the payments in this currency")
+	queryHistoryCmd.Flags().StringVar(&queryFlags.before, "before", "", "Only the payments before this ID")
+	queryHistoryCmd.Flags().IntVar(&queryFlags.limit, "limit", 0, "Maximum number of payments")
+	queryBookCmd.Flags().IntVar(&queryFlags.limit, "limit", 0, "Maximum number of offers")
+
+	queryCmd.AddCommand(queryBalanceCmd)
+	queryCmd.AddCommand(queryBookCmd)
+	queryCmd.AddCommand(queryHistoryCmd)
+
+	return queryCmd
+}
+
+var queryCmd = &cobra.Command{
+	Use:   "query",
+	Short: "Query a running app.",
+	Long:  `Query the balances, order books and history of a running app over its REST API.`,
+}
+
+var queryBalanceCmd = &cobra.Command{
+	Use:          "balance <account>",
+	Short:        "Get the balances of an account.",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("expecting an account")
+		}
+
+		balances := &BalancesResponse{}
+		if err := callApp("GET", "/v1/accounts/"+url.QueryEscape(args[0])+"/balances", nil, balances); err != nil {
+			return err
+		}
+
+		var rows [][]string
+		for _, currency := range sortedKeys(balances.Balances) {
+			rows = append(rows, []string{currency, balances.Balances[currency]})
+		}
+
+		return printOutput(balances, []string{"CURRENCY", "BALANCE"}, rows)
+	},
+}
+
+var queryBookCmd = &cobra.Command{
+	Use:          "book <getsCurrency>/<paysCurrency>",
+	Short:        "List the resting offers of a pair, best rate first.",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("expecting a pair")
+		}
+
+		pair := strings.SplitN(args[0], "/", 2)
+		if len(pair) != 2 || pair[0] == "" || pair[1] == "" {
+			return fmt.Errorf("invalid pair %q, expecting <getsCurrency>/<paysCurrency>", args[0])
+		}
+
+		offers := []*BookOffer{}
+		if err := callApp("GET", "/v1/books/"+url.QueryEscape(pair[0])+"/"+url.QueryEscape(pair[1]), nil, &offers); err != nil {
+			return err
+		}
+		if queryFlags.limit > 0 && len(offers) > queryFlags.limit {
+			offers = offers[:queryFlags.limit]
+		}
+
+		var rows [][]string
+		for _, offer := range offers {
+			rows = append(rows, []string{offer.ID, offer.Sender, offer.TakerGets, offer.TakerPays, offer.Timestamp})
+		}
+
+		return printOutput(offers, []string{"ID", "SENDER", "TAKER GETS", "TAKER PAYS", "PLACED"}, rows)
+	},
+}
+
+var queryHistoryCmd = &cobra.Command{
+	Use:          "history <account>",
+	Short:        "List the indexed payments of an account, newest first.",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("expecting an account")
+		}
+
+		params := url.Values{}
+		if queryFlags.currency != "" {
+			params.Set("currency", queryFlags.currency)
+		}
+		if queryFlags.before != "" {
+			params.Set("before", queryFlags.before)
+		}
+		if queryFlags.limit > 0 {
+			params.Set("limit", strconv.Itoa(queryFlags.limit))
+		}
+
+		payments := []*Payment{}
+		path := "/accounts/" + url.QueryEscape(args[0]) + "/history?" + params.Encode()
+		if err := callApp("GET", path, nil, &payments); err != nil {
+			return err
+		}
+
+		var rows [][]string
+		for _, p := range payments {
+			rows = append(rows, []string{strconv.FormatInt(p.ID, 10), p.TxID, p.Kind, p.Sender, p.Receiver,
+				p.Amount, p.Currency, p.CommittedAt})
+		}
+
+		return printOutput(payments, []string{"ID", "TXID", "KIND", "SENDER", "RECEIVER", "AMOUNT", "CURRENCY", "COMMITTED"}, rows)
+	},
+}
+
+// --------------- REST client ---------------
+
+// clientURL returns the URL of the app: --url, app.client.url, or the
+// app's own address on this host
+func clientURL() string {
+	if clientFlags.url != "" {
+		return strings.TrimSuffix(clientFlags.url, "/")
+	}
+	if u := viper.GetString("app.client.url"); u != "" {
+		return strings.TrimSuffix(u, "/")
+	}
+
+	scheme := "http"
+	if viper.GetBool("app.tls.enabled") {
+		scheme = "https"
+	}
+	address := strings.Replace(viper.GetString("app.address"), "0.0.0.0", "localhost", 1)
+	if address == "" {
+		address = "localhost:8001"
+	}
+
+	return scheme + "://" + address
+}
+
+// callApp sends a request to the app and decodes the JSON response into
+// result. An error response is returned as an error with its message.
+func callApp(method, path string, body interface{}, result interface{}) error {
+	// a transaction is not submitted for an output that cannot be printed
+	if clientFlags.output != outputJSON && clientFlags.output != outputTable {
+		return fmt.Errorf("unknown output %s, expecting json or table", clientFlags.output)
+	}
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, clientURL()+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if key := firstNonEmpty(clientFlags.apiKey, viper.GetString("app.client.apiKey")); key != "" {
+		req.Header.Set(apiKeyHeader, key)
+	}
+	if token := firstNonEmpty(clientFlags.token, viper.GetString("app.client.token")); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if clientFlags.idempotencyKey != "" && method == "POST" {
+		req.Header.Set(idempotencyKeyHeader, clientFlags.idempotencyKey)
+	}
+
+	client := &http.Client{Timeout: clientFlags.timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return responseError(resp.StatusCode, data)
+	}
+
+	return json.Unmarshal(data, result)
+}
+
+// responseError returns the error of an error response of the v1 or the
+// form routes
+func responseError(status int, data []byte) error {
+	e := &ErrorResponse{}
+	if json.Unmarshal(data, e) == nil && e.Error != nil {
+		msg := e.Error.Message
+		for _, field := range sortedKeys(e.Error.Fields) {
+			msg += fmt.Sprintf("\n  %s: %s", field, e.Error.Fields[field])
+		}
+		if e.Error.TxID != "" {
+			msg += "\n  txid: " + e.Error.TxID
+		}
+		return fmt.Errorf("%d %s: %s", status, e.Error.Code, msg)
+	}
+
+	legacy := &BlueResponse{}
+	if json.Unmarshal(data, legacy) == nil && legacy.Status != "" {
+		return fmt.Errorf("%d: %s", status, legacy.Status)
+	}
+
+	return fmt.Errorf("%d: %s", status, strings.TrimSpace(string(data)))
+}
+
+// printOutput prints v as JSON, or the rows as a table under header
+func printOutput(v interface{}, header []string, rows [][]string) error {
+	switch clientFlags.output {
+	case outputJSON:
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(append(data, '\n'))
+		return err
+	case outputTable:
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, strings.Join(header, "\t"))
+		for _, row := range rows {
+			fmt.Fprintln(w, strings.Join(row, "\t"))
+		}
+		return w.Flush()
+	}
+
+	return fmt.Errorf("unknown output %s, expecting json or table", clientFlags.output)
+}
+
+// sortedKeys returns the keys of m in order
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"github.com/gocraft/web"
+	"github.com/spf13/viper"
+)
+
+// error codes of peer calls cut short
+const (
+	codeTimeout  = "timeout"
+	codeCanceled = "canceled"
+)
+
+// statusClientClosed is the status logged for a request whose client went
+// away, nobody reads the response
+const statusClientClosed = 499
+
+// invokeTimeout bounds the submission of a transaction to a peer
+func invokeTimeout() time.Duration {
+	if timeout := viper.GetDuration("app.tx.invokeTimeout"); timeout > 0 {
+		return timeout
+	}
+
+	return 30 * time.Second
+}
+
+// queryTimeout bounds a chaincode query
+func queryTimeout() time.Duration {
+	if timeout := viper.GetDuration("app.tx.queryTimeout"); timeout > 0 {
+		return timeout
+	}
+
+	return 10 * time.Second
+}
+
+// RequestContext is a middleware function that gives the request a context
+// cancelled when the client disconnects, so that the peer calls made for it
+// stop.
+func (s *BlueAPP) RequestContext(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	closed := rw.CloseNotify()
+	go func() {
+		select {
+		case <-closed:
+			logger.Debugf("%s %s: client disconnected", req.Method, req.URL.Path)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	s.ctx = ctx
+	next(rw, req)
+}
+
+// isTimeout reports whether err is a peer call that ran out of time
+func isTimeout(err error) bool {
+	return err == context.DeadlineExceeded || grpc.Code(err) == codes.DeadlineExceeded
+}
+
+// isCanceled reports whether err is a peer call cancelled with its request
+func isCanceled(err error) bool {
+	return err == context.Canceled || grpc.Code(err) == codes.Canceled
+}
+
+// peerError returns the error of a failed call of function: a timeout, a
+// cancelled request or a chaincode error
+func peerError(function string, err error, timeout time.Duration) *APIError {
+	switch {
+	case isTimeout(err):
+		return newAPIError(http.StatusGatewayTimeout, codeTimeout,
+			fmt.Sprintf("%s error: the peer did not answer within %v", function, timeout))
+	case isCanceled(err):
+		return newAPIError(statusClientClosed, codeCanceled, fmt.Sprintf("%s error: request cancelled", function))
+	}
+
+	return newAPIError(http.StatusBadRequest, codeChaincode, fmt.Sprintf("%s error: %v", function, err))
+}
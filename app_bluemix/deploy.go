@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/hyperledger/fabric/core/util"
+	pb "github.com/hyperledger/fabric/protos"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// pingInterval spaces the pings of a chaincode that is not running yet
+const pingInterval = 2 * time.Second
+
+// chaincodeNameFlag is the --chaincode-name of the commands using the
+// chaincode
+var chaincodeNameFlag string
+
+// chaincodeName is the chaincode the app uses, an upgrade switches it while
+// serving
+var (
+	chaincodeMu   sync.RWMutex
+	chaincodeName string
+)
+
+// currentChaincode returns the name of the chaincode the app uses
+func currentChaincode() string {
+	chaincodeMu.RLock()
+	defer chaincodeMu.RUnlock()
+
+	return chaincodeName
+}
+
+// setChaincode switches the app to the chaincode name. The event hub
+// registers again for the events of the new chaincode.
+func setChaincode(name string) {
+	chaincodeMu.Lock()
+	chaincodeName = name
+	chaincodeMu.Unlock()
+
+	if blueEvents != nil {
+		blueEvents.reconnect()
+	}
+}
+
+// --------------- DeployCmd ---------------
+
+// DeployCmd returns the cobra command deploying the chaincode. The name is
+// printed and saved to app.blue.chaincodeNameFile, where start finds it.
+func DeployCmd() *cobra.Command {
+	return deployCmd
+}
+
+var deployCmd = &cobra.Command{
+	Use:   "deploy",
+	Short: "Deploy the chaincode.",
+	Long:  `Deploy the chaincode of app.blue.chaincodePath, print its name and save it for the next start.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := initPeerClient(); err != nil {
+			return fmt.Errorf("Error connecting to the peers: %s", err)
+		}
+		if err := initDeployer(); err != nil {
+			return fmt.Errorf("Error enrolling the deployer: %s", err)
+		}
+
+		name, err := deployChaincode()
+		if err != nil {
+			return err
+		}
+		if err := saveChaincodeName(name); err != nil {
+			return fmt.Errorf("Error saving chaincode name: %s", err)
+		}
+		if err := pingChaincode(name); err != nil {
+			return err
+		}
+
+		fmt.Println(name)
+
+		return nil
+	},
+}
+
+// --------------- chaincode selection ---------------
+
+// connectBlue connects to the peers, enrolls the deployer and selects the
+// chaincode: --chaincode-name, app.blue.chaincodeName, the name saved by
+// deploy, or a new deployment when app.blue.deployIfMissing is set. It fails
+// unless the chaincode answers a ping.
+func connectBlue() error {
+	if err := initPeerClient(); err != nil {
+		return fmt.Errorf("Error connecting to the peers: %s", err)
+	}
+	if err := initDeployer(); err != nil {
+		return fmt.Errorf("Error enrolling the deployer: %s", err)
+	}
+
+	name, err := selectChaincodeName()
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		if !viper.GetBool("app.blue.deployIfMissing") {
+			return fmt.Errorf("No chaincode name: run deploy, pass --chaincode-name or set app.blue.chaincodeName")
+		}
+
+		logger.Infof("No chaincode name, deploying the chaincode")
+		if name, err = deployChaincode(); err != nil {
+			return err
+		}
+		if err := saveChaincodeName(name); err != nil {
+			return fmt.Errorf("Error saving chaincode name: %s", err)
+		}
+	}
+	setChaincode(name)
+
+	return pingChaincode(name)
+}
+
+// selectChaincodeName returns the configured chaincode name, empty when
+// there is none
+func selectChaincodeName() (string, error) {
+	if chaincodeNameFlag != "" {
+		return chaincodeNameFlag, nil
+	}
+
+	name := os.Getenv("CORE_APP_BLUE_CHAINCODENAME")
+	if name == "" {
+		name = viper.GetString("app.blue.chaincodeName")
+	}
+	if name != "" {
+		return name, nil
+	}
+
+	data, err := ioutil.ReadFile(chaincodeNameFile())
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+// chaincodeNameFile returns the file the deployed chaincode name is saved to
+func chaincodeNameFile() string {
+	if file := viper.GetString("app.blue.chaincodeNameFile"); file != "" {
+		return file
+	}
+
+	return "chaincode.name"
+}
+
+// saveChaincodeName saves the name of a deployed chaincode. The file is
+// replaced in one rename, so a start never reads half a name.
+func saveChaincodeName(name string) error {
+	file := chaincodeNameFile()
+	if err := ioutil.WriteFile(file+".tmp", []byte(name+"\n"), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(file+".tmp", file)
+}
+
+// pingChaincode queries ping until the chaincode name answers, a fresh
+// deployment takes a while to start, or app.blue.pingTimeout passes
+func pingChaincode(name string) error {
+	timeout := viper.GetDuration("app.blue.pingTimeout")
+	if timeout <= 0 {
+		timeout = 2 * time.Minute
+	}
+	deadline := time.Now().Add(timeout)
+
+	for {
+		result, err := queryChaincodeAt(name, "ping")
+		if err == nil && string(result) == "pong" {
+			logger.Infof("Chaincode %s is running", name)
+			return nil
+		}
+
+		if err == nil {
+			err = fmt.Errorf("unexpected answer %q", result)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Chaincode %s did not answer ping within %v: %v", name, timeout, err)
+		}
+
+		logger.Debugf("ping chaincode %s: %v", name, err)
+		time.Sleep(pingInterval)
+	}
+}
+
+// queryChaincodeAt queries the chaincode name as the deployer
+func queryChaincodeAt(name string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout())
+	defer cancel()
+
+	resp, err := queryChaincodeOf(ctx, deployerClient, name, &pb.ChaincodeInput{Args: util.ToChaincodeArgs(args...)})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status != pb.Response_SUCCESS {
+		return nil, fmt.Errorf("%s", resp.Msg)
+	}
+
+	return resp.Msg, nil
+}
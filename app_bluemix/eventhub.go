@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/hyperledger/fabric/core/peer"
+	pb "github.com/hyperledger/fabric/protos"
+	"github.com/spf13/viper"
+)
+
+// blueEventPrefix is the name prefix of the events set by the blue chaincode
+const blueEventPrefix = "blue."
+
+// backoff bounds of the event hub client
+const (
+	eventHubMinBackoff = time.Second
+	eventHubMaxBackoff = time.Minute
+)
+
+// eventHub is a long-lived client of the peer's event hub. It registers for
+// block, rejection and blue chaincode events, reconnects with exponential
+// backoff and fans the events out to in-process subscribers.
+type eventHub struct {
+	address string
+
+	mu          sync.RWMutex
+	subscribers map[int]*eventSubscriber
+	nextID      int
+	connected   bool
+	// cancel closes the current stream
+	cancel context.CancelFunc
+}
+
+// eventSubscriber receives the events accepted by its filter.
+type eventSubscriber struct {
+	events chan *pb.Event
+	filter func(*pb.Event) bool
+}
+
+// blueEvents is the app's event hub client, set by startEventHub
+var blueEvents *eventHub
+
+// newEventHub creates an event hub client for address
+func newEventHub(address string) *eventHub {
+	return &eventHub{
+		address:     address,
+		subscribers: make(map[int]*eventSubscriber),
+	}
+}
+
+// startEventHub starts the app's event hub client
+func startEventHub() {
+	blueEvents = newEventHub(eventHubAddress())
+	if blueEvents.address == "" {
+		logger.Warning("No event hub address configured, transactions stay pending.")
+		return
+	}
+
+	go blueEvents.run()
+}
+
+// eventHubAddress returns app.events.address, defaulting to the peer's
+// configured event address
+func eventHubAddress() string {
+	address := viper.GetString("app.events.address")
+	if address == "" {
+		address = viper.GetString("peer.validator.events.address")
+	}
+
+	return address
+}
+
+// Subscribe returns a channel receiving the events accepted by filter, nil
+// accepts all events, and a function cancelling the subscription. Events are
+// dropped for a subscriber whose buffer is full, so slow consumers cannot
+// stall the others.
+func (h *eventHub) Subscribe(buffer int, filter func(*pb.Event) bool) (<-chan *pb.Event, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	id := h.nextID
+	h.nextID++
+	sub := &eventSubscriber{events: make(chan *pb.Event, buffer), filter: filter}
+	h.subscribers[id] = sub
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			h.mu.Lock()
+			delete(h.subscribers, id)
+			h.mu.Unlock()
+			close(sub.events)
+		})
+	}
+
+	return sub.events, cancel
+}
+
+// Connected reports whether the client currently holds an event stream
+func (h *eventHub) Connected() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.connected
+}
+
+// publish fans event out to the subscribers
+func (h *eventHub) publish(event *pb.Event) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for id, sub := range h.subscribers {
+		if sub.filter != nil && !sub.filter(event) {
+			continue
+		}
+
+		select {
+		case sub.events <- event:
+		default:
+			logger.Warningf("Event hub subscriber %d is full, dropping event", id)
+		}
+	}
+}
+
+func (h *eventHub) setConnected(connected bool) {
+	h.mu.Lock()
+	h.connected = connected
+	h.mu.Unlock()
+}
+
+// reconnect closes the current stream, the client connects and registers
+// again
+func (h *eventHub) reconnect() {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if h.cancel != nil {
+		h.cancel()
+	}
+}
+
+// run consumes the event stream forever, reconnecting with backoff
+func (h *eventHub) run() {
+	backoff := eventHubMinBackoff
+
+	for {
+		start := time.Now()
+		err := h.consume()
+		h.setConnected(false)
+
+		// a stream that stayed up for a while resets the backoff
+		if time.Since(start) > eventHubMaxBackoff {
+			backoff = eventHubMinBackoff
+		}
+
+		logger.Errorf("Event hub %s: %v, reconnecting in %v", h.address, err, backoff)
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > eventHubMaxBackoff {
+			backoff = eventHubMaxBackoff
+		}
+	}
+}
+
+// consume registers for events and publishes them until the stream fails
+func (h *eventHub) consume() error {
+	conn, err := peer.NewPeerClientConnectionWithAddress(h.address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := pb.NewEventsClient(conn).Chat(ctx)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	h.cancel = cancel
+	h.mu.Unlock()
+
+	// an empty event name registers all events of the chaincode, the blue.*
+	// ones are selected in isBlueEvent
+	register := &pb.Event{Event: &pb.Event_Register{Register: &pb.Register{Events: []*pb.Interest{
+		&pb.Interest{EventType: pb.EventType_BLOCK},
+		&pb.Interest{EventType: pb.EventType_REJECTION},
+		&pb.Interest{EventType: pb.EventType_CHAINCODE, RegInfo: &pb.Interest_ChaincodeRegInfo{
+			ChaincodeRegInfo: &pb.ChaincodeReg{ChaincodeID: currentChaincode()}}},
+	}}}}
+	if err := stream.Send(register); err != nil {
+		return err
+	}
+
+	h.setConnected(true)
+	logger.Infof("Connected to event hub %s", h.address)
+
+	for {
+		event, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if event == nil {
+			return errors.New("nil event")
+		}
+
+		if e, ok := event.Event.(*pb.Event_ChaincodeEvent); ok && !isBlueEvent(e.ChaincodeEvent) {
+			continue
+		}
+
+		h.publish(event)
+	}
+}
+
+// isBlueEvent reports whether a chaincode event was set by the blue chaincode
+func isBlueEvent(event *pb.ChaincodeEvent) bool {
+	return event != nil && strings.HasPrefix(event.EventName, blueEventPrefix)
+}
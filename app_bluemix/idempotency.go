@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/gocraft/web"
+	"github.com/spf13/viper"
+)
+
+// idempotency headers
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	idempotencyReplayedHeader = "Idempotent-Replayed"
+
+	maxIdempotencyKeyLength = 255
+)
+
+// error codes of repeated idempotency keys
+const (
+	codeIdempotencyMismatch   = "idempotency_key_mismatch"
+	codeIdempotencyInProgress = "idempotency_key_in_progress"
+)
+
+var idempotencySchema = []string{
+	`CREATE TABLE IF NOT EXISTS idempotency_keys (
+		enroll_id TEXT NOT NULL,
+		key TEXT NOT NULL,
+		fingerprint TEXT NOT NULL,
+		status INTEGER NOT NULL DEFAULT 0,
+		response TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (enroll_id, key)
+	)`,
+}
+
+// idempotentRoutes are the routes accepting an Idempotency-Key header, by
+// method and path, filled by buildBlueRouter
+var idempotentRoutes = map[string]bool{}
+
+// idempotentRecord is a stored key, status is 0 until the first request
+// completes.
+type idempotentRecord struct {
+	fingerprint string
+	status      int
+	response    []byte
+}
+
+// responseRecorder keeps a copy of the response written through it.
+type responseRecorder struct {
+	web.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(b)
+
+	return r.ResponseWriter.Write(b)
+}
+
+// startIdempotency creates the idempotency key table
+func startIdempotency() error {
+	return execSchema(idempotencySchema)
+}
+
+// Idempotency is a middleware function that makes the routes marked
+// Idempotent safe to retry. The first request with an Idempotency-Key stores
+// its response, a repeat of the same request within app.idempotency.retention
+// gets it back and a different request with the key is rejected. The key
+// also fixes the transaction ID, so the chaincode rejects a transaction
+// submitted twice.
+func (s *BlueAPP) Idempotency(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	key := req.Header.Get(idempotencyKeyHeader)
+	if key == "" || !idempotentRoutes[req.Method+" "+req.URL.Path] || s.principal == nil {
+		next(rw, req)
+		return
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		writeError(rw, req, paramsError(map[string]string{idempotencyKeyHeader: "exceeds 255 bytes"}))
+		return
+	}
+
+	fingerprint, err := requestFingerprint(req)
+	if err != nil {
+		writeError(rw, req, newAPIError(http.StatusBadRequest, codeInvalidParams, err.Error()))
+		return
+	}
+
+	enrollID := s.principal.EnrollID
+	claimedAt := time.Now()
+	stored, err := claimIdempotencyKey(enrollID, key, fingerprint, claimedAt)
+	if err != nil {
+		writeStoreError(rw, "idempotency", err)
+		return
+	}
+
+	switch {
+	case stored == nil:
+	case stored.fingerprint != fingerprint:
+		writeError(rw, req, newAPIError(http.StatusUnprocessableEntity, codeIdempotencyMismatch,
+			"idempotency key was used with a different request"))
+		logger.Errorf("Error: %s %s: idempotency key %s reused", req.Method, req.URL.Path, key)
+		return
+	case stored.status == 0:
+		writeError(rw, req, newAPIError(http.StatusConflict, codeIdempotencyInProgress,
+			"a request with this idempotency key is in progress"))
+		return
+	default:
+		logger.Infof("%s %s: replaying idempotency key %s", req.Method, req.URL.Path, key)
+		rw.Header().Set(idempotencyReplayedHeader, "true")
+		rw.WriteHeader(stored.status)
+		rw.Write(stored.response)
+		return
+	}
+
+	s.idempotencyKey = key
+	recorder := &responseRecorder{ResponseWriter: rw}
+	next(recorder, req)
+
+	if err := saveIdempotentResponse(enrollID, key, claimedAt, recorder); err != nil {
+		logger.Errorf("idempotency key %s save error: %v", key, err)
+	}
+}
+
+// requestFingerprint hashes the method, path, parameters and body of a
+// request. The body is put back for the handler.
+func requestFingerprint(req *web.Request) (string, error) {
+	if err := req.ParseForm(); err != nil {
+		return "", err
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return "", err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	h := sha256.New()
+	for _, part := range []string{req.Method, req.URL.Path, req.Form.Encode()} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	h.Write(body)
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// claimIdempotencyKey records a new key of enrollID, returning nil, or the
+// stored record of a key used within the retention window. A claim whose
+// request did not complete within invokeTimeout, e.g. because the app
+// stopped, expires so that the client can retry.
+func claimIdempotencyKey(enrollID, key, fingerprint string, now time.Time) (*idempotentRecord, error) {
+	retention := viper.GetDuration("app.idempotency.retention")
+	if retention <= 0 {
+		retention = 24 * time.Hour
+	}
+
+	_, err := appDB.Exec(`DELETE FROM idempotency_keys WHERE created_at < ? OR (status = 0 AND created_at < ?)`,
+		now.Add(-retention).Unix(), now.Add(-invokeTimeout()).Unix())
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := appDB.Exec(`INSERT OR IGNORE INTO idempotency_keys (enroll_id, key, fingerprint, created_at) VALUES (?, ?, ?, ?)`,
+		enrollID, key, fingerprint, now.Unix())
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return nil, err
+	}
+
+	stored := &idempotentRecord{}
+	var response string
+	err = appDB.QueryRow(`SELECT fingerprint, status, response FROM idempotency_keys WHERE enroll_id = ? AND key = ?`, enrollID, key).
+		Scan(&stored.fingerprint, &stored.status, &response)
+	if err != nil {
+		return nil, err
+	}
+	stored.response = []byte(response)
+
+	return stored, nil
+}
+
+// saveIdempotentResponse stores the response of the claim of a key made at
+// claimedAt. A server error frees the key, so that the client can retry. A
+// claim that expired meanwhile is left to the request that took it over.
+func saveIdempotentResponse(enrollID, key string, claimedAt time.Time, recorder *responseRecorder) error {
+	if recorder.status == 0 || recorder.status >= http.StatusInternalServerError {
+		_, err := appDB.Exec(`DELETE FROM idempotency_keys WHERE enroll_id = ? AND key = ? AND status = 0 AND created_at = ?`,
+			enrollID, key, claimedAt.Unix())
+		return err
+	}
+
+	_, err := appDB.Exec(`UPDATE idempotency_keys SET status = ?, response = ? WHERE enroll_id = ? AND key = ? AND status = 0 AND created_at = ?`,
+		recorder.status, recorder.body.String(), enrollID, key, claimedAt.Unix())
+	return err
+}
+
+// idempotentTxID returns the transaction ID of an idempotency key of
+// enrollID
+func idempotentTxID(enrollID, key string) string {
+	sum := sha256.Sum256([]byte(enrollID + "\x00" + key))
+	return hex.EncodeToString(sum[:])
+}
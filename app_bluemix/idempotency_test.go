@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestClaimIdempotencyKeyExpiresInProgress(t *testing.T) {
+	openTestStore(t, startIdempotency)
+
+	start := time.Now()
+	if stored, err := claimIdempotencyKey("alice", "k", "f", start); err != nil || stored != nil {
+		t.Fatalf("first claim: %v %v", stored, err)
+	}
+
+	stored, err := claimIdempotencyKey("alice", "k", "f", start.Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored == nil || stored.status != 0 {
+		t.Fatalf("repeat within the timeout: %+v, want in progress", stored)
+	}
+
+	// the first request never completed, its claim expires
+	later := start.Add(invokeTimeout() + time.Second)
+	if stored, err := claimIdempotencyKey("alice", "k", "f", later); err != nil || stored != nil {
+		t.Fatalf("claim after the timeout: %v %v", stored, err)
+	}
+
+	// the late first request does not overwrite the new claim
+	late := &responseRecorder{status: http.StatusOK}
+	late.body.WriteString("late")
+	if err := saveIdempotentResponse("alice", "k", start, late); err != nil {
+		t.Fatal(err)
+	}
+	done := &responseRecorder{status: http.StatusOK}
+	done.body.WriteString("done")
+	if err := saveIdempotentResponse("alice", "k", later, done); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err = claimIdempotencyKey("alice", "k", "f", later.Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored == nil || stored.status != http.StatusOK || string(stored.response) != "done" {
+		t.Fatalf("stored %+v, want the response of the second request", stored)
+	}
+}
@@ -0,0 +1,801 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gocraft/web"
+	pb "github.com/hyperledger/fabric/protos"
+	"github.com/spf13/viper"
+)
+
+// kinds of indexed payments
+const (
+	paymentSend        = "send"
+	paymentInvoicePaid = "invoicePaid"
+	paymentCheckCash   = "checkCash"
+
+	// entryFill is the kind of the statement entries of a fill
+	entryFill = "fill"
+)
+
+// indexer settings
+const (
+	// indexerTimeout bounds a single call to the peer
+	indexerTimeout = 30 * time.Second
+	// indexBalancePrecision is the number of decimals kept in balances, as in
+	// the chaincode
+	indexBalancePrecision = 18
+
+	defaultIndexLimit = 50
+	maxIndexLimit     = 500
+)
+
+var indexSchema = []string{
+	`CREATE TABLE IF NOT EXISTS index_checkpoint (
+		id INTEGER PRIMARY KEY CHECK (id = 0),
+		block INTEGER NOT NULL
+	)`,
+	`INSERT OR IGNORE INTO index_checkpoint (id, block) VALUES (0, -1)`,
+	`CREATE TABLE IF NOT EXISTS index_payments (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		txid TEXT NOT NULL UNIQUE,
+		block INTEGER NOT NULL,
+		kind TEXT NOT NULL,
+		sender TEXT NOT NULL,
+		receiver TEXT NOT NULL,
+		amount TEXT NOT NULL,
+		currency TEXT NOT NULL,
+		destination_tag TEXT NOT NULL DEFAULT '',
+		source_tag TEXT NOT NULL DEFAULT '',
+		memo TEXT NOT NULL DEFAULT '',
+		invoice_id TEXT NOT NULL DEFAULT '',
+		committed_at INTEGER NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS index_payments_sender ON index_payments (sender, currency, id)`,
+	`CREATE INDEX IF NOT EXISTS index_payments_receiver ON index_payments (receiver, currency, id)`,
+	`CREATE TABLE IF NOT EXISTS index_offers (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		txid TEXT NOT NULL UNIQUE,
+		block INTEGER NOT NULL,
+		sender TEXT NOT NULL,
+		taker_gets TEXT NOT NULL,
+		taker_pays TEXT NOT NULL,
+		pair TEXT NOT NULL,
+		committed_at INTEGER NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS index_offers_sender ON index_offers (sender, id)`,
+	`CREATE INDEX IF NOT EXISTS index_offers_pair ON index_offers (pair, id)`,
+	`CREATE TABLE IF NOT EXISTS index_fills (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		txid TEXT NOT NULL,
+		seq INTEGER NOT NULL,
+		block INTEGER NOT NULL,
+		offer TEXT NOT NULL,
+		sender TEXT NOT NULL,
+		maker TEXT NOT NULL,
+		taker_gets TEXT NOT NULL,
+		taker_pays TEXT NOT NULL,
+		pair TEXT NOT NULL,
+		committed_at INTEGER NOT NULL,
+		UNIQUE (txid, seq)
+	)`,
+	`CREATE INDEX IF NOT EXISTS index_fills_sender ON index_fills (sender, id)`,
+	`CREATE INDEX IF NOT EXISTS index_fills_maker ON index_fills (maker, id)`,
+	`CREATE INDEX IF NOT EXISTS index_fills_pair ON index_fills (pair, id)`,
+	`CREATE TABLE IF NOT EXISTS index_balances (
+		account TEXT NOT NULL,
+		currency TEXT NOT NULL,
+		amount TEXT NOT NULL,
+		PRIMARY KEY (account, currency)
+	)`,
+	`CREATE TABLE IF NOT EXISTS index_entries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		payment_id INTEGER NOT NULL,
+		fill_id INTEGER NOT NULL DEFAULT 0,
+		account TEXT NOT NULL,
+		currency TEXT NOT NULL,
+		amount TEXT NOT NULL,
+		balance TEXT NOT NULL,
+		committed_at INTEGER NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS index_entries_account ON index_entries (account, id)`,
+}
+
+// indexVersion is the layout version of the index tables. An index of an
+// older version is dropped and rebuilt from the chain.
+const indexVersion = 3
+
+// indexTables are the tables rebuilt with the index
+var indexTables = []string{"index_payments", "index_offers", "index_fills", "index_balances", "index_entries"}
+
+// Payment defines an indexed transfer: a send, a paid invoice or a cashed
+// check.
+type Payment struct {
+	ID             int64  `json:"id"`
+	TxID           string `json:"txid"`
+	Block          uint64 `json:"block"`
+	Kind           string `json:"kind"`
+	Sender         string `json:"sender"`
+	Receiver       string `json:"receiver"`
+	Amount         string `json:"amount"`
+	Currency       string `json:"currency"`
+	DestinationTag string `json:"destinationTag,omitempty"`
+	SourceTag      string `json:"sourceTag,omitempty"`
+	Memo           string `json:"memo,omitempty"`
+	InvoiceID      string `json:"invoiceID,omitempty"`
+	CommittedAt    string `json:"committedAt"`
+}
+
+// IndexedOffer defines an indexed offer.
+type IndexedOffer struct {
+	ID          int64  `json:"id"`
+	TxID        string `json:"txid"`
+	Block       uint64 `json:"block"`
+	Sender      string `json:"sender"`
+	TakerGets   string `json:"takerGets"`
+	TakerPays   string `json:"takerPays"`
+	Pair        string `json:"pair"`
+	CommittedAt string `json:"committedAt"`
+}
+
+// IndexedFill defines an indexed fill of the resting offer of a maker by
+// the offer of sender, who gave takerGets and received takerPays.
+type IndexedFill struct {
+	ID          int64  `json:"id"`
+	TxID        string `json:"txid"`
+	Block       uint64 `json:"block"`
+	Offer       string `json:"offer"`
+	Sender      string `json:"sender"`
+	Maker       string `json:"maker"`
+	TakerGets   string `json:"takerGets"`
+	TakerPays   string `json:"takerPays"`
+	Pair        string `json:"pair"`
+	CommittedAt string `json:"committedAt"`
+}
+
+// SearchResponse is the response of /search.
+type SearchResponse struct {
+	Payments []*Payment      `json:"payments"`
+	Offers   []*IndexedOffer `json:"offers"`
+	Fills    []*IndexedFill  `json:"fills"`
+}
+
+// IndexStatus reports how far the indexer got.
+type IndexStatus struct {
+	Block  int64  `json:"block"`
+	Height uint64 `json:"height"`
+}
+
+// --------------- indexer ---------------
+
+// initIndex creates the index tables and empties an index of an older
+// version
+func initIndex() error {
+	if err := dropOldIndex(); err != nil {
+		return err
+	}
+	if err := execSchema(indexSchema); err != nil {
+		return err
+	}
+	if err := addColumn("index_checkpoint", "version", "INTEGER NOT NULL DEFAULT 1"); err != nil {
+		return err
+	}
+
+	return upgradeIndex()
+}
+
+// startIndexer creates the index tables and starts the indexer. It reads the
+// committed blocks from the peer after the last indexed one, so it resumes
+// where it stopped and never misses a block while the event hub is down.
+// Block events only wake it up early.
+func startIndexer() error {
+	if err := initIndex(); err != nil {
+		return err
+	}
+
+	if !viper.GetBool("app.indexer.enabled") {
+		logger.Infof("Indexer is disabled.")
+		return nil
+	}
+
+	interval := viper.GetDuration("app.indexer.interval")
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	blocks, _ := blueEvents.Subscribe(1, func(event *pb.Event) bool {
+		_, ok := event.Event.(*pb.Event_Block)
+		return ok
+	})
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if err := indexBlocks(); err != nil {
+				logger.Errorf("indexer: %v", err)
+			}
+
+			select {
+			case <-blocks:
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return nil
+}
+
+// dropOldIndex drops the tables of an index of an older version before they
+// are created, their layout may differ
+func dropOldIndex() error {
+	var n int
+	err := appDB.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'index_checkpoint'`).Scan(&n)
+	if err != nil || n == 0 {
+		return err
+	}
+	if err := addColumn("index_checkpoint", "version", "INTEGER NOT NULL DEFAULT 1"); err != nil {
+		return err
+	}
+
+	var version int
+	err = appDB.QueryRow(`SELECT version FROM index_checkpoint WHERE id = 0`).Scan(&version)
+	if err == sql.ErrNoRows || err == nil && version >= indexVersion {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, table := range indexTables {
+		if _, err := appDB.Exec(`DROP TABLE IF EXISTS ` + table); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// upgradeIndex empties an index of an older version, so the indexer rebuilds
+// it from the first block
+func upgradeIndex() error {
+	var version int
+	if err := appDB.QueryRow(`SELECT version FROM index_checkpoint WHERE id = 0`).Scan(&version); err != nil {
+		return err
+	}
+	if version >= indexVersion {
+		return nil
+	}
+
+	logger.Infof("Rebuilding the index, version %d is older than %d", version, indexVersion)
+
+	return resetIndex()
+}
+
+// resetIndex empties the index tables and moves the checkpoint before the
+// first block
+func resetIndex() error {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+
+	tx, err := appDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range indexTables {
+		if _, err := tx.Exec(`DELETE FROM ` + table); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`UPDATE index_checkpoint SET block = -1, version = ? WHERE id = 0`, indexVersion); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// indexCheckpoint returns the number of the last indexed block, -1 before
+// the first one
+func indexCheckpoint() (int64, error) {
+	var block int64
+	err := appDB.QueryRow(`SELECT block FROM index_checkpoint WHERE id = 0`).Scan(&block)
+
+	return block, err
+}
+
+// indexMu serializes the indexer, reconciliation and rebuilds
+var indexMu sync.Mutex
+
+// indexBlocks indexes the committed blocks after the checkpoint
+func indexBlocks() error {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+
+	last, err := indexCheckpoint()
+	if err != nil {
+		return err
+	}
+
+	info, err := getBlockchainInfo(indexerTimeout)
+	if err != nil {
+		return err
+	}
+
+	chaincodes, err := indexedChaincodes()
+	if err != nil {
+		return err
+	}
+
+	for number := uint64(last + 1); number < info.Height; number++ {
+		block, err := getBlockByNumber(number, indexerTimeout)
+		if err != nil {
+			return err
+		}
+
+		if err := indexBlock(number, block, chaincodes); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// indexedChaincodes returns the chaincodes whose events are indexed: the
+// current one and those it was upgraded from, so that a rebuild finds the
+// events set before an upgrade
+func indexedChaincodes() (map[string]bool, error) {
+	names, err := upgradedChaincodes()
+	if err != nil {
+		return nil, err
+	}
+
+	chaincodes := map[string]bool{currentChaincode(): true}
+	for _, name := range names {
+		chaincodes[name] = true
+	}
+
+	return chaincodes, nil
+}
+
+// indexBlock writes the blue events of chaincodes in a block and moves the
+// checkpoint in one transaction, so a block is indexed exactly once
+func indexBlock(number uint64, block *pb.Block, chaincodes map[string]bool) error {
+	committedAt := time.Now().Unix()
+	if block.Timestamp != nil {
+		committedAt = block.Timestamp.Seconds
+	}
+
+	tx, err := appDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, event := range block.GetNonHashData().GetChaincodeEvents() {
+		if event == nil || !chaincodes[event.ChaincodeID] || !isBlueEvent(event) {
+			continue
+		}
+		if err := indexEvent(tx, number, committedAt, event); err != nil {
+			logger.Errorf("indexer: block %d %s %s: %v", number, event.EventName, event.TxID, err)
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(`UPDATE index_checkpoint SET block = ? WHERE id = 0`, number); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// indexedSend is the payload of a blue.send event, and the send of the
+// blue.invoicePaid and blue.checkCash events.
+type indexedSend struct {
+	Sender         string `json:"sender"`
+	Receiver       string `json:"receiver"`
+	Amount         string `json:"amount"`
+	Currency       string `json:"currency"`
+	DestinationTag string `json:"destinationTag"`
+	SourceTag      string `json:"sourceTag"`
+	Memo           string `json:"memo"`
+	InvoiceID      string `json:"invoiceID"`
+}
+
+// indexEvent writes the rows of a blue chaincode event
+func indexEvent(tx *sql.Tx, block uint64, committedAt int64, event *pb.ChaincodeEvent) error {
+	switch event.EventName {
+	case "blue.send":
+		send := &indexedSend{}
+		if err := json.Unmarshal(event.Payload, send); err != nil {
+			return skipEvent(event, err)
+		}
+		return indexPayment(tx, block, committedAt, event, paymentSend, send)
+	case "blue.invoicePaid", "blue.checkCash":
+		wrapper := &struct {
+			Send *indexedSend `json:"send"`
+		}{Send: &indexedSend{}}
+		if err := json.Unmarshal(event.Payload, wrapper); err != nil {
+			return skipEvent(event, err)
+		}
+		kind := paymentInvoicePaid
+		if event.EventName == "blue.checkCash" {
+			kind = paymentCheckCash
+		}
+		return indexPayment(tx, block, committedAt, event, kind, wrapper.Send)
+	case "blue.offer":
+		offer := &streamOffer{}
+		if err := json.Unmarshal(event.Payload, offer); err != nil {
+			return skipEvent(event, err)
+		}
+		return indexOffer(tx, block, committedAt, event, offer)
+	case "blue.trade":
+		trade := &streamTrade{}
+		if err := json.Unmarshal(event.Payload, trade); err != nil {
+			return skipEvent(event, err)
+		}
+		if err := indexOffer(tx, block, committedAt, event, &trade.streamOffer); err != nil {
+			return err
+		}
+		for seq, fill := range trade.Fills {
+			fill.Sender = trade.Sender
+			if err := indexFill(tx, block, committedAt, event, seq, fill); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// indexOffer writes an offer
+func indexOffer(tx *sql.Tx, block uint64, committedAt int64, event *pb.ChaincodeEvent, offer *streamOffer) error {
+	_, err := tx.Exec(`INSERT OR IGNORE INTO index_offers (txid, block, sender, taker_gets, taker_pays, pair, committed_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		event.TxID, block, offer.Sender, offer.TakerGets, offer.TakerPays, offerPair(offer.TakerGets, offer.TakerPays), committedAt)
+	return err
+}
+
+// indexFill writes the seq-th fill of a trade and moves the balances of the
+// sender and the maker
+func indexFill(tx *sql.Tx, block uint64, committedAt int64, event *pb.ChaincodeEvent, seq int, fill *streamFill) error {
+	gets, getsCurrency, ok := splitIndexAmount(fill.TakerGets)
+	if !ok {
+		return skipEvent(event, fmt.Errorf("invalid amount %s", fill.TakerGets))
+	}
+	pays, paysCurrency, ok := splitIndexAmount(fill.TakerPays)
+	if !ok {
+		return skipEvent(event, fmt.Errorf("invalid amount %s", fill.TakerPays))
+	}
+
+	res, err := tx.Exec(`INSERT OR IGNORE INTO index_fills (txid, seq, block, offer, sender, maker, taker_gets, taker_pays, pair, committed_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		event.TxID, seq, block, fill.Offer, fill.Sender, fill.Maker, fill.TakerGets, fill.TakerPays,
+		offerPair(fill.TakerGets, fill.TakerPays), committedAt)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+	fillID, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	// the sender gives takerGets to the maker, who gives takerPays back
+	legs := []struct {
+		account  string
+		currency string
+		delta    *big.Rat
+	}{
+		{fill.Sender, getsCurrency, new(big.Rat).Neg(gets)},
+		{fill.Maker, getsCurrency, gets},
+		{fill.Maker, paysCurrency, new(big.Rat).Neg(pays)},
+		{fill.Sender, paysCurrency, pays},
+	}
+	for _, leg := range legs {
+		if err := addIndexEntry(tx, 0, fillID, leg.account, leg.currency, leg.delta, committedAt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// splitIndexAmount parses an amount formatted as <amount>/<currency>
+func splitIndexAmount(amount string) (*big.Rat, string, bool) {
+	i := strings.Index(amount, "/")
+	if i < 0 {
+		return nil, "", false
+	}
+
+	value, ok := new(big.Rat).SetString(amount[:i])
+	if !ok || value.Sign() <= 0 {
+		return nil, "", false
+	}
+
+	return value, amount[i+1:], true
+}
+
+// skipEvent logs a malformed event, which is skipped so that it cannot stall
+// the indexer
+func skipEvent(event *pb.ChaincodeEvent, err error) error {
+	logger.Warningf("indexer: skipping %s %s: %v", event.EventName, event.TxID, err)
+	return nil
+}
+
+// indexPayment writes a payment and moves the balances of its accounts
+func indexPayment(tx *sql.Tx, block uint64, committedAt int64, event *pb.ChaincodeEvent, kind string, send *indexedSend) error {
+	amount, ok := new(big.Rat).SetString(send.Amount)
+	if !ok {
+		return skipEvent(event, fmt.Errorf("invalid amount %s", send.Amount))
+	}
+
+	res, err := tx.Exec(`INSERT OR IGNORE INTO index_payments (txid, block, kind, sender, receiver, amount, currency,
+			destination_tag, source_tag, memo, invoice_id, committed_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		event.TxID, block, kind, send.Sender, send.Receiver, send.Amount, send.Currency,
+		send.DestinationTag, send.SourceTag, send.Memo, send.InvoiceID, committedAt)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+	paymentID, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	if err := addIndexEntry(tx, paymentID, 0, send.Sender, send.Currency, new(big.Rat).Neg(amount), committedAt); err != nil {
+		return err
+	}
+
+	return addIndexEntry(tx, paymentID, 0, send.Receiver, send.Currency, amount, committedAt)
+}
+
+// addIndexEntry posts delta to the indexed balance of account in currency and
+// records the entry of the payment or the fill with the resulting balance
+func addIndexEntry(tx *sql.Tx, paymentID int64, fillID int64, account string, currency string, delta *big.Rat, committedAt int64) error {
+	var current string
+	err := tx.QueryRow(`SELECT amount FROM index_balances WHERE account = ? AND currency = ?`, account, currency).Scan(&current)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	balance := new(big.Rat)
+	if current != "" {
+		if _, ok := balance.SetString(current); !ok {
+			return fmt.Errorf("invalid balance %s", current)
+		}
+	}
+	balance.Add(balance, delta)
+
+	_, err = tx.Exec(`INSERT OR REPLACE INTO index_balances (account, currency, amount) VALUES (?, ?, ?)`,
+		account, currency, formatIndexAmount(balance))
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO index_entries (payment_id, fill_id, account, currency, amount, balance, committed_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		paymentID, fillID, account, currency, formatIndexAmount(delta), formatIndexAmount(balance), committedAt)
+	return err
+}
+
+// formatIndexAmount formats an amount as a decimal string without trailing
+// zeros
+func formatIndexAmount(amount *big.Rat) string {
+	s := amount.FloatString(indexBalancePrecision)
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+// --------------- reads ---------------
+
+const paymentColumns = `id, txid, block, kind, sender, receiver, amount, currency, destination_tag, source_tag, memo, invoice_id, committed_at`
+
+func scanPayments(rows *sql.Rows) ([]*Payment, error) {
+	defer rows.Close()
+
+	payments := []*Payment{}
+	for rows.Next() {
+		p := &Payment{}
+		var committedAt int64
+		if err := rows.Scan(&p.ID, &p.TxID, &p.Block, &p.Kind, &p.Sender, &p.Receiver, &p.Amount, &p.Currency,
+			&p.DestinationTag, &p.SourceTag, &p.Memo, &p.InvoiceID, &committedAt); err != nil {
+			return nil, err
+		}
+		p.CommittedAt = formatUnix(committedAt)
+		payments = append(payments, p)
+	}
+
+	return payments, rows.Err()
+}
+
+func scanOffers(rows *sql.Rows) ([]*IndexedOffer, error) {
+	defer rows.Close()
+
+	offers := []*IndexedOffer{}
+	for rows.Next() {
+		o := &IndexedOffer{}
+		var committedAt int64
+		if err := rows.Scan(&o.ID, &o.TxID, &o.Block, &o.Sender, &o.TakerGets, &o.TakerPays, &o.Pair, &committedAt); err != nil {
+			return nil, err
+		}
+		o.CommittedAt = formatUnix(committedAt)
+		offers = append(offers, o)
+	}
+
+	return offers, rows.Err()
+}
+
+func scanFills(rows *sql.Rows) ([]*IndexedFill, error) {
+	defer rows.Close()
+
+	fills := []*IndexedFill{}
+	for rows.Next() {
+		f := &IndexedFill{}
+		var committedAt int64
+		if err := rows.Scan(&f.ID, &f.TxID, &f.Block, &f.Offer, &f.Sender, &f.Maker, &f.TakerGets, &f.TakerPays, &f.Pair, &committedAt); err != nil {
+			return nil, err
+		}
+		f.CommittedAt = formatUnix(committedAt)
+		fills = append(fills, f)
+	}
+
+	return fills, rows.Err()
+}
+
+// indexLimit parses the limit parameter
+func indexLimit(value string) (int, error) {
+	if value == "" {
+		return defaultIndexLimit, nil
+	}
+
+	limit, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	if limit <= 0 {
+		return 0, fmt.Errorf("invalid limit %d", limit)
+	}
+	if limit > maxIndexLimit {
+		limit = maxIndexLimit
+	}
+
+	return limit, nil
+}
+
+// History list the indexed payments of an account, newest first. before
+// pages back from the ID of the last payment seen.
+func (s *BlueAPP) History(rw web.ResponseWriter, req *web.Request) {
+	account := req.PathParams["account"]
+	currency := req.FormValue("currency")
+
+	logger.Infof("history: account=%v currency=%v before=%v limit=%v", account, currency, req.FormValue("before"), req.FormValue("limit"))
+
+	limit, err := indexLimit(req.FormValue("limit"))
+	var before int64
+	if err == nil && req.FormValue("before") != "" {
+		before, err = strconv.ParseInt(req.FormValue("before"), 10, 64)
+	}
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(rw).Encode(BlueResponse{Status: "params error"})
+		logger.Error("Error: params error.")
+
+		return
+	}
+	if e := s.checkAccount(account); e != nil {
+		writeError(rw, req, e)
+		logger.Errorf("Error: history: %s", e.Message)
+
+		return
+	}
+
+	rows, err := appDB.Query(`SELECT `+paymentColumns+` FROM index_payments
+		WHERE (sender = ? OR receiver = ?) AND (? = '' OR currency = ?) AND (? = 0 OR id < ?)
+		ORDER BY id DESC LIMIT ?`, account, account, currency, currency, before, before, limit)
+	if err != nil {
+		writeStoreError(rw, "history", err)
+		return
+	}
+	payments, err := scanPayments(rows)
+	if err != nil {
+		writeStoreError(rw, "history", err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(payments)
+}
+
+// Search look up indexed payments, offers and fills by transaction ID,
+// account, invoice ID or pair, and payments by memo
+func (s *BlueAPP) Search(rw web.ResponseWriter, req *web.Request) {
+	q := strings.TrimSpace(req.FormValue("q"))
+
+	logger.Infof("search: q=%v limit=%v", q, req.FormValue("limit"))
+
+	limit, err := indexLimit(req.FormValue("limit"))
+	if q == "" || err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(rw).Encode(BlueResponse{Status: "params error"})
+		logger.Error("Error: params error.")
+
+		return
+	}
+
+	result := &SearchResponse{}
+
+	rows, err := appDB.Query(`SELECT `+paymentColumns+` FROM index_payments
+		WHERE txid = ? OR sender = ? OR receiver = ? OR invoice_id = ? OR memo LIKE '%' || ? || '%'
+		ORDER BY id DESC LIMIT ?`, q, q, q, q, q, limit)
+	if err == nil {
+		result.Payments, err = scanPayments(rows)
+	}
+	if err == nil {
+		result.Offers, err = searchOffers(q, limit)
+	}
+	if err == nil {
+		result.Fills, err = searchFills(q, limit)
+	}
+	if err != nil {
+		writeStoreError(rw, "search", err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(result)
+}
+
+// searchOffers returns the offers matching q
+func searchOffers(q string, limit int) ([]*IndexedOffer, error) {
+	rows, err := appDB.Query(`SELECT id, txid, block, sender, taker_gets, taker_pays, pair, committed_at FROM index_offers
+		WHERE txid = ? OR sender = ? OR pair = ? ORDER BY id DESC LIMIT ?`, q, q, q, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanOffers(rows)
+}
+
+// searchFills returns the fills matching q, by either side
+func searchFills(q string, limit int) ([]*IndexedFill, error) {
+	rows, err := appDB.Query(`SELECT id, txid, block, offer, sender, maker, taker_gets, taker_pays, pair, committed_at FROM index_fills
+		WHERE txid = ? OR offer = ? OR sender = ? OR maker = ? OR pair = ? ORDER BY id DESC LIMIT ?`, q, q, q, q, q, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanFills(rows)
+}
+
+// IndexStatus reports the last indexed block and the height of the chain
+func (s *BlueAPP) IndexStatus(rw web.ResponseWriter, req *web.Request) {
+	block, err := indexCheckpoint()
+	if err != nil {
+		writeStoreError(rw, "indexStatus", err)
+		return
+	}
+	status := &IndexStatus{Block: block}
+
+	if info, err := getBlockchainInfo(indexerTimeout); err == nil {
+		status.Height = info.Height
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(status)
+}
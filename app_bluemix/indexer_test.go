@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+
+	pb "github.com/hyperledger/fabric/protos"
+)
+
+// sendEvent returns a blue.send event of the chaincode name
+func sendEvent(name, txid, sender string) *pb.ChaincodeEvent {
+	return &pb.ChaincodeEvent{
+		ChaincodeID: name,
+		TxID:        txid,
+		EventName:   "blue.send",
+		Payload:     []byte(`{"sender":"` + sender + `","receiver":"bob","amount":"10","currency":"USD"}`),
+	}
+}
+
+func TestIndexBlockIndexesUpgradedChaincodes(t *testing.T) {
+	openTestStore(t, startUpgrade, initIndex)
+
+	setChaincode("new")
+	defer setChaincode("")
+	if err := saveUpgradedChaincode("old", "new"); err != nil {
+		t.Fatal(err)
+	}
+
+	chaincodes, err := indexedChaincodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := &pb.Block{NonHashData: &pb.NonHashData{ChaincodeEvents: []*pb.ChaincodeEvent{
+		sendEvent("old", "tx-old", "alice"),
+		sendEvent("new", "tx-new", "alice"),
+		sendEvent("other", "tx-other", "alice"),
+	}}}
+	if err := indexBlock(0, block, chaincodes); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := appDB.Query(`SELECT txid FROM index_payments ORDER BY id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var txids []string
+	for rows.Next() {
+		var txid string
+		if err := rows.Scan(&txid); err != nil {
+			t.Fatal(err)
+		}
+		txids = append(txids, txid)
+	}
+	if len(txids) != 2 || txids[0] != "tx-old" || txids[1] != "tx-new" {
+		t.Fatalf("indexed %v, want [tx-old tx-new]", txids)
+	}
+}
+
+func TestIndexBlockIndexesFills(t *testing.T) {
+	openTestStore(t, startUpgrade, initIndex)
+
+	setChaincode("blue")
+	defer setChaincode("")
+
+	trade := &pb.ChaincodeEvent{
+		ChaincodeID: "blue",
+		TxID:        "tx-trade",
+		EventName:   "blue.trade",
+		Payload: []byte(`{"id":"tx-trade","sender":"alice","takerGets":"30/USD","takerPays":"60/CNY","fills":[` +
+			`{"offer":"tx-1","maker":"bob","takerGets":"10/USD","takerPays":"20/CNY"},` +
+			`{"offer":"tx-2","maker":"carol","takerGets":"5/USD","takerPays":"10/CNY"}]}`),
+	}
+	block := &pb.Block{NonHashData: &pb.NonHashData{ChaincodeEvents: []*pb.ChaincodeEvent{trade}}}
+	if err := indexBlock(0, block, map[string]bool{"blue": true}); err != nil {
+		t.Fatal(err)
+	}
+
+	var offers, fills int
+	if err := appDB.QueryRow(`SELECT COUNT(*) FROM index_offers`).Scan(&offers); err != nil {
+		t.Fatal(err)
+	}
+	if err := appDB.QueryRow(`SELECT COUNT(*) FROM index_fills WHERE txid = 'tx-trade'`).Scan(&fills); err != nil {
+		t.Fatal(err)
+	}
+	if offers != 1 || fills != 2 {
+		t.Fatalf("indexed %d offers and %d fills, want 1 and 2", offers, fills)
+	}
+
+	balances := map[string]string{
+		"alice/USD": "-15", "alice/CNY": "30",
+		"bob/USD": "10", "bob/CNY": "-20",
+		"carol/USD": "5", "carol/CNY": "-10",
+	}
+	for key, want := range balances {
+		var got string
+		if err := appDB.QueryRow(`SELECT amount FROM index_balances WHERE account || '/' || currency = ?`, key).Scan(&got); err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		if got != want {
+			t.Errorf("balance %s = %s, want %s", key, got, want)
+		}
+	}
+
+	entries, err := statementEntries(&statementQuery{account: "bob"}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("bob has %d entries, want 2", len(entries))
+	}
+	if e := entries[0]; e.Kind != entryFill || e.TxID != "tx-trade" || e.Counterparty != "alice" || e.Credit != "10" {
+		t.Fatalf("bob entry %+v", e)
+	}
+}
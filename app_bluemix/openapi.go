@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/gocraft/web"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// openAPIVersion is the OpenAPI version of the generated document
+const openAPIVersion = "3.0.3"
+
+// blueSpec is the OpenAPI document of blueRoutes, set by buildBlueRouter
+var blueSpec []byte
+
+// openAPIBuilder collects the component schemas of a document.
+type openAPIBuilder struct {
+	schemas map[string]interface{}
+}
+
+// buildOpenAPI returns the OpenAPI document of routes. Request and response
+// schemas are derived from the structs of the routes by reflection.
+func buildOpenAPI(routes []blueRoute) ([]byte, error) {
+	b := &openAPIBuilder{schemas: make(map[string]interface{})}
+
+	paths := make(map[string]map[string]interface{})
+	for _, route := range routes {
+		path, params := openAPIPath(route.Path)
+		if paths[path] == nil {
+			paths[path] = make(map[string]interface{})
+		}
+
+		method := strings.ToLower(route.Method)
+		if _, ok := paths[path][method]; ok {
+			return nil, fmt.Errorf("duplicate route %s %s", route.Method, route.Path)
+		}
+		paths[path][method] = b.operation(route, params)
+	}
+
+	doc := map[string]interface{}{
+		"openapi": openAPIVersion,
+		"info": map[string]interface{}{
+			"title":   "Blue",
+			"version": viper.GetString("app.version"),
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": b.schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]interface{}{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+				"apiKey": map[string]interface{}{"type": "apiKey", "in": "header", "name": apiKeyHeader},
+			},
+		},
+	}
+
+	// json.Marshal sorts map keys, so the document is stable
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+// openAPIPath converts a router path to an OpenAPI path and its parameters
+func openAPIPath(path string) (string, []string) {
+	var params []string
+
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") {
+			params = append(params, segment[1:])
+			segments[i] = "{" + segment[1:] + "}"
+		}
+	}
+
+	return strings.Join(segments, "/"), params
+}
+
+func (b *openAPIBuilder) operation(route blueRoute, pathParams []string) map[string]interface{} {
+	op := map[string]interface{}{
+		"summary":     route.Summary,
+		"operationId": strings.ToLower(route.Method) + strings.Replace(strings.Title(strings.NewReplacer("/", " ", ":", "", ".", " ").Replace(route.Path)), " ", "", -1),
+		"tags":        []string{route.Tag},
+	}
+
+	var parameters []interface{}
+	for _, name := range pathParams {
+		parameters = append(parameters, map[string]interface{}{
+			"name": name, "in": "path", "required": true, "schema": map[string]interface{}{"type": "string"}})
+	}
+
+	// form routes take POST and PUT parameters in the body
+	inBody := route.Method == "POST" || route.Method == "PUT"
+	if !inBody {
+		for _, param := range route.Params {
+			name, required := splitParam(param)
+			parameters = append(parameters, map[string]interface{}{
+				"name": name, "in": "query", "required": required, "schema": map[string]interface{}{"type": "string"}})
+		}
+	}
+	if route.Wait {
+		parameters = append(parameters,
+			map[string]interface{}{"name": "wait", "in": "query", "schema": map[string]interface{}{
+				"type": "string", "enum": []string{waitCommitted}}},
+			map[string]interface{}{"name": "timeout", "in": "query", "schema": map[string]interface{}{
+				"type": "string", "example": defaultWaitTimeout.String()}})
+	}
+	if route.Idempotent {
+		parameters = append(parameters,
+			map[string]interface{}{"name": idempotencyKeyHeader, "in": "header", "schema": map[string]interface{}{
+				"type": "string", "maxLength": maxIdempotencyKeyLength}})
+	}
+	if len(parameters) > 0 {
+		op["parameters"] = parameters
+	}
+
+	if route.Body != nil {
+		op["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": b.schema(reflect.TypeOf(route.Body))},
+			},
+		}
+	} else if inBody && len(route.Params) > 0 {
+		properties := make(map[string]interface{})
+		var required []string
+		for _, param := range route.Params {
+			name, req := splitParam(param)
+			properties[name] = map[string]interface{}{"type": "string"}
+			if req {
+				required = append(required, name)
+			}
+		}
+		form := map[string]interface{}{"type": "object", "properties": properties}
+		if len(required) > 0 {
+			form["required"] = required
+		}
+		op["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{
+				"application/x-www-form-urlencoded": map[string]interface{}{"schema": form},
+			},
+		}
+	}
+
+	contentType := "application/json"
+	if route.Stream {
+		contentType = "text/event-stream"
+	}
+	errorBody := b.schema(reflect.TypeOf(BlueResponse{}))
+	if strings.HasPrefix(route.Path, v1Prefix) {
+		errorBody = b.schema(reflect.TypeOf(ErrorResponse{}))
+	}
+	op["responses"] = map[string]interface{}{
+		"200": map[string]interface{}{
+			"description": "success",
+			"content": map[string]interface{}{
+				contentType: map[string]interface{}{"schema": b.schema(reflect.TypeOf(route.Response))},
+			},
+		},
+		"default": map[string]interface{}{
+			"description": "error",
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": errorBody},
+			},
+		},
+	}
+
+	if !publicRoutes[route.Path] {
+		op["security"] = []interface{}{
+			map[string]interface{}{"bearer": []string{}},
+			map[string]interface{}{"apiKey": []string{}},
+		}
+	}
+
+	return op
+}
+
+// splitParam returns the name of a route parameter and whether it is required
+func splitParam(param string) (string, bool) {
+	if strings.HasSuffix(param, "*") {
+		return strings.TrimSuffix(param, "*"), true
+	}
+
+	return param, false
+}
+
+// schema returns the JSON schema of t, named structs become components
+func (b *openAPIBuilder) schema(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return b.schema(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		// json.RawMessage is any JSON value
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{}
+		}
+		return map[string]interface{}{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		ref := map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+		if _, ok := b.schemas[t.Name()]; ok {
+			return ref
+		}
+		// registered before the fields so recursive structs terminate
+		b.schemas[t.Name()] = nil
+		b.schemas[t.Name()] = b.structSchema(t)
+		return ref
+	}
+
+	return map[string]interface{}{}
+}
+
+func (b *openAPIBuilder) structSchema(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	var required []string
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		name, opts := field.Name, ""
+		if tag := field.Tag.Get("json"); tag != "" {
+			parts := strings.SplitN(tag, ",", 2)
+			if parts[0] == "-" {
+				continue
+			}
+			if parts[0] != "" {
+				name = parts[0]
+			}
+			if len(parts) > 1 {
+				opts = parts[1]
+			}
+		}
+
+		properties[name] = b.schema(field.Type)
+		if !strings.Contains(opts, "omitempty") && field.Type.Kind() != reflect.Ptr {
+			required = append(required, name)
+		}
+	}
+
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		sort.Strings(required)
+		schema["required"] = required
+	}
+
+	return schema
+}
+
+// OpenAPI returns the OpenAPI document of the REST service
+func (s *BlueAPP) OpenAPI(rw web.ResponseWriter, req *web.Request) {
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(blueSpec)
+}
+
+// --------------- OpenAPICmd ---------------
+
+var openAPICheckFile string
+
+// OpenAPICmd returns the cobra command printing the OpenAPI document. With
+// --check it fails when the document differs from a committed copy, which
+// catches a handler struct changed without updating the published spec.
+func OpenAPICmd() *cobra.Command {
+	openAPICmd.Flags().StringVar(&openAPICheckFile, "check", "", "Compare the document with this file instead of printing it")
+
+	return openAPICmd
+}
+
+var openAPICmd = &cobra.Command{
+	Use:   "openapi",
+	Short: "Print the OpenAPI document of the app.",
+	Long:  `Print the OpenAPI document of the app's REST service, or check it against a file.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		spec, err := buildOpenAPI(blueRoutes)
+		if err != nil {
+			return err
+		}
+
+		if openAPICheckFile == "" {
+			_, err = os.Stdout.Write(append(spec, '\n'))
+			return err
+		}
+
+		committed, err := ioutil.ReadFile(openAPICheckFile)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(bytes.TrimSpace(committed), spec) {
+			return fmt.Errorf("%s is out of date, regenerate it with `app openapi`", openAPICheckFile)
+		}
+
+		return nil
+	},
+}
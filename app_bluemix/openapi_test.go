@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+var updateSpec = flag.Bool("update", false, "rewrite testdata/openapi.json")
+
+// goldenSpec is the committed OpenAPI document, `app openapi --check` compares
+// with the same file
+const goldenSpec = "testdata/openapi.json"
+
+// TestOpenAPIGolden fails when a route or a response struct changes without
+// the published document being updated with go test -run OpenAPIGolden -update
+func TestOpenAPIGolden(t *testing.T) {
+	spec, err := buildOpenAPI(blueRoutes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec = append(spec, '\n')
+
+	if *updateSpec {
+		if err := ioutil.WriteFile(goldenSpec, spec, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	golden, err := ioutil.ReadFile(goldenSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(spec, golden) {
+		t.Errorf("OpenAPI document differs from %s, run go test -run OpenAPIGolden -update", goldenSpec)
+	}
+}
+
+// contractCase is a request whose response is checked against the schema of
+// its route
+type contractCase struct {
+	method string
+	route  string
+	path   string
+	form   url.Values
+	status int
+}
+
+// peerRoutes are answered by the chaincode or the peers, which the contract
+// test does not stub, so their responses are only covered by the golden
+// document. The transaction routes, which take wait, are left out as well.
+var peerRoutes = map[string]bool{
+	"POST /login": true, "POST /registrar": true, "GET /currencies": true, "GET /stream": true,
+	"POST /reconcile": true, "POST /upgrade": true,
+	"POST /schedules": true,
+	"GET /invoices":   true, "GET /invoices/:id": true, "GET /checks": true, "GET /checks/:id": true,
+	"GET /books/:gets/:pays": true, "GET /accounts/:account/balances": true, "GET /accounts/:account/deposit": true,
+	"GET /v1/invoices": true, "GET /v1/invoices/:id": true, "GET /v1/checks": true, "GET /v1/checks/:id": true,
+	"GET /v1/books/:gets/:pays": true, "GET /v1/accounts/:account/balances": true, "GET /v1/accounts/:account/deposit": true,
+}
+
+var contractCases = []contractCase{
+	{method: "GET", route: "/version", path: "/version", status: http.StatusOK},
+	{method: "GET", route: "/health", path: "/health", status: http.StatusServiceUnavailable},
+	{method: "GET", route: "/openapi.json", path: "/openapi.json", status: http.StatusOK},
+	{method: "POST", route: "/accounts", path: "/accounts", status: http.StatusOK,
+		form: url.Values{"secureContext": {"alice"}}},
+	{method: "GET", route: "/tx/:id", path: "/tx/tx-1", status: http.StatusOK},
+	{method: "GET", route: "/v1/tx/:id", path: "/v1/tx/tx-1", status: http.StatusOK},
+	{method: "GET", route: "/accounts/:account/history", path: "/accounts/alice/history", status: http.StatusOK},
+	{method: "GET", route: "/accounts/:account/statement", path: "/accounts/alice/statement", status: http.StatusOK},
+	{method: "GET", route: "/search", path: "/search?q=alice", status: http.StatusOK},
+	{method: "GET", route: "/index", path: "/index", status: http.StatusOK},
+	{method: "GET", route: "/reconcile", path: "/reconcile", status: http.StatusOK},
+	{method: "GET", route: "/upgrade", path: "/upgrade", status: http.StatusOK},
+	{method: "GET", route: "/schedules", path: "/schedules", status: http.StatusOK},
+	{method: "GET", route: "/schedules/:id", path: "/schedules/1", status: http.StatusOK},
+	{method: "PUT", route: "/schedules/:id", path: "/schedules/1", status: http.StatusOK,
+		form: url.Values{"memo": {"rent"}}},
+	{method: "POST", route: "/webhooks", path: "/webhooks", status: http.StatusOK,
+		form: url.Values{"account": {"alice"}, "url": {"https://example.com/hook"}, "events": {webhookPaymentReceived}}},
+	{method: "GET", route: "/webhooks", path: "/webhooks", status: http.StatusOK},
+	{method: "GET", route: "/webhooks/deadletters", path: "/webhooks/deadletters", status: http.StatusOK},
+	{method: "POST", route: "/webhooks/deadletters/:id/replay", path: "/webhooks/deadletters/1/replay", status: http.StatusOK},
+	{method: "DELETE", route: "/webhooks/:id", path: "/webhooks/1", status: http.StatusOK},
+	{method: "DELETE", route: "/schedules/:id", path: "/schedules/1", status: http.StatusOK},
+}
+
+// TestOpenAPIContract serves the store-backed routes from a seeded store and
+// checks that every response matches the schema the document publishes for
+// its route
+func TestOpenAPIContract(t *testing.T) {
+	server := startContractServer(t)
+	defer server.Close()
+
+	var spec map[string]interface{}
+	if err := json.Unmarshal(blueSpec, &spec); err != nil {
+		t.Fatal(err)
+	}
+
+	covered := make(map[string]bool)
+	for _, c := range contractCases {
+		covered[c.method+" "+c.route] = true
+
+		body, status, err := doContractRequest(server.URL, c)
+		if err != nil {
+			t.Errorf("%s %s: %v", c.method, c.path, err)
+			continue
+		}
+		if status != c.status {
+			t.Errorf("%s %s: status %d, want %d: %s", c.method, c.path, status, c.status, body)
+			continue
+		}
+
+		schema, err := responseSchema(spec, c.method, c.route)
+		if err != nil {
+			t.Errorf("%s %s: %v", c.method, c.path, err)
+			continue
+		}
+		var value interface{}
+		if err := json.Unmarshal(body, &value); err != nil {
+			t.Errorf("%s %s: invalid JSON: %v", c.method, c.path, err)
+			continue
+		}
+		if err := validateSchema(spec, schema, value, "response"); err != nil {
+			t.Errorf("%s %s: %v", c.method, c.path, err)
+		}
+	}
+
+	for _, route := range blueRoutes {
+		key := route.Method + " " + route.Path
+		if !covered[key] && !peerRoutes[key] && !route.Wait {
+			t.Errorf("%s has no contract case", key)
+		}
+	}
+}
+
+// startContractServer opens an in-memory store, seeds one row of each
+// listing and serves the router without authentication
+func startContractServer(t *testing.T) *httptest.Server {
+	blueEvents = newEventHub("")
+	bluePeers = &peerPool{}
+	blueAuth = &authSettings{}
+
+	openTestStore(t, startUsers, startIdempotency, startTxStatus, startStream,
+		startScheduler, startWebhooks, startReconcile, startUpgrade, initIndex)
+
+	now := time.Now().Unix()
+	seed := []string{
+		fmt.Sprintf(`INSERT INTO tx_status (txid, function, status, created_at, updated_at) VALUES ('tx-1', 'send', 'committed', %d, %d)`, now, now),
+		fmt.Sprintf(`INSERT INTO schedules (sender, receiver, amount, currency, interval, start_at, next_run, enabled, enroll_id, created_at)
+			VALUES ('alice', 'bob', '10', 'USD', 'monthly', %d, %d, 1, 'alice', %d)`, now, now+3600, now),
+		fmt.Sprintf(`INSERT INTO schedule_runs (schedule_id, due_at, status, next_attempt, txid, updated_at) VALUES (1, %d, 'committed', 0, 'tx-1', %d)`, now, now),
+		fmt.Sprintf(`INSERT INTO webhooks (account, url, events, secret, created_at) VALUES ('alice', 'https://example.com', '%s', 'secret', %d)`, webhookPaymentReceived, now),
+		fmt.Sprintf(`INSERT INTO webhook_dead_letters (webhook_id, event, payload, attempts, last_error, created_at, failed_at)
+			VALUES (1, '%s', '{"txid":"tx-1"}', 8, 'status 500', %d, %d)`, webhookPaymentReceived, now, now),
+		fmt.Sprintf(`INSERT INTO index_payments (txid, block, kind, sender, receiver, amount, currency, memo, committed_at)
+			VALUES ('tx-1', 3, 'send', 'alice', 'bob', '10', 'USD', 'rent', %d)`, now),
+		fmt.Sprintf(`INSERT INTO index_entries (payment_id, account, currency, amount, balance, committed_at) VALUES (1, 'alice', 'USD', '-10', '90', %d)`, now),
+		fmt.Sprintf(`INSERT INTO index_offers (txid, block, sender, taker_gets, taker_pays, pair, committed_at)
+			VALUES ('tx-2', 4, 'alice', '10/USD', '20/CNY', 'USD/CNY', %d)`, now),
+		fmt.Sprintf(`INSERT INTO index_fills (txid, seq, block, offer, sender, maker, taker_gets, taker_pays, pair, committed_at)
+			VALUES ('tx-2', 0, 4, 'tx-0', 'alice', 'carol', '5/USD', '10/CNY', 'USD/CNY', %d)`, now),
+		fmt.Sprintf(`INSERT INTO index_entries (payment_id, fill_id, account, currency, amount, balance, committed_at) VALUES (0, 1, 'alice', 'USD', '-5', '85', %d)`, now),
+		`UPDATE index_checkpoint SET block = 4`,
+	}
+	if err := execSchema(seed); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := saveReconcileReport(&ReconcileReport{OK: false, Block: 4, Accounts: 2,
+		Mismatches: []*BalanceMismatch{{Account: "alice", Currency: "USD", Index: "90", Ledger: "80", TxIDs: []string{"tx-1"}}},
+		StartedAt:  time.Now().String(), FinishedAt: time.Now().String()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveUpgradeReport(&UpgradeReport{OK: true, From: "old", To: "new",
+		Tables:    []*TableChecksum{{Table: "Balance", Rows: 2, Checksum: "abc"}},
+		StartedAt: time.Now().String(), FinishedAt: time.Now().String()}); err != nil {
+		t.Fatal(err)
+	}
+
+	return httptest.NewServer(buildBlueRouter())
+}
+
+func doContractRequest(base string, c contractCase) ([]byte, int, error) {
+	var body *strings.Reader
+	if c.form != nil {
+		body = strings.NewReader(c.form.Encode())
+	} else {
+		body = strings.NewReader("")
+	}
+
+	req, err := http.NewRequest(c.method, base+c.path, body)
+	if err != nil {
+		return nil, 0, err
+	}
+	if c.form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	return data, resp.StatusCode, err
+}
+
+// responseSchema returns the success schema of a route in spec
+func responseSchema(spec map[string]interface{}, method, route string) (map[string]interface{}, error) {
+	path, _ := openAPIPath(route)
+	op, ok := lookup(spec, "paths", path, strings.ToLower(method), "responses", "200", "content", "application/json", "schema")
+	if !ok {
+		return nil, fmt.Errorf("no JSON response schema for %s %s", method, route)
+	}
+
+	return op, nil
+}
+
+// lookup walks the nested objects of doc along keys
+func lookup(doc map[string]interface{}, keys ...string) (map[string]interface{}, bool) {
+	for _, key := range keys {
+		next, ok := doc[key].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		doc = next
+	}
+
+	return doc, true
+}
+
+// validateSchema checks a decoded JSON value against the subset of JSON
+// schema buildOpenAPI generates. Objects may only have the documented
+// properties, and a null is no array or object.
+func validateSchema(spec, schema map[string]interface{}, value interface{}, at string) error {
+	if ref, ok := schema["$ref"].(string); ok {
+		resolved, ok := lookup(spec, strings.Split(strings.TrimPrefix(ref, "#/"), "/")...)
+		if !ok {
+			return fmt.Errorf("%s: unresolved %s", at, ref)
+		}
+		schema = resolved
+	}
+
+	switch schema["type"] {
+	case nil:
+		return nil
+	case "string":
+		if _, ok := value.(string); !ok {
+			return fmt.Errorf("%s: %v is not a string", at, value)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s: %v is not a boolean", at, value)
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			return fmt.Errorf("%s: %v is not a number", at, value)
+		}
+	case "integer":
+		if n, ok := value.(float64); !ok || n != math.Trunc(n) {
+			return fmt.Errorf("%s: %v is not an integer", at, value)
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: %v is not an array", at, value)
+		}
+		itemSchema, _ := schema["items"].(map[string]interface{})
+		for i, item := range items {
+			if err := validateSchema(spec, itemSchema, item, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+				return err
+			}
+		}
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: %v is not an object", at, value)
+		}
+		required, _ := schema["required"].([]interface{})
+		for _, name := range required {
+			if _, ok := object[name.(string)]; !ok {
+				return fmt.Errorf("%s: missing required %s", at, name)
+			}
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		additional, _ := schema["additionalProperties"].(map[string]interface{})
+		for name, field := range object {
+			fieldSchema, ok := properties[name].(map[string]interface{})
+			if !ok {
+				if additional == nil {
+					return fmt.Errorf("%s: undocumented property %s", at, name)
+				}
+				fieldSchema = additional
+			}
+			if err := validateSchema(spec, fieldSchema, field, at+"."+name); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("%s: unknown type %v", at, schema["type"])
+	}
+
+	return nil
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/hyperledger/fabric/core/util"
+	pb "github.com/hyperledger/fabric/protos"
+	"github.com/spf13/viper"
+)
+
+// outbox status
+const (
+	outboxQueued     = "queued"
+	outboxSubmitting = "submitting"
+	outboxSubmitted  = "submitted"
+	outboxFailed     = "failed"
+)
+
+// outboxBatch bounds the entries dispatched per tick
+const outboxBatch = 100
+
+// errTxSubmitted is returned when the transaction of an idempotency key is
+// already in the outbox
+var errTxSubmitted = errors.New("transaction already submitted")
+
+var outboxSchema = []string{
+	`CREATE TABLE IF NOT EXISTS outbox (
+		txid TEXT PRIMARY KEY,
+		idempotency_key TEXT NOT NULL UNIQUE,
+		enroll_id TEXT NOT NULL,
+		function TEXT NOT NULL,
+		args TEXT NOT NULL,
+		status TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		error TEXT NOT NULL DEFAULT '',
+		next_attempt INTEGER NOT NULL,
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS outbox_due ON outbox (status, next_attempt)`,
+}
+
+// outboxEntry is an invoke accepted by the app. Its transaction ID is fixed
+// when it is accepted, so every attempt submits the same transaction.
+type outboxEntry struct {
+	txid     string
+	enrollID string
+	args     []string
+	attempts int
+}
+
+// startOutbox creates the outbox table and starts app.workers workers
+// submitting the queued invokes. Invokes are submitted by the request first,
+// the workers retry those the peer could not take with exponential backoff.
+func startOutbox() error {
+	if err := execSchema(outboxSchema); err != nil {
+		return err
+	}
+
+	// a submission interrupted by a restart is retried with the same
+	// transaction ID
+	if _, err := appDB.Exec(`UPDATE outbox SET status = ? WHERE status = ?`, outboxQueued, outboxSubmitting); err != nil {
+		return err
+	}
+
+	workers := viper.GetInt("app.workers")
+	if workers <= 0 {
+		workers = 2
+	}
+	interval := viper.GetDuration("app.outbox.interval")
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	jobs := make(chan *outboxEntry)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for entry := range jobs {
+				ctx, cancel := context.WithTimeout(context.Background(), invokeTimeout())
+				attemptOutbox(ctx, entry)
+				cancel()
+			}
+		}()
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := dispatchOutbox(jobs, time.Now()); err != nil {
+				logger.Errorf("outbox: dispatch error: %v", err)
+			}
+		}
+	}()
+
+	logger.Infof("Outbox started, %d workers, interval %v", workers, interval)
+
+	return nil
+}
+
+// enqueueTx records an invoke of enrollID, claimed for its first attempt by
+// the caller. The transaction ID derives from the client's idempotency key
+// when there is one, otherwise key is empty and the ID is random.
+func enqueueTx(enrollID string, key string, args []string) (*outboxEntry, error) {
+	data, err := json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &outboxEntry{txid: util.GenerateUUID(), enrollID: enrollID, args: args}
+	outboxKey := entry.txid
+	if key != "" {
+		entry.txid = idempotentTxID(enrollID, key)
+		outboxKey = enrollID + "/" + key
+	}
+
+	now := time.Now().Unix()
+	res, err := appDB.Exec(`INSERT OR IGNORE INTO outbox (txid, idempotency_key, enroll_id, function, args, status, next_attempt, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		entry.txid, outboxKey, enrollID, args[0], string(data), outboxSubmitting, now, now, now)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		if err == nil {
+			err = errTxSubmitted
+		}
+		return entry, err
+	}
+
+	return entry, nil
+}
+
+// dispatchOutbox claims the queued entries that are due and hands them to the
+// workers
+func dispatchOutbox(jobs chan<- *outboxEntry, now time.Time) error {
+	if err := purgeOutbox(now); err != nil {
+		return err
+	}
+
+	rows, err := appDB.Query(`SELECT txid, enroll_id, args, attempts FROM outbox
+		WHERE status = ? AND next_attempt <= ? ORDER BY next_attempt LIMIT ?`, outboxQueued, now.Unix(), outboxBatch)
+	if err != nil {
+		return err
+	}
+
+	var entries []*outboxEntry
+	for rows.Next() {
+		entry := &outboxEntry{}
+		var args string
+		if err := rows.Scan(&entry.txid, &entry.enrollID, &args, &entry.attempts); err != nil {
+			rows.Close()
+			return err
+		}
+		if err := json.Unmarshal([]byte(args), &entry.args); err != nil {
+			rows.Close()
+			return err
+		}
+		entries = append(entries, entry)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		res, err := appDB.Exec(`UPDATE outbox SET status = ?, updated_at = ? WHERE txid = ? AND status = ?`,
+			outboxSubmitting, now.Unix(), entry.txid, outboxQueued)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			continue
+		}
+
+		jobs <- entry
+	}
+
+	return nil
+}
+
+// purgeOutbox drops the settled entries older than app.outbox.retention
+func purgeOutbox(now time.Time) error {
+	retention := viper.GetDuration("app.outbox.retention")
+	if retention <= 0 {
+		retention = 72 * time.Hour
+	}
+
+	_, err := appDB.Exec(`DELETE FROM outbox WHERE status IN (?, ?) AND updated_at < ?`,
+		outboxSubmitted, outboxFailed, now.Add(-retention).Unix())
+	return err
+}
+
+// attemptOutbox submits a claimed entry and records the outcome. It returns
+// submitted, queued when the peer could not be reached and the entry will be
+// retried, or failed with the error of the chaincode or of the last attempt.
+func attemptOutbox(ctx context.Context, entry *outboxEntry) (string, error) {
+	entry.attempts++
+
+	client, release, err := blueUsers.get(entry.enrollID)
+	if err != nil {
+		return recordOutboxAttempt(entry, outboxFailed, err)
+	}
+	defer release()
+
+	chaincodeInput := &pb.ChaincodeInput{
+		Args: util.ToChaincodeArgs(entry.args...),
+	}
+
+	resp, err := invokeChaincode(ctx, client, chaincodeInput, entry.txid)
+	if err != nil {
+		return recordOutboxAttempt(entry, outboxQueued, err)
+	}
+	if resp.Status != pb.Response_SUCCESS {
+		return recordOutboxAttempt(entry, outboxFailed, fmt.Errorf("%s", resp.Msg))
+	}
+
+	return recordOutboxAttempt(entry, outboxSubmitted, nil)
+}
+
+// recordOutboxAttempt stores the outcome of an attempt, scheduling a retry
+// with exponential backoff until app.outbox.maxAttempts is reached
+func recordOutboxAttempt(entry *outboxEntry, status string, attemptErr error) (string, error) {
+	now := time.Now()
+
+	maxAttempts := viper.GetInt("app.outbox.maxAttempts")
+	if maxAttempts <= 0 {
+		maxAttempts = 10
+	}
+	retryDelay := viper.GetDuration("app.outbox.retryDelay")
+	if retryDelay <= 0 {
+		retryDelay = time.Second
+	}
+
+	if status == outboxQueued && entry.attempts >= maxAttempts {
+		status = outboxFailed
+	}
+	nextAttempt := now.Add(retryDelay << uint(entry.attempts-1))
+
+	errMsg := ""
+	if attemptErr != nil {
+		errMsg = attemptErr.Error()
+		logger.Errorf("outbox: %s %s attempt %d %s: %v", entry.args[0], entry.txid, entry.attempts, status, attemptErr)
+	} else {
+		logger.Infof("outbox: %s %s submitted", entry.args[0], entry.txid)
+	}
+
+	_, err := appDB.Exec(`UPDATE outbox SET status = ?, attempts = ?, error = ?, next_attempt = ?, updated_at = ? WHERE txid = ?`,
+		status, entry.attempts, errMsg, nextAttempt.Unix(), now.Unix(), entry.txid)
+	if err != nil {
+		logger.Errorf("outbox: %s update error: %v", entry.txid, err)
+	}
+
+	return status, attemptErr
+}
+
+// getOutboxStatus returns the status of an entry the peer has not accepted
+// yet, queued or failed
+func getOutboxStatus(txid string) (*TxStatus, error) {
+	status := &TxStatus{TxID: txid}
+	var createdAt, updatedAt int64
+	err := appDB.QueryRow(`SELECT function, status, error, attempts, created_at, updated_at FROM outbox
+		WHERE txid = ? AND status != ?`, txid, outboxSubmitted).
+		Scan(&status.Function, &status.Status, &status.Error, &status.Attempts, &createdAt, &updatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if status.Status == outboxSubmitting {
+		status.Status = outboxQueued
+	}
+	status.CreatedAt = formatUnix(createdAt)
+	status.UpdatedAt = formatUnix(updatedAt)
+
+	return status, nil
+}
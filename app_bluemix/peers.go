@@ -0,0 +1,361 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/hyperledger/fabric/core/peer"
+	pb "github.com/hyperledger/fabric/protos"
+	"github.com/spf13/viper"
+)
+
+// peer selection policies
+const (
+	selectRoundRobin   = "roundRobin"
+	selectLeastLatency = "leastLatency"
+)
+
+// circuit breaker states
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "halfOpen"
+)
+
+// peerHealthTimeout bounds a health check call
+const peerHealthTimeout = 5 * time.Second
+
+// errNoPeer is returned when every peer's circuit is open
+var errNoPeer = errors.New("no peer available")
+
+// peerConn is a validating peer of the pool with its circuit breaker. The
+// connection is shared by the concurrent calls, it is dialed on first use and
+// again after the circuit opened.
+type peerConn struct {
+	address string
+
+	mu       sync.Mutex
+	conn     *grpc.ClientConn
+	state    string
+	failures int
+	openedAt time.Time
+	// latency is a moving average of the successful calls
+	latency time.Duration
+	lastErr string
+}
+
+// peerPool spreads the calls to the peer over app.peers.addresses.
+type peerPool struct {
+	peers       []*peerConn
+	next        uint32
+	selection   string
+	threshold   int
+	openTimeout time.Duration
+}
+
+var bluePeers *peerPool
+
+// PeerHealth defines the state of a peer in /health.
+type PeerHealth struct {
+	Address   string `json:"address"`
+	Circuit   string `json:"circuit"`
+	Failures  int    `json:"failures"`
+	LatencyMs int64  `json:"latencyMs"`
+	Error     string `json:"error,omitempty"`
+}
+
+// newPeerPool returns the pool of app.peers.addresses, peer.address when the
+// list is empty
+func newPeerPool() *peerPool {
+	addresses := viper.GetStringSlice("app.peers.addresses")
+	if len(addresses) == 0 {
+		addresses = []string{viper.GetString("peer.address")}
+	}
+
+	pool := &peerPool{
+		selection:   viper.GetString("app.peers.selection"),
+		threshold:   viper.GetInt("app.peers.failureThreshold"),
+		openTimeout: viper.GetDuration("app.peers.openTimeout"),
+	}
+	if pool.selection == "" {
+		pool.selection = selectRoundRobin
+	}
+	if pool.threshold <= 0 {
+		pool.threshold = 3
+	}
+	if pool.openTimeout <= 0 {
+		pool.openTimeout = 30 * time.Second
+	}
+	for _, address := range addresses {
+		pool.peers = append(pool.peers, &peerConn{address: address, state: circuitClosed})
+	}
+
+	return pool
+}
+
+// connect dials every peer, it fails when none answers
+func (p *peerPool) connect() error {
+	var err error
+	connected := 0
+	for _, peer := range p.peers {
+		if _, e := peer.dial(); e != nil {
+			logger.Warningf("peer %s: %v", peer.address, e)
+			peer.fail(e, p.threshold)
+			err = e
+			continue
+		}
+		connected++
+	}
+	if connected == 0 {
+		return err
+	}
+
+	logger.Infof("Connected to %d of %d peers, %s selection", connected, len(p.peers), p.selection)
+
+	return nil
+}
+
+// dial returns the peer's connection, dialing it when there is none
+func (c *peerConn) dial() (*grpc.ClientConn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn != nil {
+		return c.conn, nil
+	}
+
+	conn, err := peer.NewPeerClientConnectionWithAddress(c.address)
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+
+	return conn, nil
+}
+
+// allow reports whether a call may go to the peer. An open circuit lets a
+// single trial call through each openTimeout.
+func (c *peerConn) allow(now time.Time, openTimeout time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == circuitClosed {
+		return true
+	}
+	if now.Sub(c.openedAt) < openTimeout {
+		return false
+	}
+	c.state, c.openedAt = circuitHalfOpen, now
+
+	return true
+}
+
+// succeed closes the circuit and records the call's latency
+func (c *peerConn) succeed(latency time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.state, c.failures, c.lastErr = circuitClosed, 0, ""
+	if c.latency == 0 {
+		c.latency = latency
+	} else {
+		c.latency = (c.latency*7 + latency) / 8
+	}
+}
+
+// fail counts a failed call and opens the circuit after threshold
+// consecutive failures or a failed trial. A call failing, e.g. on a chaincode
+// error, leaves the connection to the other calls; it is only dropped when
+// the circuit opens, so the trial call dials again.
+func (c *peerConn) fail(err error, threshold int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.failures++
+	c.lastErr = err.Error()
+	if c.state != circuitHalfOpen && c.failures < threshold {
+		return
+	}
+
+	if c.state != circuitOpen {
+		logger.Warningf("peer %s: circuit open after %d failures: %v", c.address, c.failures, err)
+	}
+	c.state, c.openedAt = circuitOpen, time.Now()
+
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// candidates returns the peers a call may go to, in selection order
+func (p *peerPool) candidates(now time.Time) []*peerConn {
+	var peers []*peerConn
+	start := int(atomic.AddUint32(&p.next, 1))
+	for i := range p.peers {
+		peer := p.peers[(start+i)%len(p.peers)]
+		if peer.allow(now, p.openTimeout) {
+			peers = append(peers, peer)
+		}
+	}
+
+	if p.selection == selectLeastLatency {
+		sort.Stable(byLatency(peers))
+	}
+
+	return peers
+}
+
+type byLatency []*peerConn
+
+func (b byLatency) Len() int      { return len(b) }
+func (b byLatency) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byLatency) Less(i, j int) bool {
+	b[i].mu.Lock()
+	li := b[i].latency
+	b[i].mu.Unlock()
+	b[j].mu.Lock()
+	lj := b[j].latency
+	b[j].mu.Unlock()
+
+	return li < lj
+}
+
+// do calls fn with the connection of the selected peer, failing over to the
+// next one until ctx is done. With retryAll false only the errors telling
+// that the request never reached the peer fail over, so a transaction is not
+// submitted twice.
+func (p *peerPool) do(ctx context.Context, retryAll bool, fn func(*grpc.ClientConn) error) error {
+	err := errNoPeer
+	for _, peer := range p.candidates(time.Now()) {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		var conn *grpc.ClientConn
+		if conn, err = peer.dial(); err != nil {
+			peer.fail(err, p.threshold)
+			continue
+		}
+
+		start := time.Now()
+		if err = fn(conn); err == nil {
+			peer.succeed(time.Since(start))
+			return nil
+		}
+
+		// a cancelled request says nothing of the peer
+		if isCanceled(err) {
+			return err
+		}
+		peer.fail(err, p.threshold)
+		logger.Errorf("peer %s: %v", peer.address, err)
+		if !retryAll && grpc.Code(err) != codes.Unavailable {
+			return err
+		}
+	}
+
+	return err
+}
+
+// startPeerHealth pings every peer each app.peers.healthInterval, which
+// closes the circuit of a peer that is back
+func startPeerHealth() {
+	interval := viper.GetDuration("app.peers.healthInterval")
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			now := time.Now()
+			for _, peer := range bluePeers.peers {
+				if peer.allow(now, bluePeers.openTimeout) {
+					go bluePeers.check(peer)
+				}
+			}
+		}
+	}()
+}
+
+// check pings a peer with a blockchain info call
+func (p *peerPool) check(peer *peerConn) {
+	conn, err := peer.dial()
+	if err != nil {
+		peer.fail(err, p.threshold)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), peerHealthTimeout)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := pb.NewOpenchainClient(conn).GetBlockchainInfo(ctx, &empty.Empty{}); err != nil {
+		peer.fail(err, p.threshold)
+		return
+	}
+	peer.succeed(time.Since(start))
+}
+
+// health returns the state of every peer and whether one is available
+func (p *peerPool) health() ([]PeerHealth, bool) {
+	available := false
+	health := make([]PeerHealth, len(p.peers))
+	for i, peer := range p.peers {
+		peer.mu.Lock()
+		health[i] = PeerHealth{
+			Address:   peer.address,
+			Circuit:   peer.state,
+			Failures:  peer.failures,
+			LatencyMs: int64(peer.latency / time.Millisecond),
+			Error:     peer.lastErr,
+		}
+		peer.mu.Unlock()
+		available = available || health[i].Circuit != circuitOpen
+	}
+
+	return health, available
+}
+
+// --------------- ledger reads ---------------
+
+// getBlockchainInfo returns the chain height from a peer of the pool
+func getBlockchainInfo(timeout time.Duration) (*pb.BlockchainInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var info *pb.BlockchainInfo
+	err := bluePeers.do(ctx, true, func(conn *grpc.ClientConn) error {
+		var err error
+		info, err = pb.NewOpenchainClient(conn).GetBlockchainInfo(ctx, &empty.Empty{})
+		return err
+	})
+
+	return info, err
+}
+
+// getBlockByNumber returns a block from a peer of the pool
+func getBlockByNumber(number uint64, timeout time.Duration) (*pb.Block, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var block *pb.Block
+	err := bluePeers.do(ctx, true, func(conn *grpc.ClientConn) error {
+		var err error
+		block, err = pb.NewOpenchainClient(conn).GetBlockByNumber(ctx, &pb.BlockNumber{Number: number})
+		return err
+	})
+
+	return block, err
+}
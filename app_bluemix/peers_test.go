@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+func TestPeerCircuit(t *testing.T) {
+	conn, err := grpc.Dial("127.0.0.1:1", grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &peerConn{address: "127.0.0.1:1", state: circuitClosed, conn: conn}
+	start := time.Now()
+	openTimeout := time.Minute
+	failed := errors.New("chaincode error")
+
+	// failures below the threshold keep the circuit and the connection
+	c.fail(failed, 3)
+	c.fail(failed, 3)
+	if c.state != circuitClosed || c.conn != conn || !c.allow(start, openTimeout) {
+		t.Fatalf("after 2 failures: state %s, conn kept %v", c.state, c.conn == conn)
+	}
+
+	// a success resets the count
+	c.succeed(10 * time.Millisecond)
+	c.fail(failed, 3)
+	c.fail(failed, 3)
+	if c.state != circuitClosed || c.failures != 2 {
+		t.Fatalf("after a success and 2 failures: state %s, failures %d", c.state, c.failures)
+	}
+
+	// the threshold opens the circuit and drops the connection
+	c.fail(failed, 3)
+	if c.state != circuitOpen || c.conn != nil || c.lastErr != failed.Error() {
+		t.Fatalf("at the threshold: state %s, conn %v, lastErr %q", c.state, c.conn, c.lastErr)
+	}
+	if c.allow(c.openedAt.Add(openTimeout/2), openTimeout) {
+		t.Fatal("open circuit allowed a call before openTimeout")
+	}
+
+	// after openTimeout a single trial goes through
+	trial := c.openedAt.Add(openTimeout)
+	if !c.allow(trial, openTimeout) || c.state != circuitHalfOpen {
+		t.Fatalf("after openTimeout: state %s, want a trial", c.state)
+	}
+	if c.allow(trial, openTimeout) {
+		t.Fatal("half-open circuit allowed a second trial")
+	}
+
+	// a failed trial opens the circuit again, whatever the threshold
+	c.fail(failed, 100)
+	if c.state != circuitOpen {
+		t.Fatalf("after a failed trial: state %s", c.state)
+	}
+
+	// a successful trial closes it
+	if !c.allow(c.openedAt.Add(openTimeout), openTimeout) {
+		t.Fatal("no trial after the second openTimeout")
+	}
+	c.succeed(30 * time.Millisecond)
+	if c.state != circuitClosed || c.failures != 0 || c.lastErr != "" {
+		t.Fatalf("after a successful trial: state %s, failures %d, lastErr %q", c.state, c.failures, c.lastErr)
+	}
+	if c.latency != (10*time.Millisecond*7+30*time.Millisecond)/8 {
+		t.Fatalf("latency %v, want the moving average", c.latency)
+	}
+}
+
+func TestPeerPoolCandidates(t *testing.T) {
+	now := time.Now()
+	pool := &peerPool{
+		peers: []*peerConn{
+			{address: "a", state: circuitClosed, latency: 30 * time.Millisecond},
+			{address: "b", state: circuitOpen, openedAt: now},
+			{address: "c", state: circuitClosed, latency: 10 * time.Millisecond},
+		},
+		selection:   selectLeastLatency,
+		threshold:   3,
+		openTimeout: time.Minute,
+	}
+
+	peers := pool.candidates(now)
+	if len(peers) != 2 || peers[0].address != "c" || peers[1].address != "a" {
+		t.Fatalf("least latency candidates: %v", addresses(peers))
+	}
+
+	// the open peer is offered again once openTimeout passed, for a trial
+	if peers := pool.candidates(now.Add(time.Minute)); len(peers) != 3 {
+		t.Fatalf("candidates after openTimeout: %v", addresses(peers))
+	}
+	pool.peers[1].succeed(20 * time.Millisecond)
+
+	// round robin starts one peer further on each call
+	pool.selection = selectRoundRobin
+	first := pool.candidates(now)
+	second := pool.candidates(now)
+	if len(first) != 3 || len(second) != 3 || second[0] != first[1] {
+		t.Fatalf("round robin candidates: %v then %v", addresses(first), addresses(second))
+	}
+}
+
+func addresses(peers []*peerConn) []string {
+	var list []string
+	for _, peer := range peers {
+		list = append(list, peer.address)
+	}
+
+	return list
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/gocraft/web"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var reconcileSchema = []string{
+	`CREATE TABLE IF NOT EXISTS reconcile_reports (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		ok INTEGER NOT NULL,
+		report TEXT NOT NULL,
+		created_at INTEGER NOT NULL
+	)`,
+}
+
+// ReconcileReport is the result of comparing the index with the chaincode
+// state.
+type ReconcileReport struct {
+	ID         int64              `json:"id,omitempty"`
+	OK         bool               `json:"ok"`
+	Block      int64              `json:"block"`
+	Accounts   int                `json:"accounts"`
+	Counts     ReconcileCounts    `json:"counts"`
+	Mismatches []*BalanceMismatch `json:"mismatches"`
+	Rebuilt    bool               `json:"rebuilt,omitempty"`
+	StartedAt  string             `json:"startedAt"`
+	FinishedAt string             `json:"finishedAt"`
+}
+
+// ReconcileCounts defines the number of payments and offers on both sides.
+type ReconcileCounts struct {
+	IndexPayments  int `json:"indexPayments"`
+	LedgerPayments int `json:"ledgerPayments"`
+	IndexOffers    int `json:"indexOffers"`
+	LedgerOffers   int `json:"ledgerOffers"`
+}
+
+// BalanceMismatch defines a balance of the index that differs from the
+// chaincode, with the transactions that explain it.
+type BalanceMismatch struct {
+	Account  string   `json:"account"`
+	Currency string   `json:"currency"`
+	Index    string   `json:"index"`
+	Ledger   string   `json:"ledger"`
+	TxIDs    []string `json:"txids"`
+}
+
+// ledgerPayment is an item of queryPayments.
+type ledgerPayment struct {
+	TxID string       `json:"txid"`
+	Send *indexedSend `json:"send"`
+}
+
+// ledgerStats is the result of queryStats.
+type ledgerStats struct {
+	Payments int `json:"payments"`
+	Offers   int `json:"offers"`
+}
+
+// --------------- reconcile ---------------
+
+// startReconcile creates the report table and starts the periodic
+// reconciliation configured by app.reconcile
+func startReconcile() error {
+	if err := execSchema(reconcileSchema); err != nil {
+		return err
+	}
+
+	if !viper.GetBool("app.reconcile.enabled") {
+		logger.Infof("Reconciliation is disabled.")
+		return nil
+	}
+
+	interval := viper.GetDuration("app.reconcile.interval")
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	rebuild := viper.GetBool("app.reconcile.rebuild")
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if _, err := reconcile(rebuild); err != nil {
+				logger.Errorf("reconcile: %v", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// reconcile brings the index up to date and compares the balances of every
+// indexed account and the payment and offer counts with the chaincode. A
+// mismatch is checked again after indexing the blocks committed meanwhile,
+// so a transaction landing during the run is not reported. With rebuild the
+// index is rebuilt from the chain when it is out of step. The report is
+// saved.
+func reconcile(rebuild bool) (*ReconcileReport, error) {
+	report := &ReconcileReport{StartedAt: formatUnix(time.Now().Unix()), Mismatches: []*BalanceMismatch{}}
+
+	if err := indexBlocks(); err != nil {
+		return nil, err
+	}
+
+	accounts, err := reconcileAccounts()
+	if err != nil {
+		return nil, err
+	}
+	report.Accounts = len(accounts)
+
+	var suspects []string
+	for _, account := range accounts {
+		mismatches, err := compareBalances(account)
+		if err != nil {
+			return nil, err
+		}
+		if len(mismatches) > 0 {
+			suspects = append(suspects, account)
+		}
+	}
+
+	if err := indexBlocks(); err != nil {
+		return nil, err
+	}
+	for _, account := range suspects {
+		mismatches, err := compareBalances(account)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range mismatches {
+			if m.TxIDs, err = mismatchedPayments(m.Account, m.Currency); err != nil {
+				return nil, err
+			}
+		}
+		report.Mismatches = append(report.Mismatches, mismatches...)
+	}
+
+	if report.Counts, err = reconcileCounts(); err != nil {
+		return nil, err
+	}
+	if report.Block, err = indexCheckpoint(); err != nil {
+		return nil, err
+	}
+
+	c := report.Counts
+	report.OK = len(report.Mismatches) == 0 && c.IndexPayments == c.LedgerPayments && c.IndexOffers == c.LedgerOffers
+
+	if !report.OK {
+		logger.Warningf("reconcile: %d mismatched balances, payments %d/%d, offers %d/%d",
+			len(report.Mismatches), c.IndexPayments, c.LedgerPayments, c.IndexOffers, c.LedgerOffers)
+
+		if rebuild {
+			logger.Infof("reconcile: rebuilding the index from the chain")
+			if err := resetIndex(); err != nil {
+				return nil, err
+			}
+			if err := indexBlocks(); err != nil {
+				return nil, err
+			}
+			report.Rebuilt = true
+		}
+	}
+
+	report.FinishedAt = formatUnix(time.Now().Unix())
+
+	return report, saveReconcileReport(report)
+}
+
+// reconcileAccounts returns the accounts with a balance in the index or in
+// the chaincode, so an account the index missed entirely is compared too
+func reconcileAccounts() ([]string, error) {
+	result, e := queryBlueResult(context.Background(), []string{"queryBalanceAccounts"})
+	if e != nil {
+		return nil, errors.New(e.Message)
+	}
+	var ledger []string
+	if err := json.Unmarshal(result, &ledger); err != nil {
+		return nil, err
+	}
+
+	rows, err := appDB.Query(`SELECT DISTINCT account FROM index_balances`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	seen := map[string]bool{}
+	var accounts []string
+	for rows.Next() {
+		var account string
+		if err := rows.Scan(&account); err != nil {
+			return nil, err
+		}
+		seen[account] = true
+		accounts = append(accounts, account)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, account := range ledger {
+		if !seen[account] {
+			seen[account] = true
+			accounts = append(accounts, account)
+		}
+	}
+	sort.Strings(accounts)
+
+	return accounts, nil
+}
+
+// compareBalances returns the balances of account that differ between the
+// index and the chaincode, a missing balance counting as zero
+func compareBalances(account string) ([]*BalanceMismatch, error) {
+	result, e := queryBlueResult(context.Background(), []string{"queryBalances", account})
+	if e != nil {
+		return nil, errors.New(e.Message)
+	}
+	ledger := map[string]string{}
+	if err := json.Unmarshal(result, &ledger); err != nil {
+		return nil, err
+	}
+
+	rows, err := appDB.Query(`SELECT currency, amount FROM index_balances WHERE account = ?`, account)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	index := map[string]string{}
+	for rows.Next() {
+		var currency, amount string
+		if err := rows.Scan(&currency, &amount); err != nil {
+			return nil, err
+		}
+		index[currency] = amount
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var currencies []string
+	for currency := range ledger {
+		currencies = append(currencies, currency)
+	}
+	for currency := range index {
+		if _, ok := ledger[currency]; !ok {
+			currencies = append(currencies, currency)
+		}
+	}
+	sort.Strings(currencies)
+
+	mismatches := []*BalanceMismatch{}
+	for _, currency := range currencies {
+		indexAmount, err := parseBalance(index[currency])
+		if err != nil {
+			return nil, err
+		}
+		ledgerAmount, err := parseBalance(ledger[currency])
+		if err != nil {
+			return nil, err
+		}
+		if indexAmount.Cmp(ledgerAmount) != 0 {
+			mismatches = append(mismatches, &BalanceMismatch{
+				Account:  account,
+				Currency: currency,
+				Index:    formatIndexAmount(indexAmount),
+				Ledger:   formatIndexAmount(ledgerAmount),
+				TxIDs:    []string{},
+			})
+		}
+	}
+
+	return mismatches, nil
+}
+
+// parseBalance parses a decimal balance, empty for zero
+func parseBalance(value string) (*big.Rat, error) {
+	amount := new(big.Rat)
+	if value == "" {
+		return amount, nil
+	}
+	if _, ok := amount.SetString(value); !ok {
+		return nil, fmt.Errorf("invalid balance %s", value)
+	}
+
+	return amount, nil
+}
+
+// mismatchedPayments returns the transactions of account in currency that
+// are only on one side or differ between the index and the chaincode. The
+// chaincode only records the payments made since it keeps them by
+// transaction ID, so older payments show as index only.
+func mismatchedPayments(account string, currency string) ([]string, error) {
+	result, e := queryBlueResult(context.Background(), []string{"queryPayments", account})
+	if e != nil {
+		return nil, errors.New(e.Message)
+	}
+	var payments []*ledgerPayment
+	if err := json.Unmarshal(result, &payments); err != nil {
+		return nil, err
+	}
+
+	ledger := map[string]*indexedSend{}
+	for _, p := range payments {
+		if p.Send != nil && p.Send.Currency == currency {
+			ledger[p.TxID] = p.Send
+		}
+	}
+
+	rows, err := appDB.Query(`SELECT txid, sender, receiver, amount FROM index_payments
+		WHERE (sender = ? OR receiver = ?) AND currency = ?`, account, account, currency)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	txids := []string{}
+	for rows.Next() {
+		send := &indexedSend{}
+		var txid string
+		if err := rows.Scan(&txid, &send.Sender, &send.Receiver, &send.Amount); err != nil {
+			return nil, err
+		}
+
+		chain, ok := ledger[txid]
+		delete(ledger, txid)
+		if !ok || chain.Sender != send.Sender || chain.Receiver != send.Receiver || !sameAmount(chain.Amount, send.Amount) {
+			txids = append(txids, txid)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for txid := range ledger {
+		txids = append(txids, txid)
+	}
+	sort.Strings(txids)
+
+	return txids, nil
+}
+
+// sameAmount compares two decimal amounts
+func sameAmount(a, b string) bool {
+	x, errX := parseBalance(a)
+	y, errY := parseBalance(b)
+
+	return errX == nil && errY == nil && x.Cmp(y) == 0
+}
+
+// reconcileCounts returns the payment and offer counts of both sides
+func reconcileCounts() (ReconcileCounts, error) {
+	counts := ReconcileCounts{}
+
+	if err := appDB.QueryRow(`SELECT COUNT(*) FROM index_payments`).Scan(&counts.IndexPayments); err != nil {
+		return counts, err
+	}
+	if err := appDB.QueryRow(`SELECT COUNT(*) FROM index_offers`).Scan(&counts.IndexOffers); err != nil {
+		return counts, err
+	}
+
+	result, e := queryBlueResult(context.Background(), []string{"queryStats"})
+	if e != nil {
+		return counts, errors.New(e.Message)
+	}
+	stats := &ledgerStats{}
+	if err := json.Unmarshal(result, stats); err != nil {
+		return counts, err
+	}
+	counts.LedgerPayments, counts.LedgerOffers = stats.Payments, stats.Offers
+
+	return counts, nil
+}
+
+// saveReconcileReport records a report and sets its ID
+func saveReconcileReport(report *ReconcileReport) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	res, err := appDB.Exec(`INSERT INTO reconcile_reports (ok, report, created_at) VALUES (?, ?, ?)`,
+		report.OK, string(data), time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	report.ID, err = res.LastInsertId()
+
+	return err
+}
+
+// --------------- handlers ---------------
+
+// Reconcile compares the index with the chaincode now, rebuilding it when
+// rebuild is true and they differ
+func (s *BlueAPP) Reconcile(rw web.ResponseWriter, req *web.Request) {
+	rebuild := req.FormValue("rebuild") == "true"
+
+	logger.Infof("reconcile: rebuild=%v", rebuild)
+
+	report, err := reconcile(rebuild)
+	if err != nil {
+		writeError(rw, req, newAPIError(http.StatusBadGateway, codeChaincode, err.Error()))
+		logger.Errorf("reconcile error: %v", err)
+
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(report)
+}
+
+// ReconcileReports list the saved reports, newest first
+func (s *BlueAPP) ReconcileReports(rw web.ResponseWriter, req *web.Request) {
+	limit, err := indexLimit(req.FormValue("limit"))
+	if err != nil {
+		writeError(rw, req, paramsError(map[string]string{"limit": "expecting a positive integer"}))
+		logger.Errorf("Error: reconcileReports params error %v", err)
+
+		return
+	}
+
+	rows, err := appDB.Query(`SELECT id, report FROM reconcile_reports ORDER BY id DESC LIMIT ?`, limit)
+	if err != nil {
+		writeStoreError(rw, "reconcileReports", err)
+		return
+	}
+	defer rows.Close()
+
+	reports := []*ReconcileReport{}
+	for rows.Next() {
+		var id int64
+		var data string
+		if err := rows.Scan(&id, &data); err != nil {
+			writeStoreError(rw, "reconcileReports", err)
+			return
+		}
+		report := &ReconcileReport{}
+		if err := json.Unmarshal([]byte(data), report); err != nil {
+			writeStoreError(rw, "reconcileReports", err)
+			return
+		}
+		report.ID = id
+		reports = append(reports, report)
+	}
+	if err := rows.Err(); err != nil {
+		writeStoreError(rw, "reconcileReports", err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(reports)
+}
+
+// --------------- ReconcileCmd ---------------
+
+var reconcileRebuild bool
+
+// ReconcileCmd returns the cobra command comparing the index with the
+// chaincode. It fails when they differ, so it can run from a cron job.
+func ReconcileCmd() *cobra.Command {
+	reconcileCmd.Flags().BoolVar(&reconcileRebuild, "rebuild", false, "Rebuild the index from the chain when it differs")
+
+	return reconcileCmd
+}
+
+var reconcileCmd = &cobra.Command{
+	Use:   "reconcile",
+	Short: "Compare the index with the chaincode state.",
+	Long:  `Compare the balances and counts of the app's index with the chaincode state and report the mismatches.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := connectBlue(); err != nil {
+			return err
+		}
+		if err := initStore(); err != nil {
+			return fmt.Errorf("Error opening store: %s", err)
+		}
+		if err := startUpgrade(); err != nil {
+			return fmt.Errorf("Error creating upgrade tables: %s", err)
+		}
+		if err := initIndex(); err != nil {
+			return fmt.Errorf("Error creating index tables: %s", err)
+		}
+		if err := execSchema(reconcileSchema); err != nil {
+			return fmt.Errorf("Error creating reconcile table: %s", err)
+		}
+
+		report, err := reconcile(reconcileRebuild)
+		if err != nil {
+			return err
+		}
+
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stdout.Write(append(data, '\n')); err != nil {
+			return err
+		}
+
+		if !report.OK && !report.Rebuilt {
+			return fmt.Errorf("index differs from the chaincode state, %d mismatched balances", len(report.Mismatches))
+		}
+
+		return nil
+	},
+}
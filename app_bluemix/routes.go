@@ -0,0 +1,309 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/wutongtree/blue/chaincode_bluemix/validation"
+)
+
+// blueRoute describes a route of the REST service. buildBlueRouter registers
+// the routes and buildOpenAPI documents them from the same entries, so the
+// specification cannot miss a route or drift from the structs a handler uses.
+type blueRoute struct {
+	Method  string
+	Path    string
+	Handler interface{}
+	Summary string
+	Tag     string
+
+	// Params are the form or query parameters, a trailing * marks the
+	// required ones
+	Params []string
+	// Body is the JSON request body
+	Body interface{}
+	// Response is the body of a successful response
+	Response interface{}
+
+	// Wait tells that the route accepts the wait and timeout parameters
+	Wait bool
+	// Stream tells that the response is a stream of server-sent events
+	Stream bool
+	// Idempotent tells that the route accepts an Idempotency-Key header
+	Idempotent bool
+	// Scope is the scope a caller needs, read for GET and write for the
+	// other methods when empty
+	Scope string
+}
+
+// scope returns the scope a caller of the route needs
+func (r *blueRoute) scope() string {
+	if r.Scope != "" {
+		return r.Scope
+	}
+	if r.Method == "GET" {
+		return scopeRead
+	}
+
+	return scopeWrite
+}
+
+// matchRoute returns the route of blueRoutes serving a request, nil when none
+// does. Paths are split as the router splits them, which ignores a trailing
+// slash, and a literal segment wins over a wildcard as in the router.
+func matchRoute(method, path string) *blueRoute {
+	segments := splitRoutePath(path)
+
+	var match *blueRoute
+	var matchWildcards []bool
+	for i := range blueRoutes {
+		route := &blueRoutes[i]
+		if route.Method != method {
+			continue
+		}
+
+		pattern := splitRoutePath(route.Path)
+		if len(pattern) != len(segments) {
+			continue
+		}
+		wildcards := make([]bool, len(pattern))
+		matched := true
+		for j, segment := range pattern {
+			if strings.HasPrefix(segment, ":") {
+				wildcards[j] = true
+			} else if segment != segments[j] {
+				matched = false
+				break
+			}
+		}
+		if matched && (match == nil || literalFirst(wildcards, matchWildcards)) {
+			match, matchWildcards = route, wildcards
+		}
+	}
+
+	return match
+}
+
+// splitRoutePath splits a path into its segments, without the empty ones
+// around the leading and the trailing slash
+func splitRoutePath(path string) []string {
+	segments := strings.Split(path, "/")
+	if len(segments) > 0 && segments[0] == "" {
+		segments = segments[1:]
+	}
+	if len(segments) > 0 && segments[len(segments)-1] == "" {
+		segments = segments[:len(segments)-1]
+	}
+
+	return segments
+}
+
+// literalFirst reports whether a pattern with wildcards a has a literal
+// segment where b first has a wildcard
+func literalFirst(a, b []bool) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return !a[i]
+		}
+	}
+
+	return false
+}
+
+// route tags
+const (
+	tagSystem    = "system"
+	tagUsers     = "users"
+	tagTx        = "transactions"
+	tagQuery     = "queries"
+	tagIndex     = "index"
+	tagSchedules = "schedules"
+	tagWebhooks  = "webhooks"
+	tagV1        = "v1"
+)
+
+var blueRoutes = []blueRoute{
+	{Method: "GET", Path: "/version", Handler: (*BlueAPP).Version, Tag: tagSystem,
+		Summary: "Get the app version", Response: VersionResponse{}},
+	{Method: "GET", Path: "/health", Handler: (*BlueAPP).Health, Tag: tagSystem,
+		Summary: "Check the store, the event hub and the peers", Response: HealthResponse{}},
+	{Method: "GET", Path: "/openapi.json", Handler: (*BlueAPP).OpenAPI, Tag: tagSystem,
+		Summary: "Get this OpenAPI document", Response: map[string]interface{}{}},
+	{Method: "POST", Path: "/login", Handler: (*BlueAPP).Login, Tag: tagUsers,
+		Summary: "Log in and get a bearer token", Params: []string{"enrollId*", "enrollSecret*"}, Response: LoginResponse{}},
+	{Method: "POST", Path: "/registrar", Handler: (*BlueAPP).Register, Tag: tagUsers, Scope: scopeAdmin,
+		Summary: "Register and enroll a user", Params: []string{"enrollId*", "enrollSecret*"}, Response: BlueResponse{}},
+
+	{Method: "POST", Path: "/accounts", Handler: (*BlueAPP).NewAccount, Tag: tagUsers,
+		Summary: "Generate a new account identifier owned by the caller, or assign an account to a user as an admin",
+		Params:  []string{"account", "enrollId"}, Response: AccountResponse{}},
+	{Method: "POST", Path: "/currencies", Handler: (*BlueAPP).RegisterCurrency, Tag: tagTx, Scope: scopeAdmin, Wait: true,
+		Summary: "Register a custom currency", Params: []string{"code*", "precision*"}, Response: BlueResponse{}},
+	{Method: "GET", Path: "/currencies", Handler: (*BlueAPP).Currencies, Tag: tagQuery,
+		Summary: "List the registered custom currencies", Response: []validation.Currency{}},
+
+	{Method: "POST", Path: "/tx/send", Handler: (*BlueAPP).Send, Tag: tagTx, Wait: true, Idempotent: true,
+		Summary:  "Send a payment",
+		Params:   []string{"sender*", "receiver*", "amount*", "currency*", "destinationTag", "sourceTag", "memo", "invoiceID"},
+		Response: BlueResponse{}},
+	{Method: "POST", Path: "/tx/offer", Handler: (*BlueAPP).Offer, Tag: tagTx, Wait: true, Idempotent: true,
+		Summary:  "Place an offer, amounts are <value>/<currency>",
+		Params:   []string{"sender*", "takerGets*", "takerPays*"},
+		Response: BlueResponse{}},
+	{Method: "POST", Path: "/tx/offercancel", Handler: (*BlueAPP).OfferCancel, Tag: tagTx, Wait: true,
+		Summary:  "Take a resting offer off the book",
+		Params:   []string{"id*", "account*"},
+		Response: BlueResponse{}},
+	{Method: "POST", Path: "/tx/accountset", Handler: (*BlueAPP).AccountSet, Tag: tagTx, Wait: true,
+		Summary:  "Set or clear an account flag",
+		Params:   []string{"account*", "flag*", "enabled*"},
+		Response: BlueResponse{}},
+	{Method: "POST", Path: "/tx/issuerset", Handler: (*BlueAPP).IssuerSet, Tag: tagTx, Scope: scopeAdmin, Wait: true,
+		Summary:  "Let a gateway account send more than its balance, issuing the currency",
+		Params:   []string{"account*", "enabled*"},
+		Response: BlueResponse{}},
+	{Method: "POST", Path: "/tx/invoice", Handler: (*BlueAPP).CreateInvoice, Tag: tagTx, Wait: true,
+		Summary:  "Create an invoice",
+		Params:   []string{"payee*", "amount*", "currency*", "expiry", "reference", "payer"},
+		Response: BlueResponse{}},
+	{Method: "POST", Path: "/tx/payinvoice", Handler: (*BlueAPP).PayInvoice, Tag: tagTx, Wait: true,
+		Summary:  "Pay an invoice",
+		Params:   []string{"id*", "payer*", "amount*", "currency*"},
+		Response: BlueResponse{}},
+	{Method: "POST", Path: "/tx/checkcreate", Handler: (*BlueAPP).CheckCreate, Tag: tagTx, Wait: true,
+		Summary:  "Create a check",
+		Params:   []string{"sender*", "receiver*", "sendMax*", "currency*", "expiry", "destinationTag", "invoiceID"},
+		Response: BlueResponse{}},
+	{Method: "POST", Path: "/tx/checkcash", Handler: (*BlueAPP).CheckCash, Tag: tagTx, Wait: true,
+		Summary:  "Cash a check",
+		Params:   []string{"id*", "receiver*", "amount*"},
+		Response: BlueResponse{}},
+	{Method: "POST", Path: "/tx/checkcancel", Handler: (*BlueAPP).CheckCancel, Tag: tagTx, Wait: true,
+		Summary:  "Cancel a check",
+		Params:   []string{"id*", "account*"},
+		Response: BlueResponse{}},
+	{Method: "POST", Path: "/tx/depositpreauth", Handler: (*BlueAPP).DepositPreauth, Tag: tagTx, Wait: true,
+		Summary:  "Allow a sender to deposit into an account",
+		Params:   []string{"account*", "authorized*"},
+		Response: BlueResponse{}},
+	{Method: "POST", Path: "/tx/depositunauth", Handler: (*BlueAPP).DepositUnauth, Tag: tagTx, Wait: true,
+		Summary:  "Remove a sender from the deposit allow-list",
+		Params:   []string{"account*", "authorized*"},
+		Response: BlueResponse{}},
+	{Method: "GET", Path: "/tx/:id", Handler: (*BlueAPP).TxStatus, Tag: tagTx,
+		Summary: "Get the status of a transaction", Response: TxStatus{}},
+	{Method: "GET", Path: "/stream", Handler: (*BlueAPP).Stream, Tag: tagTx, Stream: true,
+		Summary:  "Stream payments, order-book changes or trades",
+		Params:   []string{"topic*", "account", "pair", "lastEventId"},
+		Response: StreamEvent{}},
+
+	{Method: "GET", Path: "/invoices", Handler: (*BlueAPP).Invoices, Tag: tagQuery,
+		Summary: "List the invoices of a payee or a payer", Params: []string{"payee", "payer"}, Response: []Invoice{}},
+	{Method: "GET", Path: "/invoices/:id", Handler: (*BlueAPP).Invoice, Tag: tagQuery,
+		Summary: "Get an invoice", Response: Invoice{}},
+	{Method: "GET", Path: "/checks", Handler: (*BlueAPP).Checks, Tag: tagQuery,
+		Summary: "List the checks of a sender or a receiver", Params: []string{"sender", "receiver"}, Response: []Check{}},
+	{Method: "GET", Path: "/checks/:id", Handler: (*BlueAPP).Check, Tag: tagQuery,
+		Summary: "Get a check", Response: Check{}},
+	{Method: "GET", Path: "/books/:gets/:pays", Handler: (*BlueAPP).Book, Tag: tagQuery,
+		Summary: "List the resting offers of a pair, best rate first", Response: []BookOffer{}},
+	{Method: "GET", Path: "/accounts/:account/balances", Handler: (*BlueAPP).Balances, Tag: tagQuery,
+		Summary: "Get the balances of an account by currency", Response: map[string]string{}},
+	{Method: "GET", Path: "/accounts/:account/deposit", Handler: (*BlueAPP).DepositAuthorized, Tag: tagQuery,
+		Summary:  "Check whether an account accepts funds from a sender",
+		Params:   []string{"sender*", "destinationTag"},
+		Response: DepositAuthorizedResponse{}},
+
+	{Method: "GET", Path: "/accounts/:account/history", Handler: (*BlueAPP).History, Tag: tagIndex,
+		Summary:  "List the indexed payments of an account, newest first",
+		Params:   []string{"currency", "before", "limit"},
+		Response: []Payment{}},
+	{Method: "GET", Path: "/accounts/:account/statement", Handler: (*BlueAPP).AccountStatement, Tag: tagIndex,
+		Summary:  "List the debits and credits of an account with the running balance, or export them with format=csv|jsonl",
+		Params:   []string{"currency", "from", "to", "cursor", "limit", "format"},
+		Response: Statement{}},
+	{Method: "GET", Path: "/search", Handler: (*BlueAPP).Search, Tag: tagIndex,
+		Summary:  "Search indexed payments, offers and fills by txid, account, invoice ID, pair or memo",
+		Params:   []string{"q*", "limit"},
+		Response: SearchResponse{}},
+	{Method: "GET", Path: "/index", Handler: (*BlueAPP).IndexStatus, Tag: tagIndex,
+		Summary: "Get the last indexed block and the chain height", Response: IndexStatus{}},
+	{Method: "POST", Path: "/reconcile", Handler: (*BlueAPP).Reconcile, Tag: tagIndex, Scope: scopeAdmin,
+		Summary: "Compare the index with the chaincode state, optionally rebuilding it", Params: []string{"rebuild"},
+		Response: ReconcileReport{}},
+	{Method: "GET", Path: "/reconcile", Handler: (*BlueAPP).ReconcileReports, Tag: tagIndex, Scope: scopeAdmin,
+		Summary: "List the reconciliation reports", Params: []string{"limit"}, Response: []ReconcileReport{}},
+	{Method: "POST", Path: "/upgrade", Handler: (*BlueAPP).Upgrade, Tag: tagSystem, Scope: scopeAdmin,
+		Summary: "Deploy the new chaincode, carry the state over and switch to it", Response: UpgradeReport{}},
+	{Method: "GET", Path: "/upgrade", Handler: (*BlueAPP).UpgradeReports, Tag: tagSystem, Scope: scopeAdmin,
+		Summary: "List the chaincode upgrade reports", Params: []string{"limit"}, Response: []UpgradeReport{}},
+
+	{Method: "POST", Path: "/schedules", Handler: (*BlueAPP).CreateSchedule, Tag: tagSchedules,
+		Summary: "Schedule a recurring or one-off send",
+		Params: []string{"sender*", "receiver*", "amount*", "currency*", "destinationTag", "sourceTag", "memo", "invoiceID",
+			"interval", "startAt*", "endAt"},
+		Response: BlueResponse{}},
+	{Method: "GET", Path: "/schedules", Handler: (*BlueAPP).Schedules, Tag: tagSchedules,
+		Summary: "List the schedules", Params: []string{"sender"}, Response: []Schedule{}},
+	{Method: "GET", Path: "/schedules/:id", Handler: (*BlueAPP).Schedule, Tag: tagSchedules,
+		Summary: "Get a schedule with its runs", Response: Schedule{}},
+	{Method: "PUT", Path: "/schedules/:id", Handler: (*BlueAPP).UpdateSchedule, Tag: tagSchedules,
+		Summary:  "Change a schedule",
+		Params:   []string{"amount", "memo", "endAt", "enabled"},
+		Response: BlueResponse{}},
+	{Method: "DELETE", Path: "/schedules/:id", Handler: (*BlueAPP).DeleteSchedule, Tag: tagSchedules,
+		Summary: "Delete a schedule", Response: BlueResponse{}},
+
+	{Method: "POST", Path: "/webhooks", Handler: (*BlueAPP).CreateWebhook, Tag: tagWebhooks,
+		Summary:  "Register a webhook",
+		Params:   []string{"account*", "url*", "events*", "secret"},
+		Response: Webhook{}},
+	{Method: "GET", Path: "/webhooks", Handler: (*BlueAPP).Webhooks, Tag: tagWebhooks,
+		Summary: "List the webhooks", Params: []string{"account"}, Response: []Webhook{}},
+	{Method: "DELETE", Path: "/webhooks/:id", Handler: (*BlueAPP).DeleteWebhook, Tag: tagWebhooks,
+		Summary: "Delete a webhook", Response: BlueResponse{}},
+	{Method: "GET", Path: "/webhooks/deadletters", Handler: (*BlueAPP).DeadLetters, Tag: tagWebhooks, Scope: scopeAdmin,
+		Summary: "List the dead-lettered deliveries", Response: []DeadLetter{}},
+	{Method: "POST", Path: "/webhooks/deadletters/:id/replay", Handler: (*BlueAPP).ReplayDeadLetter, Tag: tagWebhooks, Scope: scopeAdmin,
+		Summary: "Queue a dead-lettered delivery again", Response: BlueResponse{}},
+
+	{Method: "POST", Path: "/v1/tx/send", Handler: (*BlueAPP).V1Send, Tag: tagV1, Wait: true, Idempotent: true,
+		Summary: "Send a payment", Body: SendRequest{}, Response: TxResponse{}},
+	{Method: "POST", Path: "/v1/tx/offer", Handler: (*BlueAPP).V1Offer, Tag: tagV1, Wait: true, Idempotent: true,
+		Summary: "Place an offer", Body: OfferRequest{}, Response: TxResponse{}},
+	{Method: "POST", Path: "/v1/tx/offercancel", Handler: (*BlueAPP).V1OfferCancel, Tag: tagV1, Wait: true,
+		Summary: "Take a resting offer off the book", Body: OfferCancelRequest{}, Response: TxResponse{}},
+	{Method: "POST", Path: "/v1/tx/accountset", Handler: (*BlueAPP).V1AccountSet, Tag: tagV1, Wait: true,
+		Summary: "Set or clear an account flag", Body: AccountSetRequest{}, Response: TxResponse{}},
+	{Method: "POST", Path: "/v1/tx/invoice", Handler: (*BlueAPP).V1CreateInvoice, Tag: tagV1, Wait: true,
+		Summary: "Create an invoice", Body: CreateInvoiceRequest{}, Response: TxResponse{}},
+	{Method: "POST", Path: "/v1/tx/payinvoice", Handler: (*BlueAPP).V1PayInvoice, Tag: tagV1, Wait: true,
+		Summary: "Pay an invoice", Body: PayInvoiceRequest{}, Response: TxResponse{}},
+	{Method: "POST", Path: "/v1/tx/checkcreate", Handler: (*BlueAPP).V1CheckCreate, Tag: tagV1, Wait: true,
+		Summary: "Create a check", Body: CheckCreateRequest{}, Response: TxResponse{}},
+	{Method: "POST", Path: "/v1/tx/checkcash", Handler: (*BlueAPP).V1CheckCash, Tag: tagV1, Wait: true,
+		Summary: "Cash a check", Body: CheckCashRequest{}, Response: TxResponse{}},
+	{Method: "POST", Path: "/v1/tx/checkcancel", Handler: (*BlueAPP).V1CheckCancel, Tag: tagV1, Wait: true,
+		Summary: "Cancel a check", Body: CheckCancelRequest{}, Response: TxResponse{}},
+	{Method: "POST", Path: "/v1/tx/depositpreauth", Handler: (*BlueAPP).V1DepositPreauth, Tag: tagV1, Wait: true,
+		Summary: "Allow a sender to deposit into an account", Body: DepositAuthRequest{}, Response: TxResponse{}},
+	{Method: "POST", Path: "/v1/tx/depositunauth", Handler: (*BlueAPP).V1DepositUnauth, Tag: tagV1, Wait: true,
+		Summary: "Remove a sender from the deposit allow-list", Body: DepositAuthRequest{}, Response: TxResponse{}},
+	{Method: "GET", Path: "/v1/tx/:id", Handler: (*BlueAPP).V1TxStatus, Tag: tagV1,
+		Summary: "Get the status of a transaction", Response: TxStatus{}},
+	{Method: "GET", Path: "/v1/invoices", Handler: (*BlueAPP).V1Invoices, Tag: tagV1,
+		Summary: "List the invoices of a payee or a payer", Params: []string{"payee", "payer"}, Response: []Invoice{}},
+	{Method: "GET", Path: "/v1/invoices/:id", Handler: (*BlueAPP).V1Invoice, Tag: tagV1,
+		Summary: "Get an invoice", Response: Invoice{}},
+	{Method: "GET", Path: "/v1/checks", Handler: (*BlueAPP).V1Checks, Tag: tagV1,
+		Summary: "List the checks of a sender or a receiver", Params: []string{"sender", "receiver"}, Response: []Check{}},
+	{Method: "GET", Path: "/v1/checks/:id", Handler: (*BlueAPP).V1Check, Tag: tagV1,
+		Summary: "Get a check", Response: Check{}},
+	{Method: "GET", Path: "/v1/books/:gets/:pays", Handler: (*BlueAPP).V1Book, Tag: tagV1,
+		Summary: "List the resting offers of a pair, best rate first", Response: []BookOffer{}},
+	{Method: "GET", Path: "/v1/accounts/:account/balances", Handler: (*BlueAPP).V1Balances, Tag: tagV1,
+		Summary: "Get the balances of an account by currency", Response: BalancesResponse{}},
+	{Method: "GET", Path: "/v1/accounts/:account/deposit", Handler: (*BlueAPP).V1DepositAuthorized, Tag: tagV1,
+		Summary:  "Check whether an account accepts funds from a sender",
+		Params:   []string{"sender*", "destinationTag"},
+		Response: DepositAuthorizedResponse{}},
+}
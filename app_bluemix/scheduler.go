@@ -0,0 +1,771 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/gocraft/web"
+	"github.com/hyperledger/fabric/core/util"
+	pb "github.com/hyperledger/fabric/protos"
+	"github.com/spf13/viper"
+	"github.com/wutongtree/blue/chaincode_bluemix/validation"
+)
+
+// schedule intervals
+const (
+	intervalOnce    = "once"
+	intervalDaily   = "daily"
+	intervalWeekly  = "weekly"
+	intervalMonthly = "monthly"
+)
+
+// run status
+const (
+	runPending   = "pending"
+	runSubmitted = "submitted"
+	runFailed    = "failed"
+)
+
+var schedulerSchema = []string{
+	`CREATE TABLE IF NOT EXISTS schedules (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		sender TEXT NOT NULL,
+		receiver TEXT NOT NULL,
+		amount TEXT NOT NULL,
+		currency TEXT NOT NULL,
+		destination_tag TEXT NOT NULL DEFAULT '',
+		source_tag TEXT NOT NULL DEFAULT '',
+		memo TEXT NOT NULL DEFAULT '',
+		invoice_id TEXT NOT NULL DEFAULT '',
+		interval TEXT NOT NULL,
+		start_at INTEGER NOT NULL,
+		end_at INTEGER NOT NULL DEFAULT 0,
+		occurrence INTEGER NOT NULL DEFAULT 0,
+		next_run INTEGER NOT NULL,
+		enabled INTEGER NOT NULL DEFAULT 1,
+		created_at INTEGER NOT NULL,
+		enroll_id TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE TABLE IF NOT EXISTS schedule_runs (
+		schedule_id INTEGER NOT NULL,
+		due_at INTEGER NOT NULL,
+		status TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt INTEGER NOT NULL,
+		txid TEXT NOT NULL DEFAULT '',
+		error TEXT NOT NULL DEFAULT '',
+		updated_at INTEGER NOT NULL,
+		PRIMARY KEY (schedule_id, due_at)
+	)`,
+	`CREATE INDEX IF NOT EXISTS schedule_runs_status ON schedule_runs (status, next_attempt)`,
+}
+
+// Schedule defines a recurring or one-off send.
+type Schedule struct {
+	ID             int64          `json:"id"`
+	Sender         string         `json:"sender"`
+	Receiver       string         `json:"receiver"`
+	Amount         string         `json:"amount"`
+	Currency       string         `json:"currency"`
+	DestinationTag string         `json:"destinationTag,omitempty"`
+	SourceTag      string         `json:"sourceTag,omitempty"`
+	Memo           string         `json:"memo,omitempty"`
+	InvoiceID      string         `json:"invoiceID,omitempty"`
+	Interval       string         `json:"interval"`
+	StartAt        string         `json:"startAt"`
+	EndAt          string         `json:"endAt,omitempty"`
+	NextRun        string         `json:"nextRun,omitempty"`
+	Enabled        bool           `json:"enabled"`
+	Runs           []*ScheduleRun `json:"runs,omitempty"`
+}
+
+// ScheduleRun defines one execution of a schedule.
+type ScheduleRun struct {
+	DueAt     string `json:"dueAt"`
+	Status    string `json:"status"`
+	Attempts  int    `json:"attempts"`
+	TxID      string `json:"txid,omitempty"`
+	Error     string `json:"error,omitempty"`
+	UpdatedAt string `json:"updatedAt"`
+}
+
+// --------------- scheduler ---------------
+
+// startScheduler creates the schedule tables and starts firing due schedules
+func startScheduler() error {
+	if err := execSchema(schedulerSchema); err != nil {
+		return fmt.Errorf("Error creating scheduler tables: %s", err)
+	}
+	if err := addColumn("schedules", "enroll_id", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return fmt.Errorf("Error migrating scheduler tables: %s", err)
+	}
+
+	if !viper.GetBool("app.scheduler.enabled") {
+		logger.Infof("Scheduler is disabled.")
+		return nil
+	}
+
+	interval := viper.GetDuration("app.scheduler.interval")
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			scheduleTick(time.Now())
+			<-ticker.C
+		}
+	}()
+
+	logger.Infof("Scheduler started, interval %v", interval)
+
+	return nil
+}
+
+// scheduleTick claims the runs that are due, takes the rejected ones back
+// and executes the pending ones
+func scheduleTick(now time.Time) {
+	if err := claimDueRuns(now); err != nil {
+		logger.Errorf("scheduler: claim runs error: %v", err)
+	}
+	if err := settleRejectedRuns(); err != nil {
+		logger.Errorf("scheduler: settle runs error: %v", err)
+	}
+	if err := executePendingRuns(now); err != nil {
+		logger.Errorf("scheduler: execute runs error: %v", err)
+	}
+}
+
+// claimDueRuns records a pending run for every occurrence due by now and
+// advances the schedules. Each occurrence is recorded once, in the same
+// database transaction that advances its schedule, so a restart neither
+// skips nor repeats an occurrence: the ones missed while the app was down
+// are claimed on the next tick.
+func claimDueRuns(now time.Time) error {
+	for {
+		tx, err := appDB.Begin()
+		if err != nil {
+			return err
+		}
+
+		var (
+			id, startAt, endAt, nextRun int64
+			occurrence                  int
+			interval                    string
+		)
+		err = tx.QueryRow(`SELECT id, interval, start_at, end_at, occurrence, next_run FROM schedules
+			WHERE enabled = 1 AND next_run <= ? ORDER BY next_run LIMIT 1`, now.Unix()).
+			Scan(&id, &interval, &startAt, &endAt, &occurrence, &nextRun)
+		if err == sql.ErrNoRows {
+			tx.Rollback()
+			return nil
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		_, err = tx.Exec(`INSERT OR IGNORE INTO schedule_runs (schedule_id, due_at, status, next_attempt, updated_at)
+			VALUES (?, ?, ?, ?, ?)`, id, nextRun, runPending, now.Unix(), now.Unix())
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		occurrence++
+		next, ok := nextOccurrence(interval, time.Unix(startAt, 0), occurrence)
+		enabled := ok && (endAt == 0 || next.Unix() <= endAt)
+		_, err = tx.Exec(`UPDATE schedules SET occurrence = ?, next_run = ?, enabled = ? WHERE id = ?`,
+			occurrence, next.Unix(), enabled, id)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+
+		logger.Infof("scheduler: claimed schedule %d run due at %v", id, time.Unix(nextRun, 0))
+	}
+}
+
+// nextOccurrence returns the n-th occurrence after start, computed from start
+// to avoid drifting, and false when the interval does not recur. A monthly
+// schedule starting on a day a month lacks runs on that month's last day.
+func nextOccurrence(interval string, start time.Time, n int) (time.Time, bool) {
+	start = start.In(blueLocation())
+
+	switch interval {
+	case intervalDaily:
+		return start.AddDate(0, 0, n), true
+	case intervalWeekly:
+		return start.AddDate(0, 0, 7*n), true
+	case intervalMonthly:
+		year, month, day := start.Date()
+		// day 0 of the month after is the last day of the month
+		if last := time.Date(year, month+time.Month(n)+1, 0, 0, 0, 0, 0, start.Location()).Day(); day > last {
+			day = last
+		}
+		return time.Date(year, month+time.Month(n), day,
+			start.Hour(), start.Minute(), start.Second(), start.Nanosecond(), start.Location()), true
+	}
+
+	return start, false
+}
+
+// resumeOccurrence returns the first occurrence of a schedule at or after
+// now and its number, skipping the occurrences missed while it was
+// disabled, and false when a one-off schedule already ran
+func resumeOccurrence(interval string, start time.Time, occurrence int, now time.Time) (int, time.Time, bool) {
+	if interval == intervalOnce {
+		if occurrence > 0 {
+			return occurrence, start, false
+		}
+		if start.Before(now) {
+			return occurrence, now, true
+		}
+		return occurrence, start, true
+	}
+
+	next, _ := nextOccurrence(interval, start, occurrence)
+	for next.Before(now) {
+		occurrence++
+		next, _ = nextOccurrence(interval, start, occurrence)
+	}
+
+	return occurrence, next, true
+}
+
+// executePendingRuns submits the pending runs whose attempt is due
+func executePendingRuns(now time.Time) error {
+	rows, err := appDB.Query(`SELECT r.schedule_id, r.due_at, r.attempts, s.enroll_id, s.created_at,
+			s.sender, s.receiver, s.amount, s.currency, s.destination_tag, s.source_tag, s.memo, s.invoice_id
+		FROM schedule_runs r JOIN schedules s ON s.id = r.schedule_id
+		WHERE r.status = ? AND r.next_attempt <= ? ORDER BY r.due_at`, runPending, now.Unix())
+	if err != nil {
+		return err
+	}
+
+	type pendingRun struct {
+		scheduleID, dueAt int64
+		createdAt         int64
+		attempts          int
+		enrollID          string
+		schedule          Schedule
+	}
+	var runs []*pendingRun
+	for rows.Next() {
+		r := &pendingRun{}
+		s := &r.schedule
+		err := rows.Scan(&r.scheduleID, &r.dueAt, &r.attempts, &r.enrollID, &r.createdAt,
+			&s.Sender, &s.Receiver, &s.Amount, &s.Currency, &s.DestinationTag, &s.SourceTag, &s.Memo, &s.InvoiceID)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		runs = append(runs, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, r := range runs {
+		txid := scheduleRunTxID(r.scheduleID, r.createdAt, r.dueAt)
+		err := executeRun(&r.schedule, r.enrollID, txid)
+		if err := recordRun(r.scheduleID, r.dueAt, r.attempts+1, txid, err); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// settleRejectedRuns takes back the submitted runs whose transaction the
+// chaincode rejected. Invokes are asynchronous, so a send failing in the
+// chaincode, for an insufficient balance or an unauthorized deposit, is only
+// known from its rejection event in the transaction status tracker. The run
+// is retried as if its submission failed.
+func settleRejectedRuns() error {
+	rows, err := appDB.Query(`SELECT r.schedule_id, r.due_at, r.attempts, r.txid, t.error
+		FROM schedule_runs r JOIN tx_status t ON t.txid = r.txid
+		WHERE r.status = ? AND t.status = ?`, runSubmitted, txFailed)
+	if err != nil {
+		return err
+	}
+
+	type rejectedRun struct {
+		scheduleID, dueAt int64
+		attempts          int
+		txid, errMsg      string
+	}
+	var runs []*rejectedRun
+	for rows.Next() {
+		r := &rejectedRun{}
+		if err := rows.Scan(&r.scheduleID, &r.dueAt, &r.attempts, &r.txid, &r.errMsg); err != nil {
+			rows.Close()
+			return err
+		}
+		runs = append(runs, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, r := range runs {
+		if err := recordRun(r.scheduleID, r.dueAt, r.attempts, r.txid, fmt.Errorf("rejected: %s", r.errMsg)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// scheduleRunTxID returns the transaction ID of a schedule's run. It is the
+// same for every attempt of the run, so the chaincode applies a run once,
+// and differs between schedules sending the same amount at the same time.
+// created_at keeps it unique when schedule IDs restart with a new database.
+func scheduleRunTxID(scheduleID, createdAt, dueAt int64) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("schedule\x00%d\x00%d\x00%d", scheduleID, createdAt, dueAt)))
+	return hex.EncodeToString(sum[:])
+}
+
+// executeRun invokes the send of a schedule's run as transaction txid,
+// signed by the user who created the schedule. Resubmitting a run after a
+// crash reuses txid, which the chaincode rejects as already executed.
+func executeRun(s *Schedule, enrollID string, txid string) error {
+	args := []string{
+		"send",
+		s.Sender,
+		s.Receiver,
+		s.Amount,
+		s.Currency,
+		time.Now().In(blueLocation()).String(),
+		s.DestinationTag,
+		s.SourceTag,
+		s.Memo,
+		s.InvoiceID}
+
+	chaincodeInput := &pb.ChaincodeInput{
+		Args: util.ToChaincodeArgs(args...),
+	}
+
+	// schedules created before per-user clients are signed by the deployer
+	client := deployerClient
+	if enrollID != "" {
+		var (
+			release func()
+			err     error
+		)
+		if client, release, err = blueUsers.get(enrollID); err != nil {
+			return err
+		}
+		defer release()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), invokeTimeout())
+	defer cancel()
+
+	resp, err := invokeChaincode(ctx, client, chaincodeInput, txid)
+	if err != nil {
+		return err
+	}
+	if resp.Status != pb.Response_SUCCESS {
+		return fmt.Errorf("%s", resp.Msg)
+	}
+
+	return nil
+}
+
+// recordRun stores the outcome of an attempt, scheduling a retry with
+// exponential backoff until app.scheduler.maxAttempts is reached
+func recordRun(scheduleID, dueAt int64, attempts int, txid string, runErr error) error {
+	now := time.Now()
+
+	if runErr == nil {
+		logger.Infof("scheduler: schedule %d run due at %v submitted: %s", scheduleID, time.Unix(dueAt, 0), txid)
+
+		_, err := appDB.Exec(`UPDATE schedule_runs SET status = ?, attempts = ?, txid = ?, error = '', updated_at = ?
+			WHERE schedule_id = ? AND due_at = ?`, runSubmitted, attempts, txid, now.Unix(), scheduleID, dueAt)
+		return err
+	}
+
+	maxAttempts := viper.GetInt("app.scheduler.maxAttempts")
+	if maxAttempts <= 0 {
+		maxAttempts = 5
+	}
+	retryDelay := viper.GetDuration("app.scheduler.retryDelay")
+	if retryDelay <= 0 {
+		retryDelay = 30 * time.Second
+	}
+
+	status := runPending
+	if attempts >= maxAttempts {
+		status = runFailed
+	}
+	nextAttempt := now.Add(retryDelay << uint(attempts-1))
+
+	logger.Errorf("scheduler: schedule %d run due at %v attempt %d %s: %v", scheduleID, time.Unix(dueAt, 0), attempts, status, runErr)
+
+	_, err := appDB.Exec(`UPDATE schedule_runs SET status = ?, attempts = ?, next_attempt = ?, error = ?, updated_at = ?
+		WHERE schedule_id = ? AND due_at = ?`, status, attempts, nextAttempt.Unix(), runErr.Error(), now.Unix(), scheduleID, dueAt)
+	return err
+}
+
+// blueLocation returns the time zone used for chaincode timestamps
+func blueLocation() *time.Location {
+	location, err := time.LoadLocation("Asia/Chongqing")
+	if err != nil {
+		return time.Local
+	}
+
+	return location
+}
+
+// --------------- schedule store ---------------
+
+const scheduleColumns = `id, sender, receiver, amount, currency, destination_tag, source_tag, memo, invoice_id,
+	interval, start_at, end_at, next_run, enabled`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanSchedule(row rowScanner) (*Schedule, error) {
+	s := &Schedule{}
+	var startAt, endAt, nextRun int64
+	err := row.Scan(&s.ID, &s.Sender, &s.Receiver, &s.Amount, &s.Currency, &s.DestinationTag, &s.SourceTag, &s.Memo, &s.InvoiceID,
+		&s.Interval, &startAt, &endAt, &nextRun, &s.Enabled)
+	if err != nil {
+		return nil, err
+	}
+
+	s.StartAt = formatUnix(startAt)
+	if endAt != 0 {
+		s.EndAt = formatUnix(endAt)
+	}
+	if s.Enabled {
+		s.NextRun = formatUnix(nextRun)
+	}
+
+	return s, nil
+}
+
+func getSchedule(id int64) (*Schedule, error) {
+	s, err := scanSchedule(appDB.QueryRow(`SELECT `+scheduleColumns+` FROM schedules WHERE id = ?`, id))
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := appDB.Query(`SELECT due_at, status, attempts, txid, error, updated_at FROM schedule_runs
+		WHERE schedule_id = ? ORDER BY due_at DESC`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		r := &ScheduleRun{}
+		var dueAt, updatedAt int64
+		if err := rows.Scan(&dueAt, &r.Status, &r.Attempts, &r.TxID, &r.Error, &updatedAt); err != nil {
+			return nil, err
+		}
+		r.DueAt = formatUnix(dueAt)
+		r.UpdatedAt = formatUnix(updatedAt)
+		s.Runs = append(s.Runs, r)
+	}
+
+	return s, rows.Err()
+}
+
+func formatUnix(t int64) string {
+	return time.Unix(t, 0).In(blueLocation()).Format(time.RFC3339)
+}
+
+// parseScheduleTime parses an optional RFC3339 form value
+func parseScheduleTime(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return 0, err
+	}
+
+	return t.Unix(), nil
+}
+
+// --------------- handlers ---------------
+
+// CreateSchedule create a scheduled send
+func (s *BlueAPP) CreateSchedule(rw web.ResponseWriter, req *web.Request) {
+	encoder := json.NewEncoder(rw)
+
+	// get params
+	sched := &Schedule{
+		Sender:         req.FormValue("sender"),
+		Receiver:       req.FormValue("receiver"),
+		Amount:         req.FormValue("amount"),
+		Currency:       req.FormValue("currency"),
+		DestinationTag: req.FormValue("destinationTag"),
+		SourceTag:      req.FormValue("sourceTag"),
+		Memo:           req.FormValue("memo"),
+		InvoiceID:      req.FormValue("invoiceID"),
+		Interval:       req.FormValue("interval"),
+	}
+	if sched.Interval == "" {
+		sched.Interval = intervalOnce
+	}
+
+	logger.Infof("createSchedule: %+v startAt=%v endAt=%v", sched, req.FormValue("startAt"), req.FormValue("endAt"))
+
+	startAt, err1 := parseScheduleTime(req.FormValue("startAt"))
+	endAt, err2 := parseScheduleTime(req.FormValue("endAt"))
+	_, recurs := nextOccurrence(sched.Interval, time.Unix(startAt, 0), 1)
+
+	errs := validation.Send(blueCurrencies.currencies(), sched.Sender, sched.Receiver, sched.Amount, sched.Currency)
+	if !checkParams(rw, req, validationError(errs)) {
+		return
+	}
+	if (startAt == 0) || (err1 != nil) || (err2 != nil) || (!recurs && sched.Interval != intervalOnce) {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(BlueResponse{Status: "params error"})
+		logger.Error("Error: params error.")
+
+		return
+	}
+
+	if !requestClient(rw, s.principal.EnrollID) {
+		return
+	}
+	if e := s.checkAccount(sched.Sender); e != nil {
+		writeError(rw, req, e)
+		logger.Errorf("Error: createSchedule: %s", e.Message)
+
+		return
+	}
+
+	res, err := appDB.Exec(`INSERT INTO schedules (sender, receiver, amount, currency, destination_tag, source_tag, memo, invoice_id,
+			interval, start_at, end_at, next_run, created_at, enroll_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		sched.Sender, sched.Receiver, sched.Amount, sched.Currency, sched.DestinationTag, sched.SourceTag, sched.Memo, sched.InvoiceID,
+		sched.Interval, startAt, endAt, startAt, time.Now().Unix(), s.principal.EnrollID)
+	if err != nil {
+		writeStoreError(rw, "createSchedule", err)
+		return
+	}
+	id, _ := res.LastInsertId()
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(BlueResponse{Status: "success", ID: strconv.FormatInt(id, 10)})
+	logger.Infof("createSchedule successful: %d\n", id)
+}
+
+// Schedules list the schedules, optionally of a sender
+func (s *BlueAPP) Schedules(rw web.ResponseWriter, req *web.Request) {
+	sender := req.FormValue("sender")
+
+	// only the schedules sending from the caller's accounts are listed
+	owned, args := ownedAccountsFilter(s.principal, "sender")
+	rows, err := appDB.Query(`SELECT `+scheduleColumns+` FROM schedules WHERE (? = '' OR sender = ?) AND `+owned+` ORDER BY id`,
+		append([]interface{}{sender, sender}, args...)...)
+	if err != nil {
+		writeStoreError(rw, "schedules", err)
+		return
+	}
+	defer rows.Close()
+
+	schedules := []*Schedule{}
+	for rows.Next() {
+		sched, err := scanSchedule(rows)
+		if err != nil {
+			writeStoreError(rw, "schedules", err)
+			return
+		}
+		schedules = append(schedules, sched)
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(schedules)
+}
+
+// Schedule get a schedule with its runs
+func (s *BlueAPP) Schedule(rw web.ResponseWriter, req *web.Request) {
+	id, err := strconv.ParseInt(req.PathParams["id"], 10, 64)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(rw).Encode(BlueResponse{Status: "params error"})
+		return
+	}
+
+	sched := s.ownSchedule(rw, req, "schedule", id)
+	if sched == nil {
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(sched)
+}
+
+// UpdateSchedule change the amount, memo, end or enabled state of a
+// schedule. A re-enabled schedule resumes at its first occurrence from now.
+func (s *BlueAPP) UpdateSchedule(rw web.ResponseWriter, req *web.Request) {
+	encoder := json.NewEncoder(rw)
+
+	id, err := strconv.ParseInt(req.PathParams["id"], 10, 64)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(BlueResponse{Status: "params error"})
+		return
+	}
+
+	sched := s.ownSchedule(rw, req, "updateSchedule", id)
+	if sched == nil {
+		return
+	}
+	wasEnabled := sched.Enabled
+
+	logger.Infof("updateSchedule: id=%v amount=%v memo=%v endAt=%v enabled=%v",
+		id, req.FormValue("amount"), req.FormValue("memo"), req.FormValue("endAt"), req.FormValue("enabled"))
+
+	if amount := req.FormValue("amount"); amount != "" {
+		errs := validation.Send(blueCurrencies.currencies(), sched.Sender, sched.Receiver, amount, sched.Currency)
+		if !checkParams(rw, req, validationError(errs)) {
+			return
+		}
+		sched.Amount = amount
+	}
+	if memo := req.FormValue("memo"); memo != "" {
+		sched.Memo = memo
+	}
+	if endAt := req.FormValue("endAt"); endAt != "" {
+		sched.EndAt = endAt
+	}
+	if enabled := req.FormValue("enabled"); enabled != "" {
+		sched.Enabled, err = strconv.ParseBool(enabled)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			encoder.Encode(BlueResponse{Status: "params error"})
+			return
+		}
+	}
+	endAt, err := parseScheduleTime(sched.EndAt)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(BlueResponse{Status: "params error"})
+		return
+	}
+
+	var (
+		interval         string
+		startAt, nextRun int64
+		occurrence       int
+	)
+	err = appDB.QueryRow(`SELECT interval, start_at, occurrence, next_run FROM schedules WHERE id = ?`, id).
+		Scan(&interval, &startAt, &occurrence, &nextRun)
+	if err != nil {
+		writeStoreError(rw, "updateSchedule", err)
+		return
+	}
+
+	// a re-enabled schedule resumes from now instead of firing the runs it
+	// missed, and a schedule stays disabled past its end
+	enabled, resumed := sched.Enabled, sched.Enabled && !wasEnabled
+	if resumed {
+		var next time.Time
+		occurrence, next, enabled = resumeOccurrence(interval, time.Unix(startAt, 0), occurrence, time.Now())
+		nextRun = next.Unix()
+	}
+	if enabled && endAt != 0 && nextRun > endAt {
+		enabled = false
+	}
+	if resumed && !enabled {
+		rw.WriteHeader(http.StatusConflict)
+		encoder.Encode(BlueResponse{Status: "schedule has ended"})
+		return
+	}
+
+	_, err = appDB.Exec(`UPDATE schedules SET amount = ?, memo = ?, end_at = ?, enabled = ?, occurrence = ?, next_run = ? WHERE id = ?`,
+		sched.Amount, sched.Memo, endAt, enabled, occurrence, nextRun, id)
+	if err != nil {
+		writeStoreError(rw, "updateSchedule", err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(BlueResponse{Status: "success"})
+}
+
+// DeleteSchedule delete a schedule and its run history
+func (s *BlueAPP) DeleteSchedule(rw web.ResponseWriter, req *web.Request) {
+	encoder := json.NewEncoder(rw)
+
+	id, err := strconv.ParseInt(req.PathParams["id"], 10, 64)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(BlueResponse{Status: "params error"})
+		return
+	}
+
+	logger.Infof("deleteSchedule: id=%v", id)
+
+	if s.ownSchedule(rw, req, "deleteSchedule", id) == nil {
+		return
+	}
+	if _, err := appDB.Exec(`DELETE FROM schedule_runs WHERE schedule_id = ?`, id); err != nil {
+		writeStoreError(rw, "deleteSchedule", err)
+		return
+	}
+	if _, err := appDB.Exec(`DELETE FROM schedules WHERE id = ?`, id); err != nil {
+		writeStoreError(rw, "deleteSchedule", err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(BlueResponse{Status: "success"})
+}
+
+// ownSchedule returns the schedule id when the request's principal owns its
+// sender. On failure it writes the error response and returns nil.
+func (s *BlueAPP) ownSchedule(rw web.ResponseWriter, req *web.Request, op string, id int64) *Schedule {
+	sched, err := getSchedule(id)
+	if err != nil {
+		writeStoreError(rw, op, err)
+		return nil
+	}
+	if e := s.checkAccount(sched.Sender); e != nil {
+		writeError(rw, req, e)
+		logger.Errorf("Error: %s: %s", op, e.Message)
+
+		return nil
+	}
+
+	return sched
+}
+
+// writeStoreError writes the response of a failed store operation
+func writeStoreError(rw web.ResponseWriter, op string, err error) {
+	status := http.StatusInternalServerError
+	if err == sql.ErrNoRows {
+		status = http.StatusNotFound
+	}
+
+	errstr := fmt.Sprintf("%s error: %v", op, err)
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(BlueResponse{Status: errstr})
+	logger.Error(errstr)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	pb "github.com/hyperledger/fabric/protos"
+	"github.com/spf13/viper"
+)
+
+func TestResumeOccurrence(t *testing.T) {
+	loc := blueLocation()
+	start := time.Date(2026, 1, 1, 9, 0, 0, 0, loc)
+	now := time.Date(2026, 1, 10, 12, 0, 0, 0, loc)
+
+	tests := []struct {
+		name       string
+		interval   string
+		occurrence int
+		want       time.Time
+		wantN      int
+		ok         bool
+	}{
+		{"daily skips missed runs", intervalDaily, 2, time.Date(2026, 1, 11, 9, 0, 0, 0, loc), 10, true},
+		{"weekly skips missed runs", intervalWeekly, 1, time.Date(2026, 1, 15, 9, 0, 0, 0, loc), 2, true},
+		{"monthly keeps a future run", intervalMonthly, 1, time.Date(2026, 2, 1, 9, 0, 0, 0, loc), 1, true},
+		{"pending one-off runs now", intervalOnce, 0, now, 0, true},
+		{"one-off that ran is over", intervalOnce, 1, start, 1, false},
+	}
+	for _, tt := range tests {
+		n, next, ok := resumeOccurrence(tt.interval, start, tt.occurrence, now)
+		if ok != tt.ok || n != tt.wantN || !next.Equal(tt.want) {
+			t.Errorf("%s: got %d %v %v, want %d %v %v", tt.name, n, next, ok, tt.wantN, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestNextOccurrenceMonthly(t *testing.T) {
+	loc := blueLocation()
+
+	tests := []struct {
+		name  string
+		start time.Time
+		n     int
+		want  time.Time
+	}{
+		{"same day next month", time.Date(2026, 1, 15, 9, 0, 0, 0, loc), 1, time.Date(2026, 2, 15, 9, 0, 0, 0, loc)},
+		{"clamped to february", time.Date(2026, 1, 31, 9, 0, 0, 0, loc), 1, time.Date(2026, 2, 28, 9, 0, 0, 0, loc)},
+		{"clamped to a leap february", time.Date(2028, 1, 31, 9, 0, 0, 0, loc), 1, time.Date(2028, 2, 29, 9, 0, 0, 0, loc)},
+		{"back to the 31st after a short month", time.Date(2026, 1, 31, 9, 0, 0, 0, loc), 2, time.Date(2026, 3, 31, 9, 0, 0, 0, loc)},
+		{"clamped to a 30-day month", time.Date(2026, 1, 31, 9, 0, 0, 0, loc), 3, time.Date(2026, 4, 30, 9, 0, 0, 0, loc)},
+		{"rolls over the year", time.Date(2026, 11, 30, 9, 0, 0, 0, loc), 3, time.Date(2027, 2, 28, 9, 0, 0, 0, loc)},
+		{"december to january", time.Date(2026, 12, 31, 9, 0, 0, 0, loc), 1, time.Date(2027, 1, 31, 9, 0, 0, 0, loc)},
+	}
+	for _, tt := range tests {
+		next, ok := nextOccurrence(intervalMonthly, tt.start, tt.n)
+		if !ok || !next.Equal(tt.want) {
+			t.Errorf("%s: got %v %v, want %v", tt.name, next, ok, tt.want)
+		}
+	}
+}
+
+func TestScheduleRunTxID(t *testing.T) {
+	if scheduleRunTxID(1, 100, 200) != scheduleRunTxID(1, 100, 200) {
+		t.Fatal("attempts of a run have different transaction IDs")
+	}
+	if scheduleRunTxID(1, 100, 200) == scheduleRunTxID(2, 100, 200) {
+		t.Fatal("identical schedules share a transaction ID")
+	}
+	if scheduleRunTxID(1, 100, 200) == scheduleRunTxID(1, 100, 300) {
+		t.Fatal("runs of a schedule share a transaction ID")
+	}
+}
+
+func TestSettleRejectedRuns(t *testing.T) {
+	openTestStore(t, func() error { return execSchema(txStatusSchema) }, func() error { return execSchema(schedulerSchema) })
+
+	viper.Set("app.scheduler.maxAttempts", 2)
+	viper.Set("app.scheduler.retryDelay", time.Minute)
+	defer viper.Set("app.scheduler.maxAttempts", 0)
+	defer viper.Set("app.scheduler.retryDelay", 0)
+
+	// three submitted runs, on their first, last and first attempt
+	now := time.Now()
+	send := &pb.ChaincodeInput{Args: [][]byte{[]byte("send")}}
+	for i, run := range []struct {
+		txid     string
+		attempts int
+	}{{"tx-1", 1}, {"tx-2", 2}, {"tx-3", 1}} {
+		_, err := appDB.Exec(`INSERT INTO schedule_runs (schedule_id, due_at, status, attempts, next_attempt, txid, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`, i+1, now.Unix(), runSubmitted, run.attempts, now.Unix(), run.txid, now.Unix())
+		if err != nil {
+			t.Fatal(err)
+		}
+		trackTx(run.txid, send)
+	}
+
+	// the chaincode rejects the first two, the third is committed
+	for _, txid := range []string{"tx-1", "tx-2"} {
+		handleTxEvent(&pb.Event{Event: &pb.Event_Rejection{Rejection: &pb.Rejection{
+			Tx: &pb.Transaction{Txid: txid}, ErrorMsg: "Insufficient balance"}}})
+	}
+	handleTxEvent(&pb.Event{Event: &pb.Event_Block{Block: &pb.Block{Transactions: []*pb.Transaction{{Txid: "tx-3"}}}}})
+
+	if err := settleRejectedRuns(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		scheduleID int
+		status     string
+		errMsg     string
+	}{
+		{1, runPending, "rejected: Insufficient balance"},
+		{2, runFailed, "rejected: Insufficient balance"},
+		{3, runSubmitted, ""},
+	}
+	for _, tt := range tests {
+		var status, errMsg string
+		var nextAttempt int64
+		err := appDB.QueryRow(`SELECT status, error, next_attempt FROM schedule_runs WHERE schedule_id = ?`, tt.scheduleID).
+			Scan(&status, &errMsg, &nextAttempt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != tt.status || errMsg != tt.errMsg {
+			t.Errorf("run %d: status %s, error %q, want %s, %q", tt.scheduleID, status, errMsg, tt.status, tt.errMsg)
+		}
+		if status == runPending && nextAttempt < now.Add(time.Minute).Unix() {
+			t.Errorf("run %d retried in %ds, want after the retry delay", tt.scheduleID, nextAttempt-now.Unix())
+		}
+	}
+
+	// the retry submits the same transaction, pending again
+	trackTx("tx-1", send)
+	if status, err := getTxStatus("tx-1"); err != nil || status.Status != txPending {
+		t.Fatalf("resubmitted transaction: %+v, %v", status, err)
+	}
+}
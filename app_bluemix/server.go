@@ -4,13 +4,13 @@ import (
 	"fmt"
 	"os"
 	"runtime"
-
-	"google.golang.org/grpc"
+	"strings"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
 	core "github.com/hyperledger/fabric/core"
+	"github.com/hyperledger/fabric/core/config"
 	"github.com/hyperledger/fabric/core/crypto"
 	"github.com/hyperledger/fabric/core/crypto/primitives"
 	"github.com/hyperledger/fabric/flogging"
@@ -18,9 +18,6 @@ import (
 	logging "github.com/op/go-logging"
 )
 
-// retry count for connecting to peers
-const retryCount = 3
-
 var (
 	// Security
 	confidentialityOn    bool
@@ -29,14 +26,9 @@ var (
 	// deploy
 	deployerClient crypto.Client
 
-	// peer related objects
-	peerClientConn *grpc.ClientConn
-	serverClient   pb.PeerClient
-
 	// Chaincode
-	stopPidFile   string
-	versionFlag   bool
-	chaincodeName string
+	stopPidFile string
+	versionFlag bool
 
 	// Logging
 	logger = logging.MustGetLogger("blue.app")
@@ -68,6 +60,14 @@ func main() {
 	)
 	logging.SetFormatter(formatter)
 
+	// Load the configuration. A 'core.yaml' file is assumed to be available
+	// in the working directory, the tx and query commands run without it. The
+	// commands talking to the fabric network connect to the peers themselves,
+	// so that version or openapi need none.
+	if err := loadConfig(); err != nil {
+		logger.Warningf("No configuration loaded: %v", err)
+	}
+
 	// Init the crypto layer
 	primitives.SetSecurityLevel("SHA3", 256)
 	if err := crypto.Init(); err != nil {
@@ -76,28 +76,19 @@ func main() {
 	// Enable fabric 'confidentiality'
 	confidentiality(viper.GetBool("security.privacy"))
 
-	// Initialize a peer connect to submit
-	// transactions to the fabric network.
-	// A 'core.yaml' file is assumed to be available in the working directory.
-	if err := initPeerClient(); err != nil {
-		logger.Debugf("Failed initiliazing PeerClient [%s]", err)
-		os.Exit(-1)
-	}
-
-	// Deploy the chaincode
-	err := deployChaincode("")
-	if err != nil {
-		logger.Errorf("Deploy chaincode error: %v", err)
-
-		os.Exit(-1)
-	}
-
 	// Define command-line flags that are valid for all peer commands and
 	// subcommands.
 	mainFlags := mainCmd.PersistentFlags()
 	mainFlags.BoolVarP(&versionFlag, "version", "v", false, "Display current version of fabric peer server")
+	mainFlags.StringVar(&chaincodeNameFlag, "chaincode-name", "", "Use the chaincode deployed with this name")
 	mainCmd.AddCommand(VersionCmd())
+	mainCmd.AddCommand(DeployCmd())
 	mainCmd.AddCommand(AppCmd())
+	mainCmd.AddCommand(OpenAPICmd())
+	mainCmd.AddCommand(ReconcileCmd())
+	mainCmd.AddCommand(UpgradeCmd())
+	mainCmd.AddCommand(TxCmd())
+	mainCmd.AddCommand(QueryCmd())
 
 	runtime.GOMAXPROCS(viper.GetInt("core.gomaxprocs"))
 
@@ -109,6 +100,23 @@ func main() {
 	logger.Info("Exiting.....")
 }
 
+// loadConfig reads core.yaml from the working directory, settings can be
+// overridden by HYPERLEDGER_ environment variables
+func loadConfig() error {
+	viper.SetEnvPrefix("HYPERLEDGER")
+	viper.AutomaticEnv()
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	viper.SetConfigName("core")
+	viper.AddConfigPath(".")
+	if err := viper.ReadInConfig(); err != nil {
+		return err
+	}
+
+	config.SetupTestLogging()
+
+	return nil
+}
+
 // getAppCommandFromCobraCommand retreives the peer command from the cobra command struct.
 // i.e. for a command of `peer node start`, this should return "node"
 // For the main/root command this will return the root name (i.e. peer)
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocraft/web"
+)
+
+// statement formats
+const (
+	statementJSON  = "json"
+	statementCSV   = "csv"
+	statementJSONL = "jsonl"
+)
+
+// statementColumns are the CSV header of an exported statement
+var statementColumns = []string{"id", "txid", "kind", "counterparty", "currency", "debit", "credit", "balance",
+	"destinationTag", "sourceTag", "memo", "invoiceID", "committedAt"}
+
+// StatementEntry defines a debit or a credit of an account with the balance
+// of its currency after it.
+type StatementEntry struct {
+	ID             int64  `json:"id"`
+	TxID           string `json:"txid"`
+	Kind           string `json:"kind"`
+	Counterparty   string `json:"counterparty"`
+	Currency       string `json:"currency"`
+	Debit          string `json:"debit,omitempty"`
+	Credit         string `json:"credit,omitempty"`
+	Balance        string `json:"balance"`
+	DestinationTag string `json:"destinationTag,omitempty"`
+	SourceTag      string `json:"sourceTag,omitempty"`
+	Memo           string `json:"memo,omitempty"`
+	InvoiceID      string `json:"invoiceID,omitempty"`
+	CommittedAt    string `json:"committedAt"`
+}
+
+// Statement is a page of the entries of an account. NextCursor fetches the
+// following page, it is empty on the last one.
+type Statement struct {
+	Account    string            `json:"account"`
+	Currency   string            `json:"currency,omitempty"`
+	From       string            `json:"from,omitempty"`
+	To         string            `json:"to,omitempty"`
+	Entries    []*StatementEntry `json:"entries"`
+	NextCursor string            `json:"nextCursor,omitempty"`
+}
+
+// statementQuery selects the entries of a statement.
+type statementQuery struct {
+	account  string
+	currency string
+	// from is inclusive and to exclusive, to is 0 for no bound
+	from int64
+	to   int64
+	// after is the ID of the last entry seen
+	after int64
+}
+
+// records returns the CSV fields of e in statementColumns order
+func (e *StatementEntry) records() []string {
+	return []string{strconv.FormatInt(e.ID, 10), e.TxID, e.Kind, e.Counterparty, e.Currency, e.Debit, e.Credit, e.Balance,
+		e.DestinationTag, e.SourceTag, e.Memo, e.InvoiceID, e.CommittedAt}
+}
+
+// encodeCursor returns the opaque cursor following entry id. Entry IDs are
+// assigned in commit order and never reused, so pages stay stable while new
+// entries are indexed.
+func encodeCursor(id int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(id, 10)))
+}
+
+func decodeCursor(cursor string) (int64, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(string(b), 10, 64)
+}
+
+// statementEntries returns at most limit entries of q
+func statementEntries(q *statementQuery, limit int) ([]*StatementEntry, error) {
+	// the counterparty of a fill entry is the other side of the fill
+	rows, err := appDB.Query(`SELECT e.id, COALESCE(p.txid, f.txid), COALESCE(p.kind, ?),
+			COALESCE(p.sender, CASE WHEN e.account = f.sender THEN f.maker ELSE f.sender END),
+			COALESCE(p.receiver, CASE WHEN e.account = f.sender THEN f.maker ELSE f.sender END),
+			e.currency, e.amount, e.balance, COALESCE(p.destination_tag, ''), COALESCE(p.source_tag, ''),
+			COALESCE(p.memo, ''), COALESCE(p.invoice_id, ''), e.committed_at
+		FROM index_entries e LEFT JOIN index_payments p ON p.id = e.payment_id LEFT JOIN index_fills f ON f.id = e.fill_id
+		WHERE e.account = ? AND (? = '' OR e.currency = ?) AND e.committed_at >= ? AND (? = 0 OR e.committed_at < ?)
+			AND e.id > ?
+		ORDER BY e.id LIMIT ?`,
+		entryFill, q.account, q.currency, q.currency, q.from, q.to, q.to, q.after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*StatementEntry{}
+	for rows.Next() {
+		e := &StatementEntry{}
+		var sender, receiver, amount string
+		var committedAt int64
+		if err := rows.Scan(&e.ID, &e.TxID, &e.Kind, &sender, &receiver, &e.Currency, &amount, &e.Balance,
+			&e.DestinationTag, &e.SourceTag, &e.Memo, &e.InvoiceID, &committedAt); err != nil {
+			return nil, err
+		}
+
+		if strings.HasPrefix(amount, "-") {
+			e.Debit, e.Counterparty = strings.TrimPrefix(amount, "-"), receiver
+		} else {
+			e.Credit, e.Counterparty = amount, sender
+		}
+		e.CommittedAt = formatUnix(committedAt)
+
+		entries = append(entries, e)
+	}
+
+	return entries, rows.Err()
+}
+
+// parseStatementTime parses an optional RFC3339 bound
+func parseStatementTime(fields map[string]string, name string, value string) int64 {
+	if value == "" {
+		return 0
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		fields[name] = "expecting an RFC3339 time"
+		return 0
+	}
+
+	return t.Unix()
+}
+
+// AccountStatement list the debits and credits of an account with the
+// running balance, oldest first. The indexed entries are paginated by cursor
+// as JSON, or exported whole from the cursor as CSV or JSON Lines.
+func (s *BlueAPP) AccountStatement(rw web.ResponseWriter, req *web.Request) {
+	q := &statementQuery{
+		account:  req.PathParams["account"],
+		currency: req.FormValue("currency"),
+	}
+	format := req.FormValue("format")
+	if format == "" {
+		format = statementJSON
+	}
+
+	logger.Infof("statement: account=%v currency=%v from=%v to=%v cursor=%v format=%v",
+		q.account, q.currency, req.FormValue("from"), req.FormValue("to"), req.FormValue("cursor"), format)
+
+	fields := make(map[string]string)
+	q.from = parseStatementTime(fields, "from", req.FormValue("from"))
+	q.to = parseStatementTime(fields, "to", req.FormValue("to"))
+	after, err := decodeCursor(req.FormValue("cursor"))
+	if err != nil {
+		fields["cursor"] = "invalid cursor"
+	}
+	q.after = after
+	limit, err := indexLimit(req.FormValue("limit"))
+	if err != nil {
+		fields["limit"] = "expecting a positive integer"
+	}
+	if format != statementJSON && format != statementCSV && format != statementJSONL {
+		fields["format"] = "expecting json, csv or jsonl"
+	}
+	if len(fields) > 0 {
+		writeError(rw, req, paramsError(fields))
+		logger.Errorf("Error: statement params error %v", fields)
+
+		return
+	}
+	if e := s.checkAccount(q.account); e != nil {
+		writeError(rw, req, e)
+		logger.Errorf("Error: statement: %s", e.Message)
+
+		return
+	}
+
+	if format != statementJSON {
+		exportStatement(rw, q, format)
+		return
+	}
+
+	// one more entry tells whether there is a next page
+	entries, err := statementEntries(q, limit+1)
+	if err != nil {
+		writeStoreError(rw, "statement", err)
+		return
+	}
+
+	statement := &Statement{
+		Account:  q.account,
+		Currency: q.currency,
+		From:     req.FormValue("from"),
+		To:       req.FormValue("to"),
+		Entries:  entries,
+	}
+	if len(entries) > limit {
+		statement.Entries = entries[:limit]
+		statement.NextCursor = encodeCursor(entries[limit-1].ID)
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(statement)
+}
+
+// exportStatement streams every entry of q as CSV or JSON Lines
+func exportStatement(rw web.ResponseWriter, q *statementQuery, format string) {
+	contentType := "text/csv"
+	if format == statementJSONL {
+		contentType = "application/x-ndjson"
+	}
+	rw.Header().Set("Content-Type", contentType)
+	rw.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="statement-%s.%s"`, q.account, format))
+
+	// the first batch is read before the status is written, so a store error
+	// still gets an error response
+	entries, err := statementEntries(q, maxIndexLimit)
+	if err != nil {
+		rw.Header().Set("Content-Type", "application/json")
+		writeStoreError(rw, "statement", err)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+
+	csvWriter := csv.NewWriter(rw)
+	encoder := json.NewEncoder(rw)
+	if format == statementCSV {
+		csvWriter.Write(statementColumns)
+	}
+
+	for len(entries) > 0 {
+		for _, e := range entries {
+			if format == statementCSV {
+				err = csvWriter.Write(e.records())
+			} else {
+				err = encoder.Encode(e)
+			}
+			if err != nil {
+				logger.Errorf("statement: export error: %v", err)
+				return
+			}
+		}
+		csvWriter.Flush()
+		rw.Flush()
+
+		q.after = entries[len(entries)-1].ID
+		entries, err = statementEntries(q, maxIndexLimit)
+		if err != nil {
+			// the response is already partly written, the client sees a
+			// truncated export
+			logger.Errorf("statement: export error: %v", err)
+			return
+		}
+	}
+}
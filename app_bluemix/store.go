@@ -0,0 +1,76 @@
+package main
+
+import (
+	"database/sql"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/spf13/viper"
+)
+
+// appDB is the app's local SQLite store
+var appDB *sql.DB
+
+// initStore opens the SQLite store configured by app.db.path
+func initStore() error {
+	path := viper.GetString("app.db.path")
+	if path == "" {
+		path = "blue.db"
+	}
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	// SQLite serializes writers, a single connection avoids "database is locked"
+	db.SetMaxOpenConns(1)
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return err
+	}
+
+	logger.Infof("Opened store %s", path)
+	appDB = db
+
+	return nil
+}
+
+// execSchema executes the schema statements of a subsystem
+func execSchema(statements []string) error {
+	for _, stmt := range statements {
+		if _, err := appDB.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addColumn adds a column to a table created by an earlier version of the app
+func addColumn(table, column, definition string) error {
+	rows, err := appDB.Query(`PRAGMA table_info(` + table + `)`)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, ctype      string
+			dflt             sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &ctype, &notNull, &dflt, &pk); err != nil {
+			rows.Close()
+			return err
+		}
+		found = found || name == column
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || found {
+		return err
+	}
+
+	_, err = appDB.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + definition)
+	return err
+}
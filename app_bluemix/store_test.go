@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// openTestStore replaces the store with an empty in-memory one and creates
+// the tables of starts
+func openTestStore(t *testing.T, starts ...func() error) {
+	if appDB != nil {
+		appDB.Close()
+	}
+
+	viper.Set("app.db.path", ":memory:")
+	if err := initStore(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, start := range starts {
+		if err := start(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gocraft/web"
+	pb "github.com/hyperledger/fabric/protos"
+)
+
+// stream topics
+const (
+	topicPayments  = "payments"
+	topicOrderBook = "orderbook"
+	topicTrades    = "trades"
+)
+
+// stream settings
+const (
+	// streamRetention is the number of recorded events kept for resuming
+	streamRetention = 10000
+	// streamHeartbeat is the interval of keep-alive comments
+	streamHeartbeat = 15 * time.Second
+	streamBuffer    = 256
+)
+
+var streamSchema = []string{
+	`CREATE TABLE IF NOT EXISTS stream_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		topic TEXT NOT NULL,
+		name TEXT NOT NULL,
+		txid TEXT NOT NULL,
+		sender TEXT NOT NULL DEFAULT '',
+		receiver TEXT NOT NULL DEFAULT '',
+		pair TEXT NOT NULL DEFAULT '',
+		payload TEXT NOT NULL,
+		created_at INTEGER NOT NULL
+	)`,
+}
+
+// StreamEvent defines an event pushed to stream clients.
+type StreamEvent struct {
+	ID       int64           `json:"id"`
+	Topic    string          `json:"topic"`
+	Name     string          `json:"name"`
+	TxID     string          `json:"txid"`
+	Sender   string          `json:"sender,omitempty"`
+	Receiver string          `json:"receiver,omitempty"`
+	Pair     string          `json:"pair,omitempty"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+// streamFilter selects the events of a stream subscription.
+type streamFilter struct {
+	topic   string
+	account string
+	pair    string
+}
+
+func (f *streamFilter) match(e *StreamEvent) bool {
+	if e.Topic != f.topic {
+		return false
+	}
+	if f.account != "" && e.Sender != f.account && e.Receiver != f.account {
+		return false
+	}
+	if f.pair != "" && e.Pair != f.pair {
+		return false
+	}
+
+	return true
+}
+
+// streamHub fans recorded events out to the connected stream clients.
+type streamHub struct {
+	mu      sync.Mutex
+	clients map[chan *StreamEvent]struct{}
+}
+
+var blueStream = &streamHub{clients: make(map[chan *StreamEvent]struct{})}
+
+func (h *streamHub) subscribe() chan *StreamEvent {
+	ch := make(chan *StreamEvent, streamBuffer)
+
+	h.mu.Lock()
+	h.clients[ch] = struct{}{}
+	h.mu.Unlock()
+
+	return ch
+}
+
+func (h *streamHub) unsubscribe(ch chan *StreamEvent) {
+	h.mu.Lock()
+	delete(h.clients, ch)
+	h.mu.Unlock()
+}
+
+// publish sends e to every client, a client whose buffer is full is
+// disconnected and resumes from its last event ID
+func (h *streamHub) publish(e *StreamEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.clients {
+		select {
+		case ch <- e:
+		default:
+			delete(h.clients, ch)
+			close(ch)
+		}
+	}
+}
+
+// startStream creates the stream table and records the blue chaincode events
+func startStream() error {
+	if err := execSchema(streamSchema); err != nil {
+		return err
+	}
+
+	events, _ := blueEvents.Subscribe(streamBuffer, func(event *pb.Event) bool {
+		_, ok := event.Event.(*pb.Event_ChaincodeEvent)
+		return ok
+	})
+	go func() {
+		for event := range events {
+			for _, e := range toStreamEvents(event.GetChaincodeEvent()) {
+				if err := recordStreamEvent(e); err != nil {
+					logger.Errorf("stream: record %s error: %v", e.Name, err)
+					continue
+				}
+				blueStream.publish(e)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// streamSend is the part of a chaincode event payload describing a payment.
+type streamSend struct {
+	Sender   string `json:"sender"`
+	Receiver string `json:"receiver"`
+}
+
+// streamOffer is the part of a chaincode event payload describing an offer.
+type streamOffer struct {
+	ID        string `json:"id"`
+	Sender    string `json:"sender"`
+	TakerGets string `json:"takerGets"`
+	TakerPays string `json:"takerPays"`
+}
+
+// streamFill is a fill of a resting offer by the offer of a blue.trade
+// event, the sender gave takerGets to the maker and received takerPays.
+type streamFill struct {
+	Offer     string `json:"offer"`
+	Sender    string `json:"sender"`
+	Maker     string `json:"maker"`
+	TakerGets string `json:"takerGets"`
+	TakerPays string `json:"takerPays"`
+}
+
+// streamTrade is the payload of a blue.trade event, an offer that filled
+// resting offers.
+type streamTrade struct {
+	streamOffer
+	Fills []*streamFill `json:"fills"`
+}
+
+// toStreamEvents maps a blue chaincode event to stream events, none for
+// events without a stream topic. A trade changes the books of both sides
+// and adds a trade per fill, between the sender and the maker.
+func toStreamEvents(ce *pb.ChaincodeEvent) []*StreamEvent {
+	e := &StreamEvent{Name: ce.EventName, TxID: ce.TxID, Payload: json.RawMessage(ce.Payload)}
+
+	switch ce.EventName {
+	case "blue.send":
+		send := &streamSend{}
+		json.Unmarshal(ce.Payload, send)
+		e.Topic, e.Sender, e.Receiver = topicPayments, send.Sender, send.Receiver
+	case "blue.invoicePaid", "blue.checkCash":
+		wrapper := &struct {
+			Send *streamSend `json:"send"`
+		}{Send: &streamSend{}}
+		json.Unmarshal(ce.Payload, wrapper)
+		e.Topic, e.Sender, e.Receiver = topicPayments, wrapper.Send.Sender, wrapper.Send.Receiver
+	case "blue.offer", "blue.offerCancel":
+		offer := &streamOffer{}
+		json.Unmarshal(ce.Payload, offer)
+		e.Topic, e.Sender, e.Pair = topicOrderBook, offer.Sender, offerPair(offer.TakerGets, offer.TakerPays)
+	case "blue.trade":
+		trade := &streamTrade{}
+		json.Unmarshal(ce.Payload, trade)
+		pair := offerPair(trade.TakerGets, trade.TakerPays)
+		events := []*StreamEvent{
+			{Topic: topicOrderBook, Name: ce.EventName, TxID: ce.TxID, Sender: trade.Sender, Pair: pair, Payload: e.Payload},
+			{Topic: topicOrderBook, Name: ce.EventName, TxID: ce.TxID, Sender: trade.Sender, Pair: offerPair(trade.TakerPays, trade.TakerGets), Payload: e.Payload},
+		}
+		for _, fill := range trade.Fills {
+			fill.Sender = trade.Sender
+			payload, _ := json.Marshal(fill)
+			events = append(events, &StreamEvent{Topic: topicTrades, Name: ce.EventName, TxID: ce.TxID,
+				Sender: fill.Sender, Receiver: fill.Maker, Pair: pair, Payload: json.RawMessage(payload)})
+		}
+		return events
+	default:
+		return nil
+	}
+
+	return []*StreamEvent{e}
+}
+
+// offerPair returns the book of an offer as <getsCurrency>/<paysCurrency>
+// from amounts formatted as <amount>/<currency>
+func offerPair(takerGets, takerPays string) string {
+	currency := func(amount string) string {
+		if i := strings.Index(amount, "/"); i >= 0 {
+			return amount[i+1:]
+		}
+		return ""
+	}
+
+	return currency(takerGets) + "/" + currency(takerPays)
+}
+
+// recordStreamEvent stores e, assigning its ID, and trims old events
+func recordStreamEvent(e *StreamEvent) error {
+	res, err := appDB.Exec(`INSERT INTO stream_events (topic, name, txid, sender, receiver, pair, payload, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.Topic, e.Name, e.TxID, e.Sender, e.Receiver, e.Pair, string(e.Payload), time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	e.ID, err = res.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	_, err = appDB.Exec(`DELETE FROM stream_events WHERE id <= ?`, e.ID-streamRetention)
+	return err
+}
+
+// streamEventsAfter returns the recorded events after id accepted by filter
+func streamEventsAfter(id int64, filter *streamFilter) ([]*StreamEvent, error) {
+	rows, err := appDB.Query(`SELECT id, topic, name, txid, sender, receiver, pair, payload FROM stream_events
+		WHERE id > ? AND topic = ? ORDER BY id`, id, filter.topic)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*StreamEvent
+	for rows.Next() {
+		e := &StreamEvent{}
+		var payload string
+		if err := rows.Scan(&e.ID, &e.Topic, &e.Name, &e.TxID, &e.Sender, &e.Receiver, &e.Pair, &payload); err != nil {
+			return nil, err
+		}
+		e.Payload = json.RawMessage(payload)
+		if filter.match(e) {
+			events = append(events, e)
+		}
+	}
+
+	return events, rows.Err()
+}
+
+// writeStreamEvent writes e as a server-sent event
+func writeStreamEvent(rw web.ResponseWriter, e *StreamEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(rw, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Name, data)
+	rw.Flush()
+
+	return err
+}
+
+// Stream pushes payments of an account, order-book changes of a pair or
+// trades as server-sent events. A client resumes after the Last-Event-ID
+// header or the lastEventId parameter. Only the owner of an account streams
+// its events.
+func (s *BlueAPP) Stream(rw web.ResponseWriter, req *web.Request) {
+	filter := &streamFilter{
+		topic:   req.FormValue("topic"),
+		account: req.FormValue("account"),
+		pair:    req.FormValue("pair"),
+	}
+
+	lastID := req.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = req.FormValue("lastEventId")
+	}
+
+	logger.Infof("stream: topic=%v account=%v pair=%v lastEventId=%v", filter.topic, filter.account, filter.pair, lastID)
+
+	var last int64
+	var err error
+	if lastID != "" {
+		last, err = strconv.ParseInt(lastID, 10, 64)
+	}
+	valid := err == nil &&
+		(filter.topic == topicPayments && filter.account != "" ||
+			filter.topic == topicOrderBook && filter.pair != "" ||
+			filter.topic == topicTrades)
+	if !valid {
+		rw.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(rw).Encode(BlueResponse{Status: "params error"})
+		logger.Error("Error: params error.")
+
+		return
+	}
+	if filter.account != "" {
+		if e := s.checkAccount(filter.account); e != nil {
+			writeError(rw, req, e)
+			logger.Errorf("Error: stream: %s", e.Message)
+
+			return
+		}
+	}
+
+	// subscribe before replaying so no event falls in between
+	live := blueStream.subscribe()
+	defer blueStream.unsubscribe(live)
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+	rw.Flush()
+
+	if lastID != "" {
+		missed, err := streamEventsAfter(last, filter)
+		if err != nil {
+			logger.Errorf("stream: replay error: %v", err)
+			return
+		}
+		for _, e := range missed {
+			if err := writeStreamEvent(rw, e); err != nil {
+				return
+			}
+			last = e.ID
+		}
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case e, ok := <-live:
+			if !ok {
+				// too slow, the client reconnects with its last event ID
+				return
+			}
+			if e.ID <= last || !filter.match(e) {
+				continue
+			}
+			if err := writeStreamEvent(rw, e); err != nil {
+				return
+			}
+			last = e.ID
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(rw, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			rw.Flush()
+		case <-s.ctx.Done():
+			// RequestContext holds the close notification
+			return
+		}
+	}
+}
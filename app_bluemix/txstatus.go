@@ -0,0 +1,172 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gocraft/web"
+	pb "github.com/hyperledger/fabric/protos"
+)
+
+// transaction status
+const (
+	txQueued    = "queued"
+	txPending   = "pending"
+	txCommitted = "committed"
+	txFailed    = "failed"
+)
+
+var txStatusSchema = []string{
+	`CREATE TABLE IF NOT EXISTS tx_status (
+		txid TEXT PRIMARY KEY,
+		function TEXT NOT NULL,
+		status TEXT NOT NULL,
+		error TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL
+	)`,
+}
+
+// TxStatus defines the status of a transaction submitted by the app.
+type TxStatus struct {
+	TxID      string `json:"txid"`
+	Function  string `json:"function"`
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+	Attempts  int    `json:"attempts,omitempty"`
+	CreatedAt string `json:"createdAt"`
+	UpdatedAt string `json:"updatedAt"`
+}
+
+// txEventBuffer is the event hub buffer of the transaction status tracker
+const txEventBuffer = 1024
+
+// startTxStatus creates the transaction status table and follows block and
+// rejection events from the event hub
+func startTxStatus() error {
+	if err := execSchema(txStatusSchema); err != nil {
+		return err
+	}
+
+	events, _ := blueEvents.Subscribe(txEventBuffer, isTxEvent)
+	go func() {
+		for event := range events {
+			handleTxEvent(event)
+		}
+	}()
+
+	return nil
+}
+
+// isTxEvent accepts the events settling a transaction
+func isTxEvent(event *pb.Event) bool {
+	switch event.Event.(type) {
+	case *pb.Event_Block, *pb.Event_Rejection:
+		return true
+	}
+
+	return false
+}
+
+// trackTx records a transaction about to be submitted as pending. A failed
+// transaction submitted again, as a scheduled run is retried, is pending
+// again.
+func trackTx(txid string, chaincodeInput *pb.ChaincodeInput) {
+	if appDB == nil {
+		return
+	}
+
+	function := ""
+	if len(chaincodeInput.Args) > 0 {
+		function = string(chaincodeInput.Args[0])
+	}
+
+	now := time.Now().Unix()
+	_, err := appDB.Exec(`UPDATE tx_status SET status = ?, error = '', updated_at = ? WHERE txid = ? AND status = ?`,
+		txPending, now, txid, txFailed)
+	if err == nil {
+		_, err = appDB.Exec(`INSERT OR IGNORE INTO tx_status (txid, function, status, created_at, updated_at) VALUES (?, ?, ?, ?, ?)`,
+			txid, function, txPending, now, now)
+	}
+	if err != nil {
+		logger.Errorf("trackTx %s error: %v", txid, err)
+	}
+}
+
+// untrackTx forgets a pending transaction the peer did not accept, its
+// status then comes from the outbox again
+func untrackTx(txid string) {
+	if appDB == nil {
+		return
+	}
+
+	_, err := appDB.Exec(`DELETE FROM tx_status WHERE txid = ? AND status = ?`, txid, txPending)
+	if err != nil {
+		logger.Errorf("untrackTx %s error: %v", txid, err)
+	}
+}
+
+// updateTxStatus moves a tracked transaction out of pending. A rejection is
+// final, so a later block carrying the same transaction does not override it.
+func updateTxStatus(txid string, status string, errMsg string) {
+	_, err := appDB.Exec(`UPDATE tx_status SET status = ?, error = ?, updated_at = ? WHERE txid = ? AND status = ?`,
+		status, errMsg, time.Now().Unix(), txid, txPending)
+	if err != nil {
+		logger.Errorf("updateTxStatus %s error: %v", txid, err)
+	}
+}
+
+// handleTxEvent updates the tracked transactions from block and rejection events
+func handleTxEvent(event *pb.Event) {
+	switch e := event.Event.(type) {
+	case *pb.Event_Block:
+		for _, tx := range e.Block.GetTransactions() {
+			updateTxStatus(tx.Txid, txCommitted, "")
+		}
+	case *pb.Event_Rejection:
+		if tx := e.Rejection.GetTx(); tx != nil {
+			updateTxStatus(tx.Txid, txFailed, e.Rejection.ErrorMsg)
+		}
+	}
+}
+
+// getTxStatus returns the status of a tracked transaction, or of an invoke
+// still in the outbox
+func getTxStatus(txid string) (*TxStatus, error) {
+	status := &TxStatus{TxID: txid}
+	var createdAt, updatedAt int64
+	err := appDB.QueryRow(`SELECT function, status, error, created_at, updated_at FROM tx_status WHERE txid = ?`, txid).
+		Scan(&status.Function, &status.Status, &status.Error, &createdAt, &updatedAt)
+	if err == sql.ErrNoRows {
+		return getOutboxStatus(txid)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	status.CreatedAt = formatUnix(createdAt)
+	status.UpdatedAt = formatUnix(updatedAt)
+
+	return status, nil
+}
+
+// TxStatus reports whether a transaction is pending, committed or failed
+func (s *BlueAPP) TxStatus(rw web.ResponseWriter, req *web.Request) {
+	txid := req.PathParams["id"]
+
+	status, err := getTxStatus(txid)
+	if err == sql.ErrNoRows {
+		rw.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(rw).Encode(BlueResponse{Status: "unknown transaction", TxID: txid})
+		return
+	}
+	if err != nil {
+		writeStoreError(rw, "txStatus", err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(status)
+}
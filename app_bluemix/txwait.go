@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/gocraft/web"
+	pb "github.com/hyperledger/fabric/protos"
+	"github.com/spf13/viper"
+)
+
+// synchronous commit mode
+const (
+	waitCommitted = "committed"
+
+	// txUnknown reports a transaction whose outcome was not seen in time
+	txUnknown = "unknown"
+
+	defaultWaitTimeout = 30 * time.Second
+	txWaitBuffer       = 256
+)
+
+// commitWaiter follows block and rejection events to settle one transaction.
+// It subscribes before the transaction is submitted, so the events of a fast
+// commit are not missed.
+type commitWaiter struct {
+	events <-chan *pb.Event
+	cancel func()
+}
+
+// waitOptions parses the wait and timeout parameters of a write request,
+// returning nil when the request does not ask to wait
+func waitOptions(req *web.Request) (*time.Duration, error) {
+	wait := req.FormValue("wait")
+	if wait == "" {
+		return nil, nil
+	}
+	if wait != waitCommitted {
+		return nil, fmt.Errorf("unsupported wait mode %s", wait)
+	}
+
+	timeout := defaultWaitTimeout
+	if value := req.FormValue("timeout"); value != "" {
+		var err error
+		timeout, err = time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid timeout %s", value)
+		}
+	}
+	if max := viper.GetDuration("app.tx.maxWait"); max > 0 && timeout > max {
+		timeout = max
+	}
+
+	return &timeout, nil
+}
+
+func newCommitWaiter() *commitWaiter {
+	events, cancel := blueEvents.Subscribe(txWaitBuffer, isTxEvent)
+	return &commitWaiter{events: events, cancel: cancel}
+}
+
+// wait returns committed, failed with the rejection message, or unknown when
+// neither was seen before timeout
+func (w *commitWaiter) wait(ctx context.Context, txid string, timeout time.Duration) (string, string) {
+	defer w.cancel()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case event := <-w.events:
+			switch e := event.Event.(type) {
+			case *pb.Event_Block:
+				for _, tx := range e.Block.GetTransactions() {
+					if tx.Txid == txid {
+						return txCommitted, ""
+					}
+				}
+			case *pb.Event_Rejection:
+				if tx := e.Rejection.GetTx(); tx != nil && tx.Txid == txid {
+					return txFailed, e.Rejection.ErrorMsg
+				}
+			}
+		case <-ctx.Done():
+			return txUnknown, ""
+		case <-timer.C:
+			// events dropped for a full buffer still reached the tracker
+			if status, err := getTxStatus(txid); err == nil && status.Status != txPending {
+				return status.Status, status.Error
+			}
+
+			return txUnknown, ""
+		}
+	}
+}
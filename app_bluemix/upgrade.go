@@ -0,0 +1,424 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/gocraft/web"
+	"github.com/hyperledger/fabric/core/util"
+	pb "github.com/hyperledger/fabric/protos"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var upgradeSchema = []string{
+	`CREATE TABLE IF NOT EXISTS upgrade_reports (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		ok INTEGER NOT NULL,
+		report TEXT NOT NULL,
+		created_at INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS upgraded_chaincodes (
+		name TEXT PRIMARY KEY,
+		upgraded_to TEXT NOT NULL,
+		upgraded_at INTEGER NOT NULL
+	)`,
+}
+
+// upgradeMu runs one upgrade at a time
+var upgradeMu sync.Mutex
+
+// UpgradeReport is the result of a chaincode upgrade. The old chaincode is
+// kept read-only, so its state can still be queried for audit.
+type UpgradeReport struct {
+	ID         int64            `json:"id,omitempty"`
+	OK         bool             `json:"ok"`
+	From       string           `json:"from"`
+	To         string           `json:"to,omitempty"`
+	Tables     []*TableChecksum `json:"tables"`
+	Error      string           `json:"error,omitempty"`
+	StartedAt  string           `json:"startedAt"`
+	FinishedAt string           `json:"finishedAt"`
+}
+
+// TableChecksum defines the row count and checksum of a chaincode table.
+type TableChecksum struct {
+	Table    string `json:"table"`
+	Rows     int    `json:"rows"`
+	Checksum string `json:"checksum"`
+}
+
+// stateChecksum is the result of queryStateChecksum.
+type stateChecksum struct {
+	Tables       []*TableChecksum `json:"tables"`
+	UpgradedTo   string           `json:"upgradedTo"`
+	ImportedFrom string           `json:"importedFrom"`
+}
+
+// --------------- upgrade ---------------
+
+// startUpgrade creates the upgrade tables and records the upgrades reported
+// before the upgraded chaincodes were kept
+func startUpgrade() error {
+	if err := execSchema(upgradeSchema); err != nil {
+		return err
+	}
+
+	rows, err := appDB.Query(`SELECT report FROM upgrade_reports WHERE ok = 1 ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	var reports []*UpgradeReport
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			rows.Close()
+			return err
+		}
+		report := &UpgradeReport{}
+		if err := json.Unmarshal([]byte(data), report); err != nil {
+			rows.Close()
+			return err
+		}
+		reports = append(reports, report)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, report := range reports {
+		if err := saveUpgradedChaincode(report.From, report.To); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// saveUpgradedChaincode records that the chaincode from was upgraded to the
+// chaincode to. The indexer keeps indexing the events of from, which a
+// rebuild reads from the blocks before the upgrade.
+func saveUpgradedChaincode(from, to string) error {
+	_, err := appDB.Exec(`INSERT OR IGNORE INTO upgraded_chaincodes (name, upgraded_to, upgraded_at) VALUES (?, ?, ?)`,
+		from, to, time.Now().Unix())
+	return err
+}
+
+// upgradedChaincodes returns the names of the chaincodes the app upgraded
+// from, with the chaincodes they were upgraded to
+func upgradedChaincodes() ([]string, error) {
+	rows, err := appDB.Query(`SELECT name, upgraded_to FROM upgraded_chaincodes`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var from, to string
+		if err := rows.Scan(&from, &to); err != nil {
+			return nil, err
+		}
+		names = append(names, from, to)
+	}
+
+	return names, rows.Err()
+}
+
+// upgradeChaincode deploys the chaincode of app.blue.chaincodePath and moves
+// the state of the current one to it:
+//
+// the current chaincode is made read-only, so its state stops moving, the new
+// one imports the state with importState, which fails unless the row counts
+// and checksums match, and they are compared again here. The index is brought
+// up to date with the events of the old chaincode, then the app switches to
+// the new one and saves its name.
+//
+// Invokes reaching the old chaincode while it is read-only are rejected. An
+// upgrade failing after the old chaincode was made read-only makes it
+// writable again. The report is saved either way.
+func upgradeChaincode() (*UpgradeReport, error) {
+	upgradeMu.Lock()
+	defer upgradeMu.Unlock()
+
+	report := &UpgradeReport{From: currentChaincode(), StartedAt: formatUnix(time.Now().Unix())}
+	err := upgrade(report)
+	if err != nil {
+		report.Error = err.Error()
+		logger.Errorf("upgrade of %s: %v", report.From, err)
+	}
+	report.OK = err == nil
+	report.FinishedAt = formatUnix(time.Now().Unix())
+
+	if err := saveUpgradeReport(report); err != nil {
+		logger.Errorf("upgrade report save error: %v", err)
+	}
+
+	return report, err
+}
+
+// upgrade runs the steps of upgradeChaincode, filling report
+func upgrade(report *UpgradeReport) error {
+	from := report.From
+
+	source, err := getStateChecksum(from)
+	if err != nil {
+		return err
+	}
+	if source.UpgradedTo != "" {
+		return fmt.Errorf("chaincode %s was already upgraded to %s", from, source.UpgradedTo)
+	}
+
+	to, err := deployChaincode()
+	if err != nil {
+		return err
+	}
+	if to == from {
+		return fmt.Errorf("chaincode %s is unchanged", from)
+	}
+	report.To = to
+	if err := pingChaincode(to); err != nil {
+		return err
+	}
+
+	// freeze the old chaincode
+	if err := invokeChaincodeAt(from, "upgradeTo", to); err != nil {
+		return err
+	}
+	source, err = waitStateChecksum(from, func(state *stateChecksum) bool { return state.UpgradedTo == to })
+	if err != nil {
+		return abortUpgrade(from, err)
+	}
+	report.Tables = source.Tables
+
+	// copy its state
+	if err := invokeChaincodeAt(to, "importState", from); err != nil {
+		return abortUpgrade(from, err)
+	}
+	imported, err := waitStateChecksum(to, func(state *stateChecksum) bool { return state.ImportedFrom == from })
+	if err != nil {
+		return abortUpgrade(from, err)
+	}
+	if err := compareChecksums(source, imported); err != nil {
+		return abortUpgrade(from, err)
+	}
+
+	// the old chaincode sets no more events, so the index is complete once
+	// it has caught up
+	if err := indexBlocks(); err != nil {
+		return abortUpgrade(from, err)
+	}
+
+	if err := saveUpgradedChaincode(from, to); err != nil {
+		return abortUpgrade(from, err)
+	}
+	setChaincode(to)
+	if err := saveChaincodeName(to); err != nil {
+		logger.Errorf("Error saving chaincode name %s: %v", to, err)
+	}
+
+	logger.Infof("Upgraded chaincode %s to %s", from, to)
+
+	return nil
+}
+
+// abortUpgrade makes the old chaincode writable again after a failed upgrade
+func abortUpgrade(from string, err error) error {
+	if e := invokeChaincodeAt(from, "upgradeTo", ""); e != nil {
+		logger.Errorf("upgrade: chaincode %s stays read-only: %v", from, e)
+	}
+
+	return err
+}
+
+// getStateChecksum returns the table checksums of the chaincode name
+func getStateChecksum(name string) (*stateChecksum, error) {
+	result, err := queryChaincodeAt(name, "queryStateChecksum")
+	if err != nil {
+		return nil, fmt.Errorf("queryStateChecksum of %s error: %v", name, err)
+	}
+
+	state := &stateChecksum{}
+	if err := json.Unmarshal(result, state); err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// waitStateChecksum queries the table checksums of the chaincode name until
+// done accepts them, or app.blue.upgradeTimeout passes
+func waitStateChecksum(name string, done func(*stateChecksum) bool) (*stateChecksum, error) {
+	timeout := viper.GetDuration("app.blue.upgradeTimeout")
+	if timeout <= 0 {
+		timeout = 5 * time.Minute
+	}
+	deadline := time.Now().Add(timeout)
+
+	for {
+		state, err := getStateChecksum(name)
+		if err == nil && done(state) {
+			return state, nil
+		}
+		if time.Now().After(deadline) {
+			if err == nil {
+				err = fmt.Errorf("the transaction was not committed within %v", timeout)
+			}
+			return nil, fmt.Errorf("chaincode %s: %v", name, err)
+		}
+
+		time.Sleep(pingInterval)
+	}
+}
+
+// compareChecksums returns an error naming the first table whose count or
+// checksum differs
+func compareChecksums(source *stateChecksum, imported *stateChecksum) error {
+	tables := map[string]*TableChecksum{}
+	for _, table := range imported.Tables {
+		tables[table.Table] = table
+	}
+
+	for _, want := range source.Tables {
+		got, ok := tables[want.Table]
+		if !ok || got.Rows != want.Rows || got.Checksum != want.Checksum {
+			return fmt.Errorf("table %s differs after the import", want.Table)
+		}
+	}
+
+	return nil
+}
+
+// invokeChaincodeAt submits an invoke of the chaincode name as the deployer
+func invokeChaincodeAt(name string, args ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), invokeTimeout())
+	defer cancel()
+
+	chaincodeInput := &pb.ChaincodeInput{Args: util.ToChaincodeArgs(args...)}
+	resp, err := invokeChaincodeOf(ctx, deployerClient, name, chaincodeInput, util.GenerateUUID())
+	if err != nil {
+		return fmt.Errorf("%s of %s error: %v", args[0], name, err)
+	}
+	if resp.Status != pb.Response_SUCCESS {
+		return fmt.Errorf("%s of %s error: %s", args[0], name, resp.Msg)
+	}
+
+	return nil
+}
+
+// saveUpgradeReport stores a report
+func saveUpgradeReport(report *UpgradeReport) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	_, err = appDB.Exec(`INSERT INTO upgrade_reports (ok, report, created_at) VALUES (?, ?, ?)`,
+		report.OK, string(data), time.Now().Unix())
+	return err
+}
+
+// --------------- handlers ---------------
+
+// Upgrade upgrade the chaincode and return the report
+func (s *BlueAPP) Upgrade(rw web.ResponseWriter, req *web.Request) {
+	logger.Infof("upgrade: chaincode %s", currentChaincode())
+
+	report, err := upgradeChaincode()
+	if err != nil {
+		writeError(rw, req, newAPIError(http.StatusBadGateway, codeChaincode, err.Error()))
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(report)
+}
+
+// UpgradeReports list the saved reports, newest first
+func (s *BlueAPP) UpgradeReports(rw web.ResponseWriter, req *web.Request) {
+	limit, err := indexLimit(req.FormValue("limit"))
+	if err != nil {
+		writeError(rw, req, paramsError(map[string]string{"limit": "expecting a positive integer"}))
+		logger.Errorf("Error: upgradeReports params error %v", err)
+
+		return
+	}
+
+	rows, err := appDB.Query(`SELECT id, report FROM upgrade_reports ORDER BY id DESC LIMIT ?`, limit)
+	if err != nil {
+		writeStoreError(rw, "upgradeReports", err)
+		return
+	}
+	defer rows.Close()
+
+	reports := []*UpgradeReport{}
+	for rows.Next() {
+		var id int64
+		var data string
+		if err := rows.Scan(&id, &data); err != nil {
+			writeStoreError(rw, "upgradeReports", err)
+			return
+		}
+		report := &UpgradeReport{}
+		if err := json.Unmarshal([]byte(data), report); err != nil {
+			writeStoreError(rw, "upgradeReports", err)
+			return
+		}
+		report.ID = id
+		reports = append(reports, report)
+	}
+	if err := rows.Err(); err != nil {
+		writeStoreError(rw, "upgradeReports", err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(reports)
+}
+
+// --------------- UpgradeCmd ---------------
+
+// UpgradeCmd returns the cobra command upgrading the chaincode
+func UpgradeCmd() *cobra.Command {
+	return upgradeCmd
+}
+
+var upgradeCmd = &cobra.Command{
+	Use:   "upgrade",
+	Short: "Upgrade the chaincode, carrying its state over.",
+	Long: `Deploy the chaincode of app.blue.chaincodePath, copy the state of the current chaincode to it, verify the row counts and checksums and switch to it.
+The current chaincode is kept read-only. A running app keeps using it until it is restarted, POST /upgrade switches a running app instead.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := connectBlue(); err != nil {
+			return err
+		}
+		if err := initStore(); err != nil {
+			return fmt.Errorf("Error opening store: %s", err)
+		}
+		if err := initIndex(); err != nil {
+			return fmt.Errorf("Error creating index tables: %s", err)
+		}
+		if err := startUpgrade(); err != nil {
+			return fmt.Errorf("Error creating upgrade tables: %s", err)
+		}
+
+		report, upgradeErr := upgradeChaincode()
+
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stdout.Write(append(data, '\n')); err != nil {
+			return err
+		}
+
+		return upgradeErr
+	},
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gocraft/web"
+	"github.com/hyperledger/fabric/core/crypto"
+	"github.com/spf13/viper"
+)
+
+// errNoUser is returned when a request does not name an enrolled user
+var errNoUser = errors.New("login required")
+
+// errBadCredentials is returned when a login does not match a registered user
+var errBadCredentials = errors.New("invalid enrollId or enrollSecret")
+
+// errUserExists is returned when registering an enrollID already registered
+var errUserExists = errors.New("user already registered")
+
+// secretIterations is the PBKDF2 iteration count of stored secret hashes
+const secretIterations = 10000
+
+var usersSchema = []string{
+	`CREATE TABLE IF NOT EXISTS users (
+		enroll_id TEXT PRIMARY KEY,
+		salt TEXT NOT NULL,
+		hash TEXT NOT NULL,
+		created_at INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS accounts (
+		account TEXT PRIMARY KEY,
+		enroll_id TEXT NOT NULL,
+		created_at INTEGER NOT NULL
+	)`,
+}
+
+// userClients is a bounded cache of initialized crypto clients, one per
+// enrolled user. The least recently used client is evicted when the cache is
+// full, and closed once the requests holding it released it.
+type userClients struct {
+	mu       sync.Mutex
+	capacity int
+	lru      *list.List
+	entries  map[string]*list.Element
+
+	// initClient and closeClient are crypto.InitClient and
+	// crypto.CloseClient outside of tests
+	initClient  func(enrollID string) (crypto.Client, error)
+	closeClient func(client crypto.Client) error
+}
+
+// userClient is an entry of userClients.
+type userClient struct {
+	enrollID string
+	client   crypto.Client
+	err      error
+	// ready is closed once client is initialized
+	ready chan struct{}
+	// refs counts the holders of client, the cache is not one of them
+	refs    int
+	evicted bool
+}
+
+// blueUsers is the app's cache of user clients, set by startUsers
+var blueUsers *userClients
+
+// newUserClients creates a cache holding up to capacity clients
+func newUserClients(capacity int) *userClients {
+	if capacity <= 0 {
+		capacity = 1
+	}
+
+	return &userClients{
+		capacity: capacity,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		initClient: func(enrollID string) (crypto.Client, error) {
+			return crypto.InitClient(enrollID, nil)
+		},
+		closeClient: crypto.CloseClient,
+	}
+}
+
+// startUsers creates the users and accounts tables and the cache of user clients sized by
+// app.users.cacheSize
+func startUsers() error {
+	if err := execSchema(usersSchema); err != nil {
+		return err
+	}
+
+	capacity := viper.GetInt("app.users.cacheSize")
+	if capacity <= 0 {
+		capacity = 100
+	}
+
+	blueUsers = newUserClients(capacity)
+
+	return nil
+}
+
+// enroll registers enrollID with the CA using enrollSecret and caches its
+// client. Enrolling a user that is already enrolled is a no-op.
+func (c *userClients) enroll(enrollID, enrollSecret string) error {
+	if err := crypto.RegisterClient(enrollID, nil, enrollID, enrollSecret); err != nil {
+		return err
+	}
+
+	_, release, err := c.get(enrollID)
+	if err == nil {
+		release()
+	}
+	return err
+}
+
+// get returns the client of an enrolled user, initializing it from the local
+// key store when it is not cached, and the function releasing it. The client
+// stays open until released, even when it is evicted meanwhile. The key store
+// is read outside of the lock, concurrent gets of the user wait for it.
+func (c *userClients) get(enrollID string) (crypto.Client, func(), error) {
+	if enrollID == "" {
+		return nil, nil, errNoUser
+	}
+
+	c.mu.Lock()
+	var (
+		entry   *userClient
+		evicted []*userClient
+	)
+	if e, ok := c.entries[enrollID]; ok {
+		c.lru.MoveToFront(e)
+		entry = e.Value.(*userClient)
+		entry.refs++
+		c.mu.Unlock()
+
+		<-entry.ready
+	} else {
+		entry = &userClient{enrollID: enrollID, ready: make(chan struct{}), refs: 1}
+		c.entries[enrollID] = c.lru.PushFront(entry)
+		evicted = c.evict()
+		c.mu.Unlock()
+
+		c.close(evicted)
+		entry.client, entry.err = c.initClient(enrollID)
+		close(entry.ready)
+	}
+
+	if entry.err != nil {
+		c.mu.Lock()
+		if e, ok := c.entries[enrollID]; ok && e.Value.(*userClient) == entry {
+			c.lru.Remove(e)
+			delete(c.entries, enrollID)
+			entry.evicted = true
+		}
+		c.mu.Unlock()
+		c.release(entry)
+
+		return nil, nil, entry.err
+	}
+
+	return entry.client, func() { c.release(entry) }, nil
+}
+
+// evict removes the least recently used entries over capacity and returns
+// those no request holds, which are to be closed. c.mu must be held.
+func (c *userClients) evict() []*userClient {
+	var unused []*userClient
+	for c.lru.Len() > c.capacity {
+		oldest := c.lru.Remove(c.lru.Back()).(*userClient)
+		delete(c.entries, oldest.enrollID)
+
+		oldest.evicted = true
+		if oldest.refs == 0 {
+			unused = append(unused, oldest)
+		}
+	}
+
+	return unused
+}
+
+// release drops a reference to entry, closing its client when it was the
+// last one of an evicted entry
+func (c *userClients) release(entry *userClient) {
+	c.mu.Lock()
+	entry.refs--
+	unused := entry.refs == 0 && entry.evicted
+	c.mu.Unlock()
+
+	if unused {
+		c.close([]*userClient{entry})
+	}
+}
+
+// close closes the clients of evicted entries
+func (c *userClients) close(entries []*userClient) {
+	for _, entry := range entries {
+		if entry.client == nil {
+			continue
+		}
+		if err := c.closeClient(entry.client); err != nil {
+			logger.Warningf("Failed closing client of %s: %v", entry.enrollID, err)
+		}
+	}
+}
+
+// registerUser stores a hash of a new user's secret, which later logins are
+// checked against, and enrolls the user with the CA. The CA accepts
+// registering an enrolled user again, so the stored hash decides: an
+// enrollID already registered fails with errUserExists and keeps its secret.
+func registerUser(enrollID, enrollSecret string) error {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+
+	res, err := appDB.Exec(`INSERT OR IGNORE INTO users (enroll_id, salt, hash, created_at) VALUES (?, ?, ?, ?)`,
+		enrollID, hex.EncodeToString(salt), hex.EncodeToString(hashSecret(enrollSecret, salt)), time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errUserExists
+	}
+
+	if err := blueUsers.enroll(enrollID, enrollSecret); err != nil {
+		if _, e := appDB.Exec(`DELETE FROM users WHERE enroll_id = ?`, enrollID); e != nil {
+			logger.Errorf("register %s: removing the user failed: %v", enrollID, e)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// verifyUser checks enrollSecret against the stored hash of a registered user
+func verifyUser(enrollID, enrollSecret string) error {
+	var saltHex, hashHex string
+	err := appDB.QueryRow(`SELECT salt, hash FROM users WHERE enroll_id = ?`, enrollID).Scan(&saltHex, &hashHex)
+	if err == sql.ErrNoRows {
+		return errBadCredentials
+	}
+	if err != nil {
+		return err
+	}
+
+	salt, err1 := hex.DecodeString(saltHex)
+	hash, err2 := hex.DecodeString(hashHex)
+	if err1 != nil || err2 != nil || !hmac.Equal(hash, hashSecret(enrollSecret, salt)) {
+		return errBadCredentials
+	}
+
+	return nil
+}
+
+// hashSecret derives a 32 bytes key from secret with PBKDF2-HMAC-SHA256
+func hashSecret(secret string, salt []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+
+	block := make([]byte, 4)
+	binary.BigEndian.PutUint32(block, 1)
+	mac.Write(salt)
+	mac.Write(block)
+	u := mac.Sum(nil)
+
+	key := make([]byte, len(u))
+	copy(key, u)
+	for i := 1; i < secretIterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+
+	return key
+}
+
+// saveAccount records enrollID as the owner of account
+func saveAccount(account, enrollID string) error {
+	_, err := appDB.Exec(`INSERT OR REPLACE INTO accounts (account, enroll_id, created_at) VALUES (?, ?, ?)`,
+		account, enrollID, time.Now().Unix())
+	return err
+}
+
+// ownsAccount reports whether principal may act for account: the account was
+// created by or assigned to its user, or is named after it as the accounts
+// preceding the account identifiers are. The admin scope acts for every
+// account.
+func ownsAccount(principal *Principal, account string) (bool, error) {
+	if principal.HasScope(scopeAdmin) {
+		return true, nil
+	}
+	if principal.EnrollID == "" {
+		return false, nil
+	}
+	if account == principal.EnrollID {
+		return true, nil
+	}
+
+	var enrollID string
+	err := appDB.QueryRow(`SELECT enroll_id FROM accounts WHERE account = ?`, account).Scan(&enrollID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return enrollID == principal.EnrollID, nil
+}
+
+// ownedAccountsFilter returns the SQL condition, with its arguments, keeping
+// the rows whose column holds an account principal owns as ownsAccount
+// decides. The store has a single connection, so listings filter in SQL
+// rather than calling ownsAccount while their rows are open.
+func ownedAccountsFilter(principal *Principal, column string) (string, []interface{}) {
+	if principal.HasScope(scopeAdmin) {
+		return "1", nil
+	}
+	if principal.EnrollID == "" {
+		return "0", nil
+	}
+
+	return "(" + column + " = ? OR " + column + " IN (SELECT account FROM accounts WHERE enroll_id = ?))",
+		[]interface{}{principal.EnrollID, principal.EnrollID}
+}
+
+// requestClient checks that the user enrollID has a crypto client. On
+// failure it writes the error response and returns false.
+func requestClient(rw web.ResponseWriter, enrollID string) bool {
+	_, release, err := blueUsers.get(enrollID)
+	if err != nil {
+		rw.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(rw).Encode(BlueResponse{Status: err.Error()})
+		logger.Errorf("Error: user %q: %v", enrollID, err)
+
+		return false
+	}
+	release()
+
+	return true
+}
+
+// --------------- handlers ---------------
+
+// Register register and enroll a user with the CA, the user then logs in
+// with the same enrollSecret
+func (s *BlueAPP) Register(rw web.ResponseWriter, req *web.Request) {
+	encoder := json.NewEncoder(rw)
+
+	// get params
+	enrollID := req.FormValue("enrollId")
+	enrollSecret := req.FormValue("enrollSecret")
+
+	logger.Infof("register: enrollId=%v", enrollID)
+
+	if enrollID == "" || enrollSecret == "" {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(BlueResponse{Status: "params error"})
+		logger.Error("Error: params error.")
+
+		return
+	}
+
+	if err := registerUser(enrollID, enrollSecret); err != nil {
+		if err == errUserExists {
+			rw.WriteHeader(http.StatusConflict)
+		} else {
+			rw.WriteHeader(http.StatusUnauthorized)
+		}
+		encoder.Encode(BlueResponse{Status: "register error: " + err.Error()})
+		logger.Errorf("register error: %v", err)
+
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(BlueResponse{Status: "success", ID: enrollID})
+	logger.Infof("register successful: %s\n", enrollID)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/crypto"
+)
+
+// fakeClient is a crypto.Client of a test user
+type fakeClient struct {
+	crypto.Client
+	enrollID string
+}
+
+// fakeUserClients returns a cache of fake clients counting the inits and
+// the closes per user
+func fakeUserClients(capacity int) (*userClients, map[string]int, map[string]int) {
+	var mu sync.Mutex
+	inits, closes := make(map[string]int), make(map[string]int)
+
+	c := newUserClients(capacity)
+	c.initClient = func(enrollID string) (crypto.Client, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		inits[enrollID]++
+		return &fakeClient{enrollID: enrollID}, nil
+	}
+	c.closeClient = func(client crypto.Client) error {
+		mu.Lock()
+		defer mu.Unlock()
+		closes[client.(*fakeClient).enrollID]++
+		return nil
+	}
+
+	return c, inits, closes
+}
+
+func TestUserClientsEvictionWaitsForRelease(t *testing.T) {
+	c, inits, closes := fakeUserClients(1)
+
+	alice, releaseAlice, err := c.get("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// bob evicts alice, who is still held
+	_, releaseBob, err := c.get("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if closes["alice"] != 0 {
+		t.Fatalf("alice closed while held")
+	}
+	if alice.(*fakeClient).enrollID != "alice" {
+		t.Fatalf("got client of %s", alice.(*fakeClient).enrollID)
+	}
+
+	releaseAlice()
+	if closes["alice"] != 1 {
+		t.Fatalf("alice closed %d times after release, want 1", closes["alice"])
+	}
+
+	// bob is cached, releasing keeps it open
+	releaseBob()
+	if closes["bob"] != 0 {
+		t.Fatalf("cached bob closed")
+	}
+	_, releaseBob, err = c.get("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	releaseBob()
+	if inits["bob"] != 1 {
+		t.Fatalf("bob initialized %d times, want 1", inits["bob"])
+	}
+
+	// an unused client is closed as soon as it is evicted
+	_, releaseCarol, err := c.get("carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	releaseCarol()
+	if closes["bob"] != 1 {
+		t.Fatalf("bob closed %d times after eviction, want 1", closes["bob"])
+	}
+}
+
+func TestUserClientsInitOnce(t *testing.T) {
+	c, inits, _ := fakeUserClients(10)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, release, err := c.get("alice")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			release()
+		}()
+	}
+	wg.Wait()
+
+	if inits["alice"] != 1 {
+		t.Fatalf("alice initialized %d times, want 1", inits["alice"])
+	}
+}
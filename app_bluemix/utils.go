@@ -13,29 +13,25 @@ import (
 	"time"
 
 	"golang.org/x/net/context"
+	"google.golang.org/grpc"
 
 	"github.com/hyperledger/fabric/core/chaincode"
 	"github.com/hyperledger/fabric/core/chaincode/platforms"
-	"github.com/hyperledger/fabric/core/config"
 	"github.com/hyperledger/fabric/core/container"
 	"github.com/hyperledger/fabric/core/crypto"
-	"github.com/hyperledger/fabric/core/peer"
 	"github.com/hyperledger/fabric/core/util"
 	pb "github.com/hyperledger/fabric/protos"
 	"github.com/spf13/viper"
 )
 
-func initPeerClient() (err error) {
-	config.SetupTestConfig(".")
-
-	peerClientConn, err = peer.NewPeerClientConnection()
-	if err != nil {
-		fmt.Printf("error connection to server at host:port = %s\n", viper.GetString("peer.address"))
-		return
+func initPeerClient() error {
+	bluePeers = newPeerPool()
+	if err := bluePeers.connect(); err != nil {
+		fmt.Printf("error connection to peers %v: %v\n", viper.GetStringSlice("app.peers.addresses"), err)
+		return err
 	}
-	serverClient = pb.NewPeerClient(peerClientConn)
 
-	return
+	return nil
 }
 
 func initCryptoClient(enrollID, enrollPWD string) (crypto.Client, error) {
@@ -54,23 +50,16 @@ func initCryptoClient(enrollID, enrollPWD string) (crypto.Client, error) {
 	return client, nil
 }
 
-func processTransaction(tx *pb.Transaction) (*pb.Response, error) {
-	resp, err := serverClient.ProcessTransaction(context.Background(), tx)
-
-	if err != nil {
-		for i := 0; i < retryCount; i++ {
-			err = initPeerClient()
-			if err != nil {
-				logger.Errorf("processTransaction[%v]: %v", i, err)
-				continue
-			}
-			resp, err = serverClient.ProcessTransaction(context.Background(), tx)
-			if err == nil {
-				logger.Errorf("processTransaction[%v]: successful", i)
-				return resp, err
-			}
-		}
-	}
+// processTransaction sends tx to a peer of the pool. A query fails over to
+// the next peer on any error, a transaction only when it did not reach the
+// peer.
+func processTransaction(ctx context.Context, tx *pb.Transaction) (*pb.Response, error) {
+	var resp *pb.Response
+	err := bluePeers.do(ctx, tx.Type == pb.Transaction_CHAINCODE_QUERY, func(conn *grpc.ClientConn) error {
+		var err error
+		resp, err = pb.NewPeerClient(conn).ProcessTransaction(ctx, tx)
+		return err
+	})
 
 	return resp, err
 }
@@ -120,17 +109,9 @@ func checkSpec(spec *pb.ChaincodeSpec) error {
 	return platform.ValidateSpec(spec)
 }
 
-func deployChaincode(string) error {
-	// Get chaincode path
-	chaincodePath := os.Getenv("CORE_APP_BLUE_CHAINCODEPATH")
-	if chaincodePath == "" {
-		chaincodePath = viper.GetString("app.blue.chaincodePath")
-		if chaincodePath == "" {
-			chaincodePath = "github.com/wutongtree/blue/chaincode"
-		}
-	}
-
-	// Get deployer
+// initDeployer enrolls the deployer, who deploys the chaincode and makes
+// the queries
+func initDeployer() error {
 	deployerID := os.Getenv("CORE_APP_BLUE_DEPLOYER")
 	if deployerID == "" {
 		deployerID = viper.GetString("app.blue.deployerID")
@@ -147,14 +128,28 @@ func deployChaincode(string) error {
 		}
 	}
 
-	// init deployer
 	client, err := initCryptoClient(deployerID, deployerSecret)
 	if err != nil {
-		logger.Debugf("Failed deploying [%s]", err)
+		logger.Debugf("Failed enrolling deployer [%s]", err)
 		return err
 	}
 	deployerClient = client
 
+	return nil
+}
+
+// deployChaincode deploys the chaincode of app.blue.chaincodePath and
+// returns its name
+func deployChaincode() (string, error) {
+	// Get chaincode path
+	chaincodePath := os.Getenv("CORE_APP_BLUE_CHAINCODEPATH")
+	if chaincodePath == "" {
+		chaincodePath = viper.GetString("app.blue.chaincodePath")
+		if chaincodePath == "" {
+			chaincodePath = "github.com/wutongtree/blue/chaincode"
+		}
+	}
+
 	// Prepare the spec. The metadata includes the identity of the administrator
 	spec := &pb.ChaincodeSpec{
 		Type:                 1,
@@ -166,28 +161,48 @@ func deployChaincode(string) error {
 	// First build the deployment spec
 	cds, err := getChaincodeBytes(spec)
 	if err != nil {
-		return fmt.Errorf("Error getting deployment spec: %s ", err)
+		return "", fmt.Errorf("Error getting deployment spec: %s ", err)
 	}
 
 	logger.Infof("deployChaincode: %v", cds.ChaincodeSpec)
 
 	// Now create the Transactions message and send to Peer.
-	transaction, err := client.NewChaincodeDeployTransaction(cds, cds.ChaincodeSpec.ChaincodeID.Name)
+	transaction, err := deployerClient.NewChaincodeDeployTransaction(cds, cds.ChaincodeSpec.ChaincodeID.Name)
 	if err != nil {
-		return fmt.Errorf("Error deploy chaincode: %s ", err)
+		return "", fmt.Errorf("Error deploy chaincode: %s ", err)
 	}
 
-	resp, err := processTransaction(transaction)
+	resp, err := processTransaction(context.Background(), transaction)
+	if err != nil {
+		return "", fmt.Errorf("Error deploy chaincode: %s ", err)
+	}
+	if resp.Status != pb.Response_SUCCESS {
+		return "", fmt.Errorf("Error deploy chaincode: %s ", resp.Msg)
+	}
 
 	logger.Debugf("resp [%s]", resp.String())
+	logger.Debugf("ChaincodeName [%s]", cds.ChaincodeSpec.ChaincodeID.Name)
 
-	chaincodeName = cds.ChaincodeSpec.ChaincodeID.Name
-	logger.Debugf("ChaincodeName [%s]", chaincodeName)
+	return cds.ChaincodeSpec.ChaincodeID.Name, nil
+}
 
-	return nil
+// invokeChaincode submits an invoke transaction with ID txid, giving up when
+// ctx is done. The transaction is tracked as pending until the event hub
+// reports it. It is tracked before it is submitted, as the block can be
+// reported before the peer answers, and untracked when the peer refuses it.
+func invokeChaincode(ctx context.Context, invoker crypto.Client, chaincodeInput *pb.ChaincodeInput, txid string) (resp *pb.Response, err error) {
+	trackTx(txid, chaincodeInput)
+
+	resp, err = invokeChaincodeOf(ctx, invoker, currentChaincode(), chaincodeInput, txid)
+	if err != nil || resp.Status != pb.Response_SUCCESS {
+		untrackTx(txid)
+	}
+
+	return resp, err
 }
 
-func invokeChaincode(invoker crypto.Client, chaincodeInput *pb.ChaincodeInput) (resp *pb.Response, err error) {
+// invokeChaincodeOf submits an invoke transaction of the chaincode name
+func invokeChaincodeOf(ctx context.Context, invoker crypto.Client, name string, chaincodeInput *pb.ChaincodeInput, txid string) (resp *pb.Response, err error) {
 	// Get a transaction handler to be used to submit the execute transaction
 	txCertHandler, err := invoker.GetTCertificateHandlerNext()
 	if err != nil {
@@ -201,7 +216,7 @@ func invokeChaincode(invoker crypto.Client, chaincodeInput *pb.ChaincodeInput) (
 	// Prepare spec and submit
 	spec := &pb.ChaincodeSpec{
 		Type:                 1,
-		ChaincodeID:          &pb.ChaincodeID{Name: chaincodeName},
+		ChaincodeID:          &pb.ChaincodeID{Name: name},
 		CtorMsg:              chaincodeInput,
 		ConfidentialityLevel: confidentialityLevel,
 	}
@@ -209,15 +224,20 @@ func invokeChaincode(invoker crypto.Client, chaincodeInput *pb.ChaincodeInput) (
 	chaincodeInvocationSpec := &pb.ChaincodeInvocationSpec{ChaincodeSpec: spec}
 
 	// Now create the Transactions message and send to Peer.
-	transaction, err := txHandler.NewChaincodeExecute(chaincodeInvocationSpec, util.GenerateUUID())
+	transaction, err := txHandler.NewChaincodeExecute(chaincodeInvocationSpec, txid)
 	if err != nil {
 		return nil, fmt.Errorf("Error invoke chaincode: %s ", err)
 	}
 
-	return processTransaction(transaction)
+	return processTransaction(ctx, transaction)
+}
+
+func queryChaincode(ctx context.Context, invoker crypto.Client, chaincodeInput *pb.ChaincodeInput) (resp *pb.Response, err error) {
+	return queryChaincodeOf(ctx, invoker, currentChaincode(), chaincodeInput)
 }
 
-func queryChaincode(invoker crypto.Client, chaincodeInput *pb.ChaincodeInput) (resp *pb.Response, err error) {
+// queryChaincodeOf queries the chaincode name
+func queryChaincodeOf(ctx context.Context, invoker crypto.Client, name string, chaincodeInput *pb.ChaincodeInput) (resp *pb.Response, err error) {
 	// Get a transaction handler to be used to submit the execute transaction
 	txCertHandler, err := invoker.GetTCertificateHandlerNext()
 	if err != nil {
@@ -231,7 +251,7 @@ func queryChaincode(invoker crypto.Client, chaincodeInput *pb.ChaincodeInput) (r
 	// Prepare spec and submit
 	spec := &pb.ChaincodeSpec{
 		Type:                 1,
-		ChaincodeID:          &pb.ChaincodeID{Name: chaincodeName},
+		ChaincodeID:          &pb.ChaincodeID{Name: name},
 		CtorMsg:              chaincodeInput,
 		ConfidentialityLevel: confidentialityLevel,
 	}
@@ -244,7 +264,7 @@ func queryChaincode(invoker crypto.Client, chaincodeInput *pb.ChaincodeInput) (r
 		return nil, fmt.Errorf("Error query chaincode: %s ", err)
 	}
 
-	return processTransaction(transaction)
+	return processTransaction(ctx, transaction)
 }
 
 func getHTTPURL(resource string) string {
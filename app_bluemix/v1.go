@@ -0,0 +1,857 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/gocraft/web"
+	"github.com/hyperledger/fabric/core/util"
+	pb "github.com/hyperledger/fabric/protos"
+	"github.com/wutongtree/blue/chaincode_bluemix/validation"
+)
+
+// v1Prefix is the path prefix of the JSON API
+const v1Prefix = "/v1/"
+
+// error codes of the JSON API
+const (
+	codeInvalidJSON   = "invalid_json"
+	codeInvalidParams = "invalid_params"
+	codeUnauthorized  = "unauthorized"
+	codeForbidden     = "forbidden"
+	codeNotFound      = "not_found"
+	codeChaincode     = "chaincode_error"
+	codeTxRejected    = "tx_rejected"
+	codeCommitUnknown = "commit_unknown"
+	codeQueued        = "queued"
+	codeInternal      = "internal_error"
+)
+
+// APIError is a machine-readable error of the JSON API. Fields maps the
+// request fields in error to their problem.
+type APIError struct {
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+	TxID    string            `json:"txid,omitempty"`
+
+	// status is the HTTP status of the error
+	status int
+	// legacy is the status string of the form routes when it differs from
+	// the message
+	legacy string
+}
+
+// ErrorResponse is the body of a JSON API error.
+type ErrorResponse struct {
+	Error *APIError `json:"error"`
+}
+
+func newAPIError(status int, code string, message string) *APIError {
+	return &APIError{Code: code, Message: message, status: status}
+}
+
+// paramsError returns an invalid_params error for fields
+func paramsError(fields map[string]string) *APIError {
+	e := newAPIError(http.StatusBadRequest, codeInvalidParams, "params error")
+	e.Fields = fields
+
+	return e
+}
+
+// isV1 reports whether a request is served by the JSON API
+func isV1(req *web.Request) bool {
+	return strings.HasPrefix(req.URL.Path, v1Prefix)
+}
+
+// writeError writes e as an ErrorResponse on the JSON API and as a
+// BlueResponse on the form routes
+func writeError(rw web.ResponseWriter, req *web.Request, e *APIError) {
+	rw.WriteHeader(e.status)
+
+	if isV1(req) {
+		json.NewEncoder(rw).Encode(ErrorResponse{Error: e})
+		return
+	}
+
+	status := e.Message
+	if e.legacy != "" {
+		status = e.legacy
+	}
+	json.NewEncoder(rw).Encode(BlueResponse{Status: status, TxID: e.TxID, Fields: e.Fields})
+}
+
+// --------------- invoke and query ---------------
+
+// accountArgs maps the invoked functions to the position in their args of
+// the account they act for
+var accountArgs = map[string]int{
+	"send":           1,
+	"offer":          1,
+	"offerCancel":    2,
+	"accountSet":     1,
+	"createInvoice":  1,
+	"payInvoice":     2,
+	"checkCreate":    1,
+	"checkCash":      2,
+	"checkCancel":    2,
+	"depositPreauth": 1,
+	"depositUnauth":  1,
+}
+
+// checkAccount returns a forbidden error unless the request's principal owns
+// account
+func (s *BlueAPP) checkAccount(account string) *APIError {
+	owns, err := ownsAccount(s.principal, account)
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, codeInternal, err.Error())
+	}
+	if !owns {
+		return newAPIError(http.StatusForbidden, codeForbidden, fmt.Sprintf("%s does not own account %s", s.principal.Subject, account))
+	}
+
+	return nil
+}
+
+// checkParty returns a forbidden error unless the request's principal owns
+// one of accounts, the parties of an invoice or a check
+func (s *BlueAPP) checkParty(accounts ...string) *APIError {
+	var e *APIError
+	for _, account := range accounts {
+		if e = s.checkAccount(account); e == nil || e.status != http.StatusForbidden {
+			return e
+		}
+	}
+
+	return e
+}
+
+// queryAccountArgs maps the queries reading the data of an account to the
+// position in their args of that account
+var queryAccountArgs = map[string]int{
+	"queryBalances":         1,
+	"queryInvoicesByPayee":  1,
+	"queryInvoicesByPayer":  1,
+	"queryChecksBySender":   1,
+	"queryChecksByReceiver": 1,
+}
+
+// queryOwned queries the blue chaincode like queryBlueResult for the
+// request's principal, who must own the account the query reads, or a party
+// of the invoice or check it returns.
+func (s *BlueAPP) queryOwned(args []string) ([]byte, *APIError) {
+	if i, ok := queryAccountArgs[args[0]]; ok {
+		if e := s.checkAccount(args[i]); e != nil {
+			return nil, e
+		}
+	}
+
+	result, e := queryBlueResult(s.ctx, args)
+	if e != nil || (args[0] != "queryInvoice" && args[0] != "queryCheck") {
+		return result, e
+	}
+
+	var parties struct{ Payee, Payer, Sender, Receiver string }
+	if err := json.Unmarshal(result, &parties); err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, codeInternal, err.Error())
+	}
+	if args[0] == "queryCheck" {
+		e = s.checkParty(parties.Sender, parties.Receiver)
+	} else if parties.Payer != "" {
+		// an open invoice, without a payer, is for whoever pays it
+		e = s.checkParty(parties.Payee, parties.Payer)
+	}
+	if e != nil {
+		return nil, e
+	}
+
+	return result, nil
+}
+
+// submitBlue invokes the blue chaincode with args, the first of which is the
+// function name, signed by the request's user, who must own the account the
+// function acts for. With wait=committed it returns only once the transaction
+// is in a block.
+func (s *BlueAPP) submitBlue(req *web.Request, args []string) (string, *APIError) {
+	_, release, err := blueUsers.get(s.principal.EnrollID)
+	if err != nil {
+		return "", newAPIError(http.StatusUnauthorized, codeUnauthorized, err.Error())
+	}
+	release()
+	if i, ok := accountArgs[args[0]]; ok {
+		if e := s.checkAccount(args[i]); e != nil {
+			return "", e
+		}
+	}
+
+	timeout, err := waitOptions(req)
+	if err != nil {
+		e := paramsError(map[string]string{"wait": err.Error()})
+		e.legacy = fmt.Sprintf("params error: %v", err)
+		return "", e
+	}
+
+	var waiter *commitWaiter
+	if timeout != nil {
+		waiter = newCommitWaiter()
+	}
+
+	entry, err := enqueueTx(s.principal.EnrollID, s.idempotencyKey, args)
+	if err == errTxSubmitted {
+		if waiter != nil {
+			waiter.cancel()
+		}
+
+		e := newAPIError(http.StatusConflict, codeIdempotencyInProgress, fmt.Sprintf("%s error: %v", args[0], err))
+		e.TxID = entry.txid
+		return "", e
+	}
+	if err != nil {
+		if waiter != nil {
+			waiter.cancel()
+		}
+
+		return "", newAPIError(http.StatusInternalServerError, codeInternal, err.Error())
+	}
+	txid := entry.txid
+
+	// the outbox workers retry an invoke the peer could not take, the client
+	// follows it by its transaction ID
+	ctx, cancel := context.WithTimeout(s.ctx, invokeTimeout())
+	status, err := attemptOutbox(ctx, entry)
+	cancel()
+	if status != outboxSubmitted && waiter != nil {
+		waiter.cancel()
+	}
+	switch status {
+	case outboxQueued:
+		e := newAPIError(http.StatusAccepted, codeQueued, fmt.Sprintf("%s queued: %v", args[0], err))
+		e.legacy = txQueued
+		if isTimeout(err) || isCanceled(err) {
+			e = peerError(args[0], err, invokeTimeout())
+			e.Message += ", the transaction is retried"
+		}
+		e.TxID = txid
+		return "", e
+	case outboxFailed:
+		e := newAPIError(http.StatusBadRequest, codeChaincode, fmt.Sprintf("%s error: %v", args[0], err))
+		e.TxID = txid
+		return "", e
+	}
+
+	if waiter != nil {
+		switch status, errMsg := waiter.wait(s.ctx, txid, *timeout); status {
+		case txCommitted:
+		case txFailed:
+			e := newAPIError(http.StatusBadRequest, codeTxRejected, fmt.Sprintf("%s error: %s", args[0], errMsg))
+			e.TxID = txid
+			return "", e
+		default:
+			e := newAPIError(http.StatusAccepted, codeCommitUnknown, "commit not seen before timeout")
+			e.TxID, e.legacy = txid, txUnknown
+			return "", e
+		}
+	}
+
+	return txid, nil
+}
+
+// queryBlueResult queries the blue chaincode with args, the first of which is
+// the function name, and returns its JSON result. The query is bounded by
+// app.tx.queryTimeout and cancelled with ctx.
+func queryBlueResult(ctx context.Context, args []string) ([]byte, *APIError) {
+	chaincodeInput := &pb.ChaincodeInput{
+		Args: util.ToChaincodeArgs(args...),
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout())
+	defer cancel()
+
+	resp, err := queryChaincode(ctx, deployerClient, chaincodeInput)
+	if err == nil && resp.Status != pb.Response_SUCCESS {
+		err = fmt.Errorf("%s", resp.Msg)
+	}
+	if err != nil {
+		e := peerError(args[0], err, queryTimeout())
+		if e.Code == codeChaincode && strings.Contains(err.Error(), " not found") {
+			e.Code = codeNotFound
+		}
+		return nil, e
+	}
+
+	return resp.Msg, nil
+}
+
+// --------------- request and response structs ---------------
+
+// Amount is an amount of a currency.
+type Amount struct {
+	Value    string `json:"value"`
+	Currency string `json:"currency"`
+}
+
+// String formats the amount as <value>/<currency> for the chaincode
+func (a Amount) String() string {
+	return a.Value + "/" + a.Currency
+}
+
+// SendRequest is the body of POST /v1/tx/send.
+type SendRequest struct {
+	Sender         string  `json:"sender"`
+	Receiver       string  `json:"receiver"`
+	Amount         string  `json:"amount"`
+	Currency       string  `json:"currency"`
+	DestinationTag *uint32 `json:"destinationTag,omitempty"`
+	SourceTag      *uint32 `json:"sourceTag,omitempty"`
+	Memo           string  `json:"memo,omitempty"`
+	InvoiceID      string  `json:"invoiceID,omitempty"`
+}
+
+// OfferRequest is the body of POST /v1/tx/offer.
+type OfferRequest struct {
+	Sender    string `json:"sender"`
+	TakerGets Amount `json:"takerGets"`
+	TakerPays Amount `json:"takerPays"`
+}
+
+// OfferCancelRequest is the body of POST /v1/tx/offercancel.
+type OfferCancelRequest struct {
+	ID      string `json:"id"`
+	Account string `json:"account"`
+}
+
+// AccountSetRequest is the body of POST /v1/tx/accountset.
+type AccountSetRequest struct {
+	Account string `json:"account"`
+	Flag    string `json:"flag"`
+	Enabled bool   `json:"enabled"`
+}
+
+// CreateInvoiceRequest is the body of POST /v1/tx/invoice.
+type CreateInvoiceRequest struct {
+	Payee     string `json:"payee"`
+	Amount    string `json:"amount"`
+	Currency  string `json:"currency"`
+	Expiry    string `json:"expiry,omitempty"`
+	Reference string `json:"reference,omitempty"`
+	Payer     string `json:"payer,omitempty"`
+}
+
+// PayInvoiceRequest is the body of POST /v1/tx/payinvoice.
+type PayInvoiceRequest struct {
+	ID       string `json:"id"`
+	Payer    string `json:"payer"`
+	Amount   string `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// CheckCreateRequest is the body of POST /v1/tx/checkcreate.
+type CheckCreateRequest struct {
+	Sender         string  `json:"sender"`
+	Receiver       string  `json:"receiver"`
+	SendMax        string  `json:"sendMax"`
+	Currency       string  `json:"currency"`
+	Expiry         string  `json:"expiry,omitempty"`
+	DestinationTag *uint32 `json:"destinationTag,omitempty"`
+	InvoiceID      string  `json:"invoiceID,omitempty"`
+}
+
+// CheckCashRequest is the body of POST /v1/tx/checkcash.
+type CheckCashRequest struct {
+	ID       string `json:"id"`
+	Receiver string `json:"receiver"`
+	Amount   string `json:"amount"`
+}
+
+// CheckCancelRequest is the body of POST /v1/tx/checkcancel.
+type CheckCancelRequest struct {
+	ID      string `json:"id"`
+	Account string `json:"account"`
+}
+
+// DepositAuthRequest is the body of POST /v1/tx/depositpreauth and
+// /v1/tx/depositunauth.
+type DepositAuthRequest struct {
+	Account    string `json:"account"`
+	Authorized string `json:"authorized"`
+}
+
+// TxResponse is the response of a submitted transaction. ID is the invoice or
+// check created by the transaction.
+type TxResponse struct {
+	Status string `json:"status"`
+	TxID   string `json:"txid"`
+	ID     string `json:"id,omitempty"`
+}
+
+// Invoice is a payment request.
+type Invoice struct {
+	ID        string `json:"id"`
+	Payee     string `json:"payee"`
+	Payer     string `json:"payer,omitempty"`
+	Amount    string `json:"amount"`
+	Currency  string `json:"currency"`
+	Expiry    string `json:"expiry,omitempty"`
+	Reference string `json:"reference,omitempty"`
+	Status    string `json:"status"`
+	PaidBy    string `json:"paidBy,omitempty"`
+	PaidAt    string `json:"paidAt,omitempty"`
+}
+
+// Check is an authorization for a receiver to pull funds from a sender.
+type Check struct {
+	ID             string `json:"id"`
+	Sender         string `json:"sender"`
+	Receiver       string `json:"receiver"`
+	SendMax        string `json:"sendMax"`
+	Currency       string `json:"currency"`
+	Expiry         string `json:"expiry,omitempty"`
+	DestinationTag string `json:"destinationTag,omitempty"`
+	InvoiceID      string `json:"invoiceID,omitempty"`
+	Status         string `json:"status"`
+	CashedAmount   string `json:"cashedAmount,omitempty"`
+	ClosedAt       string `json:"closedAt,omitempty"`
+}
+
+// BookOffer is an offer resting in the book of its pair with the amounts
+// left to fill, formatted as <value>/<currency>.
+type BookOffer struct {
+	ID        string `json:"id"`
+	Sender    string `json:"sender"`
+	TakerGets string `json:"takerGets"`
+	TakerPays string `json:"takerPays"`
+	Timestamp string `json:"timestamp"`
+}
+
+// BalancesResponse holds the balances of an account by currency.
+type BalancesResponse struct {
+	Account  string            `json:"account"`
+	Balances map[string]string `json:"balances"`
+}
+
+// DepositAuthorizedResponse tells whether an account accepts funds from a
+// sender.
+type DepositAuthorizedResponse struct {
+	Authorized bool   `json:"authorized"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+// --------------- helpers ---------------
+
+// decodeJSON decodes the request body into v, writing the error response on
+// failure
+func decodeJSON(rw web.ResponseWriter, req *web.Request, v interface{}) bool {
+	if err := json.NewDecoder(req.Body).Decode(v); err != nil {
+		writeError(rw, req, newAPIError(http.StatusBadRequest, codeInvalidJSON, err.Error()))
+		logger.Errorf("Error: %s %s: %v", req.Method, req.URL.Path, err)
+
+		return false
+	}
+
+	return true
+}
+
+// required returns an invalid_params error naming the empty fields
+func required(fields ...string) *APIError {
+	missing := make(map[string]string)
+	for i := 0; i+1 < len(fields); i += 2 {
+		if fields[i+1] == "" {
+			missing[fields[i]] = "required"
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	return paramsError(missing)
+}
+
+// formatTag formats an optional tag as a chaincode argument
+func formatTag(tag *uint32) string {
+	if tag == nil {
+		return ""
+	}
+
+	return strconv.FormatUint(uint64(*tag), 10)
+}
+
+// blueTime returns the current chaincode timestamp
+func blueTime() string {
+	return time.Now().In(blueLocation()).String()
+}
+
+// v1Invoke submits args unless the request is in error e and writes the
+// TxResponse. created tells that the transaction ID is also the ID of the
+// invoice or check it creates.
+func (s *BlueAPP) v1Invoke(rw web.ResponseWriter, req *web.Request, e *APIError, args []string, created bool) {
+	if e != nil {
+		writeError(rw, req, e)
+		logger.Errorf("Error: %s: %s %v", args[0], e.Message, e.Fields)
+		return
+	}
+
+	txid, e := s.submitBlue(req, args)
+	if e != nil {
+		writeError(rw, req, e)
+		logger.Errorf("Error: %s: %s", args[0], e.Message)
+		return
+	}
+
+	resp := TxResponse{Status: "submitted", TxID: txid}
+	if req.FormValue("wait") == waitCommitted {
+		resp.Status = txCommitted
+	}
+	if created {
+		resp.ID = txid
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(resp)
+	logger.Infof("%s successful: '%s'\n", args[0], txid)
+}
+
+// v1Query queries args and decodes the result into out, writing the error
+// response on failure
+func (s *BlueAPP) v1Query(rw web.ResponseWriter, req *web.Request, args []string, out interface{}) bool {
+	result, e := s.queryOwned(args)
+	if e == nil {
+		if err := json.Unmarshal(result, out); err != nil {
+			e = newAPIError(http.StatusInternalServerError, codeInternal, err.Error())
+		}
+	}
+	if e != nil {
+		if e.Code == codeNotFound {
+			e.status = http.StatusNotFound
+		}
+		writeError(rw, req, e)
+		logger.Errorf("Error: %s: %s", args[0], e.Message)
+		return false
+	}
+
+	return true
+}
+
+// writeJSON writes v with status OK
+func writeJSON(rw web.ResponseWriter, v interface{}) {
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(v)
+}
+
+// --------------- handlers ---------------
+
+// V1Send send a payment
+func (s *BlueAPP) V1Send(rw web.ResponseWriter, req *web.Request) {
+	body := &SendRequest{}
+	if !decodeJSON(rw, req, body) {
+		return
+	}
+
+	logger.Infof("v1 send: %+v", body)
+
+	e := validationError(validation.Send(blueCurrencies.currencies(), body.Sender, body.Receiver, body.Amount, body.Currency))
+	s.v1Invoke(rw, req, e, []string{
+		"send",
+		body.Sender,
+		body.Receiver,
+		body.Amount,
+		body.Currency,
+		blueTime(),
+		formatTag(body.DestinationTag),
+		formatTag(body.SourceTag),
+		body.Memo,
+		body.InvoiceID}, false)
+}
+
+// V1Offer place an offer
+func (s *BlueAPP) V1Offer(rw web.ResponseWriter, req *web.Request) {
+	body := &OfferRequest{}
+	if !decodeJSON(rw, req, body) {
+		return
+	}
+
+	logger.Infof("v1 offer: %+v", body)
+
+	// empty values are reported on their own field rather than as a
+	// malformed <value>/<currency>
+	e := required(
+		"takerGets.value", body.TakerGets.Value, "takerGets.currency", body.TakerGets.Currency,
+		"takerPays.value", body.TakerPays.Value, "takerPays.currency", body.TakerPays.Currency)
+	if e == nil {
+		e = validationError(validation.Offer(blueCurrencies.currencies(), body.Sender, body.TakerGets.String(), body.TakerPays.String()))
+	}
+	s.v1Invoke(rw, req, e, []string{
+		"offer",
+		body.Sender,
+		body.TakerGets.String(),
+		body.TakerPays.String(),
+		blueTime()}, false)
+}
+
+// V1AccountSet set or clear an account flag
+func (s *BlueAPP) V1AccountSet(rw web.ResponseWriter, req *web.Request) {
+	body := &AccountSetRequest{}
+	if !decodeJSON(rw, req, body) {
+		return
+	}
+
+	logger.Infof("v1 accountSet: %+v", body)
+
+	e := mergeErrors(validationError(accountErrors("account", body.Account)), required("flag", body.Flag))
+	s.v1Invoke(rw, req, e, []string{
+		"accountSet",
+		body.Account,
+		body.Flag,
+		strconv.FormatBool(body.Enabled)}, false)
+}
+
+// V1CreateInvoice create a payment request
+func (s *BlueAPP) V1CreateInvoice(rw web.ResponseWriter, req *web.Request) {
+	body := &CreateInvoiceRequest{}
+	if !decodeJSON(rw, req, body) {
+		return
+	}
+
+	logger.Infof("v1 createInvoice: %+v", body)
+
+	e := validationError(validation.Invoice(blueCurrencies.currencies(), body.Payee, body.Payer, body.Amount, body.Currency))
+	s.v1Invoke(rw, req, e, []string{
+		"createInvoice",
+		body.Payee,
+		body.Amount,
+		body.Currency,
+		body.Expiry,
+		body.Reference,
+		body.Payer}, true)
+}
+
+// V1PayInvoice pay a payment request
+func (s *BlueAPP) V1PayInvoice(rw web.ResponseWriter, req *web.Request) {
+	body := &PayInvoiceRequest{}
+	if !decodeJSON(rw, req, body) {
+		return
+	}
+
+	logger.Infof("v1 payInvoice: %+v", body)
+
+	errs := accountErrors("payer", body.Payer)
+	errs.Add(validation.CurrencyAmount(blueCurrencies.currencies(), "amount", "currency", body.Amount, body.Currency))
+	e := mergeErrors(validationError(errs), required("id", body.ID))
+	s.v1Invoke(rw, req, e, []string{
+		"payInvoice",
+		body.ID,
+		body.Payer,
+		body.Amount,
+		body.Currency,
+		blueTime()}, false)
+}
+
+// V1CheckCreate create a check
+func (s *BlueAPP) V1CheckCreate(rw web.ResponseWriter, req *web.Request) {
+	body := &CheckCreateRequest{}
+	if !decodeJSON(rw, req, body) {
+		return
+	}
+
+	logger.Infof("v1 checkCreate: %+v", body)
+
+	e := validationError(validation.Check(blueCurrencies.currencies(), body.Sender, body.Receiver, body.SendMax, body.Currency))
+	s.v1Invoke(rw, req, e, []string{
+		"checkCreate",
+		body.Sender,
+		body.Receiver,
+		body.SendMax,
+		body.Currency,
+		body.Expiry,
+		formatTag(body.DestinationTag),
+		body.InvoiceID}, true)
+}
+
+// V1CheckCash cash a check
+func (s *BlueAPP) V1CheckCash(rw web.ResponseWriter, req *web.Request) {
+	body := &CheckCashRequest{}
+	if !decodeJSON(rw, req, body) {
+		return
+	}
+
+	logger.Infof("v1 checkCash: %+v", body)
+
+	e := mergeErrors(validationError(accountErrors("receiver", body.Receiver)), required("id", body.ID, "amount", body.Amount))
+	s.v1Invoke(rw, req, e, []string{
+		"checkCash",
+		body.ID,
+		body.Receiver,
+		body.Amount,
+		blueTime()}, false)
+}
+
+// V1CheckCancel cancel a check
+func (s *BlueAPP) V1CheckCancel(rw web.ResponseWriter, req *web.Request) {
+	body := &CheckCancelRequest{}
+	if !decodeJSON(rw, req, body) {
+		return
+	}
+
+	logger.Infof("v1 checkCancel: %+v", body)
+
+	e := mergeErrors(validationError(accountErrors("account", body.Account)), required("id", body.ID))
+	s.v1Invoke(rw, req, e, []string{
+		"checkCancel",
+		body.ID,
+		body.Account}, false)
+}
+
+// V1OfferCancel take a resting offer off the book
+func (s *BlueAPP) V1OfferCancel(rw web.ResponseWriter, req *web.Request) {
+	body := &OfferCancelRequest{}
+	if !decodeJSON(rw, req, body) {
+		return
+	}
+
+	logger.Infof("v1 offerCancel: %+v", body)
+
+	e := mergeErrors(validationError(accountErrors("account", body.Account)), required("id", body.ID))
+	s.v1Invoke(rw, req, e, []string{
+		"offerCancel",
+		body.ID,
+		body.Account}, false)
+}
+
+// V1DepositPreauth allow a sender to deposit into an account with depositAuth
+func (s *BlueAPP) V1DepositPreauth(rw web.ResponseWriter, req *web.Request) {
+	s.v1DepositAuth(rw, req, "depositPreauth")
+}
+
+// V1DepositUnauth remove a sender from the deposit allow-list of an account
+func (s *BlueAPP) V1DepositUnauth(rw web.ResponseWriter, req *web.Request) {
+	s.v1DepositAuth(rw, req, "depositUnauth")
+}
+
+func (s *BlueAPP) v1DepositAuth(rw web.ResponseWriter, req *web.Request, function string) {
+	body := &DepositAuthRequest{}
+	if !decodeJSON(rw, req, body) {
+		return
+	}
+
+	logger.Infof("v1 %s: %+v", function, body)
+
+	e := validationError(validation.Preauth(body.Account, body.Authorized))
+	s.v1Invoke(rw, req, e, []string{
+		function,
+		body.Account,
+		body.Authorized}, false)
+}
+
+// V1Invoice query an invoice by ID
+func (s *BlueAPP) V1Invoice(rw web.ResponseWriter, req *web.Request) {
+	invoice := &Invoice{}
+	if s.v1Query(rw, req, []string{"queryInvoice", req.PathParams["id"]}, invoice) {
+		writeJSON(rw, invoice)
+	}
+}
+
+// V1Invoices query the invoices of a payee or a payer
+func (s *BlueAPP) V1Invoices(rw web.ResponseWriter, req *web.Request) {
+	payee := req.FormValue("payee")
+	payer := req.FormValue("payer")
+
+	if (payee == "") == (payer == "") {
+		writeError(rw, req, paramsError(map[string]string{"payee": "expecting one of payee or payer"}))
+		return
+	}
+
+	args := []string{"queryInvoicesByPayee", payee}
+	if payee == "" {
+		args = []string{"queryInvoicesByPayer", payer}
+	}
+
+	invoices := []*Invoice{}
+	if s.v1Query(rw, req, args, &invoices) {
+		writeJSON(rw, invoices)
+	}
+}
+
+// V1Check query a check by ID
+func (s *BlueAPP) V1Check(rw web.ResponseWriter, req *web.Request) {
+	check := &Check{}
+	if s.v1Query(rw, req, []string{"queryCheck", req.PathParams["id"]}, check) {
+		writeJSON(rw, check)
+	}
+}
+
+// V1Book query the resting offers of a pair
+func (s *BlueAPP) V1Book(rw web.ResponseWriter, req *web.Request) {
+	offers := []*BookOffer{}
+	if s.v1Query(rw, req, []string{"queryBook", req.PathParams["gets"] + "/" + req.PathParams["pays"]}, &offers) {
+		writeJSON(rw, offers)
+	}
+}
+
+// V1Checks query the checks of a sender or a receiver
+func (s *BlueAPP) V1Checks(rw web.ResponseWriter, req *web.Request) {
+	sender := req.FormValue("sender")
+	receiver := req.FormValue("receiver")
+
+	if (sender == "") == (receiver == "") {
+		writeError(rw, req, paramsError(map[string]string{"sender": "expecting one of sender or receiver"}))
+		return
+	}
+
+	args := []string{"queryChecksBySender", sender}
+	if sender == "" {
+		args = []string{"queryChecksByReceiver", receiver}
+	}
+
+	checks := []*Check{}
+	if s.v1Query(rw, req, args, &checks) {
+		writeJSON(rw, checks)
+	}
+}
+
+// V1Balances query the balances of an account by currency
+func (s *BlueAPP) V1Balances(rw web.ResponseWriter, req *web.Request) {
+	account := req.PathParams["account"]
+
+	balances := &BalancesResponse{Account: account}
+	if s.v1Query(rw, req, []string{"queryBalances", account}, &balances.Balances) {
+		writeJSON(rw, balances)
+	}
+}
+
+// V1DepositAuthorized query whether an account accepts funds from a sender
+func (s *BlueAPP) V1DepositAuthorized(rw web.ResponseWriter, req *web.Request) {
+	sender := req.FormValue("sender")
+	if sender == "" {
+		writeError(rw, req, paramsError(map[string]string{"sender": "required"}))
+		return
+	}
+
+	result := &DepositAuthorizedResponse{}
+	args := []string{"queryDepositAuthorized", sender, req.PathParams["account"], req.FormValue("destinationTag")}
+	if s.v1Query(rw, req, args, result) {
+		writeJSON(rw, result)
+	}
+}
+
+// V1TxStatus get the status of a transaction submitted by the app
+func (s *BlueAPP) V1TxStatus(rw web.ResponseWriter, req *web.Request) {
+	txid := req.PathParams["id"]
+
+	status, err := getTxStatus(txid)
+	if err == sql.ErrNoRows {
+		writeError(rw, req, newAPIError(http.StatusNotFound, codeNotFound, "unknown transaction"))
+		return
+	}
+	if err != nil {
+		writeError(rw, req, newAPIError(http.StatusInternalServerError, codeInternal, err.Error()))
+		return
+	}
+
+	writeJSON(rw, status)
+}
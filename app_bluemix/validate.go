@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/gocraft/web"
+	"github.com/spf13/viper"
+	"github.com/wutongtree/blue/chaincode_bluemix/validation"
+)
+
+// currencyCache holds the currencies known to the chaincode, refreshed from
+// queryCurrencies at most every ttl.
+type currencyCache struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	registry  *validation.Registry
+	refreshed time.Time
+}
+
+var blueCurrencies = &currencyCache{}
+
+// currencies returns the known currencies. When the chaincode cannot be
+// queried the last loaded registry is kept, the ISO 4217 currencies before
+// the first load.
+func (c *currencyCache) currencies() *validation.Registry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.registry != nil && time.Since(c.refreshed) < c.ttl {
+		return c.registry
+	}
+
+	registry, err := loadCurrencies()
+	if err != nil {
+		logger.Warningf("queryCurrencies error: %v", err)
+		if c.registry == nil {
+			return validation.NewRegistry()
+		}
+		return c.registry
+	}
+
+	c.registry, c.refreshed = registry, time.Now()
+
+	return registry
+}
+
+// invalidate forces the next lookup to query the chaincode
+func (c *currencyCache) invalidate() {
+	c.mu.Lock()
+	c.refreshed = time.Time{}
+	c.mu.Unlock()
+}
+
+// loadCurrencies returns the ISO 4217 currencies and the custom ones
+// registered in the chaincode
+func loadCurrencies() (*validation.Registry, error) {
+	result, e := queryBlueResult(context.Background(), []string{"queryCurrencies"})
+	if e != nil {
+		return nil, errors.New(e.Message)
+	}
+
+	var custom []validation.Currency
+	if err := json.Unmarshal(result, &custom); err != nil {
+		return nil, err
+	}
+
+	registry := validation.NewRegistry()
+	for _, c := range custom {
+		if err := registry.Register(c.Code, c.Precision); err != nil {
+			return nil, err
+		}
+	}
+
+	return registry, nil
+}
+
+// startValidation loads the app.validation settings
+func startValidation() {
+	blueCurrencies.ttl = viper.GetDuration("app.validation.currencyTTL")
+	if blueCurrencies.ttl <= 0 {
+		blueCurrencies.ttl = time.Minute
+	}
+}
+
+// validationError returns the invalid_params error of errs, nil when there is
+// no field error
+func validationError(errs validation.Errors) *APIError {
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return paramsError(errs.Fields())
+}
+
+// mergeErrors returns the first non-nil error of es, the fields of the
+// invalid_params ones merged
+func mergeErrors(es ...*APIError) *APIError {
+	var merged *APIError
+	for _, e := range es {
+		switch {
+		case e == nil:
+		case merged == nil:
+			merged = e
+		case merged.Code == codeInvalidParams && e.Code == codeInvalidParams:
+			for field, message := range e.Fields {
+				if _, ok := merged.Fields[field]; !ok {
+					merged.Fields[field] = message
+				}
+			}
+		}
+	}
+
+	return merged
+}
+
+// checkParams writes e and returns false when the request is in error
+func checkParams(rw web.ResponseWriter, req *web.Request, e *APIError) bool {
+	if e == nil {
+		return true
+	}
+
+	writeError(rw, req, e)
+	logger.Errorf("Error: %s %s: %s %v", req.Method, req.URL.Path, e.Message, e.Fields)
+
+	return false
+}
+
+// accountErrors checks account identifiers given as field, value pairs
+func accountErrors(fields ...string) validation.Errors {
+	var errs validation.Errors
+	for i := 0; i+1 < len(fields); i += 2 {
+		errs.Add(validation.Account(fields[i], fields[i+1]))
+	}
+
+	return errs
+}
+
+// --------------- handlers ---------------
+
+// AccountResponse is the response of POST /accounts.
+type AccountResponse struct {
+	Account string `json:"account"`
+}
+
+// NewAccount returns a new random account identifier owned by the caller.
+// An admin assigns an existing account to enrollId instead.
+func (s *BlueAPP) NewAccount(rw web.ResponseWriter, req *web.Request) {
+	account := req.FormValue("account")
+	enrollID := req.FormValue("enrollId")
+
+	if account != "" || enrollID != "" {
+		if !s.principal.HasScope(scopeAdmin) {
+			writeError(rw, req, newAPIError(http.StatusForbidden, codeForbidden, "scope "+scopeAdmin+" required"))
+			logger.Errorf("Error: %s cannot assign accounts", s.principal.Subject)
+
+			return
+		}
+		if !checkParams(rw, req, mergeErrors(validationError(accountErrors("account", account)), required("enrollId", enrollID))) {
+			return
+		}
+	} else {
+		if s.principal.EnrollID == "" {
+			writeError(rw, req, newAPIError(http.StatusUnauthorized, codeUnauthorized, errNoUser.Error()))
+			return
+		}
+
+		seed := make([]byte, 32)
+		if _, err := rand.Read(seed); err != nil {
+			writeError(rw, req, newAPIError(http.StatusInternalServerError, codeInternal, err.Error()))
+			logger.Errorf("newAccount error: %v", err)
+
+			return
+		}
+		account, enrollID = validation.NewAccount(seed), s.principal.EnrollID
+	}
+
+	if err := saveAccount(account, enrollID); err != nil {
+		writeStoreError(rw, "newAccount", err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(AccountResponse{Account: account})
+}
+
+// RegisterCurrency register a custom currency
+func (s *BlueAPP) RegisterCurrency(rw web.ResponseWriter, req *web.Request) {
+	encoder := json.NewEncoder(rw)
+
+	// get params
+	code := req.FormValue("code")
+	precision := req.FormValue("precision")
+
+	logger.Infof("registerCurrency: code=%v precision=%v", code, precision)
+
+	if !checkParams(rw, req, required("code", code, "precision", precision)) {
+		return
+	}
+
+	// invoke chaincode
+	txid := s.invokeBlue(rw, req, []string{"registerCurrency", code, precision})
+	if txid == "" {
+		return
+	}
+	blueCurrencies.invalidate()
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(BlueResponse{Status: "success", ID: code, TxID: txid})
+	logger.Infof("registerCurrency successful: '%s'\n", txid)
+}
+
+// Currencies list the registered custom currencies
+func (s *BlueAPP) Currencies(rw web.ResponseWriter, req *web.Request) {
+	s.queryBlue(rw, req, []string{"queryCurrencies"})
+}
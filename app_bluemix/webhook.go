@@ -0,0 +1,586 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocraft/web"
+	"github.com/spf13/viper"
+)
+
+// webhook events
+const (
+	webhookPaymentReceived = "payment.received"
+	webhookPaymentSent     = "payment.sent"
+	webhookOfferFilled     = "offer.filled"
+)
+
+// webhook signature headers
+const (
+	webhookSignatureHeader = "X-Blue-Signature"
+	webhookEventHeader     = "X-Blue-Event"
+	webhookDeliveryHeader  = "X-Blue-Delivery"
+)
+
+var webhookEvents = map[string]bool{
+	webhookPaymentReceived: true,
+	webhookPaymentSent:     true,
+	webhookOfferFilled:     true,
+}
+
+var webhookSchema = []string{
+	`CREATE TABLE IF NOT EXISTS webhooks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		account TEXT NOT NULL,
+		url TEXT NOT NULL,
+		events TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		created_at INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		webhook_id INTEGER NOT NULL,
+		event TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt INTEGER NOT NULL,
+		last_error TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS webhook_dead_letters (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		webhook_id INTEGER NOT NULL,
+		event TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		attempts INTEGER NOT NULL,
+		last_error TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		failed_at INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS webhook_checkpoint (
+		id INTEGER PRIMARY KEY CHECK (id = 0),
+		stream_event_id INTEGER NOT NULL
+	)`,
+	`INSERT OR IGNORE INTO webhook_checkpoint (id, stream_event_id) VALUES (0, 0)`,
+}
+
+// Webhook defines an HTTP callback registered by an account.
+type Webhook struct {
+	ID      int64    `json:"id"`
+	Account string   `json:"account"`
+	URL     string   `json:"url"`
+	Events  []string `json:"events"`
+	Secret  string   `json:"secret,omitempty"`
+}
+
+// WebhookPayload defines the body posted to a webhook.
+type WebhookPayload struct {
+	Event   string          `json:"event"`
+	Account string          `json:"account"`
+	TxID    string          `json:"txid"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// DeadLetter defines a delivery that exhausted its retries.
+type DeadLetter struct {
+	ID        int64           `json:"id"`
+	WebhookID int64           `json:"webhookId"`
+	Event     string          `json:"event"`
+	Payload   json.RawMessage `json:"payload"`
+	Attempts  int             `json:"attempts"`
+	LastError string          `json:"lastError"`
+	FailedAt  string          `json:"failedAt"`
+}
+
+// --------------- delivery worker ---------------
+
+// startWebhooks creates the webhook tables and starts the delivery worker. It
+// follows the recorded stream events from a checkpoint, so events seen while
+// a delivery is retried or the app restarts are not lost.
+func startWebhooks() error {
+	if err := execSchema(webhookSchema); err != nil {
+		return err
+	}
+
+	if !viper.GetBool("app.webhooks.enabled") {
+		logger.Infof("Webhooks are disabled.")
+		return nil
+	}
+
+	interval := viper.GetDuration("app.webhooks.interval")
+	if interval <= 0 {
+		interval = time.Second
+	}
+	timeout := viper.GetDuration("app.webhooks.timeout")
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	client := &http.Client{Timeout: timeout}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := enqueueWebhookDeliveries(); err != nil {
+				logger.Errorf("webhooks: enqueue error: %v", err)
+			}
+			if err := deliverWebhooks(client, time.Now()); err != nil {
+				logger.Errorf("webhooks: deliver error: %v", err)
+			}
+		}
+	}()
+
+	logger.Infof("Webhook worker started, interval %v", interval)
+
+	return nil
+}
+
+// webhookTarget is a webhook event and the account it concerns.
+type webhookTarget struct {
+	event   string
+	account string
+}
+
+// webhookEventsOf returns the webhook events of a stream event with the
+// account each one concerns. A fill concerns both the sender of the offer
+// and the maker of the offer it filled.
+func webhookEventsOf(e *StreamEvent) []webhookTarget {
+	switch e.Topic {
+	case topicPayments:
+		return []webhookTarget{{webhookPaymentReceived, e.Receiver}, {webhookPaymentSent, e.Sender}}
+	case topicTrades:
+		return []webhookTarget{{webhookOfferFilled, e.Sender}, {webhookOfferFilled, e.Receiver}}
+	}
+
+	return nil
+}
+
+// enqueueWebhookDeliveries turns the stream events after the checkpoint into
+// deliveries, advancing the checkpoint in the same database transaction
+func enqueueWebhookDeliveries() error {
+	var checkpoint int64
+	if err := appDB.QueryRow(`SELECT stream_event_id FROM webhook_checkpoint WHERE id = 0`).Scan(&checkpoint); err != nil {
+		return err
+	}
+
+	events, err := streamEventsSince(checkpoint)
+	if err != nil || len(events) == 0 {
+		return err
+	}
+
+	tx, err := appDB.Begin()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	for _, e := range events {
+		for _, target := range webhookEventsOf(e) {
+			event, account := target.event, target.account
+			if account == "" {
+				continue
+			}
+
+			hooks, err := webhooksOf(tx, account, event)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+
+			payload, err := json.Marshal(&WebhookPayload{Event: event, Account: account, TxID: e.TxID, Data: e.Payload})
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+
+			for _, hook := range hooks {
+				_, err := tx.Exec(`INSERT INTO webhook_deliveries (webhook_id, event, payload, next_attempt, created_at)
+					VALUES (?, ?, ?, ?, ?)`, hook.ID, event, string(payload), now, now)
+				if err != nil {
+					tx.Rollback()
+					return err
+				}
+			}
+		}
+		checkpoint = e.ID
+	}
+
+	if _, err := tx.Exec(`UPDATE webhook_checkpoint SET stream_event_id = ? WHERE id = 0`, checkpoint); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// streamEventsSince returns the recorded stream events after id of all topics
+func streamEventsSince(id int64) ([]*StreamEvent, error) {
+	rows, err := appDB.Query(`SELECT id, topic, name, txid, sender, receiver, pair, payload FROM stream_events
+		WHERE id > ? ORDER BY id LIMIT 100`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*StreamEvent
+	for rows.Next() {
+		e := &StreamEvent{}
+		var payload string
+		if err := rows.Scan(&e.ID, &e.Topic, &e.Name, &e.TxID, &e.Sender, &e.Receiver, &e.Pair, &payload); err != nil {
+			return nil, err
+		}
+		e.Payload = json.RawMessage(payload)
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+// webhooksOf returns the webhooks of account subscribed to event
+func webhooksOf(tx *sql.Tx, account string, event string) ([]*Webhook, error) {
+	rows, err := tx.Query(`SELECT id, url, events FROM webhooks WHERE account = ?`, account)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hooks []*Webhook
+	for rows.Next() {
+		hook := &Webhook{Account: account}
+		var events string
+		if err := rows.Scan(&hook.ID, &hook.URL, &events); err != nil {
+			return nil, err
+		}
+		hook.Events = strings.Split(events, ",")
+		for _, e := range hook.Events {
+			if e == event {
+				hooks = append(hooks, hook)
+				break
+			}
+		}
+	}
+
+	return hooks, rows.Err()
+}
+
+// deliverWebhooks posts the deliveries whose attempt is due
+func deliverWebhooks(client *http.Client, now time.Time) error {
+	rows, err := appDB.Query(`SELECT d.id, d.webhook_id, d.event, d.payload, d.attempts, d.created_at, w.url, w.secret
+		FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id
+		WHERE d.next_attempt <= ? ORDER BY d.id LIMIT 100`, now.Unix())
+	if err != nil {
+		return err
+	}
+
+	type delivery struct {
+		id, webhookID, createdAt int64
+		event, payload, url      string
+		secret                   string
+		attempts                 int
+	}
+	var deliveries []*delivery
+	for rows.Next() {
+		d := &delivery{}
+		if err := rows.Scan(&d.id, &d.webhookID, &d.event, &d.payload, &d.attempts, &d.createdAt, &d.url, &d.secret); err != nil {
+			rows.Close()
+			return err
+		}
+		deliveries = append(deliveries, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	maxAttempts := viper.GetInt("app.webhooks.maxAttempts")
+	if maxAttempts <= 0 {
+		maxAttempts = 8
+	}
+	retryDelay := viper.GetDuration("app.webhooks.retryDelay")
+	if retryDelay <= 0 {
+		retryDelay = 10 * time.Second
+	}
+
+	for _, d := range deliveries {
+		deliveryErr := postWebhook(client, d.url, d.secret, d.event, d.id, []byte(d.payload))
+		attempts := d.attempts + 1
+
+		if deliveryErr == nil {
+			logger.Infof("webhooks: delivery %d to %s succeeded", d.id, d.url)
+			_, err = appDB.Exec(`DELETE FROM webhook_deliveries WHERE id = ?`, d.id)
+		} else if attempts >= maxAttempts {
+			logger.Errorf("webhooks: delivery %d to %s dead after %d attempts: %v", d.id, d.url, attempts, deliveryErr)
+			err = deadLetterWebhook(d.id, d.webhookID, d.event, d.payload, attempts, deliveryErr.Error(), d.createdAt)
+		} else {
+			nextAttempt := time.Now().Add(retryDelay << uint(attempts-1))
+			logger.Warningf("webhooks: delivery %d to %s attempt %d failed: %v", d.id, d.url, attempts, deliveryErr)
+			_, err = appDB.Exec(`UPDATE webhook_deliveries SET attempts = ?, next_attempt = ?, last_error = ? WHERE id = ?`,
+				attempts, nextAttempt.Unix(), deliveryErr.Error(), d.id)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deadLetterWebhook moves an exhausted delivery into the dead-letter table
+func deadLetterWebhook(id, webhookID int64, event, payload string, attempts int, lastError string, createdAt int64) error {
+	tx, err := appDB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO webhook_dead_letters (webhook_id, event, payload, attempts, last_error, created_at, failed_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`, webhookID, event, payload, attempts, lastError, createdAt, time.Now().Unix())
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM webhook_deliveries WHERE id = ?`, id); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// postWebhook posts payload signed with HMAC-SHA256 of secret, any 2xx
+// response acknowledges the delivery
+func postWebhook(client *http.Client, url string, secret string, event string, delivery int64, payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, event)
+	req.Header.Set(webhookDeliveryHeader, strconv.FormatInt(delivery, 10))
+	req.Header.Set(webhookSignatureHeader, signWebhook(secret, payload))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("receiver responded %s", resp.Status)
+	}
+
+	return nil
+}
+
+// signWebhook returns the signature header value of payload
+func signWebhook(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// --------------- handlers ---------------
+
+// CreateWebhook register a webhook, the response carries its secret once
+func (s *BlueAPP) CreateWebhook(rw web.ResponseWriter, req *web.Request) {
+	encoder := json.NewEncoder(rw)
+
+	// get params
+	hook := &Webhook{
+		Account: req.FormValue("account"),
+		URL:     req.FormValue("url"),
+		Events:  strings.Split(req.FormValue("events"), ","),
+		Secret:  req.FormValue("secret"),
+	}
+
+	logger.Infof("createWebhook: account=%v url=%v events=%v", hook.Account, hook.URL, hook.Events)
+
+	valid := hook.Account != "" && len(hook.Events) > 0
+	for _, event := range hook.Events {
+		valid = valid && webhookEvents[event]
+	}
+	if u, err := url.Parse(hook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		valid = false
+	}
+	if !valid {
+		rw.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(BlueResponse{Status: "params error"})
+		logger.Error("Error: params error.")
+
+		return
+	}
+	if e := s.checkAccount(hook.Account); e != nil {
+		writeError(rw, req, e)
+		logger.Errorf("Error: createWebhook: %s", e.Message)
+
+		return
+	}
+
+	if hook.Secret == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			writeStoreError(rw, "createWebhook", err)
+			return
+		}
+		hook.Secret = hex.EncodeToString(b)
+	}
+
+	res, err := appDB.Exec(`INSERT INTO webhooks (account, url, events, secret, created_at) VALUES (?, ?, ?, ?, ?)`,
+		hook.Account, hook.URL, strings.Join(hook.Events, ","), hook.Secret, time.Now().Unix())
+	if err != nil {
+		writeStoreError(rw, "createWebhook", err)
+		return
+	}
+	hook.ID, _ = res.LastInsertId()
+
+	rw.WriteHeader(http.StatusOK)
+	encoder.Encode(hook)
+	logger.Infof("createWebhook successful: %d\n", hook.ID)
+}
+
+// Webhooks list the webhooks of the caller's accounts, optionally of one
+func (s *BlueAPP) Webhooks(rw web.ResponseWriter, req *web.Request) {
+	account := req.FormValue("account")
+
+	owned, args := ownedAccountsFilter(s.principal, "account")
+	rows, err := appDB.Query(`SELECT id, account, url, events FROM webhooks WHERE (? = '' OR account = ?) AND `+owned+` ORDER BY id`,
+		append([]interface{}{account, account}, args...)...)
+	if err != nil {
+		writeStoreError(rw, "webhooks", err)
+		return
+	}
+	defer rows.Close()
+
+	hooks := []*Webhook{}
+	for rows.Next() {
+		hook := &Webhook{}
+		var events string
+		if err := rows.Scan(&hook.ID, &hook.Account, &hook.URL, &events); err != nil {
+			writeStoreError(rw, "webhooks", err)
+			return
+		}
+		hook.Events = strings.Split(events, ",")
+		hooks = append(hooks, hook)
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(hooks)
+}
+
+// DeleteWebhook delete a webhook and its pending deliveries
+func (s *BlueAPP) DeleteWebhook(rw web.ResponseWriter, req *web.Request) {
+	id, err := strconv.ParseInt(req.PathParams["id"], 10, 64)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(rw).Encode(BlueResponse{Status: "params error"})
+		return
+	}
+
+	logger.Infof("deleteWebhook: id=%v", id)
+
+	var account string
+	if err := appDB.QueryRow(`SELECT account FROM webhooks WHERE id = ?`, id).Scan(&account); err != nil {
+		writeStoreError(rw, "deleteWebhook", err)
+		return
+	}
+	if e := s.checkAccount(account); e != nil {
+		writeError(rw, req, e)
+		logger.Errorf("Error: deleteWebhook: %s", e.Message)
+
+		return
+	}
+
+	if _, err := appDB.Exec(`DELETE FROM webhook_deliveries WHERE webhook_id = ?`, id); err != nil {
+		writeStoreError(rw, "deleteWebhook", err)
+		return
+	}
+	if _, err := appDB.Exec(`DELETE FROM webhooks WHERE id = ?`, id); err != nil {
+		writeStoreError(rw, "deleteWebhook", err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(BlueResponse{Status: "success"})
+}
+
+// DeadLetters list the deliveries that exhausted their retries
+func (s *BlueAPP) DeadLetters(rw web.ResponseWriter, req *web.Request) {
+	rows, err := appDB.Query(`SELECT id, webhook_id, event, payload, attempts, last_error, failed_at
+		FROM webhook_dead_letters ORDER BY id`)
+	if err != nil {
+		writeStoreError(rw, "deadLetters", err)
+		return
+	}
+	defer rows.Close()
+
+	letters := []*DeadLetter{}
+	for rows.Next() {
+		l := &DeadLetter{}
+		var payload string
+		var failedAt int64
+		if err := rows.Scan(&l.ID, &l.WebhookID, &l.Event, &payload, &l.Attempts, &l.LastError, &failedAt); err != nil {
+			writeStoreError(rw, "deadLetters", err)
+			return
+		}
+		l.Payload = json.RawMessage(payload)
+		l.FailedAt = formatUnix(failedAt)
+		letters = append(letters, l)
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(letters)
+}
+
+// ReplayDeadLetter queue a dead-lettered delivery again with fresh retries
+func (s *BlueAPP) ReplayDeadLetter(rw web.ResponseWriter, req *web.Request) {
+	id, err := strconv.ParseInt(req.PathParams["id"], 10, 64)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(rw).Encode(BlueResponse{Status: "params error"})
+		return
+	}
+
+	logger.Infof("replayDeadLetter: id=%v", id)
+
+	tx, err := appDB.Begin()
+	if err != nil {
+		writeStoreError(rw, "replayDeadLetter", err)
+		return
+	}
+
+	now := time.Now().Unix()
+	res, err := tx.Exec(`INSERT INTO webhook_deliveries (webhook_id, event, payload, next_attempt, created_at)
+		SELECT webhook_id, event, payload, ?, created_at FROM webhook_dead_letters WHERE id = ?`, now, id)
+	if err == nil {
+		if n, _ := res.RowsAffected(); n == 0 {
+			err = sql.ErrNoRows
+		}
+	}
+	if err == nil {
+		_, err = tx.Exec(`DELETE FROM webhook_dead_letters WHERE id = ?`, id)
+	}
+	if err != nil {
+		tx.Rollback()
+		writeStoreError(rw, "replayDeadLetter", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeStoreError(rw, "replayDeadLetter", err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(BlueResponse{Status: "success"})
+}
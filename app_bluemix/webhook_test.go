@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// webhookRequest is a delivery received by the test receiver
+type webhookRequest struct {
+	path      string
+	event     string
+	signature string
+	body      []byte
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	// the stream events are recorded by hand, without the event hub
+	openTestStore(t, func() error { return execSchema(streamSchema) }, startWebhooks)
+
+	viper.Set("app.webhooks.maxAttempts", 3)
+	viper.Set("app.webhooks.retryDelay", time.Minute)
+	defer viper.Set("app.webhooks.maxAttempts", 0)
+	defer viper.Set("app.webhooks.retryDelay", 0)
+
+	// alice's receiver acknowledges, carol's always fails
+	var mu sync.Mutex
+	var received []*webhookRequest
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		mu.Lock()
+		received = append(received, &webhookRequest{req.URL.Path, req.Header.Get(webhookEventHeader),
+			req.Header.Get(webhookSignatureHeader), body})
+		mu.Unlock()
+		if req.URL.Path == "/carol" {
+			rw.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+	receivedCount := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received)
+	}
+
+	now := time.Now()
+	for _, hook := range []struct{ account, path, secret string }{
+		{"alice", "/alice", "alice-secret"},
+		{"carol", "/carol", "carol-secret"},
+		{"bob", "/bob", "bob-secret"},
+	} {
+		_, err := appDB.Exec(`INSERT INTO webhooks (account, url, events, secret, created_at) VALUES (?, ?, ?, ?, ?)`,
+			hook.account, server.URL+hook.path, webhookOfferFilled, hook.secret, now.Unix())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// alice's offer fills carol's, the fill concerns both of them
+	fill := &StreamEvent{Topic: topicTrades, Name: "blue.trade", TxID: "tx-1", Sender: "alice", Receiver: "carol",
+		Pair: "USD/CNY", Payload: json.RawMessage(`{"offer":"tx-0","maker":"carol"}`)}
+	if err := recordStreamEvent(fill); err != nil {
+		t.Fatal(err)
+	}
+	if err := enqueueWebhookDeliveries(); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	if err := deliverWebhooks(client, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if n := receivedCount(); n != 2 {
+		t.Fatalf("first round: %d deliveries, want alice's and carol's", n)
+	}
+	for _, r := range received {
+		secret := map[string]string{"/alice": "alice-secret", "/carol": "carol-secret"}[r.path]
+		if r.signature != signWebhook(secret, r.body) {
+			t.Errorf("%s: signature %s does not match the body", r.path, r.signature)
+		}
+		if r.event != webhookOfferFilled {
+			t.Errorf("%s: event %s, want %s", r.path, r.event, webhookOfferFilled)
+		}
+		payload := &WebhookPayload{}
+		if err := json.Unmarshal(r.body, payload); err != nil {
+			t.Fatal(err)
+		}
+		if "/"+payload.Account != r.path || payload.TxID != "tx-1" {
+			t.Errorf("%s: payload %+v", r.path, payload)
+		}
+	}
+
+	// carol's delivery backs off, doubling the delay on each failure
+	for attempt, delay := range []time.Duration{time.Minute, 2 * time.Minute} {
+		var attempts int
+		var nextAttempt int64
+		err := appDB.QueryRow(`SELECT attempts, next_attempt FROM webhook_deliveries`).Scan(&attempts, &nextAttempt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := time.Now().Add(delay).Unix()
+		if attempts != attempt+1 || nextAttempt < want-5 || nextAttempt > want {
+			t.Fatalf("after attempt %d: attempts %d, next attempt in %ds, want %v", attempt+1, attempts,
+				nextAttempt-time.Now().Unix(), delay)
+		}
+
+		// nothing is due before the delay
+		before := receivedCount()
+		if err := deliverWebhooks(client, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		if receivedCount() != before {
+			t.Fatalf("after attempt %d: retried before the delay", attempt+1)
+		}
+
+		if err := deliverWebhooks(client, time.Unix(nextAttempt, 0)); err != nil {
+			t.Fatal(err)
+		}
+		if receivedCount() != before+1 {
+			t.Fatalf("after attempt %d: not retried after the delay", attempt+1)
+		}
+	}
+
+	// the third failure reaches maxAttempts and dead-letters the delivery
+	var pending int
+	if err := appDB.QueryRow(`SELECT COUNT(*) FROM webhook_deliveries`).Scan(&pending); err != nil {
+		t.Fatal(err)
+	}
+	if pending != 0 {
+		t.Fatalf("%d deliveries pending after maxAttempts", pending)
+	}
+
+	var event, lastError string
+	var attempts int
+	err := appDB.QueryRow(`SELECT event, attempts, last_error FROM webhook_dead_letters`).Scan(&event, &attempts, &lastError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event != webhookOfferFilled || attempts != 3 || lastError != "receiver responded 500 Internal Server Error" {
+		t.Fatalf("dead letter: event %s, attempts %d, last error %q", event, attempts, lastError)
+	}
+}
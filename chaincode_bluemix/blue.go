@@ -1,11 +1,18 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	"github.com/hyperledger/fabric/core/crypto/primitives"
 	"github.com/op/go-logging"
+	"github.com/wutongtree/blue/chaincode_bluemix/validation"
 )
 
 // For environment variables.
@@ -15,6 +22,15 @@ var (
 	sHandler = NewBlueHandler()
 )
 
+// limits of optional send fields
+const (
+	maxMemoLength      = 256
+	maxInvoiceIDLength = 64
+
+	// amountPrecision is the number of decimals kept in balances
+	amountPrecision = 18
+)
+
 // restResult defines the response payload for a general REST interface request.
 type restResult struct {
 	OK    string `protobuf:"bytes,1,opt,name=OK" json:"OK,omitempty"`
@@ -31,55 +47,283 @@ type BlueChaincode struct {
 // args[2]: amount
 // args[3]: currency
 // args[4]: timestr
+// args[5]: destinationTag, optional
+// args[6]: sourceTag, optional
+// args[7]: memo, optional
+// args[8]: invoiceID, optional
 func (t *BlueChaincode) send(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	logger.Debugf("+++++++++++++++++++++++++++++++++++ send in chaincode +++++++++++++++++++++++++++++++++")
 	logger.Debugf("send args: %v", args)
 
 	// parse arguments
-	if len(args) != 5 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 5")
+	if len(args) < 5 || len(args) > 9 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 5 to 9")
 	}
 
-	sender := args[0]
-	receiver := args[1]
-	amount := args[2]
-	currency := args[3]
-	timestr := args[4]
+	send := &sendRecord{
+		Sender:    args[0],
+		Receiver:  args[1],
+		Amount:    args[2],
+		Currency:  args[3],
+		Timestamp: args[4],
+	}
+	optional := make([]string, 4)
+	copy(optional, args[5:])
+	send.DestinationTag = optional[0]
+	send.SourceTag = optional[1]
+	send.Memo = optional[2]
+	send.InvoiceID = optional[3]
+
+	currencies, err := sHandler.getCurrencies(stub)
+	if err != nil {
+		return nil, err
+	}
+	if err := validation.Send(currencies, send.Sender, send.Receiver, send.Amount, send.Currency).Err(); err != nil {
+		return nil, err
+	}
+	if err := checkSendFields(send); err != nil {
+		return nil, err
+	}
 
 	// save state
-	return nil, sHandler.submitSend(stub,
-		timestr,
-		sender,
-		receiver,
-		amount,
-		currency)
+	return nil, sHandler.submitSend(stub, send)
+}
+
+// checkSendFields checks the optional fields of a send
+func checkSendFields(send *sendRecord) error {
+	if err := checkTag("destinationTag", send.DestinationTag); err != nil {
+		return err
+	}
+	if err := checkTag("sourceTag", send.SourceTag); err != nil {
+		return err
+	}
+	if len(send.Memo) > maxMemoLength {
+		return fmt.Errorf("memo exceeds %d bytes", maxMemoLength)
+	}
+	if len(send.InvoiceID) > maxInvoiceIDLength {
+		return fmt.Errorf("invoiceID exceeds %d bytes", maxInvoiceIDLength)
+	}
+
+	return nil
+}
+
+// checkTag checks that a non-empty tag is an unsigned 32-bit integer
+func checkTag(name, tag string) error {
+	if tag == "" {
+		return nil
+	}
+	if _, err := strconv.ParseUint(tag, 10, 32); err != nil {
+		return fmt.Errorf("%s must be an unsigned 32-bit integer: %s", name, tag)
+	}
+
+	return nil
+}
+
+// parseAmount parses a positive decimal amount
+func parseAmount(amount string) (*big.Rat, error) {
+	r, ok := new(big.Rat).SetString(amount)
+	if !ok || r.Sign() <= 0 {
+		return nil, fmt.Errorf("Invalid amount %s", amount)
+	}
+
+	return r, nil
+}
+
+// formatAmount formats an amount as a decimal string without trailing zeros
+func formatAmount(amount *big.Rat) string {
+	s := amount.FloatString(amountPrecision)
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+// txTime returns the timestamp of the current transaction
+func txTime(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Unix(ts.Seconds, int64(ts.Nanos)), nil
+}
+
+// queryBalances query the balances of an account by currency
+// args[0]: account
+func (t *BlueChaincode) queryBalances(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	balances, err := sHandler.getBalances(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(balances)
+}
+
+// queryBalanceAccounts query the accounts holding a balance
+func (t *BlueChaincode) queryBalanceAccounts(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 0 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 0")
+	}
+
+	accounts, err := sHandler.getBalanceAccounts(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(accounts)
 }
 
-// offer offer transactions
+// accountSet set or clear an account flag
+// args[0]: account
+// args[1]: flag, e.g. requireDestTag
+// args[2]: enabled, true or false
+func (t *BlueChaincode) accountSet(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debugf("+++++++++++++++++++++++++++++++++++ accountSet in chaincode +++++++++++++++++++++++++++++++++")
+	logger.Debugf("accountSet args: %v", args)
+
+	// parse arguments
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+	}
+
+	account := args[0]
+	if err := validation.Account("account", account); err != nil {
+		return nil, err
+	}
+	flag, ok := accountFlags[args[1]]
+	if !ok {
+		return nil, fmt.Errorf("Unknown account flag %s", args[1])
+	}
+	enabled, err := strconv.ParseBool(args[2])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid flag value %s", args[2])
+	}
+
+	// save state
+	return nil, sHandler.setAccountFlag(stub, account, flag, enabled)
+}
+
+// issuerSet set or clear the issuer flag of a gateway account, which may
+// send more than its balance. The app restricts it to admins.
+// args[0]: account
+// args[1]: enabled, true or false
+func (t *BlueChaincode) issuerSet(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debugf("+++++++++++++++++++++++++++++++++++ issuerSet in chaincode +++++++++++++++++++++++++++++++++")
+	logger.Debugf("issuerSet args: %v", args)
+
+	// parse arguments
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+
+	account := args[0]
+	if err := validation.Account("account", account); err != nil {
+		return nil, err
+	}
+	enabled, err := strconv.ParseBool(args[1])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid flag value %s", args[1])
+	}
+
+	// save state
+	return nil, sHandler.setAccountFlag(stub, account, flagIssuer, enabled)
+}
+
+// offer offer transactions, the offer fills the crossing offers of the
+// opposite book and the rest stays in the book. The offer ID is the
+// transaction ID.
 // args[0]: sender
-// args[1]: takerGets
-// args[2]: takerPays
+// args[1]: takerGets, <amount>/<currency>
+// args[2]: takerPays, <amount>/<currency>
 // args[3]: timestr
 func (t *BlueChaincode) offer(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	logger.Debugf("+++++++++++++++++++++++++++++++++++ send in chaincode +++++++++++++++++++++++++++++++++")
-	logger.Debugf("send args: %v", args)
+	logger.Debugf("+++++++++++++++++++++++++++++++++++ offer in chaincode +++++++++++++++++++++++++++++++++")
+	logger.Debugf("offer args: %v", args)
 
 	// parse arguments
 	if len(args) != 4 {
 		return nil, errors.New("Incorrect number of arguments. Expecting 4")
 	}
 
-	sender := args[0]
-	takerGets := args[1]
-	takerPays := args[2]
-	timestr := args[3]
+	offer := &offerRecord{
+		ID:        stub.GetTxID(),
+		Sender:    args[0],
+		TakerGets: args[1],
+		TakerPays: args[2],
+		Timestamp: args[3],
+	}
+
+	currencies, err := sHandler.getCurrencies(stub)
+	if err != nil {
+		return nil, err
+	}
+	if err := validation.Offer(currencies, offer.Sender, offer.TakerGets, offer.TakerPays).Err(); err != nil {
+		return nil, err
+	}
 
 	// save state
-	return nil, sHandler.submitOffer(stub,
-		timestr,
-		sender,
-		takerGets,
-		takerPays)
+	return []byte(offer.ID), sHandler.submitOffer(stub, currencies, offer)
+}
+
+// depositPreauth add or remove a sender in the deposit allow-list of an account
+// args[0]: account
+// args[1]: authorized sender
+func (t *BlueChaincode) depositPreauth(stub shim.ChaincodeStubInterface, args []string, enabled bool) ([]byte, error) {
+	logger.Debugf("+++++++++++++++++++++++++++++++++++ depositPreauth in chaincode +++++++++++++++++++++++++++++++++")
+	logger.Debugf("depositPreauth args: %v enabled: %v", args, enabled)
+
+	// parse arguments
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+
+	account := args[0]
+	authorized := args[1]
+	if err := validation.Preauth(account, authorized).Err(); err != nil {
+		return nil, err
+	}
+
+	// save state
+	return nil, sHandler.setPreauth(stub, account, authorized, enabled)
+}
+
+// depositAuthorized defines the result of queryDepositAuthorized.
+type depositAuthorized struct {
+	Authorized bool   `json:"authorized"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+// queryDepositAuthorized query whether receiver accepts funds from sender
+// args[0]: sender
+// args[1]: receiver
+// args[2]: destinationTag, optional
+func (t *BlueChaincode) queryDepositAuthorized(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) < 2 || len(args) > 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2 or 3")
+	}
+
+	destinationTag := ""
+	if len(args) == 3 {
+		destinationTag = args[2]
+	}
+
+	result := depositAuthorized{Authorized: true}
+	if err := sHandler.checkDeposit(stub, args[0], args[1], destinationTag); err != nil {
+		result = depositAuthorized{Authorized: false, Reason: err.Error()}
+	}
+
+	return json.Marshal(result)
+}
+
+// ping answers pong, the app checks that the chaincode is running with it
+func (t *BlueChaincode) ping(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 0 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 0")
+	}
+
+	return []byte("pong"), nil
 }
 
 // ----------------------- CHAINCODE ----------------------- //
@@ -101,6 +345,21 @@ func (t *BlueChaincode) Init(stub shim.ChaincodeStubInterface, function string,
 func (t *BlueChaincode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 	logger.Debugf("********************************Invoke****************************************")
 
+	// an upgraded chaincode is kept read-only for audit
+	if function != "upgradeTo" {
+		if err := checkWritable(stub); err != nil {
+			return nil, err
+		}
+	}
+
+	// a resubmitted transaction is applied once. importState needs empty
+	// tables and fails on a second run anyway.
+	if function != "importState" {
+		if err := claimTx(stub); err != nil {
+			return nil, err
+		}
+	}
+
 	//	 Handle different functions
 	if function == "send" {
 		// Sign file
@@ -108,6 +367,32 @@ func (t *BlueChaincode) Invoke(stub shim.ChaincodeStubInterface, function string
 	} else if function == "offer" {
 		// Verify file
 		return t.offer(stub, args)
+	} else if function == "offerCancel" {
+		return t.offerCancel(stub, args)
+	} else if function == "accountSet" {
+		return t.accountSet(stub, args)
+	} else if function == "issuerSet" {
+		return t.issuerSet(stub, args)
+	} else if function == "createInvoice" {
+		return t.createInvoice(stub, args)
+	} else if function == "payInvoice" {
+		return t.payInvoice(stub, args)
+	} else if function == "checkCreate" {
+		return t.checkCreate(stub, args)
+	} else if function == "checkCash" {
+		return t.checkCash(stub, args)
+	} else if function == "checkCancel" {
+		return t.checkCancel(stub, args)
+	} else if function == "depositPreauth" {
+		return t.depositPreauth(stub, args, true)
+	} else if function == "depositUnauth" {
+		return t.depositPreauth(stub, args, false)
+	} else if function == "registerCurrency" {
+		return t.registerCurrency(stub, args)
+	} else if function == "importState" {
+		return t.importState(stub, args)
+	} else if function == "upgradeTo" {
+		return t.upgradeTo(stub, args)
 	}
 
 	return nil, errors.New("Received unknown function invocation")
@@ -118,6 +403,40 @@ func (t *BlueChaincode) Invoke(stub shim.ChaincodeStubInterface, function string
 func (t *BlueChaincode) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 	logger.Debugf("********************************Query****************************************")
 
+	if function == "queryInvoice" {
+		return t.queryInvoice(stub, args)
+	} else if function == "queryInvoicesByPayee" {
+		return t.queryInvoices(stub, tableInvoicePayee, args)
+	} else if function == "queryInvoicesByPayer" {
+		return t.queryInvoices(stub, tableInvoicePayer, args)
+	} else if function == "queryCheck" {
+		return t.queryCheck(stub, args)
+	} else if function == "queryChecksBySender" {
+		return t.queryChecks(stub, tableCheckSender, args)
+	} else if function == "queryChecksByReceiver" {
+		return t.queryChecks(stub, tableCheckReceiver, args)
+	} else if function == "queryBook" {
+		return t.queryBook(stub, args)
+	} else if function == "queryBalances" {
+		return t.queryBalances(stub, args)
+	} else if function == "queryBalanceAccounts" {
+		return t.queryBalanceAccounts(stub, args)
+	} else if function == "queryDepositAuthorized" {
+		return t.queryDepositAuthorized(stub, args)
+	} else if function == "queryCurrencies" {
+		return t.queryCurrencies(stub, args)
+	} else if function == "queryPayments" {
+		return t.queryPayments(stub, args)
+	} else if function == "queryStats" {
+		return t.queryStats(stub, args)
+	} else if function == "ping" {
+		return t.ping(stub, args)
+	} else if function == "queryStateChecksum" {
+		return t.queryStateChecksum(stub, args)
+	} else if function == "exportState" {
+		return t.exportState(stub, args)
+	}
+
 	return nil, errors.New("Received unknown function query invocation with function " + function)
 }
 
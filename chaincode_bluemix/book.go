@@ -0,0 +1,427 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/wutongtree/blue/chaincode_bluemix/validation"
+)
+
+// bookRecord defines an offer resting in the book of its pair, with the
+// amounts left to fill.
+type bookRecord struct {
+	ID        string `json:"id"`
+	Sender    string `json:"sender"`
+	TakerGets string `json:"takerGets"`
+	TakerPays string `json:"takerPays"`
+	Timestamp string `json:"timestamp"`
+	// Placed is the transaction time of the offer in nanoseconds, older
+	// offers fill first at the same rate
+	Placed int64 `json:"placed"`
+}
+
+// fillRecord defines a fill of a resting offer. As in the offer that
+// crossed it, the sender gave takerGets and received takerPays.
+type fillRecord struct {
+	Offer     string `json:"offer"`
+	Maker     string `json:"maker"`
+	TakerGets string `json:"takerGets"`
+	TakerPays string `json:"takerPays"`
+}
+
+// tradeRecord defines the payload of a trade event, an offer that filled
+// resting offers.
+type tradeRecord struct {
+	*offerRecord
+	Fills []*fillRecord `json:"fills"`
+}
+
+// bookAmount is a parsed <value>/<currency> amount.
+type bookAmount struct {
+	value    *big.Rat
+	currency validation.Currency
+}
+
+// restingOffer is a book record with its amounts parsed.
+type restingOffer struct {
+	*bookRecord
+	gets *bookAmount
+	pays *bookAmount
+}
+
+// offerCancel take a resting offer off the book, only its sender may cancel
+// args[0]: offer ID
+// args[1]: account
+func (t *BlueChaincode) offerCancel(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debugf("+++++++++++++++++++++++++++++++++++ offerCancel in chaincode +++++++++++++++++++++++++++++++++")
+	logger.Debugf("offerCancel args: %v", args)
+
+	// parse arguments
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+
+	id := args[0]
+	account := args[1]
+
+	offer := &bookRecord{}
+	ok, err := getObject(stub, tableBook, id, offer)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("Offer %s not found", id)
+	}
+	if account != offer.Sender {
+		return nil, fmt.Errorf("Offer %s can only be cancelled by %s", id, offer.Sender)
+	}
+
+	// save state
+	if err := sHandler.removeBookOffer(stub, offer); err != nil {
+		return nil, err
+	}
+
+	return nil, setEvent(stub, eventOfferCancel, offer)
+}
+
+// queryBook query the resting offers of a pair, best rate first
+// args[0]: pair, <getsCurrency>/<paysCurrency>
+func (t *BlueChaincode) queryBook(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	currencies, err := sHandler.getCurrencies(stub)
+	if err != nil {
+		return nil, err
+	}
+	resting, err := sHandler.getBook(stub, currencies, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	offers := []*bookRecord{}
+	for _, r := range resting {
+		offers = append(offers, r.bookRecord)
+	}
+
+	return json.Marshal(offers)
+}
+
+// submitOffer records an offer, fills it against the crossing offers of the
+// opposite book at their rates and rests what is left
+// currencies: known currencies
+// offer: offer record
+func (t *tableHandler) submitOffer(stub shim.ChaincodeStubInterface, currencies *validation.Registry, offer *offerRecord) error {
+
+	logger.Debugf("insert table offer: %+v", offer)
+
+	gets, err := parseBookAmount(currencies, offer.TakerGets)
+	if err != nil {
+		return err
+	}
+	pays, err := parseBookAmount(currencies, offer.TakerPays)
+	if err != nil {
+		return err
+	}
+	if err := t.checkFunds(stub, offer.Sender, gets.currency.Code, gets.value); err != nil {
+		return err
+	}
+
+	//insert a new row for offer transaction
+	ok, err := stub.InsertRow(tableOffer, shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: offer.Timestamp}},
+			&shim.Column{Value: &shim.Column_String_{String_: offer.Sender}},
+			&shim.Column{Value: &shim.Column_String_{String_: offer.TakerGets}},
+			&shim.Column{Value: &shim.Column_String_{String_: offer.TakerPays}}},
+	})
+	if err != nil {
+		logger.Errorf("submitOffer: system error %v", err)
+		return err
+	}
+	if !ok {
+		return errors.New("Offer was already submitted.")
+	}
+
+	resting, err := t.getBook(stub, currencies, bookPair(offer.TakerPays, offer.TakerGets))
+	if err != nil {
+		return err
+	}
+
+	// wantPays is left to receive
+	wantPays := new(big.Rat).Set(pays.value)
+	var fills []*fillRecord
+	for _, r := range resting {
+		if wantPays.Sign() <= 0 {
+			break
+		}
+		if r.Sender == offer.Sender {
+			continue
+		}
+		if !crosses(r, gets, pays) {
+			break
+		}
+
+		// the maker gives b of the pays currency for a of the gets currency
+		b := minRat(r.gets.value, wantPays)
+		a := fillPrice(b, r, gets, pays)
+		if a.Sign() <= 0 {
+			break
+		}
+
+		// a maker that no longer holds what it offers is taken off the book
+		if err := t.checkFunds(stub, r.Sender, r.gets.currency.Code, b); err != nil {
+			logger.Debugf("submitOffer: removing unfunded offer %s: %v", r.ID, err)
+			if err := t.removeBookOffer(stub, r.bookRecord); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// settling credits both sides, a maker with depositAuth that did not
+		// preauthorize the taker keeps its offer for other takers, while a
+		// taker that did not preauthorize the maker cannot take it
+		if err := t.checkDepositAuth(stub, offer.Sender, r.Sender); err != nil {
+			logger.Debugf("submitOffer: skipping offer %s: %v", r.ID, err)
+			continue
+		}
+		if err := t.checkDepositAuth(stub, r.Sender, offer.Sender); err != nil {
+			return err
+		}
+
+		if err := t.trade(stub, offer.Sender, r.Sender, gets.currency.Code, a, pays.currency.Code, b); err != nil {
+			return err
+		}
+		if err := t.consumeBookOffer(stub, r, b, a); err != nil {
+			return err
+		}
+
+		wantPays.Sub(wantPays, b)
+		fills = append(fills, &fillRecord{
+			Offer:     r.ID,
+			Maker:     r.Sender,
+			TakerGets: formatAmount(a) + "/" + gets.currency.Code,
+			TakerPays: formatAmount(b) + "/" + pays.currency.Code,
+		})
+	}
+
+	if wantPays.Sign() > 0 {
+		restGets := restAmount(wantPays, gets, pays)
+		if restGets.Sign() > 0 {
+			now, err := txTime(stub)
+			if err != nil {
+				return err
+			}
+			rest := &bookRecord{
+				ID:        offer.ID,
+				Sender:    offer.Sender,
+				TakerGets: formatAmount(restGets) + "/" + gets.currency.Code,
+				TakerPays: formatAmount(wantPays) + "/" + pays.currency.Code,
+				Timestamp: offer.Timestamp,
+				Placed:    now.UnixNano(),
+			}
+			if err := t.putBookOffer(stub, rest); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(fills) == 0 {
+		return setEvent(stub, eventOffer, offer)
+	}
+
+	return setEvent(stub, eventTrade, &tradeRecord{offerRecord: offer, Fills: fills})
+}
+
+// crosses reports whether the resting offer r crosses an offer giving gets
+// for pays: its rate, what it wants per unit it gives, is at most the rate of
+// the offer
+func crosses(r *restingOffer, gets *bookAmount, pays *bookAmount) bool {
+	return new(big.Rat).Mul(r.pays.value, pays.value).Cmp(new(big.Rat).Mul(gets.value, r.gets.value)) <= 0
+}
+
+// restAmount returns what an offer giving gets for pays still gives for
+// wantPays left to receive. The rest keeps the rate of the offer, rounded
+// down in its favor, and is zero when less than the precision of gets.
+func restAmount(wantPays *big.Rat, gets *bookAmount, pays *bookAmount) *big.Rat {
+	restGets := new(big.Rat).Mul(wantPays, new(big.Rat).Quo(gets.value, pays.value))
+
+	return roundAmount(restGets, gets.currency.Precision, false)
+}
+
+// fillPrice returns what the taker gives for b at the rate of the resting
+// offer r, rounded up to the precision of the gets currency in favor of the
+// maker unless that exceeds the rate of the taker
+func fillPrice(b *big.Rat, r *restingOffer, gets *bookAmount, pays *bookAmount) *big.Rat {
+	exact := new(big.Rat).Mul(b, new(big.Rat).Quo(r.pays.value, r.gets.value))
+	limit := new(big.Rat).Mul(b, new(big.Rat).Quo(gets.value, pays.value))
+
+	a := roundAmount(exact, gets.currency.Precision, true)
+	if a.Cmp(limit) > 0 {
+		a = roundAmount(exact, gets.currency.Precision, false)
+	}
+
+	return a
+}
+
+// trade moves a of currency ca from taker to maker and b of currency cb from
+// maker to taker
+func (t *tableHandler) trade(stub shim.ChaincodeStubInterface, taker, maker string, ca string, a *big.Rat, cb string, b *big.Rat) error {
+	if err := t.addBalance(stub, taker, ca, new(big.Rat).Neg(a)); err != nil {
+		return err
+	}
+	if err := t.addBalance(stub, maker, ca, a); err != nil {
+		return err
+	}
+	if err := t.addBalance(stub, maker, cb, new(big.Rat).Neg(b)); err != nil {
+		return err
+	}
+
+	return t.addBalance(stub, taker, cb, b)
+}
+
+// getBook returns the resting offers of a pair, best rate first and older
+// first at the same rate
+// currencies: known currencies
+// pair: <getsCurrency>/<paysCurrency>
+func (t *tableHandler) getBook(stub shim.ChaincodeStubInterface, currencies *validation.Registry, pair string) ([]*restingOffer, error) {
+	ids, err := getIndex(stub, tableBookPair, pair)
+	if err != nil {
+		return nil, err
+	}
+
+	var offers []*restingOffer
+	for _, id := range ids {
+		record := &bookRecord{}
+		ok, err := getObject(stub, tableBook, id, record)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("Book offer %s not found", id)
+		}
+
+		r := &restingOffer{bookRecord: record}
+		if r.gets, err = parseBookAmount(currencies, record.TakerGets); err != nil {
+			return nil, err
+		}
+		if r.pays, err = parseBookAmount(currencies, record.TakerPays); err != nil {
+			return nil, err
+		}
+		offers = append(offers, r)
+	}
+
+	sort.Sort(byRate(offers))
+
+	return offers, nil
+}
+
+// byRate sorts resting offers by rate, what they want per unit they give,
+// then by age.
+type byRate []*restingOffer
+
+func (s byRate) Len() int      { return len(s) }
+func (s byRate) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byRate) Less(i, j int) bool {
+	ri := new(big.Rat).Mul(s[i].pays.value, s[j].gets.value)
+	rj := new(big.Rat).Mul(s[j].pays.value, s[i].gets.value)
+	if c := ri.Cmp(rj); c != 0 {
+		return c < 0
+	}
+	if s[i].Placed != s[j].Placed {
+		return s[i].Placed < s[j].Placed
+	}
+
+	return s[i].ID < s[j].ID
+}
+
+// putBookOffer rests an offer in the book of its pair
+func (t *tableHandler) putBookOffer(stub shim.ChaincodeStubInterface, offer *bookRecord) error {
+	logger.Debugf("insert table book: %+v", offer)
+
+	if err := putObject(stub, tableBook, offer.ID, offer); err != nil {
+		return err
+	}
+
+	return putIndex(stub, tableBookPair, bookPair(offer.TakerGets, offer.TakerPays), offer.ID)
+}
+
+// consumeBookOffer takes b given and a received off a resting offer and
+// removes it once filled
+func (t *tableHandler) consumeBookOffer(stub shim.ChaincodeStubInterface, r *restingOffer, b *big.Rat, a *big.Rat) error {
+	r.gets.value.Sub(r.gets.value, b)
+	r.pays.value.Sub(r.pays.value, a)
+	if r.gets.value.Sign() <= 0 || r.pays.value.Sign() <= 0 {
+		return t.removeBookOffer(stub, r.bookRecord)
+	}
+
+	r.TakerGets = formatAmount(r.gets.value) + "/" + r.gets.currency.Code
+	r.TakerPays = formatAmount(r.pays.value) + "/" + r.pays.currency.Code
+
+	return putObject(stub, tableBook, r.ID, r.bookRecord)
+}
+
+// removeBookOffer deletes a resting offer and its pair index
+func (t *tableHandler) removeBookOffer(stub shim.ChaincodeStubInterface, offer *bookRecord) error {
+	logger.Debugf("delete table book: %v", offer.ID)
+
+	if err := stub.DeleteRow(tableBook, []shim.Column{
+		shim.Column{Value: &shim.Column_String_{String_: offer.ID}},
+	}); err != nil {
+		return err
+	}
+
+	return deleteIndex(stub, tableBookPair, bookPair(offer.TakerGets, offer.TakerPays), offer.ID)
+}
+
+// bookPair returns the book of an offer as <getsCurrency>/<paysCurrency>
+func bookPair(takerGets, takerPays string) string {
+	_, gets, _ := validation.SplitAmount("takerGets", takerGets)
+	_, pays, _ := validation.SplitAmount("takerPays", takerPays)
+
+	return gets + "/" + pays
+}
+
+// parseBookAmount parses a <value>/<currency> amount of a known currency
+func parseBookAmount(currencies *validation.Registry, amount string) (*bookAmount, error) {
+	value, code, ferr := validation.SplitAmount("amount", amount)
+	if ferr != nil {
+		return nil, ferr
+	}
+	currency, ok := currencies.Lookup(code)
+	if !ok {
+		return nil, fmt.Errorf("Unknown currency %s", code)
+	}
+	r, err := parseAmount(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return &bookAmount{value: r, currency: currency}, nil
+}
+
+// roundAmount rounds x to precision decimals, up or down
+func roundAmount(x *big.Rat, precision int, up bool) *big.Rat {
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(precision)), nil)
+	n := new(big.Int).Mul(x.Num(), scale)
+
+	q, m := new(big.Int).QuoRem(n, x.Denom(), new(big.Int))
+	if up && m.Sign() > 0 {
+		q.Add(q, big.NewInt(1))
+	}
+
+	return new(big.Rat).SetFrac(q, scale)
+}
+
+func minRat(x, y *big.Rat) *big.Rat {
+	if x.Cmp(y) < 0 {
+		return new(big.Rat).Set(x)
+	}
+
+	return new(big.Rat).Set(y)
+}
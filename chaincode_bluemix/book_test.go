@@ -0,0 +1,458 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/wutongtree/blue/chaincode_bluemix/validation"
+)
+
+var (
+	usd = validation.Currency{Code: "USD", Precision: 2}
+	cny = validation.Currency{Code: "CNY", Precision: 2}
+	jpy = validation.Currency{Code: "JPY", Precision: 0}
+)
+
+func rat(s string) *big.Rat {
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		panic("bad rat " + s)
+	}
+
+	return r
+}
+
+func amount(value string, currency validation.Currency) *bookAmount {
+	return &bookAmount{value: rat(value), currency: currency}
+}
+
+// resting returns an offer resting in the book giving gets for pays
+func resting(id string, placed int64, gets, pays *bookAmount) *restingOffer {
+	return &restingOffer{bookRecord: &bookRecord{ID: id, Placed: placed}, gets: gets, pays: pays}
+}
+
+func TestRoundAmount(t *testing.T) {
+	tests := []struct {
+		x         string
+		precision int
+		up        bool
+		want      string
+	}{
+		{"1/3", 2, false, "0.33"},
+		{"1/3", 2, true, "0.34"},
+		{"0.5", 2, true, "0.5"},
+		{"0.005", 2, false, "0"},
+		{"0.005", 2, true, "0.01"},
+		{"7/2", 0, false, "3"},
+		{"7/2", 0, true, "4"},
+	}
+	for _, tt := range tests {
+		got := roundAmount(rat(tt.x), tt.precision, tt.up)
+		if got.Cmp(rat(tt.want)) != 0 {
+			t.Errorf("roundAmount(%s, %d, %v) = %s, want %s", tt.x, tt.precision, tt.up, formatAmount(got), tt.want)
+		}
+	}
+}
+
+func TestFillPrice(t *testing.T) {
+	// the maker gives 3 CNY for 1 USD
+	maker := resting("m", 1, amount("3", cny), amount("1", usd))
+
+	tests := []struct {
+		name       string
+		b          string
+		gets, pays *bookAmount
+		want       string
+	}{
+		{"exact at the maker's rate", "3", amount("1", usd), amount("3", cny), "1"},
+		{"maker rounded up", "1", amount("1", usd), amount("2.9", cny), "0.34"},
+		{"rounded down to the taker's limit", "1", amount("1", usd), amount("3", cny), "0.33"},
+	}
+	for _, tt := range tests {
+		got := fillPrice(rat(tt.b), maker, tt.gets, tt.pays)
+		if got.Cmp(rat(tt.want)) != 0 {
+			t.Errorf("%s: fillPrice = %s, want %s", tt.name, formatAmount(got), tt.want)
+		}
+	}
+}
+
+func TestCrosses(t *testing.T) {
+	// an offer giving 10 USD for 70 CNY, 7 CNY per USD
+	gets, pays := amount("10", usd), amount("70", cny)
+
+	tests := []struct {
+		name  string
+		maker *restingOffer
+		want  bool
+	}{
+		{"better rate", resting("m", 1, amount("80", cny), amount("10", usd)), true},
+		{"same rate", resting("m", 1, amount("7", cny), amount("1", usd)), true},
+		{"worse rate", resting("m", 1, amount("60", cny), amount("10", usd)), false},
+	}
+	for _, tt := range tests {
+		if got := crosses(tt.maker, gets, pays); got != tt.want {
+			t.Errorf("%s: crosses = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRestAmount(t *testing.T) {
+	tests := []struct {
+		name       string
+		wantPays   string
+		gets, pays *bookAmount
+		want       string
+	}{
+		{"whole offer", "70", amount("10", usd), amount("70", cny), "10"},
+		{"partial fill", "35", amount("10", usd), amount("70", cny), "5"},
+		{"rounded down", "1", amount("10", usd), amount("30", cny), "0.33"},
+		{"rounds to zero", "5", amount("1", jpy), amount("10", usd), "0"},
+	}
+	for _, tt := range tests {
+		got := restAmount(rat(tt.wantPays), tt.gets, tt.pays)
+		if got.Cmp(rat(tt.want)) != 0 {
+			t.Errorf("%s: restAmount = %s, want %s", tt.name, formatAmount(got), tt.want)
+		}
+	}
+}
+
+func TestByRate(t *testing.T) {
+	offers := []*restingOffer{
+		resting("worse", 1, amount("60", cny), amount("10", usd)),
+		resting("late", 3, amount("70", cny), amount("10", usd)),
+		resting("b", 2, amount("7", cny), amount("1", usd)),
+		resting("a", 2, amount("70", cny), amount("10", usd)),
+		resting("best", 4, amount("80", cny), amount("10", usd)),
+	}
+	sort.Sort(byRate(offers))
+
+	var got []string
+	for _, r := range offers {
+		got = append(got, r.ID)
+	}
+	if want := "best a b late worse"; strings.Join(got, " ") != want {
+		t.Fatalf("book order %v, want %s", got, want)
+	}
+}
+
+// --------------- submitOffer ---------------
+
+// tableStub is an in-memory chaincode stub with the tables of the shim
+type tableStub struct {
+	shim.ChaincodeStubInterface
+	rows   map[string]map[string]shim.Row
+	state  map[string][]byte
+	events map[string][]byte
+	txid   string
+	now    int64
+}
+
+func newTableStub() *tableStub {
+	return &tableStub{rows: map[string]map[string]shim.Row{}, state: map[string][]byte{}, events: map[string][]byte{}}
+}
+
+// key joins the values of the key columns of a row or a partial key
+func (s *tableStub) key(table string, columns []*shim.Column) string {
+	definitions, _ := tableColumns(table)
+	var values []string
+	for i, d := range definitions {
+		if !d.Key || i >= len(columns) {
+			break
+		}
+		values = append(values, fmt.Sprint(columns[i].Value))
+	}
+
+	return strings.Join(values, "\x00")
+}
+
+func keyColumns(key []shim.Column) []*shim.Column {
+	columns := make([]*shim.Column, len(key))
+	for i := range key {
+		columns[i] = &key[i]
+	}
+
+	return columns
+}
+
+func (s *tableStub) GetTxID() string { return s.txid }
+
+func (s *tableStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	s.now++
+	return &timestamp.Timestamp{Seconds: s.now}, nil
+}
+
+func (s *tableStub) GetState(key string) ([]byte, error) { return s.state[key], nil }
+
+func (s *tableStub) PutState(key string, value []byte) error {
+	s.state[key] = value
+	return nil
+}
+
+func (s *tableStub) DelState(key string) error {
+	delete(s.state, key)
+	return nil
+}
+
+func (s *tableStub) SetEvent(name string, payload []byte) error {
+	s.events[name] = payload
+	return nil
+}
+
+func (s *tableStub) CreateTable(name string, columns []*shim.ColumnDefinition) error {
+	s.rows[name] = map[string]shim.Row{}
+	return nil
+}
+
+func (s *tableStub) InsertRow(table string, row shim.Row) (bool, error) {
+	k := s.key(table, row.Columns)
+	if _, ok := s.rows[table][k]; ok {
+		return false, nil
+	}
+	s.rows[table][k] = row
+
+	return true, nil
+}
+
+func (s *tableStub) ReplaceRow(table string, row shim.Row) (bool, error) {
+	k := s.key(table, row.Columns)
+	if _, ok := s.rows[table][k]; !ok {
+		return false, nil
+	}
+	s.rows[table][k] = row
+
+	return true, nil
+}
+
+func (s *tableStub) GetRow(table string, key []shim.Column) (shim.Row, error) {
+	return s.rows[table][s.key(table, keyColumns(key))], nil
+}
+
+func (s *tableStub) DeleteRow(table string, key []shim.Column) error {
+	delete(s.rows[table], s.key(table, keyColumns(key)))
+	return nil
+}
+
+func (s *tableStub) GetRows(table string, key []shim.Column) (<-chan shim.Row, error) {
+	prefix := s.key(table, keyColumns(key))
+	var keys []string
+	for k := range s.rows[table] {
+		if prefix == "" || k == prefix || strings.HasPrefix(k, prefix+"\x00") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	rows := make(chan shim.Row, len(keys))
+	for _, k := range keys {
+		rows <- s.rows[table][k]
+	}
+	close(rows)
+
+	return rows, nil
+}
+
+// bookTest runs transactions against a chaincode on a tableStub
+type bookTest struct {
+	t    *testing.T
+	stub *tableStub
+	cc   *BlueChaincode
+}
+
+func newBookTest(t *testing.T) *bookTest {
+	b := &bookTest{t: t, stub: newTableStub(), cc: new(BlueChaincode)}
+	if _, err := b.cc.Init(b.stub, "init", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the gateway issues the balances of the traders
+	b.must("issuer", "issuerSet", "gateway", "true")
+	b.must("fund-alice", "send", "gateway", "alice", "100", "USD", "t")
+	b.must("fund-bob", "send", "gateway", "bob", "300", "CNY", "t")
+	b.must("fund-carol", "send", "gateway", "carol", "300", "CNY", "t")
+
+	return b
+}
+
+// account returns the account identifier of a test user
+func account(name string) string {
+	return validation.NewAccount([]byte(name))
+}
+
+func (b *bookTest) invoke(txid, function string, args ...string) error {
+	b.stub.txid = txid
+	b.stub.events = map[string][]byte{}
+	for i, arg := range args {
+		switch arg {
+		case "gateway", "alice", "bob", "carol":
+			args[i] = account(arg)
+		}
+	}
+
+	_, err := b.cc.Invoke(b.stub, function, args)
+	return err
+}
+
+func (b *bookTest) must(txid, function string, args ...string) {
+	if err := b.invoke(txid, function, args...); err != nil {
+		b.t.Fatalf("%s %s: %v", txid, function, err)
+	}
+}
+
+func (b *bookTest) balances(name string) map[string]string {
+	balances, err := sHandler.getBalances(b.stub, account(name))
+	if err != nil {
+		b.t.Fatal(err)
+	}
+
+	return balances
+}
+
+func (b *bookTest) book(pair string) []*bookRecord {
+	result, err := b.cc.Query(b.stub, "queryBook", []string{pair})
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	var offers []*bookRecord
+	if err := json.Unmarshal(result, &offers); err != nil {
+		b.t.Fatal(err)
+	}
+
+	return offers
+}
+
+func (b *bookTest) fills() []*fillRecord {
+	trade := &tradeRecord{offerRecord: &offerRecord{}}
+	if payload, ok := b.stub.events[eventTrade]; ok {
+		if err := json.Unmarshal(payload, trade); err != nil {
+			b.t.Fatal(err)
+		}
+	}
+
+	return trade.Fills
+}
+
+func TestSubmitOfferPartialFill(t *testing.T) {
+	b := newBookTest(t)
+
+	// bob gives 70 CNY for 10 USD, alice takes half of it
+	b.must("bob-offer", "offer", "bob", "70/CNY", "10/USD", "t")
+	b.must("alice-offer", "offer", "alice", "5/USD", "35/CNY", "t")
+
+	fills := b.fills()
+	if len(fills) != 1 || fills[0].Offer != "bob-offer" || fills[0].TakerGets != "5/USD" || fills[0].TakerPays != "35/CNY" {
+		t.Fatalf("fills %+v", fills)
+	}
+	if got := b.balances("alice"); got["USD"] != "95" || got["CNY"] != "35" {
+		t.Errorf("alice balances %v", got)
+	}
+	if got := b.balances("bob"); got["USD"] != "5" || got["CNY"] != "265" {
+		t.Errorf("bob balances %v", got)
+	}
+
+	// the rest of bob's offer stays in the book, alice's filled entirely
+	if book := b.book("CNY/USD"); len(book) != 1 || book[0].TakerGets != "35/CNY" || book[0].TakerPays != "5/USD" {
+		t.Errorf("CNY/USD book %+v", book)
+	}
+	if book := b.book("USD/CNY"); len(book) != 0 {
+		t.Errorf("USD/CNY book %+v", book)
+	}
+}
+
+func TestSubmitOfferPriority(t *testing.T) {
+	b := newBookTest(t)
+
+	// carol and bob rest the same rate, carol first, and bob a worse one
+	b.must("carol-offer", "offer", "carol", "70/CNY", "10/USD", "t")
+	b.must("bob-offer", "offer", "bob", "70/CNY", "10/USD", "t")
+	b.must("bob-worse", "offer", "bob", "60/CNY", "10/USD", "t")
+
+	// alice takes 140 CNY at 7 CNY per USD, which leaves bob's worse offer
+	b.must("alice-offer", "offer", "alice", "20/USD", "140/CNY", "t")
+
+	fills := b.fills()
+	if len(fills) != 2 || fills[0].Offer != "carol-offer" || fills[1].Offer != "bob-offer" {
+		t.Fatalf("fills %+v", fills)
+	}
+	if book := b.book("CNY/USD"); len(book) != 1 || book[0].ID != "bob-worse" {
+		t.Errorf("CNY/USD book %+v", book)
+	}
+}
+
+func TestSubmitOfferSkipsOwnOffers(t *testing.T) {
+	b := newBookTest(t)
+	b.must("fund-bob-usd", "send", "gateway", "bob", "10", "USD", "t")
+
+	// bob's own offer crosses his new one but is left alone
+	b.must("bob-sell", "offer", "bob", "70/CNY", "10/USD", "t")
+	b.must("bob-buy", "offer", "bob", "10/USD", "70/CNY", "t")
+
+	if fills := b.fills(); len(fills) != 0 {
+		t.Fatalf("bob filled his own offer: %+v", fills)
+	}
+	if _, ok := b.stub.events[eventOffer]; !ok {
+		t.Errorf("no %s event for an offer that rests", eventOffer)
+	}
+	if len(b.book("CNY/USD")) != 1 || len(b.book("USD/CNY")) != 1 {
+		t.Errorf("books %+v %+v", b.book("CNY/USD"), b.book("USD/CNY"))
+	}
+}
+
+func TestSubmitOfferRemainderRoundsToZero(t *testing.T) {
+	b := newBookTest(t)
+
+	b.must("fund-bob-jpy", "send", "gateway", "bob", "149", "JPY", "t")
+
+	// alice wants 150 JPY for 1 USD and bob gives 149 JPY for 0.99 USD: the
+	// 1 JPY left would rest for less than 0.01 USD
+	b.must("bob-offer", "offer", "bob", "149/JPY", "0.99/USD", "t")
+	b.must("alice-offer", "offer", "alice", "1/USD", "150/JPY", "t")
+
+	fills := b.fills()
+	if len(fills) != 1 || fills[0].TakerGets != "0.99/USD" || fills[0].TakerPays != "149/JPY" {
+		t.Fatalf("fills %+v", fills)
+	}
+	if book := b.book("USD/JPY"); len(book) != 0 {
+		t.Errorf("a remainder worth nothing rests: %+v", book)
+	}
+	if book := b.book("JPY/USD"); len(book) != 0 {
+		t.Errorf("bob's filled offer rests: %+v", book)
+	}
+}
+
+func TestSubmitOfferDepositAuth(t *testing.T) {
+	b := newBookTest(t)
+
+	// carol accepts deposits from nobody, her offer is skipped for bob's
+	b.must("carol-auth", "accountSet", "carol", "depositAuth", "true")
+	b.must("carol-offer", "offer", "carol", "70/CNY", "10/USD", "t")
+	b.must("bob-offer", "offer", "bob", "70/CNY", "10/USD", "t")
+	b.must("alice-offer", "offer", "alice", "10/USD", "70/CNY", "t")
+
+	if fills := b.fills(); len(fills) != 1 || fills[0].Offer != "bob-offer" {
+		t.Fatalf("fills %+v", fills)
+	}
+	if book := b.book("CNY/USD"); len(book) != 1 || book[0].ID != "carol-offer" {
+		t.Errorf("CNY/USD book %+v", book)
+	}
+
+	// alice accepts deposits from nobody either, she cannot take carol's
+	b.must("alice-auth", "accountSet", "alice", "depositAuth", "true")
+	b.must("carol-preauth", "depositPreauth", "carol", "alice")
+	err := b.invoke("alice-rejected", "offer", "alice", "10/USD", "70/CNY", "t2")
+	if err == nil || !strings.Contains(err.Error(), "has not preauthorized") {
+		t.Fatalf("taker without preauthorization: %v", err)
+	}
+
+	// once both preauthorized the other the offers settle
+	b.must("alice-preauth", "depositPreauth", "alice", "carol")
+	b.must("alice-again", "offer", "alice", "10/USD", "70/CNY", "t3")
+	if fills := b.fills(); len(fills) != 1 || fills[0].Offer != "carol-offer" {
+		t.Fatalf("fills %+v", fills)
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/wutongtree/blue/chaincode_bluemix/validation"
+)
+
+// check status
+const (
+	checkOpen      = "open"
+	checkCashed    = "cashed"
+	checkCancelled = "cancelled"
+)
+
+// checkRecord defines a deferred payment the receiver cashes later.
+type checkRecord struct {
+	ID             string `json:"id"`
+	Sender         string `json:"sender"`
+	Receiver       string `json:"receiver"`
+	SendMax        string `json:"sendMax"`
+	Currency       string `json:"currency"`
+	Expiry         string `json:"expiry,omitempty"`
+	DestinationTag string `json:"destinationTag,omitempty"`
+	InvoiceID      string `json:"invoiceID,omitempty"`
+	Status         string `json:"status"`
+	CashedAmount   string `json:"cashedAmount,omitempty"`
+	ClosedAt       string `json:"closedAt,omitempty"`
+}
+
+// checkCashEvent defines the payload of a checkCash event.
+type checkCashEvent struct {
+	Check *checkRecord `json:"check"`
+	Send  *sendRecord  `json:"send"`
+}
+
+// checkCreate authorize receiver to pull up to sendMax from sender, the check
+// ID is the transaction ID
+// args[0]: sender
+// args[1]: receiver
+// args[2]: sendMax
+// args[3]: currency
+// args[4]: expiry, RFC3339, optional
+// args[5]: destinationTag, optional
+// args[6]: invoiceID, optional
+func (t *BlueChaincode) checkCreate(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debugf("+++++++++++++++++++++++++++++++++++ checkCreate in chaincode +++++++++++++++++++++++++++++++++")
+	logger.Debugf("checkCreate args: %v", args)
+
+	// parse arguments
+	if len(args) < 4 || len(args) > 7 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4 to 7")
+	}
+
+	check := &checkRecord{
+		ID:       stub.GetTxID(),
+		Sender:   args[0],
+		Receiver: args[1],
+		SendMax:  args[2],
+		Currency: args[3],
+		Status:   checkOpen,
+	}
+	optional := make([]string, 3)
+	copy(optional, args[4:])
+	check.Expiry = optional[0]
+	check.DestinationTag = optional[1]
+	check.InvoiceID = optional[2]
+
+	currencies, err := sHandler.getCurrencies(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validation.Check(currencies, check.Sender, check.Receiver, check.SendMax, check.Currency).Err(); err != nil {
+		return nil, err
+	}
+	if check.Expiry != "" {
+		expiry, err := time.Parse(time.RFC3339, check.Expiry)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid expiry %s", check.Expiry)
+		}
+		now, err := txTime(stub)
+		if err != nil {
+			return nil, err
+		}
+		if !now.Before(expiry) {
+			return nil, fmt.Errorf("Expiry %s is in the past", check.Expiry)
+		}
+	}
+	if err := checkTag("destinationTag", check.DestinationTag); err != nil {
+		return nil, err
+	}
+	if len(check.InvoiceID) > maxInvoiceIDLength {
+		return nil, fmt.Errorf("invoiceID exceeds %d bytes", maxInvoiceIDLength)
+	}
+
+	// save state
+	return []byte(check.ID), sHandler.createCheck(stub, check)
+}
+
+// checkCash pull amount from the check's sender, only the receiver may cash
+// args[0]: check ID
+// args[1]: receiver
+// args[2]: amount, at most the check's sendMax
+// args[3]: timestr
+func (t *BlueChaincode) checkCash(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debugf("+++++++++++++++++++++++++++++++++++ checkCash in chaincode +++++++++++++++++++++++++++++++++")
+	logger.Debugf("checkCash args: %v", args)
+
+	// parse arguments
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4")
+	}
+
+	id := args[0]
+	receiver := args[1]
+	amount := args[2]
+	timestr := args[3]
+
+	cash, err := parseAmount(amount)
+	if err != nil {
+		return nil, err
+	}
+
+	check, now, err := getOpenCheck(stub, id)
+	if err != nil {
+		return nil, err
+	}
+	if check.Receiver != receiver {
+		return nil, fmt.Errorf("Check %s can only be cashed by %s", id, check.Receiver)
+	}
+	currencies, err := sHandler.getCurrencies(stub)
+	if err != nil {
+		return nil, err
+	}
+	if err := validation.CurrencyAmount(currencies, "amount", "currency", amount, check.Currency); err != nil {
+		return nil, err
+	}
+	sendMax, err := parseAmount(check.SendMax)
+	if err != nil {
+		return nil, err
+	}
+	if cash.Cmp(sendMax) > 0 {
+		return nil, fmt.Errorf("Check %s allows at most %s %s", id, check.SendMax, check.Currency)
+	}
+
+	// funds are pulled at cash time, so the sender must hold them now
+	if err := sHandler.checkFunds(stub, check.Sender, check.Currency, cash); err != nil {
+		return nil, err
+	}
+
+	send := &sendRecord{
+		Timestamp:      timestr,
+		Sender:         check.Sender,
+		Receiver:       check.Receiver,
+		Amount:         amount,
+		Currency:       check.Currency,
+		DestinationTag: check.DestinationTag,
+		InvoiceID:      check.InvoiceID,
+	}
+
+	// save state
+	return nil, sHandler.cashCheck(stub, check, send, now.UTC().Format(time.RFC3339))
+}
+
+// checkCancel cancel an open check, only its sender or receiver may cancel
+// args[0]: check ID
+// args[1]: account
+func (t *BlueChaincode) checkCancel(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debugf("+++++++++++++++++++++++++++++++++++ checkCancel in chaincode +++++++++++++++++++++++++++++++++")
+	logger.Debugf("checkCancel args: %v", args)
+
+	// parse arguments
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+
+	id := args[0]
+	account := args[1]
+
+	check := &checkRecord{}
+	ok, err := getObject(stub, tableCheck, id, check)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("Check %s not found", id)
+	}
+	if check.Status != checkOpen {
+		return nil, fmt.Errorf("Check %s is %s", id, check.Status)
+	}
+	if account != check.Sender && account != check.Receiver {
+		return nil, fmt.Errorf("Check %s can only be cancelled by %s or %s", id, check.Sender, check.Receiver)
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	// save state
+	return nil, sHandler.cancelCheck(stub, check, now.UTC().Format(time.RFC3339))
+}
+
+// getOpenCheck loads a check that is open and not expired, with the transaction time
+func getOpenCheck(stub shim.ChaincodeStubInterface, id string) (*checkRecord, time.Time, error) {
+	check := &checkRecord{}
+	ok, err := getObject(stub, tableCheck, id, check)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if !ok {
+		return nil, time.Time{}, fmt.Errorf("Check %s not found", id)
+	}
+	if check.Status != checkOpen {
+		return nil, time.Time{}, fmt.Errorf("Check %s is %s", id, check.Status)
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if check.Expiry != "" {
+		expiry, err := time.Parse(time.RFC3339, check.Expiry)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		if !now.Before(expiry) {
+			return nil, time.Time{}, fmt.Errorf("Check %s expired at %s", id, check.Expiry)
+		}
+	}
+
+	return check, now, nil
+}
+
+// queryCheck query a check
+// args[0]: check ID
+func (t *BlueChaincode) queryCheck(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	check := &checkRecord{}
+	ok, err := getObject(stub, tableCheck, args[0], check)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("Check %s not found", args[0])
+	}
+
+	return json.Marshal(check)
+}
+
+// queryChecks query the checks of a sender or receiver
+// args[0]: account
+func (t *BlueChaincode) queryChecks(stub shim.ChaincodeStubInterface, index string, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	ids, err := getIndex(stub, index, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	checks := []*checkRecord{}
+	for _, id := range ids {
+		check := &checkRecord{}
+		if _, err := getObject(stub, tableCheck, id, check); err != nil {
+			return nil, err
+		}
+		checks = append(checks, check)
+	}
+
+	return json.Marshal(checks)
+}
+
+// createCheck insert a check and its indexes
+// check: check
+func (t *tableHandler) createCheck(stub shim.ChaincodeStubInterface, check *checkRecord) error {
+	logger.Debugf("insert table check: %+v", check)
+
+	if err := putObject(stub, tableCheck, check.ID, check); err != nil {
+		logger.Errorf("createCheck: system error %v", err)
+		return err
+	}
+	if err := putIndex(stub, tableCheckSender, check.Sender, check.ID); err != nil {
+		logger.Errorf("createCheck: system error %v", err)
+		return err
+	}
+	if err := putIndex(stub, tableCheckReceiver, check.Receiver, check.ID); err != nil {
+		logger.Errorf("createCheck: system error %v", err)
+		return err
+	}
+
+	return setEvent(stub, eventCheckCreate, check)
+}
+
+// cashCheck submit the send and close the check in the same transaction
+// check: check
+// send: send cashing the check
+// closedAt: transaction time
+func (t *tableHandler) cashCheck(stub shim.ChaincodeStubInterface,
+	check *checkRecord,
+	send *sendRecord,
+	closedAt string) error {
+
+	if err := t.submitSend(stub, send); err != nil {
+		return err
+	}
+
+	check.CashedAmount = send.Amount
+	if err := t.closeCheck(stub, check, checkCashed, closedAt); err != nil {
+		return err
+	}
+
+	// a transaction carries a single event, so it replaces the send event
+	return setEvent(stub, eventCheckCash, &checkCashEvent{Check: check, Send: send})
+}
+
+// cancelCheck mark a check cancelled
+// check: check
+// closedAt: transaction time
+func (t *tableHandler) cancelCheck(stub shim.ChaincodeStubInterface, check *checkRecord, closedAt string) error {
+	if err := t.closeCheck(stub, check, checkCancelled, closedAt); err != nil {
+		return err
+	}
+
+	return setEvent(stub, eventCheckCancel, check)
+}
+
+// closeCheck mark a check cashed or cancelled
+// check: check
+// status: checkCashed or checkCancelled
+// closedAt: transaction time
+func (t *tableHandler) closeCheck(stub shim.ChaincodeStubInterface,
+	check *checkRecord,
+	status string,
+	closedAt string) error {
+
+	check.Status = status
+	check.ClosedAt = closedAt
+
+	logger.Debugf("update table check: %+v", check)
+
+	err := putObject(stub, tableCheck, check.ID, check)
+	if err != nil {
+		logger.Errorf("closeCheck: system error %v", err)
+	}
+
+	return err
+}
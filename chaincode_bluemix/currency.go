@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/wutongtree/blue/chaincode_bluemix/validation"
+)
+
+// registerCurrency register a custom currency, the precision of a registered
+// currency cannot change
+// args[0]: code, 3 to 12 upper case letters or digits
+// args[1]: precision, number of decimals
+func (t *BlueChaincode) registerCurrency(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debugf("+++++++++++++++++++++++++++++++++++ registerCurrency in chaincode +++++++++++++++++++++++++++++++++")
+	logger.Debugf("registerCurrency args: %v", args)
+
+	// parse arguments
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+
+	code := args[0]
+	precision, err := strconv.Atoi(args[1])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid precision %s", args[1])
+	}
+
+	currencies, err := sHandler.getCurrencies(stub)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := currencies.Lookup(code); ok {
+		return nil, fmt.Errorf("Currency %s is already registered", code)
+	}
+	if err := currencies.Register(code, precision); err != nil {
+		return nil, err
+	}
+
+	// save state
+	currency, _ := currencies.Lookup(code)
+	if err := putObject(stub, tableCurrency, code, currency); err != nil {
+		return nil, err
+	}
+
+	return nil, setEvent(stub, eventCurrencyRegister, currency)
+}
+
+// queryCurrencies query the registered custom currencies
+func (t *BlueChaincode) queryCurrencies(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 0 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 0")
+	}
+
+	currencies, err := sHandler.getCurrencies(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(currencies.Custom())
+}
+
+// getCurrencies returns the ISO 4217 currencies and the registered ones
+func (t *tableHandler) getCurrencies(stub shim.ChaincodeStubInterface) (*validation.Registry, error) {
+	rows, err := stub.GetRows(tableCurrency, []shim.Column{})
+	if err != nil {
+		return nil, err
+	}
+
+	currencies := validation.NewRegistry()
+	for row := range rows {
+		currency := validation.Currency{}
+		if err := json.Unmarshal(row.Columns[1].GetBytes(), &currency); err != nil {
+			return nil, err
+		}
+		if err := currencies.Register(currency.Code, currency.Precision); err != nil {
+			return nil, err
+		}
+	}
+
+	return currencies, nil
+}
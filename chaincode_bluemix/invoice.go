@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/wutongtree/blue/chaincode_bluemix/validation"
+)
+
+// invoice status
+const (
+	invoiceOpen = "open"
+	invoicePaid = "paid"
+)
+
+// invoiceRecord defines a payment request created by its payee.
+type invoiceRecord struct {
+	ID        string `json:"id"`
+	Payee     string `json:"payee"`
+	Payer     string `json:"payer,omitempty"`
+	Amount    string `json:"amount"`
+	Currency  string `json:"currency"`
+	Expiry    string `json:"expiry,omitempty"`
+	Reference string `json:"reference,omitempty"`
+	Status    string `json:"status"`
+	PaidBy    string `json:"paidBy,omitempty"`
+	PaidAt    string `json:"paidAt,omitempty"`
+}
+
+// invoicePaidEvent defines the payload of an invoicePaid event.
+type invoicePaidEvent struct {
+	Invoice *invoiceRecord `json:"invoice"`
+	Send    *sendRecord    `json:"send"`
+}
+
+// createInvoice create a payment request, the invoice ID is the transaction ID
+// args[0]: payee
+// args[1]: amount
+// args[2]: currency
+// args[3]: expiry, RFC3339, optional
+// args[4]: reference, optional
+// args[5]: payer, optional, restricts who may pay the invoice
+func (t *BlueChaincode) createInvoice(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debugf("+++++++++++++++++++++++++++++++++++ createInvoice in chaincode +++++++++++++++++++++++++++++++++")
+	logger.Debugf("createInvoice args: %v", args)
+
+	// parse arguments
+	if len(args) < 3 || len(args) > 6 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3 to 6")
+	}
+
+	invoice := &invoiceRecord{
+		ID:       stub.GetTxID(),
+		Payee:    args[0],
+		Amount:   args[1],
+		Currency: args[2],
+		Status:   invoiceOpen,
+	}
+	optional := make([]string, 3)
+	copy(optional, args[3:])
+	invoice.Expiry = optional[0]
+	invoice.Reference = optional[1]
+	invoice.Payer = optional[2]
+
+	currencies, err := sHandler.getCurrencies(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validation.Invoice(currencies, invoice.Payee, invoice.Payer, invoice.Amount, invoice.Currency).Err(); err != nil {
+		return nil, err
+	}
+	if invoice.Expiry != "" {
+		if _, err := time.Parse(time.RFC3339, invoice.Expiry); err != nil {
+			return nil, fmt.Errorf("Invalid expiry %s", invoice.Expiry)
+		}
+	}
+	if len(invoice.Reference) > maxMemoLength {
+		return nil, fmt.Errorf("reference exceeds %d bytes", maxMemoLength)
+	}
+
+	// save state
+	return []byte(invoice.ID), sHandler.createInvoice(stub, invoice)
+}
+
+// payInvoice settle a payment request with a send of exactly its amount
+// args[0]: invoice ID
+// args[1]: payer
+// args[2]: amount
+// args[3]: currency
+// args[4]: timestr
+func (t *BlueChaincode) payInvoice(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debugf("+++++++++++++++++++++++++++++++++++ payInvoice in chaincode +++++++++++++++++++++++++++++++++")
+	logger.Debugf("payInvoice args: %v", args)
+
+	// parse arguments
+	if len(args) != 5 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 5")
+	}
+
+	id := args[0]
+	payer := args[1]
+	amount := args[2]
+	currency := args[3]
+	timestr := args[4]
+
+	currencies, err := sHandler.getCurrencies(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs validation.Errors
+	errs.Add(validation.Account("payer", payer))
+	errs.Add(validation.CurrencyAmount(currencies, "amount", "currency", amount, currency))
+	if err := errs.Err(); err != nil {
+		return nil, err
+	}
+	paid, err := parseAmount(amount)
+	if err != nil {
+		return nil, err
+	}
+
+	invoice := &invoiceRecord{}
+	ok, err := getObject(stub, tableInvoice, id, invoice)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("Invoice %s not found", id)
+	}
+
+	if invoice.Status != invoiceOpen {
+		return nil, fmt.Errorf("Invoice %s is %s", id, invoice.Status)
+	}
+	if invoice.Payer != "" && invoice.Payer != payer {
+		return nil, fmt.Errorf("Invoice %s must be paid by %s", id, invoice.Payer)
+	}
+	if invoice.Currency != currency {
+		return nil, fmt.Errorf("Invoice %s is in %s", id, invoice.Currency)
+	}
+	due, err := parseAmount(invoice.Amount)
+	if err != nil {
+		return nil, err
+	}
+	if paid.Cmp(due) != 0 {
+		return nil, fmt.Errorf("Invoice %s requires exactly %s %s", id, invoice.Amount, invoice.Currency)
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	if invoice.Expiry != "" {
+		expiry, err := time.Parse(time.RFC3339, invoice.Expiry)
+		if err != nil {
+			return nil, err
+		}
+		if now.After(expiry) {
+			return nil, fmt.Errorf("Invoice %s expired at %s", id, invoice.Expiry)
+		}
+	}
+
+	send := &sendRecord{
+		Timestamp: timestr,
+		Sender:    payer,
+		Receiver:  invoice.Payee,
+		Amount:    amount,
+		Currency:  currency,
+		InvoiceID: id,
+	}
+
+	// save state
+	return nil, sHandler.payInvoice(stub, invoice, send, now.UTC().Format(time.RFC3339))
+}
+
+// queryInvoice query an invoice
+// args[0]: invoice ID
+func (t *BlueChaincode) queryInvoice(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	invoice := &invoiceRecord{}
+	ok, err := getObject(stub, tableInvoice, args[0], invoice)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("Invoice %s not found", args[0])
+	}
+
+	return json.Marshal(invoice)
+}
+
+// queryInvoices query the invoices of a payee or payer
+// args[0]: account
+func (t *BlueChaincode) queryInvoices(stub shim.ChaincodeStubInterface, index string, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	invoices, err := sHandler.getInvoices(stub, index, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(invoices)
+}
+
+// createInvoice insert an invoice and its indexes
+// invoice: invoice
+func (t *tableHandler) createInvoice(stub shim.ChaincodeStubInterface, invoice *invoiceRecord) error {
+	logger.Debugf("insert table invoice: %+v", invoice)
+
+	if err := putObject(stub, tableInvoice, invoice.ID, invoice); err != nil {
+		logger.Errorf("createInvoice: system error %v", err)
+		return err
+	}
+	if err := putIndex(stub, tableInvoicePayee, invoice.Payee, invoice.ID); err != nil {
+		logger.Errorf("createInvoice: system error %v", err)
+		return err
+	}
+	if invoice.Payer != "" {
+		if err := putIndex(stub, tableInvoicePayer, invoice.Payer, invoice.ID); err != nil {
+			logger.Errorf("createInvoice: system error %v", err)
+			return err
+		}
+	}
+
+	return setEvent(stub, eventInvoiceCreate, invoice)
+}
+
+// payInvoice submit the send and mark the invoice paid in the same transaction
+// invoice: invoice
+// send: send paying the invoice
+// paidAt: transaction time
+func (t *tableHandler) payInvoice(stub shim.ChaincodeStubInterface,
+	invoice *invoiceRecord,
+	send *sendRecord,
+	paidAt string) error {
+
+	if err := t.submitSend(stub, send); err != nil {
+		return err
+	}
+
+	invoice.Status = invoicePaid
+	invoice.PaidBy = send.Sender
+	invoice.PaidAt = paidAt
+
+	logger.Debugf("update table invoice: %+v", invoice)
+
+	if err := putObject(stub, tableInvoice, invoice.ID, invoice); err != nil {
+		logger.Errorf("payInvoice: system error %v", err)
+		return err
+	}
+	if invoice.Payer == "" {
+		if err := putIndex(stub, tableInvoicePayer, send.Sender, invoice.ID); err != nil {
+			logger.Errorf("payInvoice: system error %v", err)
+			return err
+		}
+	}
+
+	// a transaction carries a single event, so it replaces the send event
+	return setEvent(stub, eventInvoicePaid, &invoicePaidEvent{Invoice: invoice, Send: send})
+}
+
+// getInvoices returns the invoices of account in an index table
+// index: tableInvoicePayee or tableInvoicePayer
+// account: account
+func (t *tableHandler) getInvoices(stub shim.ChaincodeStubInterface, index string, account string) ([]*invoiceRecord, error) {
+	ids, err := getIndex(stub, index, account)
+	if err != nil {
+		logger.Errorf("getInvoices: system error %v", err)
+		return nil, err
+	}
+
+	invoices := []*invoiceRecord{}
+	for _, id := range ids {
+		invoice := &invoiceRecord{}
+		if _, err := getObject(stub, tableInvoice, id, invoice); err != nil {
+			return nil, err
+		}
+		invoices = append(invoices, invoice)
+	}
+
+	return invoices, nil
+}
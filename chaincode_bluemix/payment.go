@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// paymentRecord defines a send stored by its transaction ID, which the app
+// reconciles its off-chain view against.
+type paymentRecord struct {
+	TxID string      `json:"txid"`
+	Send *sendRecord `json:"send"`
+}
+
+// ledgerStats defines the result of queryStats.
+type ledgerStats struct {
+	Payments int `json:"payments"`
+	Offers   int `json:"offers"`
+}
+
+// queryPayments query the payments sent or received by an account
+// args[0]: account
+func (t *BlueChaincode) queryPayments(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	payments, err := sHandler.getPayments(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(payments)
+}
+
+// queryStats query the number of payments and offers
+func (t *BlueChaincode) queryStats(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 0 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 0")
+	}
+
+	payments, err := countRows(stub, tablePayment)
+	if err != nil {
+		return nil, err
+	}
+	offers, err := countRows(stub, tableOffer)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(&ledgerStats{Payments: payments, Offers: offers})
+}
+
+// putPayment insert a payment and its account indexes
+// payment: payment
+func (t *tableHandler) putPayment(stub shim.ChaincodeStubInterface, payment *paymentRecord) error {
+	logger.Debugf("insert table payment: %+v", payment)
+
+	if err := putObject(stub, tablePayment, payment.TxID, payment); err != nil {
+		logger.Errorf("putPayment: system error %v", err)
+		return err
+	}
+	if err := putIndex(stub, tablePaymentAccount, payment.Send.Sender, payment.TxID); err != nil {
+		logger.Errorf("putPayment: system error %v", err)
+		return err
+	}
+	if err := putIndex(stub, tablePaymentAccount, payment.Send.Receiver, payment.TxID); err != nil {
+		logger.Errorf("putPayment: system error %v", err)
+		return err
+	}
+
+	return nil
+}
+
+// getPayments returns the payments of account
+// account: sender or receiver
+func (t *tableHandler) getPayments(stub shim.ChaincodeStubInterface, account string) ([]*paymentRecord, error) {
+	ids, err := getIndex(stub, tablePaymentAccount, account)
+	if err != nil {
+		logger.Errorf("getPayments: system error %v", err)
+		return nil, err
+	}
+
+	payments := []*paymentRecord{}
+	for _, id := range ids {
+		payment := &paymentRecord{}
+		if _, err := getObject(stub, tablePayment, id, payment); err != nil {
+			return nil, err
+		}
+		payments = append(payments, payment)
+	}
+
+	return payments, nil
+}
+
+// countRows returns the number of rows of a table
+func countRows(stub shim.ChaincodeStubInterface, tableName string) (int, error) {
+	rows, err := stub.GetRows(tableName, []shim.Column{})
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for range rows {
+		n++
+	}
+
+	return n, nil
+}
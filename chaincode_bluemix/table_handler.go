@@ -1,7 +1,11 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"math/big"
+	"sort"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 )
@@ -9,19 +13,121 @@ import (
 // consts associated with chaincode table
 const (
 	// table
-	tableSend  = "send"
-	tableOffer = "offer"
+	tableSend    = "send"
+	tableOffer   = "offer"
+	tableAccount = "account"
+
+	tableInvoice      = "invoice"
+	tableInvoicePayee = "invoicePayee"
+	tableInvoicePayer = "invoicePayer"
+
+	tableBalance       = "balance"
+	tableCheck         = "check"
+	tableCheckSender   = "checkSender"
+	tableCheckReceiver = "checkReceiver"
+
+	tableDepositPreauth = "depositPreauth"
+
+	tableCurrency = "currency"
+
+	tablePayment        = "payment"
+	tablePaymentAccount = "paymentAccount"
+
+	tableTransaction = "transaction"
+
+	tableBook     = "book"
+	tableBookPair = "bookPair"
 
 	// column
-	columnSender    = "sender"
-	columnReceiver  = "receiver"
-	columnAmount    = "amount"
-	columnCurrency  = "currency"
-	columnTakerGets = "takerGets"
-	columnTakerPays = "takerPays"
-	columnTimestamp = "timestamp"
+	columnSender         = "sender"
+	columnReceiver       = "receiver"
+	columnAmount         = "amount"
+	columnCurrency       = "currency"
+	columnTakerGets      = "takerGets"
+	columnTakerPays      = "takerPays"
+	columnTimestamp      = "timestamp"
+	columnDestinationTag = "destinationTag"
+	columnSourceTag      = "sourceTag"
+	columnMemo           = "memo"
+	columnInvoiceID      = "invoiceID"
+	columnAccount        = "account"
+	columnFlags          = "flags"
+	columnID             = "id"
+	columnData           = "data"
+	columnAuthorized     = "authorized"
+	columnPair           = "pair"
+
+	// event
+	eventSend        = "blue.send"
+	eventOffer       = "blue.offer"
+	eventTrade       = "blue.trade"
+	eventOfferCancel = "blue.offerCancel"
+	eventAccountSet  = "blue.accountSet"
+
+	eventInvoiceCreate = "blue.invoiceCreate"
+	eventInvoicePaid   = "blue.invoicePaid"
+
+	eventCheckCreate = "blue.checkCreate"
+	eventCheckCash   = "blue.checkCash"
+	eventCheckCancel = "blue.checkCancel"
+
+	eventDepositPreauth = "blue.depositPreauth"
+	eventDepositUnauth  = "blue.depositUnauth"
+
+	eventCurrencyRegister = "blue.currencyRegister"
+)
+
+// account flags
+const (
+	// flagRequireDestTag rejects incoming payments without a destination tag
+	flagRequireDestTag uint32 = 1 << iota
+	// flagDepositAuth rejects incoming funds from senders not preauthorized
+	flagDepositAuth
+	// flagIssuer lets a gateway send more than its balance, issuing the
+	// currency, set by issuerSet only
+	flagIssuer
 )
 
+// accountFlags maps flag names accepted by accountSet to their bits
+var accountFlags = map[string]uint32{
+	"requireDestTag": flagRequireDestTag,
+	"depositAuth":    flagDepositAuth,
+}
+
+// sendRecord defines the payload of a send transaction in storage and events.
+type sendRecord struct {
+	Timestamp      string `json:"timestamp"`
+	Sender         string `json:"sender"`
+	Receiver       string `json:"receiver"`
+	Amount         string `json:"amount"`
+	Currency       string `json:"currency"`
+	DestinationTag string `json:"destinationTag,omitempty"`
+	SourceTag      string `json:"sourceTag,omitempty"`
+	Memo           string `json:"memo,omitempty"`
+	InvoiceID      string `json:"invoiceID,omitempty"`
+}
+
+// preauthRecord defines the payload of depositPreauth and depositUnauth events.
+type preauthRecord struct {
+	Account    string `json:"account"`
+	Authorized string `json:"authorized"`
+}
+
+// offerRecord defines the payload of an offer transaction in storage and events.
+type offerRecord struct {
+	ID        string `json:"id"`
+	Timestamp string `json:"timestamp"`
+	Sender    string `json:"sender"`
+	TakerGets string `json:"takerGets"`
+	TakerPays string `json:"takerPays"`
+}
+
+// accountRecord defines the payload of an accountSet event.
+type accountRecord struct {
+	Account string `json:"account"`
+	Flags   uint32 `json:"flags"`
+}
+
 //BlueHandler provides APIs used to perform operations on CC's KV store
 type tableHandler struct {
 }
@@ -31,100 +137,525 @@ func NewBlueHandler() *tableHandler {
 	return &tableHandler{}
 }
 
-// createTable
-// stub: chaincodestub
-func (t *tableHandler) createTable(stub shim.ChaincodeStubInterface) error {
-
-	// Create send table
-	err := stub.CreateTable(tableSend, []*shim.ColumnDefinition{
+// tableDefinitions defines the tables created in Init
+var tableDefinitions = []struct {
+	name    string
+	columns []*shim.ColumnDefinition
+}{
+	{tableSend, []*shim.ColumnDefinition{
 		&shim.ColumnDefinition{Name: columnTimestamp, Type: shim.ColumnDefinition_STRING, Key: true},
 		&shim.ColumnDefinition{Name: columnSender, Type: shim.ColumnDefinition_STRING, Key: true},
 		&shim.ColumnDefinition{Name: columnReceiver, Type: shim.ColumnDefinition_STRING, Key: true},
 		&shim.ColumnDefinition{Name: columnAmount, Type: shim.ColumnDefinition_STRING, Key: true},
 		&shim.ColumnDefinition{Name: columnCurrency, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnDestinationTag, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnSourceTag, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnMemo, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnInvoiceID, Type: shim.ColumnDefinition_STRING, Key: false},
+	}},
+	{tableOffer, []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: columnTimestamp, Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: columnSender, Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: columnTakerGets, Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: columnTakerPays, Type: shim.ColumnDefinition_STRING, Key: true},
+	}},
+	{tableAccount, []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: columnAccount, Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: columnFlags, Type: shim.ColumnDefinition_UINT32, Key: false},
+	}},
+	{tableInvoice, []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: columnID, Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: columnData, Type: shim.ColumnDefinition_BYTES, Key: false},
+	}},
+	{tableBalance, []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: columnAccount, Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: columnCurrency, Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: columnAmount, Type: shim.ColumnDefinition_STRING, Key: false},
+	}},
+	{tableCheck, []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: columnID, Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: columnData, Type: shim.ColumnDefinition_BYTES, Key: false},
+	}},
+	{tableCheckSender, []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: columnAccount, Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: columnID, Type: shim.ColumnDefinition_STRING, Key: true},
+	}},
+	{tableCheckReceiver, []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: columnAccount, Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: columnID, Type: shim.ColumnDefinition_STRING, Key: true},
+	}},
+	{tableDepositPreauth, []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: columnAccount, Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: columnAuthorized, Type: shim.ColumnDefinition_STRING, Key: true},
+	}},
+	{tableInvoicePayee, []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: columnAccount, Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: columnID, Type: shim.ColumnDefinition_STRING, Key: true},
+	}},
+	{tableInvoicePayer, []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: columnAccount, Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: columnID, Type: shim.ColumnDefinition_STRING, Key: true},
+	}},
+	{tableCurrency, []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: columnID, Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: columnData, Type: shim.ColumnDefinition_BYTES, Key: false},
+	}},
+	{tablePayment, []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: columnID, Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: columnData, Type: shim.ColumnDefinition_BYTES, Key: false},
+	}},
+	{tablePaymentAccount, []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: columnAccount, Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: columnID, Type: shim.ColumnDefinition_STRING, Key: true},
+	}},
+	{tableTransaction, []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: columnID, Type: shim.ColumnDefinition_STRING, Key: true},
+	}},
+	{tableBook, []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: columnID, Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: columnData, Type: shim.ColumnDefinition_BYTES, Key: false},
+	}},
+	{tableBookPair, []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: columnPair, Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: columnID, Type: shim.ColumnDefinition_STRING, Key: true},
+	}},
+}
+
+// createTable
+// stub: chaincodestub
+func (t *tableHandler) createTable(stub shim.ChaincodeStubInterface) error {
+	for _, table := range tableDefinitions {
+		if err := stub.CreateTable(table.name, table.columns); err != nil {
+			logger.Errorf("createTable %s error: %v", table.name, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// submitSend submit send
+// send: send record
+func (t *tableHandler) submitSend(stub shim.ChaincodeStubInterface, send *sendRecord) error {
+
+	logger.Debugf("insert table send: %+v", send)
+
+	// check receiver's flags
+	if err := t.checkDeposit(stub, send.Sender, send.Receiver, send.DestinationTag); err != nil {
+		return err
+	}
+
+	//insert a new row for send transaction
+	ok, err := stub.InsertRow(tableSend, shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: send.Timestamp}},
+			&shim.Column{Value: &shim.Column_String_{String_: send.Sender}},
+			&shim.Column{Value: &shim.Column_String_{String_: send.Receiver}},
+			&shim.Column{Value: &shim.Column_String_{String_: send.Amount}},
+			&shim.Column{Value: &shim.Column_String_{String_: send.Currency}},
+			&shim.Column{Value: &shim.Column_String_{String_: send.DestinationTag}},
+			&shim.Column{Value: &shim.Column_String_{String_: send.SourceTag}},
+			&shim.Column{Value: &shim.Column_String_{String_: send.Memo}},
+			&shim.Column{Value: &shim.Column_String_{String_: send.InvoiceID}}},
 	})
+	if err != nil {
+		logger.Errorf("submitSend: system error %v", err)
+		return err
+	}
+	if !ok {
+		return errors.New("Send was already submitted.")
+	}
 
+	// move the amount between the balances, only issuers go below zero
+	amount, err := parseAmount(send.Amount)
 	if err != nil {
-		logger.Errorf("createTable error: %v", err)
+		return err
+	}
+	if err := t.checkFunds(stub, send.Sender, send.Currency, amount); err != nil {
+		return err
+	}
+	if err := t.addBalance(stub, send.Sender, send.Currency, new(big.Rat).Neg(amount)); err != nil {
+		return err
+	}
+	if err := t.addBalance(stub, send.Receiver, send.Currency, amount); err != nil {
 		return err
 	}
 
-	// Create offer table
-	err = stub.CreateTable(tableOffer, []*shim.ColumnDefinition{
-		&shim.ColumnDefinition{Name: columnTimestamp, Type: shim.ColumnDefinition_STRING, Key: true},
-		&shim.ColumnDefinition{Name: columnSender, Type: shim.ColumnDefinition_STRING, Key: true},
-		&shim.ColumnDefinition{Name: columnTakerGets, Type: shim.ColumnDefinition_STRING, Key: true},
-		&shim.ColumnDefinition{Name: columnTakerPays, Type: shim.ColumnDefinition_STRING, Key: true},
+	// record the send by transaction ID for reconciliation
+	if err := t.putPayment(stub, &paymentRecord{TxID: stub.GetTxID(), Send: send}); err != nil {
+		return err
+	}
+
+	return setEvent(stub, eventSend, send)
+}
+
+// getBalance returns the balance of account in currency, 0 for unknown accounts
+// account: account
+// currency: currency
+func (t *tableHandler) getBalance(stub shim.ChaincodeStubInterface, account string, currency string) (*big.Rat, error) {
+	row, err := stub.GetRow(tableBalance, []shim.Column{
+		shim.Column{Value: &shim.Column_String_{String_: account}},
+		shim.Column{Value: &shim.Column_String_{String_: currency}},
 	})
+	if err != nil {
+		logger.Errorf("getBalance: system error %v", err)
+		return nil, err
+	}
+	if len(row.Columns) == 0 {
+		return new(big.Rat), nil
+	}
+
+	balance, ok := new(big.Rat).SetString(row.Columns[2].GetString_())
+	if !ok {
+		return nil, fmt.Errorf("Corrupted balance of %s in %s", account, currency)
+	}
+
+	return balance, nil
+}
 
+// getBalances returns all balances of account by currency
+// account: account
+func (t *tableHandler) getBalances(stub shim.ChaincodeStubInterface, account string) (map[string]string, error) {
+	rows, err := stub.GetRows(tableBalance, []shim.Column{
+		shim.Column{Value: &shim.Column_String_{String_: account}},
+	})
 	if err != nil {
-		logger.Errorf("createTable error: %v", err)
+		logger.Errorf("getBalances: system error %v", err)
+		return nil, err
+	}
+
+	balances := map[string]string{}
+	for row := range rows {
+		balances[row.Columns[1].GetString_()] = row.Columns[2].GetString_()
+	}
+
+	return balances, nil
+}
+
+// getBalanceAccounts returns the accounts holding a balance, sorted
+func (t *tableHandler) getBalanceAccounts(stub shim.ChaincodeStubInterface) ([]string, error) {
+	rows, err := stub.GetRows(tableBalance, []shim.Column{})
+	if err != nil {
+		logger.Errorf("getBalanceAccounts: system error %v", err)
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	accounts := []string{}
+	for row := range rows {
+		account := row.Columns[0].GetString_()
+		if !seen[account] {
+			seen[account] = true
+			accounts = append(accounts, account)
+		}
+	}
+	sort.Strings(accounts)
+
+	return accounts, nil
+}
+
+// checkFunds checks that account holds amount of currency, unless it is an
+// issuer
+// account: sender
+// currency: currency
+// amount: amount sent
+func (t *tableHandler) checkFunds(stub shim.ChaincodeStubInterface, account string, currency string, amount *big.Rat) error {
+	flags, err := t.getAccountFlags(stub, account)
+	if err != nil {
+		return err
+	}
+	if flags&flagIssuer != 0 {
+		return nil
+	}
+
+	balance, err := t.getBalance(stub, account, currency)
+	if err != nil {
+		return err
+	}
+	if balance.Cmp(amount) < 0 {
+		return fmt.Errorf("Insufficient balance of %s in %s", account, currency)
+	}
+
+	return nil
+}
+
+// addBalance adds delta to the balance of account in currency
+// account: account
+// currency: currency
+// delta: signed amount
+func (t *tableHandler) addBalance(stub shim.ChaincodeStubInterface, account string, currency string, delta *big.Rat) error {
+	balance, err := t.getBalance(stub, account, currency)
+	if err != nil {
+		return err
+	}
+	balance.Add(balance, delta)
+
+	logger.Debugf("replace table balance: account=%v currency=%v amount=%v", account, currency, formatAmount(balance))
+
+	err = upsertRow(stub, tableBalance, shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: account}},
+			&shim.Column{Value: &shim.Column_String_{String_: currency}},
+			&shim.Column{Value: &shim.Column_String_{String_: formatAmount(balance)}}},
+	})
+	if err != nil {
+		logger.Errorf("addBalance: system error %v", err)
 	}
 
 	return err
 }
 
-// submitSend submit send
+// checkDeposit checks that receiver accepts funds from sender, every transfer
+// into an account must pass it
 // sender: sender
 // receiver: receiver
-// amount: amount
-// currency: currency
-// timestamp: timestamp
-func (t *tableHandler) submitSend(stub shim.ChaincodeStubInterface,
+// destinationTag: destination tag of the transfer
+func (t *tableHandler) checkDeposit(stub shim.ChaincodeStubInterface,
 	sender string,
 	receiver string,
-	amount string,
-	currency string,
-	timestamp string) error {
+	destinationTag string) error {
 
-	logger.Debugf("insert table send: sender=%v receiver=%v amount=%v currency=%v timestamp=%v", sender, receiver, amount, currency, timestamp)
+	flags, err := t.getAccountFlags(stub, receiver)
+	if err != nil {
+		return err
+	}
+	if flags&flagRequireDestTag != 0 && destinationTag == "" {
+		return fmt.Errorf("Receiver %s requires a destination tag", receiver)
+	}
 
-	//insert a new row for send transaction
-	ok, err := stub.InsertRow(tableSend, shim.Row{
+	return t.checkDepositAuth(stub, sender, receiver)
+}
+
+// checkDepositAuth checks that a receiver with depositAuth preauthorized
+// sender. Offer settlements, which carry no destination tag, only pass this
+// part of checkDeposit.
+// sender: sender
+// receiver: receiver
+func (t *tableHandler) checkDepositAuth(stub shim.ChaincodeStubInterface, sender string, receiver string) error {
+	flags, err := t.getAccountFlags(stub, receiver)
+	if err != nil {
+		return err
+	}
+	if flags&flagDepositAuth == 0 || sender == receiver {
+		return nil
+	}
+
+	ok, err := t.isPreauthorized(stub, receiver, sender)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("Receiver %s has not preauthorized %s", receiver, sender)
+	}
+
+	return nil
+}
+
+// isPreauthorized returns whether account preauthorized deposits from authorized
+// account: account
+// authorized: sender
+func (t *tableHandler) isPreauthorized(stub shim.ChaincodeStubInterface, account string, authorized string) (bool, error) {
+	row, err := stub.GetRow(tableDepositPreauth, []shim.Column{
+		shim.Column{Value: &shim.Column_String_{String_: account}},
+		shim.Column{Value: &shim.Column_String_{String_: authorized}},
+	})
+	if err != nil {
+		logger.Errorf("isPreauthorized: system error %v", err)
+		return false, err
+	}
+
+	return len(row.Columns) != 0, nil
+}
+
+// setPreauth add or remove authorized in the allow-list of account
+// account: account
+// authorized: sender
+// enabled: add or remove
+func (t *tableHandler) setPreauth(stub shim.ChaincodeStubInterface,
+	account string,
+	authorized string,
+	enabled bool) error {
+
+	logger.Debugf("update table depositPreauth: account=%v authorized=%v enabled=%v", account, authorized, enabled)
+
+	key := []shim.Column{
+		shim.Column{Value: &shim.Column_String_{String_: account}},
+		shim.Column{Value: &shim.Column_String_{String_: authorized}},
+	}
+
+	if !enabled {
+		if err := stub.DeleteRow(tableDepositPreauth, key); err != nil {
+			logger.Errorf("setPreauth: system error %v", err)
+			return err
+		}
+
+		return setEvent(stub, eventDepositUnauth, &preauthRecord{Account: account, Authorized: authorized})
+	}
+
+	_, err := stub.InsertRow(tableDepositPreauth, shim.Row{
+		Columns: []*shim.Column{&key[0], &key[1]},
+	})
+	if err != nil {
+		logger.Errorf("setPreauth: system error %v", err)
+		return err
+	}
+
+	return setEvent(stub, eventDepositPreauth, &preauthRecord{Account: account, Authorized: authorized})
+}
+
+// getAccountFlags returns the flags of account, 0 for unknown accounts
+// account: account
+func (t *tableHandler) getAccountFlags(stub shim.ChaincodeStubInterface, account string) (uint32, error) {
+	row, err := stub.GetRow(tableAccount, []shim.Column{
+		shim.Column{Value: &shim.Column_String_{String_: account}},
+	})
+	if err != nil {
+		logger.Errorf("getAccountFlags: system error %v", err)
+		return 0, err
+	}
+	if len(row.Columns) == 0 {
+		return 0, nil
+	}
+
+	return row.Columns[1].GetUint32(), nil
+}
+
+// setAccountFlag set or clear a flag of account
+// account: account
+// flag: flag bit
+// enabled: set or clear
+func (t *tableHandler) setAccountFlag(stub shim.ChaincodeStubInterface,
+	account string,
+	flag uint32,
+	enabled bool) error {
+
+	flags, err := t.getAccountFlags(stub, account)
+	if err != nil {
+		return err
+	}
+
+	if enabled {
+		flags |= flag
+	} else {
+		flags &^= flag
+	}
+
+	logger.Debugf("replace table account: account=%v flags=%v", account, flags)
+
+	err = upsertRow(stub, tableAccount, shim.Row{
 		Columns: []*shim.Column{
-			&shim.Column{Value: &shim.Column_String_{String_: timestamp}},
-			&shim.Column{Value: &shim.Column_String_{String_: sender}},
-			&shim.Column{Value: &shim.Column_String_{String_: receiver}},
-			&shim.Column{Value: &shim.Column_String_{String_: amount}},
-			&shim.Column{Value: &shim.Column_String_{String_: currency}}},
+			&shim.Column{Value: &shim.Column_String_{String_: account}},
+			&shim.Column{Value: &shim.Column_Uint32{Uint32: flags}}},
 	})
+	if err != nil {
+		logger.Errorf("setAccountFlag: system error %v", err)
+		return err
+	}
 
-	// you can only assign balances to new account IDs
-	if !ok && err == nil {
-		logger.Errorf("submitSend: system error %v", err)
-		return errors.New("Fiel was already signed.")
+	return setEvent(stub, eventAccountSet, &accountRecord{Account: account, Flags: flags})
+}
+
+// upsertRow replaces the row, inserting it when it does not exist yet
+func upsertRow(stub shim.ChaincodeStubInterface, tableName string, row shim.Row) error {
+	ok, err := stub.ReplaceRow(tableName, row)
+	if err != nil || ok {
+		return err
+	}
+
+	_, err = stub.InsertRow(tableName, row)
+	return err
+}
+
+// claimTx records the ID of the current transaction and fails when it was
+// already executed, so a resubmitted transaction is not applied twice
+func claimTx(stub shim.ChaincodeStubInterface) error {
+	txid := stub.GetTxID()
+	ok, err := stub.InsertRow(tableTransaction, shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: txid}}},
+	})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("Transaction %s was already executed", txid)
 	}
 
 	return nil
 }
 
-// submitSend submit offer
-// sender: sender
-// takerGets: takerGets
-// takerPays: takerPays
-// timestamp: timestamp
-func (t *tableHandler) submitOffer(stub shim.ChaincodeStubInterface,
-	sender string,
-	takerGets string,
-	takerPays string,
-	timestamp string) error {
+// putIndex inserts an (account, id) row into an index table
+func putIndex(stub shim.ChaincodeStubInterface, tableName string, account string, id string) error {
+	_, err := stub.InsertRow(tableName, shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: account}},
+			&shim.Column{Value: &shim.Column_String_{String_: id}}},
+	})
 
-	logger.Debugf("insert table send: sender=%v takerGets=%v takerPays=%v timestamp=%v", sender, takerGets, takerPays, timestamp)
+	return err
+}
 
-	//insert a new row for send transaction
-	ok, err := stub.InsertRow(tableSend, shim.Row{
+// getIndex returns the ids of account in an index table
+func getIndex(stub shim.ChaincodeStubInterface, tableName string, account string) ([]string, error) {
+	rows, err := stub.GetRows(tableName, []shim.Column{
+		shim.Column{Value: &shim.Column_String_{String_: account}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for row := range rows {
+		ids = append(ids, row.Columns[1].GetString_())
+	}
+
+	return ids, nil
+}
+
+// deleteIndex deletes an (account, id) row from an index table
+func deleteIndex(stub shim.ChaincodeStubInterface, tableName string, account string, id string) error {
+	return stub.DeleteRow(tableName, []shim.Column{
+		shim.Column{Value: &shim.Column_String_{String_: account}},
+		shim.Column{Value: &shim.Column_String_{String_: id}},
+	})
+}
+
+// putObject stores obj as JSON under id in a (id, data) table
+func putObject(stub shim.ChaincodeStubInterface, tableName string, id string, obj interface{}) error {
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+
+	return upsertRow(stub, tableName, shim.Row{
 		Columns: []*shim.Column{
-			&shim.Column{Value: &shim.Column_String_{String_: timestamp}},
-			&shim.Column{Value: &shim.Column_String_{String_: sender}},
-			&shim.Column{Value: &shim.Column_String_{String_: takerGets}},
-			&shim.Column{Value: &shim.Column_String_{String_: takerPays}}},
+			&shim.Column{Value: &shim.Column_String_{String_: id}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: b}}},
 	})
+}
 
-	// you can only assign balances to new account IDs
-	if !ok && err == nil {
-		logger.Errorf("submitSend: system error %v", err)
-		return errors.New("Fiel was already signed.")
+// getObject loads the JSON stored under id in a (id, data) table into obj,
+// returns false when id does not exist
+func getObject(stub shim.ChaincodeStubInterface, tableName string, id string, obj interface{}) (bool, error) {
+	row, err := stub.GetRow(tableName, []shim.Column{
+		shim.Column{Value: &shim.Column_String_{String_: id}},
+	})
+	if err != nil {
+		return false, err
+	}
+	if len(row.Columns) == 0 {
+		return false, nil
 	}
 
-	return nil
+	return true, json.Unmarshal(row.Columns[1].GetBytes(), obj)
+}
+
+// setEvent marshals payload and sets it as the chaincode event of the transaction
+func setEvent(stub shim.ChaincodeStubInterface, name string, payload interface{}) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	return stub.SetEvent(name, b)
 }
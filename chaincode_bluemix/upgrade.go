@@ -0,0 +1,361 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// state keys of an upgrade
+const (
+	// keyUpgradedTo holds the name of the chaincode that replaced this one,
+	// which makes it read-only
+	keyUpgradedTo = "upgradedTo"
+	// keyImportedFrom holds the name of the chaincode the state was imported
+	// from
+	keyImportedFrom = "importedFrom"
+)
+
+// exportPageSize bounds the rows returned by an exportState query
+const exportPageSize = 500
+
+// exportPage defines the result of exportState. Each row holds its column
+// values as strings, bytes columns base64 encoded.
+type exportPage struct {
+	Rows [][]string `json:"rows"`
+	More bool       `json:"more"`
+}
+
+// tableChecksum defines the row count and checksum of a table.
+type tableChecksum struct {
+	Table    string `json:"table"`
+	Rows     int    `json:"rows"`
+	Checksum string `json:"checksum"`
+}
+
+// stateChecksum defines the result of queryStateChecksum.
+type stateChecksum struct {
+	Tables       []*tableChecksum `json:"tables"`
+	UpgradedTo   string           `json:"upgradedTo,omitempty"`
+	ImportedFrom string           `json:"importedFrom,omitempty"`
+}
+
+// queryStateChecksum query the row count and checksum of every table
+func (t *BlueChaincode) queryStateChecksum(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 0 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 0")
+	}
+
+	checksum, err := getStateChecksum(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(checksum)
+}
+
+// exportState query a page of the rows of a table, in key order
+// args[0]: table
+// args[1]: offset, number of rows skipped
+func (t *BlueChaincode) exportState(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+
+	columns, ok := tableColumns(args[0])
+	if !ok {
+		return nil, fmt.Errorf("Unknown table %s", args[0])
+	}
+	offset, err := strconv.Atoi(args[1])
+	if err != nil || offset < 0 {
+		return nil, fmt.Errorf("Invalid offset %s", args[1])
+	}
+
+	rows, err := stub.GetRows(args[0], []shim.Column{})
+	if err != nil {
+		return nil, err
+	}
+
+	// the rows channel is drained, the shim blocks on a row not read
+	var rowErr error
+	page := &exportPage{Rows: [][]string{}}
+	n := 0
+	for row := range rows {
+		switch {
+		case n < offset || rowErr != nil:
+		case len(page.Rows) < exportPageSize:
+			var values []string
+			if values, rowErr = encodeRow(columns, row); rowErr == nil {
+				page.Rows = append(page.Rows, values)
+			}
+		default:
+			page.More = true
+		}
+		n++
+	}
+	if rowErr != nil {
+		return nil, fmt.Errorf("Table %s: %v", args[0], rowErr)
+	}
+
+	return json.Marshal(page)
+}
+
+// upgradeTo make the chaincode read-only once it is replaced, an empty name
+// makes it writable again when an upgrade is abandoned
+// args[0]: name of the new chaincode
+func (t *BlueChaincode) upgradeTo(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	if args[0] == "" {
+		return nil, stub.DelState(keyUpgradedTo)
+	}
+
+	return nil, stub.PutState(keyUpgradedTo, []byte(args[0]))
+}
+
+// importState copy the state of a read-only chaincode, the tables of this
+// one must be empty. The transaction fails unless the row counts and
+// checksums of both chaincodes match.
+// args[0]: name of the old chaincode
+func (t *BlueChaincode) importState(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debugf("+++++++++++++++++++++++++++++++++++ importState in chaincode +++++++++++++++++++++++++++++++++")
+	logger.Debugf("importState args: %v", args)
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+	from := args[0]
+
+	current, err := getStateChecksum(stub)
+	if err != nil {
+		return nil, err
+	}
+	if current.ImportedFrom != "" {
+		return nil, fmt.Errorf("State was already imported from %s", current.ImportedFrom)
+	}
+	for _, table := range current.Tables {
+		if table.Rows != 0 {
+			return nil, fmt.Errorf("Table %s is not empty", table.Table)
+		}
+	}
+
+	// the old chaincode must be read-only, so its state does not move
+	// during the copy
+	source := &stateChecksum{}
+	if err := queryOld(stub, from, source, "queryStateChecksum"); err != nil {
+		return nil, err
+	}
+	if source.UpgradedTo == "" {
+		return nil, fmt.Errorf("Chaincode %s is not read-only", from)
+	}
+
+	// tables added since the old chaincode stay empty
+	exported := map[string]bool{}
+	for _, table := range source.Tables {
+		exported[table.Table] = true
+	}
+
+	for _, table := range tableDefinitions {
+		if !exported[table.name] {
+			continue
+		}
+		for offset := 0; ; {
+			page := &exportPage{}
+			if err := queryOld(stub, from, page, "exportState", table.name, strconv.Itoa(offset)); err != nil {
+				return nil, err
+			}
+
+			for _, values := range page.Rows {
+				row, err := decodeRow(table.columns, values)
+				if err != nil {
+					return nil, fmt.Errorf("Table %s: %v", table.name, err)
+				}
+				if _, err := stub.InsertRow(table.name, row); err != nil {
+					return nil, err
+				}
+			}
+
+			if !page.More {
+				break
+			}
+			offset += len(page.Rows)
+		}
+	}
+
+	imported, err := getStateChecksum(stub)
+	if err != nil {
+		return nil, err
+	}
+	if err := compareChecksums(source, imported); err != nil {
+		return nil, err
+	}
+
+	return nil, stub.PutState(keyImportedFrom, []byte(from))
+}
+
+// checkWritable returns an error when the chaincode was upgraded
+func checkWritable(stub shim.ChaincodeStubInterface) error {
+	to, err := stub.GetState(keyUpgradedTo)
+	if err != nil {
+		return err
+	}
+	if len(to) != 0 {
+		return fmt.Errorf("Chaincode was upgraded to %s and is read-only", to)
+	}
+
+	return nil
+}
+
+// queryOld queries function of the chaincode named from and decodes the
+// JSON result into v
+func queryOld(stub shim.ChaincodeStubInterface, from string, v interface{}, function string, args ...string) error {
+	input := [][]byte{[]byte(function)}
+	for _, arg := range args {
+		input = append(input, []byte(arg))
+	}
+
+	result, err := stub.QueryChaincode(from, input)
+	if err != nil {
+		return fmt.Errorf("Query %s of %s error: %v", function, from, err)
+	}
+
+	return json.Unmarshal(result, v)
+}
+
+// getStateChecksum returns the row count and checksum of every table, the
+// checksum hashes the encoded rows in key order
+func getStateChecksum(stub shim.ChaincodeStubInterface) (*stateChecksum, error) {
+	checksum := &stateChecksum{}
+	for _, table := range tableDefinitions {
+		rows, err := stub.GetRows(table.name, []shim.Column{})
+		if err != nil {
+			return nil, err
+		}
+
+		var rowErr error
+		h := sha256.New()
+		summary := &tableChecksum{Table: table.name}
+		for row := range rows {
+			values, err := encodeRow(table.columns, row)
+			if err != nil {
+				rowErr = err
+				continue
+			}
+			b, _ := json.Marshal(values)
+			h.Write(b)
+			summary.Rows++
+		}
+		if rowErr != nil {
+			return nil, fmt.Errorf("Table %s: %v", table.name, rowErr)
+		}
+		summary.Checksum = hex.EncodeToString(h.Sum(nil))
+		checksum.Tables = append(checksum.Tables, summary)
+	}
+
+	upgradedTo, err := stub.GetState(keyUpgradedTo)
+	if err != nil {
+		return nil, err
+	}
+	importedFrom, err := stub.GetState(keyImportedFrom)
+	if err != nil {
+		return nil, err
+	}
+	checksum.UpgradedTo = string(upgradedTo)
+	checksum.ImportedFrom = string(importedFrom)
+
+	return checksum, nil
+}
+
+// compareChecksums returns an error naming the first table whose count or
+// checksum differs
+func compareChecksums(source *stateChecksum, imported *stateChecksum) error {
+	tables := map[string]*tableChecksum{}
+	for _, table := range imported.Tables {
+		tables[table.Table] = table
+	}
+
+	for _, want := range source.Tables {
+		got, ok := tables[want.Table]
+		if !ok {
+			return fmt.Errorf("Table %s was not imported", want.Table)
+		}
+		if got.Rows != want.Rows || got.Checksum != want.Checksum {
+			return fmt.Errorf("Table %s differs: %d rows imported of %d", want.Table, got.Rows, want.Rows)
+		}
+	}
+
+	return nil
+}
+
+// tableColumns returns the column definitions of a table
+func tableColumns(name string) ([]*shim.ColumnDefinition, bool) {
+	for _, table := range tableDefinitions {
+		if table.name == name {
+			return table.columns, true
+		}
+	}
+
+	return nil, false
+}
+
+// encodeRow returns the column values of a row as strings
+func encodeRow(columns []*shim.ColumnDefinition, row shim.Row) ([]string, error) {
+	if len(row.Columns) != len(columns) {
+		return nil, fmt.Errorf("row has %d columns, expecting %d", len(row.Columns), len(columns))
+	}
+
+	values := make([]string, len(columns))
+	for i, column := range columns {
+		switch column.Type {
+		case shim.ColumnDefinition_STRING:
+			values[i] = row.Columns[i].GetString_()
+		case shim.ColumnDefinition_UINT32:
+			values[i] = strconv.FormatUint(uint64(row.Columns[i].GetUint32()), 10)
+		case shim.ColumnDefinition_BYTES:
+			values[i] = base64.StdEncoding.EncodeToString(row.Columns[i].GetBytes())
+		default:
+			return nil, fmt.Errorf("column %s has unsupported type %v", column.Name, column.Type)
+		}
+	}
+
+	return values, nil
+}
+
+// decodeRow returns the row of column values encoded by encodeRow
+func decodeRow(columns []*shim.ColumnDefinition, values []string) (shim.Row, error) {
+	if len(values) != len(columns) {
+		return shim.Row{}, fmt.Errorf("row has %d columns, expecting %d", len(values), len(columns))
+	}
+
+	row := shim.Row{Columns: make([]*shim.Column, len(columns))}
+	for i, column := range columns {
+		switch column.Type {
+		case shim.ColumnDefinition_STRING:
+			row.Columns[i] = &shim.Column{Value: &shim.Column_String_{String_: values[i]}}
+		case shim.ColumnDefinition_UINT32:
+			n, err := strconv.ParseUint(values[i], 10, 32)
+			if err != nil {
+				return shim.Row{}, fmt.Errorf("column %s: %v", column.Name, err)
+			}
+			row.Columns[i] = &shim.Column{Value: &shim.Column_Uint32{Uint32: uint32(n)}}
+		case shim.ColumnDefinition_BYTES:
+			b, err := base64.StdEncoding.DecodeString(values[i])
+			if err != nil {
+				return shim.Row{}, fmt.Errorf("column %s: %v", column.Name, err)
+			}
+			row.Columns[i] = &shim.Column{Value: &shim.Column_Bytes{Bytes: b}}
+		default:
+			return shim.Row{}, fmt.Errorf("column %s has unsupported type %v", column.Name, column.Type)
+		}
+	}
+
+	return row, nil
+}
@@ -0,0 +1,110 @@
+package validation
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Currency is a currency code with the number of decimals of its amounts.
+type Currency struct {
+	Code      string `json:"code"`
+	Precision int    `json:"precision"`
+	Custom    bool   `json:"custom,omitempty"`
+}
+
+// custom currency bounds
+const (
+	minCustomCodeLength = 3
+	maxCustomCodeLength = 12
+	// MaxPrecision is the highest precision of a custom currency, the
+	// precision of the chaincode balances
+	MaxPrecision = 18
+)
+
+// iso4217 holds the active ISO 4217 codes by their minor units, codes not
+// listed in the other groups have 2 decimals
+var iso4217 = map[int]string{
+	0: "BIF CLP DJF GNF ISK JPY KMF KRW PYG RWF UGX UYI VND VUV XAF XOF XPF",
+	2: "AED AFN ALL AMD ANG AOA ARS AUD AWG AZN BAM BBD BDT BGN BMD BND BOB BOV BRL BSD BTN BWP BYN BZD " +
+		"CAD CDF CHE CHF CHW CNY COP COU CRC CUC CUP CVE CZK DKK DOP DZD EGP ERN ETB EUR FJD FKP GBP GEL GHS " +
+		"GIP GMD GTQ GYD HKD HNL HTG HUF IDR ILS INR IRR JMD KES KGS KHR KPW KYD KZT LAK LBP LKR LRD LSL MAD " +
+		"MDL MGA MKD MMK MNT MOP MRU MUR MVR MWK MXN MXV MYR MZN NAD NGN NIO NOK NPR NZD PAB PEN PGK PHP PKR " +
+		"PLN QAR RON RSD RUB SAR SBD SCR SDG SEK SGD SHP SLE SLL SOS SRD SSP STN SVC SYP SZL THB TJS TMT TOP " +
+		"TRY TTD TWD TZS UAH USD USN UYU UZS VED VES WST XCD YER ZAR ZMW ZWL",
+	3: "BHD IQD JOD KWD LYD OMR TND",
+	4: "CLF UYW",
+}
+
+// Registry holds the ISO 4217 currencies and the registered custom ones.
+type Registry struct {
+	currencies map[string]Currency
+}
+
+// NewRegistry returns a registry of the ISO 4217 currencies
+func NewRegistry() *Registry {
+	r := &Registry{currencies: make(map[string]Currency)}
+	for precision, codes := range iso4217 {
+		for _, code := range strings.Fields(codes) {
+			r.currencies[code] = Currency{Code: code, Precision: precision}
+		}
+	}
+
+	return r
+}
+
+// Register adds a custom currency. Its code is 3 to 12 upper case letters or
+// digits and must not be an ISO 4217 code.
+func (r *Registry) Register(code string, precision int) error {
+	if len(code) < minCustomCodeLength || len(code) > maxCustomCodeLength || strings.Trim(code, "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789") != "" {
+		return fmt.Errorf("currency code must be %d to %d upper case letters or digits", minCustomCodeLength, maxCustomCodeLength)
+	}
+	if precision < 0 || precision > MaxPrecision {
+		return fmt.Errorf("precision must be 0 to %d", MaxPrecision)
+	}
+	if c, ok := r.currencies[code]; ok && !c.Custom {
+		return fmt.Errorf("%s is an ISO 4217 currency", code)
+	}
+
+	r.currencies[code] = Currency{Code: code, Precision: precision, Custom: true}
+
+	return nil
+}
+
+// Lookup returns a known currency
+func (r *Registry) Lookup(code string) (Currency, bool) {
+	c, ok := r.currencies[code]
+	return c, ok
+}
+
+// Currency checks that code is a known currency and returns it
+func (r *Registry) Currency(field, code string) (Currency, *FieldError) {
+	if code == "" {
+		return Currency{}, &FieldError{field, "required"}
+	}
+
+	c, ok := r.Lookup(code)
+	if !ok {
+		return Currency{}, &FieldError{field, "unknown currency " + code}
+	}
+
+	return c, nil
+}
+
+// Custom returns the registered custom currencies sorted by code
+func (r *Registry) Custom() []Currency {
+	var codes []string
+	for code, c := range r.currencies {
+		if c.Custom {
+			codes = append(codes, code)
+		}
+	}
+	sort.Strings(codes)
+
+	custom := make([]Currency, len(codes))
+	for i, code := range codes {
+		custom[i] = r.currencies[code]
+	}
+
+	return custom
+}
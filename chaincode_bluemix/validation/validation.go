@@ -0,0 +1,317 @@
+// Package validation holds the input rules of blue shared by the chaincode and
+// the app: account identifiers, amounts, currencies, sends and offers. The
+// app checks requests with them before submitting, the chaincode enforces
+// them again when executing.
+package validation
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// FieldError is a problem with one input field.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// Errors is a list of field errors, nil when the input is valid.
+type Errors []*FieldError
+
+func (e Errors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+
+	return strings.Join(messages, "; ")
+}
+
+// Fields maps each field in error to its message
+func (e Errors) Fields() map[string]string {
+	fields := make(map[string]string, len(e))
+	for _, err := range e {
+		fields[err.Field] = err.Message
+	}
+
+	return fields
+}
+
+// Err returns e as an error, nil when there is no field error
+func (e Errors) Err() error {
+	if len(e) == 0 {
+		return nil
+	}
+
+	return e
+}
+
+// Add appends err unless it is nil
+func (e *Errors) Add(err *FieldError) {
+	if err != nil {
+		*e = append(*e, err)
+	}
+}
+
+// --------------- accounts ---------------
+
+// AccountPrefix starts every account identifier
+const AccountPrefix = "b"
+
+// account identifier layout
+const (
+	accountIDLength  = 20
+	checksumLength   = 4
+	base58Alphabet   = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+	maxAccountLength = 40
+)
+
+// EncodeAccount returns the identifier of a 20 bytes account ID: the prefix
+// followed by the base58 encoding of the ID and a 4 bytes checksum, the start
+// of its double SHA-256
+func EncodeAccount(id []byte) (string, error) {
+	if len(id) != accountIDLength {
+		return "", fmt.Errorf("account ID must be %d bytes", accountIDLength)
+	}
+
+	return AccountPrefix + encodeBase58(append(append([]byte{}, id...), checksum(id)...)), nil
+}
+
+// NewAccount derives an account identifier from a public key or any seed
+func NewAccount(seed []byte) string {
+	sum := sha256.Sum256(seed)
+	account, _ := EncodeAccount(sum[:accountIDLength])
+
+	return account
+}
+
+// Account checks the format and checksum of an account identifier
+func Account(field, account string) *FieldError {
+	if account == "" {
+		return &FieldError{field, "required"}
+	}
+	if !strings.HasPrefix(account, AccountPrefix) || len(account) > maxAccountLength {
+		return &FieldError{field, "not an account identifier"}
+	}
+
+	payload, ok := decodeBase58(account[len(AccountPrefix):])
+	if !ok || len(payload) != accountIDLength+checksumLength {
+		return &FieldError{field, "not an account identifier"}
+	}
+	if !bytes.Equal(checksum(payload[:accountIDLength]), payload[accountIDLength:]) {
+		return &FieldError{field, "bad account checksum"}
+	}
+
+	return nil
+}
+
+func checksum(id []byte) []byte {
+	first := sha256.Sum256(id)
+	second := sha256.Sum256(first[:])
+
+	return second[:checksumLength]
+}
+
+func encodeBase58(b []byte) string {
+	n := new(big.Int).SetBytes(b)
+	base := big.NewInt(int64(len(base58Alphabet)))
+	mod := new(big.Int)
+
+	var out []byte
+	for n.Sign() > 0 {
+		n.DivMod(n, base, mod)
+		out = append(out, base58Alphabet[mod.Int64()])
+	}
+	// leading zero bytes are kept as leading '1'
+	for _, c := range b {
+		if c != 0 {
+			break
+		}
+		out = append(out, base58Alphabet[0])
+	}
+
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+
+	return string(out)
+}
+
+func decodeBase58(s string) ([]byte, bool) {
+	if s == "" {
+		return nil, false
+	}
+
+	n := new(big.Int)
+	base := big.NewInt(int64(len(base58Alphabet)))
+	for _, c := range s {
+		i := strings.IndexRune(base58Alphabet, c)
+		if i < 0 {
+			return nil, false
+		}
+		n.Mul(n, base)
+		n.Add(n, big.NewInt(int64(i)))
+	}
+
+	var zeros []byte
+	for _, c := range s {
+		if c != rune(base58Alphabet[0]) {
+			break
+		}
+		zeros = append(zeros, 0)
+	}
+
+	return append(zeros, n.Bytes()...), true
+}
+
+// --------------- amounts ---------------
+
+// maxAmountDigits bounds the integer digits of an amount
+const maxAmountDigits = 24
+
+// Amount checks that amount is a positive decimal with no more decimals than
+// the precision of currency
+func Amount(field, amount string, currency Currency) *FieldError {
+	if amount == "" {
+		return &FieldError{field, "required"}
+	}
+
+	integer, fraction := amount, ""
+	if i := strings.Index(amount, "."); i >= 0 {
+		integer, fraction = amount[:i], amount[i+1:]
+	}
+	if integer == "" || !isDigits(integer) || (fraction != "" && !isDigits(fraction)) || strings.HasSuffix(amount, ".") {
+		return &FieldError{field, "not a decimal amount"}
+	}
+	if len(strings.TrimLeft(integer, "0")) > maxAmountDigits {
+		return &FieldError{field, "amount too large"}
+	}
+	if len(strings.TrimRight(fraction, "0")) > currency.Precision {
+		return &FieldError{field, fmt.Sprintf("%s allows %d decimals", currency.Code, currency.Precision)}
+	}
+	if strings.Trim(integer+fraction, "0") == "" {
+		return &FieldError{field, "must be positive"}
+	}
+
+	return nil
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// --------------- transactions ---------------
+
+// Send checks the accounts, amount and currency of a payment
+func Send(currencies *Registry, sender, receiver, amount, currency string) Errors {
+	var errs Errors
+
+	errs.Add(Account("sender", sender))
+	errs.Add(Account("receiver", receiver))
+	if sender != "" && sender == receiver {
+		errs.Add(&FieldError{"receiver", "must differ from sender"})
+	}
+	errs.Add(CurrencyAmount(currencies, "amount", "currency", amount, currency))
+
+	return errs
+}
+
+// Check checks the accounts, maximum amount and currency of a check
+func Check(currencies *Registry, sender, receiver, sendMax, currency string) Errors {
+	var errs Errors
+
+	errs.Add(Account("sender", sender))
+	errs.Add(Account("receiver", receiver))
+	if sender != "" && sender == receiver {
+		errs.Add(&FieldError{"receiver", "must differ from sender"})
+	}
+	errs.Add(CurrencyAmount(currencies, "sendMax", "currency", sendMax, currency))
+
+	return errs
+}
+
+// Invoice checks the accounts, amount and currency of an invoice, payer is
+// optional
+func Invoice(currencies *Registry, payee, payer, amount, currency string) Errors {
+	var errs Errors
+
+	errs.Add(Account("payee", payee))
+	if payer != "" {
+		errs.Add(Account("payer", payer))
+	}
+	errs.Add(CurrencyAmount(currencies, "amount", "currency", amount, currency))
+
+	return errs
+}
+
+// Preauth checks an account and the sender it authorizes to deposit
+func Preauth(account, authorized string) Errors {
+	var errs Errors
+
+	errs.Add(Account("account", account))
+	errs.Add(Account("authorized", authorized))
+	if account != "" && account == authorized {
+		errs.Add(&FieldError{"authorized", "must differ from account"})
+	}
+
+	return errs
+}
+
+// CurrencyAmount checks a currency code and an amount of it
+func CurrencyAmount(currencies *Registry, amountField, currencyField, amount, currency string) *FieldError {
+	c, err := currencies.Currency(currencyField, currency)
+	if err != nil {
+		return err
+	}
+
+	return Amount(amountField, amount, c)
+}
+
+// Offer checks the sender and the <value>/<currency> amounts of an offer,
+// which must trade distinct currencies
+func Offer(currencies *Registry, sender, takerGets, takerPays string) Errors {
+	var errs Errors
+
+	errs.Add(Account("sender", sender))
+
+	getsValue, getsCurrency, err := SplitAmount("takerGets", takerGets)
+	errs.Add(err)
+	if err == nil {
+		errs.Add(CurrencyAmount(currencies, "takerGets.value", "takerGets.currency", getsValue, getsCurrency))
+	}
+
+	paysValue, paysCurrency, err := SplitAmount("takerPays", takerPays)
+	errs.Add(err)
+	if err == nil {
+		errs.Add(CurrencyAmount(currencies, "takerPays.value", "takerPays.currency", paysValue, paysCurrency))
+	}
+
+	if getsCurrency != "" && getsCurrency == paysCurrency {
+		errs.Add(&FieldError{"takerPays.currency", "must differ from takerGets.currency"})
+	}
+
+	return errs
+}
+
+// SplitAmount splits an amount formatted as <value>/<currency>
+func SplitAmount(field, amount string) (string, string, *FieldError) {
+	parts := strings.Split(amount, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", &FieldError{field, "expecting <value>/<currency>"}
+	}
+
+	return parts[0], parts[1], nil
+}
@@ -0,0 +1,157 @@
+package validation
+
+import (
+	"strings"
+	"testing"
+)
+
+var (
+	alice = NewAccount([]byte("alice"))
+	bob   = NewAccount([]byte("bob"))
+)
+
+// badChecksum returns account with its last character changed
+func badChecksum(account string) string {
+	last := account[len(account)-1:]
+	replacement := "2"
+	if last == replacement {
+		replacement = "3"
+	}
+
+	return account[:len(account)-1] + replacement
+}
+
+func TestAccount(t *testing.T) {
+	tests := []struct {
+		name    string
+		account string
+		want    string
+	}{
+		{"valid", alice, ""},
+		{"empty", "", "required"},
+		{"missing prefix", "x" + alice[1:], "not an account identifier"},
+		{"too long", alice + strings.Repeat("1", maxAccountLength), "not an account identifier"},
+		{"not base58", alice[:10] + "0" + alice[11:], "not an account identifier"},
+		{"too short", alice[:len(alice)-5], "not an account identifier"},
+		{"bad checksum", badChecksum(alice), "bad account checksum"},
+	}
+	for _, tt := range tests {
+		err := Account("sender", tt.account)
+		if got := message(err); got != tt.want {
+			t.Errorf("%s: Account(%q) = %q, want %q", tt.name, tt.account, got, tt.want)
+		}
+		if err != nil && err.Field != "sender" {
+			t.Errorf("%s: field %q, want sender", tt.name, err.Field)
+		}
+	}
+}
+
+func TestEncodeAccount(t *testing.T) {
+	if _, err := EncodeAccount(make([]byte, accountIDLength-1)); err == nil {
+		t.Fatal("accepted a short account ID")
+	}
+
+	// a zero ID encodes to leading '1's and decodes back
+	account, err := EncodeAccount(make([]byte, accountIDLength))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(account, AccountPrefix+"1111") {
+		t.Fatalf("zero ID encoded to %s", account)
+	}
+	if err := Account("account", account); err != nil {
+		t.Fatalf("zero ID account rejected: %v", err)
+	}
+}
+
+func TestAmount(t *testing.T) {
+	usd := Currency{Code: "USD", Precision: 2}
+	jpy := Currency{Code: "JPY", Precision: 0}
+
+	tests := []struct {
+		amount   string
+		currency Currency
+		want     string
+	}{
+		{"10", usd, ""},
+		{"10.5", usd, ""},
+		{"0.01", usd, ""},
+		{"10.500", usd, ""},
+		{"007", usd, ""},
+		{"", usd, "required"},
+		{"-1", usd, "not a decimal amount"},
+		{"1e3", usd, "not a decimal amount"},
+		{".5", usd, "not a decimal amount"},
+		{"5.", usd, "not a decimal amount"},
+		{"1.2.3", usd, "not a decimal amount"},
+		{"1,000", usd, "not a decimal amount"},
+		{"0", usd, "must be positive"},
+		{"0.00", usd, "must be positive"},
+		{"0.001", usd, "USD allows 2 decimals"},
+		{"1.5", jpy, "JPY allows 0 decimals"},
+		{"1.0", jpy, ""},
+		{strings.Repeat("9", maxAmountDigits), usd, ""},
+		{strings.Repeat("9", maxAmountDigits+1), usd, "amount too large"},
+		{"0" + strings.Repeat("9", maxAmountDigits), usd, ""},
+	}
+	for _, tt := range tests {
+		err := Amount("amount", tt.amount, tt.currency)
+		if got := message(err); got != tt.want {
+			t.Errorf("Amount(%q, %s) = %q, want %q", tt.amount, tt.currency.Code, got, tt.want)
+		}
+	}
+}
+
+func TestOffer(t *testing.T) {
+	currencies := NewRegistry()
+	if err := currencies.Register("GOLD", 4); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		sender    string
+		takerGets string
+		takerPays string
+		want      map[string]string
+	}{
+		{"valid", alice, "10/USD", "70/CNY", nil},
+		{"custom currency", alice, "0.0001/GOLD", "1/USD", nil},
+		{"bad sender", "", "10/USD", "70/CNY", map[string]string{"sender": "required"}},
+		{"not an amount", alice, "10USD", "70/CNY", map[string]string{"takerGets": "expecting <value>/<currency>"}},
+		{"missing currency", alice, "10/USD", "70/", map[string]string{"takerPays": "expecting <value>/<currency>"}},
+		{"unknown currency", alice, "10/XXX", "70/CNY", map[string]string{"takerGets.currency": "unknown currency XXX"}},
+		{"too precise", alice, "10.001/USD", "70/CNY", map[string]string{"takerGets.value": "USD allows 2 decimals"}},
+		{"zero", alice, "10/USD", "0/CNY", map[string]string{"takerPays.value": "must be positive"}},
+		{"same currency", alice, "10/USD", "11/USD", map[string]string{"takerPays.currency": "must differ from takerGets.currency"}},
+		{"every field", bob[:5], "x", "1/1/USD", map[string]string{
+			"sender":    "not an account identifier",
+			"takerGets": "expecting <value>/<currency>",
+			"takerPays": "expecting <value>/<currency>",
+		}},
+	}
+	for _, tt := range tests {
+		errs := Offer(currencies, tt.sender, tt.takerGets, tt.takerPays)
+		got := errs.Fields()
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: errors %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for field, msg := range tt.want {
+			if got[field] != msg {
+				t.Errorf("%s: %s = %q, want %q", tt.name, field, got[field], msg)
+			}
+		}
+		if (errs.Err() == nil) != (len(tt.want) == 0) {
+			t.Errorf("%s: Err() = %v", tt.name, errs.Err())
+		}
+	}
+}
+
+func message(err *FieldError) string {
+	if err == nil {
+		return ""
+	}
+
+	return err.Message
+}